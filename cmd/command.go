@@ -1,6 +1,7 @@
 package main
 
 import (
+	"SouthWind6510/TinyDB/data"
 	"SouthWind6510/TinyDB/db"
 	"SouthWind6510/TinyDB/pkg/constants"
 	"SouthWind6510/TinyDB/pkg/logger"
@@ -10,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/tidwall/redcon"
@@ -20,6 +22,21 @@ type cmdHandler func(*Server, [][]byte) (interface{}, error)
 var cmdHandlersMap = map[string]cmdHandler{
 	"ping":   (*Server).Ping,
 	"select": (*Server).Select,
+	"merge":  (*Server).Merge,
+	"blobgc": (*Server).BlobGC,
+
+	"bgsave":   (*Server).BGSave,
+	"lastsave": (*Server).LastSave,
+	"info":     (*Server).Info,
+
+	"expire":    (*Server).Expire,
+	"pexpire":   (*Server).PExpire,
+	"expireat":  (*Server).ExpireAt,
+	"pexpireat": (*Server).PExpireAt,
+	"ttl":       (*Server).TTL,
+	"pttl":      (*Server).PTTL,
+	"persist":   (*Server).Persist,
+	"scan":      (*Server).Scan,
 
 	"set":         (*Server).Set,
 	"mset":        (*Server).MSet,
@@ -95,28 +112,166 @@ var cmdHandlersMap = map[string]cmdHandler{
 	"zscan":            (*Server).ZScan,
 }
 
+// cmdAritiesMap 命令的参数个数，包括命令名，与redis一致，为负数时表示至少-n个
+// 执行前统一检查，MULTI中参数个数错误的命令不入队，EXEC时放弃事务
+var cmdAritiesMap = map[string]int{
+	"ping":   -1,
+	"select": 2,
+	"merge":  1,
+	"blobgc": 1,
+
+	"bgsave":   1,
+	"lastsave": 1,
+	"info":     -1,
+
+	"expire":    3,
+	"pexpire":   3,
+	"expireat":  3,
+	"pexpireat": 3,
+	"ttl":       2,
+	"pttl":      2,
+	"persist":   2,
+	"scan":      -2,
+
+	"set":         -3,
+	"mset":        -3,
+	"setex":       4,
+	"setnx":       3,
+	"msetnx":      -3,
+	"psetex":      4,
+	"setrange":    4,
+	"incr":        2,
+	"incrby":      3,
+	"incrbyfloat": 3,
+	"decr":        2,
+	"decrby":      3,
+	"append":      3,
+	"get":         -2,
+	"mget":        -2,
+	"getrange":    4,
+	"getset":      3,
+	"getdel":      2,
+	"getex":       -2,
+	"lcs":         -3,
+	"strlen":      2,
+	"substr":      4,
+
+	"lpush":  -3,
+	"rpush":  -3,
+	"lpop":   -2,
+	"rpop":   -2,
+	"lindex": -3,
+	"llen":   -2,
+	"lrange": -4,
+	"lset":   -4,
+
+	"hset":    -4,
+	"hget":    -3,
+	"hgetall": -2,
+	"hdel":    -3,
+	"hexists": -3,
+	"hlen":    -2,
+	"hkeys":   -2,
+	"hvals":   -2,
+	"hincrby": -4,
+	"hmget":   -3,
+	"hmset":   -4,
+	"hscan":   -3,
+	"hsetnx":  -4,
+
+	"sadd":        -3,
+	"srem":        -3,
+	"spop":        -2,
+	"scard":       -2,
+	"smembers":    -2,
+	"sismember":   -3,
+	"smismember":  -4,
+	"srandmember": -2,
+	"sscan":       -3,
+
+	"zadd":             -4,
+	"zcard":            -2,
+	"zcount":           -4,
+	"zincrby":          -4,
+	"zscore":           -3,
+	"zmscore":          -3,
+	"zpopmax":          -2,
+	"zpopmin":          -2,
+	"zrandmember":      -2,
+	"zrange":           -4,
+	"zrangebyscore":    -4,
+	"zrank":            -3,
+	"zrem":             -3,
+	"zremrangebyrank":  -4,
+	"zremrangebyscore": -4,
+	"zscan":            -3,
+}
+
+// checkArity 检查参数个数是否符合cmdAritiesMap，未登记的命令由handler自己检查
+func checkArity(command string, argc int) bool {
+	arity, ok := cmdAritiesMap[command]
+	if !ok {
+		return true
+	}
+	if arity < 0 {
+		return argc >= -arity
+	}
+	return argc == arity
+}
+
 func execCommand(conn redcon.Conn, cmd redcon.Command) {
 	args := ""
 	for _, arg := range cmd.Args {
 		args += string(arg) + " "
 	}
 	logger.Log.Infof("start handler: %v", args)
+	cli := conn.Context().(*Client)
 	command := strings.ToLower(string(cmd.Args[0]))
-	if handler, ok := cmdHandlersMap[command]; !ok {
+	if handler, ok := txHandlersMap[command]; ok {
+		handler(cli, conn, cmd.Args[1:])
+		return
+	}
+	handler, ok := cmdHandlersMap[command]
+	if !ok {
+		// 事务中出现错误命令时，EXEC不再执行
+		if cli.multi {
+			cli.aborted = true
+		}
 		conn.WriteError(fmt.Sprintf("unsupported command: %v", command))
-	} else {
-		result, err := handler(conn.Context().(*Server), cmd.Args[1:])
-		if err != nil {
-			if errors.Is(err, constants.ErrKeyNotFound) {
-				conn.WriteNull()
-			} else {
-				logger.Log.Errorf("exec command err: %+v", err)
-				conn.WriteError(err.Error())
-			}
+		return
+	}
+	if !checkArity(command, len(cmd.Args)) {
+		if cli.multi {
+			cli.aborted = true
+		}
+		conn.WriteError(constants.ErrWrongNumberArgs.Error())
+		return
+	}
+	if cli.multi {
+		cli.enqueue(cmd.Args)
+		conn.WriteString(constants.ResultQueued)
+		return
+	}
+	var result interface{}
+	var err error
+	svr := cli.svr
+	svr.curDB.Do(func() {
+		result, err = handler(svr, cmd.Args[1:])
+	})
+	writeResult(conn, result, err)
+}
+
+func writeResult(conn redcon.Conn, result interface{}, err error) {
+	if err != nil {
+		if errors.Is(err, constants.ErrKeyNotFound) {
+			conn.WriteNull()
 		} else {
-			logger.Log.Infof("result: %v", result)
-			conn.WriteAny(result)
+			logger.Log.Errorf("exec command err: %+v", err)
+			conn.WriteError(err.Error())
 		}
+	} else {
+		logger.Log.Infof("result: %v", result)
+		conn.WriteAny(result)
 	}
 }
 
@@ -133,6 +288,16 @@ func (s *Server) Select(args [][]byte) (res interface{}, err error) {
 	n, err := strconv.ParseInt(string(args[0]), 10, 0)
 	if s.dbs[n] == nil {
 		opt := db.DefaultOptions(filepath.Join(s.opt.path, strconv.Itoa(int(n))))
+		if opt.SyncPolicy, err = db.ParseSyncPolicy(s.opt.appendSync); err != nil {
+			return nil, err
+		}
+		opt.ReadOnly = s.opt.readOnly
+		opt.EncryptionKeyFile = s.opt.keyFile
+		opt.EncryptionKeyEnv = s.opt.keyEnv
+		opt.CacheSize = s.opt.cacheSize
+		opt.BlobThreshold = s.opt.blobThreshold
+		opt.DiskIndex = s.opt.diskIndex
+		opt.IndexCacheSize = s.opt.indexCache
 		s.dbs[n], err = db.Open(opt)
 		if err != nil {
 			return nil, err
@@ -142,33 +307,340 @@ func (s *Server) Select(args [][]byte) (res interface{}, err error) {
 	return constants.ResultOk, nil
 }
 
+func (s *Server) Merge(args [][]byte) (res interface{}, err error) {
+	if len(args) != 0 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	if err = s.curDB.Merge(); err != nil {
+		return nil, err
+	}
+	return constants.ResultOk, nil
+}
+
+// BlobGC 回收blob文件中失效的大value
+func (s *Server) BlobGC(args [][]byte) (res interface{}, err error) {
+	if len(args) != 0 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	if err = s.curDB.BlobGC(); err != nil {
+		return nil, err
+	}
+	return constants.ResultOk, nil
+}
+
+// BGSave 在后台备份当前数据库到backupDir下以时间命名的子目录
+func (s *Server) BGSave(args [][]byte) (res interface{}, err error) {
+	if len(args) != 0 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if s.saving {
+		return nil, constants.ErrBackupInProgress
+	}
+	s.saving = true
+	curDB := s.curDB
+	dir := filepath.Join(s.opt.backupDir, time.Now().Format("20060102-150405.000"))
+	go func() {
+		err := curDB.Backup(dir)
+		if err != nil {
+			logger.Log.Errorf("bgsave err: %+v", err)
+		}
+		s.saveMu.Lock()
+		defer s.saveMu.Unlock()
+		s.saving = false
+		s.lastSaveErr = err
+		if err == nil {
+			s.lastSave = time.Now().Unix()
+		}
+	}()
+	return constants.ResultBGSave, nil
+}
+
+// LastSave 最近一次备份成功的时间
+func (s *Server) LastSave(args [][]byte) (res interface{}, err error) {
+	if len(args) != 0 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	return s.lastSave, nil
+}
+
+// Info 返回备份状态和当前数据库value缓存的统计，格式与Redis的INFO相同，可以指定persistence或stats只返回一部分
+func (s *Server) Info(args [][]byte) (res interface{}, err error) {
+	if len(args) > 1 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	section := "all"
+	if len(args) == 1 {
+		section = strings.ToLower(string(args[0]))
+	}
+	var sb strings.Builder
+	if section == "all" || section == "default" || section == "persistence" {
+		s.saveMu.Lock()
+		saving, lastSave, status := 0, s.lastSave, "ok"
+		if s.saving {
+			saving = 1
+		}
+		if s.lastSaveErr != nil {
+			status = "err"
+		}
+		s.saveMu.Unlock()
+		sb.WriteString("# Persistence\r\n")
+		sb.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%v\r\n", saving))
+		sb.WriteString(fmt.Sprintf("rdb_last_save_time:%v\r\n", lastSave))
+		sb.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%v\r\n", status))
+	}
+	if section == "all" || section == "default" || section == "stats" {
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+		stats := s.curDB.CacheStats()
+		sb.WriteString("# Stats\r\n")
+		sb.WriteString(fmt.Sprintf("value_cache_hits:%v\r\n", stats.Hits))
+		sb.WriteString(fmt.Sprintf("value_cache_misses:%v\r\n", stats.Misses))
+		sb.WriteString(fmt.Sprintf("value_cache_entries:%v\r\n", stats.Entries))
+		sb.WriteString(fmt.Sprintf("value_cache_size:%v\r\n", stats.Size))
+		sb.WriteString(fmt.Sprintf("value_cache_capacity:%v\r\n", stats.Capacity))
+	}
+	return sb.String(), nil
+}
+
+// ======== Key相关命令 ========
+
+// scanTypes TYPE选项的类型名
+var scanTypes = map[string]data.DataType{
+	"string": data.String,
+	"list":   data.List,
+	"hash":   data.Hash,
+	"set":    data.Set,
+	"zset":   data.ZSet,
+}
+
+// Scan SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (s *Server) Scan(args [][]byte) (res interface{}, err error) {
+	if len(args) < 1 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	cursor, opt, err := parseScanArgs(args, true)
+	if err != nil {
+		return nil, err
+	}
+	// 不存在的类型没有key
+	if opt.Types != nil && len(opt.Types) == 0 {
+		return []interface{}{"0", []string{}}, nil
+	}
+	next, keys, err := s.curDB.Scan(cursor, opt)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{strconv.FormatUint(next, 10), keys}, nil
+}
+
+// parseScanArgs 解析cursor及之后的MATCH、COUNT选项，allowType为true时还可以有TYPE选项，类型不存在时Types为空列表
+func parseScanArgs(args [][]byte, allowType bool) (cursor uint64, opt db.ScanOptions, err error) {
+	if cursor, err = strconv.ParseUint(string(args[0]), 10, 64); err != nil {
+		return 0, opt, constants.ErrInvalidCursor
+	}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return 0, opt, constants.ErrSyntax
+		}
+		switch option := strings.ToLower(string(args[i])); {
+		case option == "match":
+			opt.Match = string(args[i+1])
+		case option == "count":
+			if opt.Count, err = strconv.Atoi(string(args[i+1])); err != nil || opt.Count < 1 {
+				return 0, opt, constants.ErrSyntax
+			}
+		case option == "type" && allowType:
+			opt.Types = []data.DataType{}
+			if dataType, ok := scanTypes[strings.ToLower(string(args[i+1]))]; ok {
+				opt.Types = append(opt.Types, dataType)
+			}
+		default:
+			return 0, opt, constants.ErrSyntax
+		}
+	}
+	return
+}
+
+func (s *Server) Expire(args [][]byte) (res interface{}, err error) {
+	return s.expire(args, time.Second, false)
+}
+
+func (s *Server) PExpire(args [][]byte) (res interface{}, err error) {
+	return s.expire(args, time.Millisecond, false)
+}
+
+func (s *Server) ExpireAt(args [][]byte) (res interface{}, err error) {
+	return s.expire(args, time.Second, true)
+}
+
+func (s *Server) PExpireAt(args [][]byte) (res interface{}, err error) {
+	return s.expire(args, time.Millisecond, true)
+}
+
+// expire unit为参数的时间单位，at为true时参数为时间戳，否则为相对时间
+func (s *Server) expire(args [][]byte, unit time.Duration, at bool) (res interface{}, err error) {
+	if len(args) != 2 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	n, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	expireAt := n * int64(unit/time.Millisecond)
+	if !at {
+		expireAt += time.Now().UnixMilli()
+	}
+	return s.curDB.Expire(args[0], expireAt)
+}
+
+func (s *Server) TTL(args [][]byte) (res interface{}, err error) {
+	if len(args) != 1 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	ttl, err := s.curDB.TTL(args[0])
+	if err != nil || ttl < 0 {
+		return ttl, err
+	}
+	return (ttl + 500) / 1000, nil
+}
+
+func (s *Server) PTTL(args [][]byte) (res interface{}, err error) {
+	if len(args) != 1 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	return s.curDB.TTL(args[0])
+}
+
+func (s *Server) Persist(args [][]byte) (res interface{}, err error) {
+	if len(args) != 1 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	return s.curDB.Persist(args[0])
+}
+
+// parseExpireAt 将EX、PX、EXAT、PXAT选项的参数转换为毫秒时间戳
+func parseExpireAt(option string, arg []byte) (expireAt int64, err error) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, constants.ErrInvalidExpireTime
+	}
+	switch option {
+	case "ex":
+		return time.Now().UnixMilli() + n*1000, nil
+	case "px":
+		return time.Now().UnixMilli() + n, nil
+	case "exat":
+		return n * 1000, nil
+	case "pxat":
+		return n, nil
+	}
+	return 0, constants.ErrSyntax
+}
+
 // ======== String相关命令 ========
 
+// Set key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+// NX和XX不满足时不写入，返回nil；指定GET时返回旧值，key不存在时返回nil
 func (s *Server) Set(args [][]byte) (res interface{}, err error) {
 	if len(args) < 2 {
 		return nil, constants.ErrWrongNumberArgs
 	}
-	err = s.curDB.Set(args[0], args[1])
-	if err == nil {
-		res = constants.ResultOk
+	var expireAt int64
+	keepTTL, nx, xx, get := false, false, false, false
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToLower(string(args[i])); option {
+		case "ex", "px", "exat", "pxat":
+			if i+1 >= len(args) || expireAt != 0 || keepTTL {
+				return nil, constants.ErrSyntax
+			}
+			expireAt, err = parseExpireAt(option, args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			i++
+		case "keepttl":
+			if expireAt != 0 {
+				return nil, constants.ErrSyntax
+			}
+			keepTTL = true
+		case "nx":
+			if xx {
+				return nil, constants.ErrSyntax
+			}
+			nx = true
+		case "xx":
+			if nx {
+				return nil, constants.ErrSyntax
+			}
+			xx = true
+		case "get":
+			get = true
+		default:
+			return nil, errors.Wrap(constants.ErrSyntax, fmt.Sprintf("unsupported SET option %v", option))
+		}
 	}
-	return
+	var old []byte
+	exist := false
+	if nx || xx || get {
+		old, err = s.curDB.Get(args[0])
+		if err != nil && !errors.Is(err, constants.ErrKeyNotFound) {
+			return nil, err
+		}
+		exist = err == nil
+	}
+	if nx && exist || xx && !exist {
+		if get && exist {
+			return old, nil
+		}
+		return nil, nil
+	}
+	if keepTTL {
+		err = s.curDB.SetKeepTTL(args[0], args[1])
+	} else {
+		err = s.curDB.SetEX(args[0], args[1], expireAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if get {
+		if exist {
+			return old, nil
+		}
+		return nil, nil
+	}
+	return constants.ResultOk, nil
 }
 
 func (s *Server) MSet(args [][]byte) (res interface{}, err error) {
 	if len(args) < 2 || len(args)%2 != 0 {
 		return nil, constants.ErrWrongNumberArgs
 	}
-	for i := 0; i < len(args); i += 2 {
-		err = s.curDB.Set(args[i], args[i+1])
-		continue
+	if err = s.curDB.MSet(args...); err != nil {
+		return nil, err
 	}
-	res = constants.ResultOk
-	return
+	return constants.ResultOk, nil
 }
 
 func (s *Server) SetEX(args [][]byte) (res interface{}, err error) {
-	return nil, constants.ErrUnsupportedCommand
+	if len(args) != 3 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	expireAt, err := parseExpireAt("ex", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err = s.curDB.SetEX(args[0], args[2], expireAt); err != nil {
+		return nil, err
+	}
+	return constants.ResultOk, nil
 }
 
 func (s *Server) SetNX(args [][]byte) (res interface{}, err error) {
@@ -186,7 +658,17 @@ func (s *Server) MSetNX(args [][]byte) (res interface{}, err error) {
 }
 
 func (s *Server) PSetEX(args [][]byte) (res interface{}, err error) {
-	return nil, constants.ErrUnsupportedCommand
+	if len(args) != 3 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	expireAt, err := parseExpireAt("px", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err = s.curDB.SetEX(args[0], args[2], expireAt); err != nil {
+		return nil, err
+	}
+	return constants.ResultOk, nil
 }
 
 func (s *Server) SetRange(args [][]byte) (res interface{}, err error) {
@@ -310,8 +792,25 @@ func (s *Server) GetDel(args [][]byte) (res interface{}, err error) {
 	return s.curDB.GetDel(args[0]), nil
 }
 
+// GetEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
 func (s *Server) GetEX(args [][]byte) (res interface{}, err error) {
-	return nil, constants.ErrUnsupportedCommand
+	if len(args) < 1 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	var expireAt int64
+	persist := false
+	switch {
+	case len(args) == 2 && strings.ToLower(string(args[1])) == "persist":
+		persist = true
+	case len(args) == 3:
+		expireAt, err = parseExpireAt(strings.ToLower(string(args[1])), args[2])
+		if err != nil {
+			return nil, err
+		}
+	case len(args) != 1:
+		return nil, constants.ErrSyntax
+	}
+	return s.curDB.GetEX(args[0], expireAt, persist)
 }
 
 func (s *Server) LCS(args [][]byte) (res interface{}, err error) {
@@ -544,9 +1043,20 @@ func (s *Server) HSetNX(args [][]byte) (res interface{}, err error) {
 	return s.curDB.HSetNX(args[0], args[1], args[2])
 }
 
-// TODO
+// HScan HSCAN key cursor [MATCH pattern] [COUNT count]
 func (s *Server) HScan(args [][]byte) (res interface{}, err error) {
-	return nil, constants.ErrUnsupportedCommand
+	if len(args) < 2 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	cursor, opt, err := parseScanArgs(args[1:], false)
+	if err != nil {
+		return nil, err
+	}
+	next, fields, err := s.curDB.HScan(args[0], cursor, opt)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{strconv.FormatUint(next, 10), fields}, nil
 }
 
 // ======== Set相关命令 ========
@@ -621,9 +1131,20 @@ func (s *Server) SRandMember(args [][]byte) (res interface{}, err error) {
 	return s.curDB.SRandMember(args[0], count)
 }
 
-// TODO
+// SScan SSCAN key cursor [MATCH pattern] [COUNT count]
 func (s *Server) SScan(args [][]byte) (res interface{}, err error) {
-	return nil, constants.ErrUnsupportedCommand
+	if len(args) < 2 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	cursor, opt, err := parseScanArgs(args[1:], false)
+	if err != nil {
+		return nil, err
+	}
+	next, members, err := s.curDB.SScan(args[0], cursor, opt)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{strconv.FormatUint(next, 10), members}, nil
 }
 
 // ======== ZSet相关命令 ========
@@ -852,6 +1373,18 @@ func (s *Server) ZRemRangeByScore(args [][]byte) (res interface{}, err error) {
 	return s.curDB.ZRemRange(args[0], min, max, true)
 }
 
+// ZScan ZSCAN key cursor [MATCH pattern] [COUNT count]
 func (s *Server) ZScan(args [][]byte) (res interface{}, err error) {
-	return nil, constants.ErrUnsupportedCommand
+	if len(args) < 2 {
+		return nil, constants.ErrWrongNumberArgs
+	}
+	cursor, opt, err := parseScanArgs(args[1:], false)
+	if err != nil {
+		return nil, err
+	}
+	next, members, err := s.curDB.ZScan(args[0], cursor, opt)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{strconv.FormatUint(next, 10), members}, nil
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"SouthWind6510/TinyDB/db"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// Client 连接的上下文，保存事务状态
+type Client struct {
+	svr      *Server
+	multi    bool                       // 是否处于MULTI中
+	aborted  bool                       // 入队时出现错误，EXEC时放弃事务
+	queued   [][][]byte                 // MULTI之后入队的命令
+	watchers map[*db.TinyDB]*db.Watcher // 每个数据库的watcher
+}
+
+type txHandler func(*Client, redcon.Conn, [][]byte)
+
+var txHandlersMap = map[string]txHandler{
+	"multi":   (*Client).Multi,
+	"exec":    (*Client).Exec,
+	"discard": (*Client).Discard,
+	"watch":   (*Client).Watch,
+	"unwatch": (*Client).Unwatch,
+}
+
+func newClient(svr *Server) *Client {
+	return &Client{
+		svr:      svr,
+		watchers: make(map[*db.TinyDB]*db.Watcher),
+	}
+}
+
+// enqueue redcon会复用参数的内存，入队前需要拷贝
+func (c *Client) enqueue(args [][]byte) {
+	cmd := make([][]byte, len(args))
+	for i, arg := range args {
+		cmd[i] = append([]byte{}, arg...)
+	}
+	c.queued = append(c.queued, cmd)
+}
+
+func (c *Client) resetMulti() {
+	c.multi = false
+	c.aborted = false
+	c.queued = nil
+}
+
+func (c *Client) unwatch() {
+	for _, w := range c.watchers {
+		w.Unwatch()
+	}
+	c.watchers = make(map[*db.TinyDB]*db.Watcher)
+}
+
+func (c *Client) Multi(conn redcon.Conn, args [][]byte) {
+	if c.multi {
+		conn.WriteError(constants.ErrNestedMulti.Error())
+		return
+	}
+	c.multi = true
+	conn.WriteString(constants.ResultOk)
+}
+
+// Exec 独占当前数据库依次执行入队的命令，监视的key被修改时返回nil
+func (c *Client) Exec(conn redcon.Conn, args [][]byte) {
+	if !c.multi {
+		conn.WriteError(constants.ErrExecWithoutMulti.Error())
+		return
+	}
+	queued, aborted := c.queued, c.aborted
+	c.resetMulti()
+	defer c.unwatch()
+	if aborted {
+		conn.WriteError(constants.ErrExecAbort.Error())
+		return
+	}
+
+	curDB := c.svr.curDB
+	for watchDB, w := range c.watchers {
+		if watchDB != curDB && w.Dirty() {
+			conn.WriteNull()
+			return
+		}
+	}
+	results := make([]interface{}, len(queued))
+	errs := make([]error, len(queued))
+	ok := curDB.Exec(c.watchers[curDB], func() {
+		for i, cmd := range queued {
+			results[i], errs[i] = cmdHandlersMap[strings.ToLower(string(cmd[0]))](c.svr, cmd[1:])
+		}
+	})
+	if !ok {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteArray(len(queued))
+	for i := range queued {
+		writeResult(conn, results[i], errs[i])
+	}
+}
+
+func (c *Client) Discard(conn redcon.Conn, args [][]byte) {
+	if !c.multi {
+		conn.WriteError(constants.ErrDiscardWithoutMulti.Error())
+		return
+	}
+	c.resetMulti()
+	c.unwatch()
+	conn.WriteString(constants.ResultOk)
+}
+
+func (c *Client) Watch(conn redcon.Conn, args [][]byte) {
+	if c.multi {
+		conn.WriteError(constants.ErrWatchInMulti.Error())
+		return
+	}
+	if len(args) == 0 {
+		conn.WriteError(constants.ErrWrongNumberArgs.Error())
+		return
+	}
+	curDB := c.svr.curDB
+	w, ok := c.watchers[curDB]
+	if !ok {
+		w = curDB.NewWatcher()
+		c.watchers[curDB] = w
+	}
+	w.Watch(args...)
+	conn.WriteString(constants.ResultOk)
+}
+
+func (c *Client) Unwatch(conn redcon.Conn, args [][]byte) {
+	c.unwatch()
+	conn.WriteString(constants.ResultOk)
+}
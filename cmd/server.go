@@ -4,6 +4,7 @@ import (
 	"SouthWind6510/TinyDB/db"
 	"SouthWind6510/TinyDB/pkg/constants"
 	"SouthWind6510/TinyDB/pkg/logger"
+	"flag"
 	"fmt"
 	"path/filepath"
 	"sync"
@@ -13,10 +14,19 @@ import (
 )
 
 type ServerOptions struct {
-	path  string
-	host  string
-	port  string
-	dbNum int
+	path          string
+	host          string
+	port          string
+	dbNum         int
+	appendSync    string // 落盘策略：always、everysec、none
+	backupDir     string // BGSAVE备份目录，每次备份写入以时间命名的子目录
+	readOnly      bool   // 只读打开数据库，可以与其他只读进程同时打开
+	keyFile       string // 加密密钥文件
+	keyEnv        string // 保存加密密钥的环境变量名
+	cacheSize     int64  // 每个数据库value缓存的容量，字节
+	blobThreshold int    // value不小于该大小时写入blob文件
+	diskIndex     bool   // String、List和Hash使用磁盘索引
+	indexCache    int64  // 磁盘索引的节点缓存大小，字节
 }
 
 type Server struct {
@@ -24,12 +34,42 @@ type Server struct {
 	dbs   []*db.TinyDB
 	curDB *db.TinyDB
 	mu    sync.RWMutex
+
+	saveMu      sync.Mutex
+	saving      bool  // 是否有BGSAVE正在进行
+	lastSave    int64 // 最近一次备份成功的时间，秒级时间戳
+	lastSaveErr error // 最近一次备份的错误
 }
 
 func main() {
+	svrOpt := ServerOptions{}
+	flag.StringVar(&svrOpt.appendSync, "appendfsync", "everysec", "sync policy: always, everysec or none")
+	flag.StringVar(&svrOpt.backupDir, "backupdir", filepath.Join(constants.DefaultPath, "backup"), "directory of BGSAVE backups")
+	flag.BoolVar(&svrOpt.readOnly, "readonly", false, "open database in read-only mode")
+	flag.StringVar(&svrOpt.keyFile, "keyfile", "", "file of encryption keys, one id:hex key per line, the last one is used for writing")
+	flag.StringVar(&svrOpt.keyEnv, "keyenv", "", "environment variable holding encryption keys, same format as keyfile")
+	flag.Int64Var(&svrOpt.cacheSize, "cachesize", 0, "capacity in bytes of the value cache of each database, 0 disables the cache")
+	flag.IntVar(&svrOpt.blobThreshold, "blobthreshold", 0, "values not smaller than this size are stored in separate blob files, 0 disables the separation")
+	flag.BoolVar(&svrOpt.diskIndex, "diskindex", false, "keep the index of strings, lists and hashes in a disk B+tree file instead of memory")
+	flag.Int64Var(&svrOpt.indexCache, "indexcachesize", 0, "capacity in bytes of the node cache of the disk index, 0 uses the default 64M")
+	flag.Parse()
+
 	start := time.Now()
 	// open数据库
 	opt := db.DefaultOptions(filepath.Join(constants.DefaultPath, "0"))
+	syncPolicy, err := db.ParseSyncPolicy(svrOpt.appendSync)
+	if err != nil {
+		logger.Log.Errorf("parse appendfsync err: %v", err)
+		return
+	}
+	opt.SyncPolicy = syncPolicy
+	opt.ReadOnly = svrOpt.readOnly
+	opt.EncryptionKeyFile = svrOpt.keyFile
+	opt.EncryptionKeyEnv = svrOpt.keyEnv
+	opt.CacheSize = svrOpt.cacheSize
+	opt.BlobThreshold = svrOpt.blobThreshold
+	opt.DiskIndex = svrOpt.diskIndex
+	opt.IndexCacheSize = svrOpt.indexCache
 	curDB, err := db.Open(opt)
 	if err != nil {
 		logger.Log.Errorf("open db err: %+v", err)
@@ -37,18 +77,19 @@ func main() {
 	}
 	logger.Log.Infof("open db success, time cost: %v", time.Since(start))
 	// 启动服务监听
-	svr := &Server{dbs: []*db.TinyDB{curDB}, curDB: curDB}
+	svr := &Server{opt: svrOpt, dbs: []*db.TinyDB{curDB}, curDB: curDB, lastSave: time.Now().Unix()}
 	err = redcon.ListenAndServe(fmt.Sprintf(constants.ServerHost+":"+constants.ServerPort),
 		execCommand,
 		func(conn redcon.Conn) bool {
 			// Use this function to accept or deny the connection.
 			logger.Log.Printf("accept: %s", conn.RemoteAddr())
-			conn.SetContext(svr)
+			conn.SetContext(newClient(svr))
 			return true
 		},
 		func(conn redcon.Conn, err error) {
 			// This is called when the connection has been closed
 			logger.Log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
+			conn.Context().(*Client).unwatch()
 		},
 	)
 	if err != nil {
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/db"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tinydb-check 离线校验数据目录，-repair模式下修复损坏的数据文件，运行前需要停止服务
+func main() {
+	path := flag.String("path", filepath.Join(constants.DefaultPath, "0"), "data directory")
+	repair := flag.Bool("repair", false, "rewrite data files skipping corrupt ranges")
+	keyFile := flag.String("keyfile", "", "file of encryption keys used by the data directory")
+	keyEnv := flag.String("keyenv", "", "environment variable holding encryption keys")
+	flag.Parse()
+
+	// 加密的数据需要先注册密钥才能读取
+	if _, err := db.LoadKeys(*keyFile, *keyEnv); err != nil {
+		fmt.Fprintf(os.Stderr, "load keys err: %+v\n", err)
+		os.Exit(2)
+	}
+
+	report, err := db.Check(*path, *repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check %v err: %+v\n", *path, err)
+		os.Exit(2)
+	}
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].FileName < report.Files[j].FileName
+	})
+	fmt.Printf("%-32s %8s %8s %8s %12s\n", "FILE", "LIVE", "DEAD", "CORRUPT", "CORRUPT_BYTES")
+	for _, file := range report.Files {
+		line := fmt.Sprintf("%-32s %8d %8d %8d %12d", filepath.Base(file.FileName), file.Live, file.Dead, file.Corrupt, file.CorruptBytes)
+		if file.Repaired {
+			line += " repaired"
+		}
+		fmt.Println(line)
+	}
+	fmt.Println()
+	for dataType := data.String; dataType <= data.ZSet; dataType++ {
+		suffix := strings.Split(data.Type2FileSufMap[dataType], ".")[1]
+		fmt.Printf("%-6s keys: %d\n", suffix, report.KeyCount[dataType])
+	}
+	if report.Corrupted() {
+		fmt.Println("\ncorrupt data found, run with -repair to fix")
+		os.Exit(1)
+	}
+}
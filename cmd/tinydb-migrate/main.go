@@ -0,0 +1,31 @@
+package main
+
+import (
+	"SouthWind6510/TinyDB/db"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// tinydb-migrate 为数据目录中没有文件头的旧数据文件原地加上文件头，entry编码不变，运行前需要停止服务
+func main() {
+	path := flag.String("path", filepath.Join(constants.DefaultPath, "0"), "data directory")
+	keyFile := flag.String("keyfile", "", "file of encryption keys used by the data directory")
+	keyEnv := flag.String("keyenv", "", "environment variable holding encryption keys")
+	flag.Parse()
+
+	opt := db.DefaultOptions(*path)
+	opt.EncryptionKeyFile = *keyFile
+	opt.EncryptionKeyEnv = *keyEnv
+	migrated, err := db.Migrate(opt)
+	for _, fileName := range migrated {
+		fmt.Printf("migrated %v\n", filepath.Base(fileName))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate %v err: %+v\n", *path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%v files migrated\n", len(migrated))
+}
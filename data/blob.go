@@ -0,0 +1,60 @@
+package data
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const BlobPtrSize = 20 // Fid4 + Offset8 + Size8
+
+// BlobPtr 大value在blob文件中的位置，分离后主entry的value只保存它
+type BlobPtr struct {
+	Fid    uint32
+	Offset int64
+	Size   int64 // blob记录编码后的长度
+}
+
+func EncodeBlobPtr(p *BlobPtr) []byte {
+	buf := make([]byte, BlobPtrSize)
+	binary.LittleEndian.PutUint32(buf[:4], p.Fid)
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(p.Offset))
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(p.Size))
+	return buf
+}
+
+func DecodeBlobPtr(buf []byte) (*BlobPtr, error) {
+	if len(buf) != BlobPtrSize {
+		return nil, errors.Wrap(constants.ErrInvalidBlobPtr, fmt.Sprintf("size: %v", len(buf)))
+	}
+	return &BlobPtr{
+		Fid:    binary.LittleEndian.Uint32(buf[:4]),
+		Offset: int64(binary.LittleEndian.Uint64(buf[4:12])),
+		Size:   int64(binary.LittleEndian.Uint64(buf[12:20])),
+	}, nil
+}
+
+// NewBlobEntry blob文件中的记录，key为数据类型加主entry的key，blob GC据此找到主entry判断记录是否仍被引用
+func NewBlobEntry(dataType DataType, key, value []byte) *Entry {
+	blobKey := make([]byte, len(key)+1)
+	blobKey[0] = byte(dataType)
+	copy(blobKey[1:], key)
+	return NewEntry(blobKey, value, Insert)
+}
+
+// DecodeBlobKey 解析blob记录的key，返回主entry的数据类型和key
+func DecodeBlobKey(blobKey []byte) (dataType DataType, key []byte) {
+	if len(blobKey) == 0 {
+		return Blob, nil
+	}
+	return DataType(blobKey[0]), blobKey[1:]
+}
+
+// MatchBlob 检查blob记录是否属于dataType中key对应的主entry
+func MatchBlob(blob *Entry, dataType DataType, key []byte) bool {
+	blobType, blobKey := DecodeBlobKey(blob.Key)
+	return blobType == dataType && bytes.Equal(blobKey, key)
+}
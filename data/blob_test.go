@@ -0,0 +1,33 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_BlobPtr(t *testing.T) {
+	ptr := &BlobPtr{Fid: 3, Offset: 1 << 33, Size: 1 << 20}
+	got, err := DecodeBlobPtr(EncodeBlobPtr(ptr))
+	if err != nil || !reflect.DeepEqual(got, ptr) {
+		t.Errorf("DecodeBlobPtr = %+v, err: %v", got, err)
+	}
+	if _, err = DecodeBlobPtr([]byte("short")); err == nil {
+		t.Errorf("DecodeBlobPtr should fail")
+	}
+
+	blob := NewBlobEntry(Hash, []byte("key"), []byte("value"))
+	if !MatchBlob(blob, Hash, []byte("key")) || MatchBlob(blob, String, []byte("key")) || MatchBlob(blob, Hash, []byte("ke")) {
+		t.Errorf("MatchBlob error, blob key: %v", blob.Key)
+	}
+
+	// 主entry的blob标记在两种格式中都能解码
+	for _, format := range []uint16{FormatV1, FormatV2} {
+		e := NewEntry([]byte("key"), EncodeBlobPtr(ptr), Insert)
+		e.Header.Blob = true
+		e.Header.Format = format
+		got, err := decodeEntry(EncodeEntry(e), format)
+		if err != nil || !got.Header.Blob || got.Header.Type != Insert {
+			t.Errorf("format %v decodeEntry = %+v, err: %v", format, got.Header, err)
+		}
+	}
+}
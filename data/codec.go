@@ -0,0 +1,148 @@
+package data
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CodecType 压缩算法，压缩后的value第一个字节记录CodecType，id写入文件后不能改变
+type CodecType uint8
+
+const (
+	NoCompression CodecType = iota
+	Flate
+	Gzip
+)
+
+// Codec value的压缩算法，实现需要并发安全
+type Codec interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	codecMu sync.RWMutex
+	codecs  = map[CodecType]Codec{
+		Flate: &flateCodec{},
+		Gzip:  &gzipCodec{},
+	}
+)
+
+// RegisterCodec 注册自定义压缩算法，读取使用该算法写入的数据前必须注册
+func RegisterCodec(codecType CodecType, codec Codec) {
+	if codecType == NoCompression {
+		panic("can not register codec for NoCompression")
+	}
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	codecs[codecType] = codec
+}
+
+// GetCodec 获取已注册的压缩算法
+func GetCodec(codecType CodecType) (Codec, error) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	codec, ok := codecs[codecType]
+	if !ok {
+		return nil, errors.Wrap(constants.ErrUnknownCodec, fmt.Sprintf("codec: %v", codecType))
+	}
+	return codec, nil
+}
+
+// compressValue 压缩value，压缩后不比原数据小时返回ok为false，按原数据写入
+func compressValue(codecType CodecType, value []byte) (buf []byte, ok bool) {
+	codec, err := GetCodec(codecType)
+	if err != nil {
+		return nil, false
+	}
+	compressed, err := codec.Compress(value)
+	if err != nil || len(compressed)+1 >= len(value) {
+		return nil, false
+	}
+	buf = make([]byte, len(compressed)+1)
+	buf[0] = byte(codecType)
+	copy(buf[1:], compressed)
+	return buf, true
+}
+
+// decompressValue 解压compressValue的结果
+func decompressValue(buf []byte) (codecType CodecType, value []byte, err error) {
+	if len(buf) == 0 {
+		return NoCompression, nil, errors.Wrap(constants.ErrUnknownCodec, "empty compressed value")
+	}
+	codecType = CodecType(buf[0])
+	codec, err := GetCodec(codecType)
+	if err != nil {
+		return codecType, nil, err
+	}
+	if value, err = codec.Decompress(buf[1:]); err != nil {
+		return codecType, nil, errors.Wrap(err, fmt.Sprintf("decompress codec: %v", codecType))
+	}
+	return codecType, value, nil
+}
+
+type flateCodec struct {
+	writers sync.Pool
+}
+
+func (c *flateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type gzipCodec struct {
+	writers sync.Pool
+}
+
+func (c *gzipCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// KeyID 加密密钥的id，加密后的数据第一个字节记录KeyID，0表示不加密
+type KeyID uint8
+
+const (
+	NoEncryption    KeyID = 0
+	nonceSize             = 12
+	tagSize               = 16
+	EncryptOverhead       = 1 + nonceSize + tagSize // KeyID1 + Nonce12 + Tag16
+)
+
+var (
+	keyMu sync.RWMutex
+	keys  = make(map[KeyID][]byte)
+	aeads = make(map[KeyID]cipher.AEAD)
+)
+
+// RegisterKey 注册AES密钥，长度为16、24或32字节，同一id不能注册不同的密钥
+// 密钥轮换后旧密钥仍需注册，直到merge用新密钥重写了所有数据
+func RegisterKey(id KeyID, key []byte) error {
+	if id == NoEncryption {
+		return errors.Wrap(constants.ErrInvalidKey, "key id 0 is reserved")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.Wrap(constants.ErrInvalidKey, err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.Wrap(constants.ErrInvalidKey, err.Error())
+	}
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	if old, ok := keys[id]; ok {
+		if !bytes.Equal(old, key) {
+			return errors.Wrap(constants.ErrKeyConflict, fmt.Sprintf("key id: %v", id))
+		}
+		return nil
+	}
+	keys[id] = append([]byte{}, key...)
+	aeads[id] = aead
+	return nil
+}
+
+// HasKey id对应的密钥是否已注册
+func HasKey(id KeyID) bool {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+	_, ok := aeads[id]
+	return ok
+}
+
+func getAEAD(id KeyID) (cipher.AEAD, error) {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+	aead, ok := aeads[id]
+	if !ok {
+		return nil, errors.Wrap(constants.ErrUnknownKey, fmt.Sprintf("key id: %v", id))
+	}
+	return aead, nil
+}
+
+// encryptPayload 加密plaintext写入dst，dst长度为len(plaintext)+EncryptOverhead，aad为参与认证的明文header
+func encryptPayload(id KeyID, dst, aad, plaintext []byte) {
+	aead, err := getAEAD(id)
+	if err != nil {
+		// 写入前已检查密钥，不可能发生
+		panic(fmt.Sprintf("%+v", err))
+	}
+	dst[0] = byte(id)
+	nonce := dst[1 : 1+nonceSize]
+	if _, err = rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("generate nonce err: %v", err))
+	}
+	aead.Seal(dst[1+nonceSize:1+nonceSize], nonce, plaintext, aad)
+}
+
+// decryptPayload 解密encryptPayload的结果，返回新分配的明文
+func decryptPayload(aad, buf []byte) (id KeyID, plaintext []byte, err error) {
+	if len(buf) < EncryptOverhead {
+		return NoEncryption, nil, errors.Wrap(constants.ErrDecrypt, "encrypted payload too short")
+	}
+	id = KeyID(buf[0])
+	aead, err := getAEAD(id)
+	if err != nil {
+		return id, nil, err
+	}
+	plaintext, err = aead.Open(nil, buf[1:1+nonceSize], buf[1+nonceSize:], aad)
+	if err != nil {
+		return id, nil, errors.Wrap(constants.ErrDecrypt, fmt.Sprintf("key id: %v", id))
+	}
+	return id, plaintext, nil
+}
+
+// Seal 用id对应的密钥加密数据文件之外的数据，返回KeyID + Nonce + 密文，aad为参与认证的明文
+func Seal(id KeyID, aad, plaintext []byte) ([]byte, error) {
+	if _, err := getAEAD(id); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, len(plaintext)+EncryptOverhead)
+	encryptPayload(id, buf, aad, plaintext)
+	return buf, nil
+}
+
+// Unseal 解密Seal的结果
+func Unseal(aad, buf []byte) ([]byte, error) {
+	_, plaintext, err := decryptPayload(aad, buf)
+	return plaintext, err
+}
@@ -1,13 +1,22 @@
 package data
 
 import (
+	"SouthWind6510/TinyDB/pkg/constants"
 	"SouthWind6510/TinyDB/util"
 	"encoding/binary"
 	"fmt"
 	"time"
 )
 
-const HeaderSize = 29
+const (
+	HeaderSize   = 29
+	BatchIDSize  = 8    // 批次entry在header之后写入8字节的批次id
+	batchFlag    = 0x80 // Type的最高位标记entry属于批次
+	compressFlag = 0x40 // Type的次高位标记value已压缩，value第一个字节为CodecType
+	encryptFlag  = 0x20 // 标记key和value已加密，格式为KeyID1 + Nonce12 + 密文 + Tag16
+	blobFlag     = 0x08 // 标记value为BlobPtr，实际value在blob文件中，操作类型只能使用低3位
+	flagMask     = batchFlag | compressFlag | encryptFlag | expiryFlag | blobFlag
+)
 
 type OptrType uint8
 
@@ -16,20 +25,28 @@ const (
 	InsertListMeta
 	Update
 	Delete
+	Expire      // 设置key的过期时间，ExpiryTime为0表示取消过期
+	DeleteKey   // 删除key的所有元素
+	BatchCommit // 批次提交记录，value为1表示批次最终提交，为0表示等待其他类型的文件提交
 )
 
 type EntryHeader struct {
-	CRC        uint32   // 循环冗余法计算校验位
-	KeySize    uint32   // key的大小
-	ValueSize  uint32   // value的大小
-	Type       OptrType // 操作类型
-	Timestamp  uint64   // 时间戳
-	ExpiryTime uint64   // 过期时间
+	CRC        uint32    // 循环冗余法计算校验位
+	KeySize    uint32    // key的大小
+	ValueSize  uint32    // 写入文件的value大小，压缩时与解压后的value长度不同
+	Type       OptrType  // 操作类型
+	Timestamp  uint64    // 时间戳
+	ExpiryTime uint64    // 过期时间，毫秒时间戳，0表示不过期
+	BatchID    uint64    // 所属批次id，0表示不属于批次
+	Codec      CodecType // value的压缩算法，编码时压缩后不比原数据小则不压缩
+	KeyID      KeyID     // 加密key和value的密钥id，0表示不加密
+	Format     uint16    // 编码格式，0与FormatV1相同，编码时按所写入文件的格式设置
+	Blob       bool      // value为编码后的BlobPtr，读取时需要到blob文件中取出实际value
 }
 
 func (eh *EntryHeader) String() string {
-	return fmt.Sprintf("{CRC: %v, KeySize: %v, ValueSize: %v, Type: %v, Timestamp: %v, ExpiryTime: %v}",
-		eh.CRC, eh.KeySize, eh.ValueSize, eh.Type, eh.Timestamp, eh.ExpiryTime)
+	return fmt.Sprintf("{CRC: %v, KeySize: %v, ValueSize: %v, Type: %v, Timestamp: %v, ExpiryTime: %v, BatchID: %v}",
+		eh.CRC, eh.KeySize, eh.ValueSize, eh.Type, eh.Timestamp, eh.ExpiryTime, eh.BatchID)
 }
 
 type Entry struct {
@@ -56,44 +73,189 @@ func NewEntry(key, value []byte, opType OptrType) (entry *Entry) {
 	return
 }
 
-func (e *Entry) size() uint64 {
-	return uint64(HeaderSize + e.Header.KeySize + e.Header.ValueSize)
+// NewBatchCommit 批次提交记录，final为false时需要等待其他类型文件中的最终提交记录
+func NewBatchCommit(batchID uint64, final bool) (entry *Entry) {
+	value := []byte{0}
+	if final {
+		value[0] = 1
+	}
+	entry = NewEntry(nil, value, BatchCommit)
+	entry.Header.BatchID = batchID
+	return
 }
 
-// EncodeEntry 编码Entry
+// Copy 复制entry，key和value复制到同一块内存
+func (e *Entry) Copy() *Entry {
+	header := *e.Header
+	buf := make([]byte, len(e.Key)+len(e.Value))
+	copy(buf, e.Key)
+	copy(buf[len(e.Key):], e.Value)
+	return &Entry{
+		Header: &header,
+		Key:    buf[:len(e.Key):len(e.Key)],
+		Value:  buf[len(e.Key):],
+	}
+}
+
+// IsFinalCommit 是否为批次的最终提交记录
+func (e *Entry) IsFinalCommit() bool {
+	return e.Header.Type == BatchCommit && len(e.Value) > 0 && e.Value[0] == 1
+}
+
+// Size entry编码后的长度
+func (e *Entry) Size() int64 {
+	size := e.Header.headerSize() + int64(e.Header.KeySize+e.Header.ValueSize)
+	if e.Header.KeyID != NoEncryption {
+		size += EncryptOverhead
+	}
+	return size
+}
+
+func (eh *EntryHeader) headerSize() int64 {
+	if eh.Format == FormatV2 {
+		return eh.headerSizeV2()
+	}
+	if eh.BatchID != 0 {
+		return HeaderSize + BatchIDSize
+	}
+	return HeaderSize
+}
+
+// flags Type字节，低3位为操作类型，其余为标记
+func (eh *EntryHeader) flags() (typ byte) {
+	typ = byte(eh.Type)
+	if eh.BatchID != 0 {
+		typ |= batchFlag
+	}
+	if eh.Codec != NoCompression {
+		typ |= compressFlag
+	}
+	if eh.KeyID != NoEncryption {
+		typ |= encryptFlag
+	}
+	if eh.Blob {
+		typ |= blobFlag
+	}
+	return typ
+}
+
+// batchIDSize 根据Type字节判断header之后是否有批次id
+func batchIDSize(typ byte) int64 {
+	if typ&batchFlag != 0 {
+		return BatchIDSize
+	}
+	return 0
+}
+
+// encryptSize 根据Type字节判断key和value之外的加密数据长度
+func encryptSize(typ byte) int64 {
+	if typ&encryptFlag != 0 {
+		return EncryptOverhead
+	}
+	return 0
+}
+
+// EncodeEntry 按Header.Format编码Entry，Header.Codec不为NoCompression时压缩value，并更新ValueSize为压缩后的大小
+// Header.KeyID不为NoEncryption时加密压缩后的key和value，header作为附加数据参与认证，CRC基于密文计算
 func EncodeEntry(e *Entry) (buf []byte) {
-	buf = make([]byte, e.size())
-	binary.LittleEndian.PutUint32(buf[4:8], e.Header.KeySize)
-	binary.LittleEndian.PutUint32(buf[8:12], e.Header.ValueSize)
-	buf[12] = byte(e.Header.Type)
-	binary.LittleEndian.PutUint64(buf[13:21], e.Header.Timestamp)
-	binary.LittleEndian.PutUint64(buf[21:29], e.Header.ExpiryTime)
-	copy(buf[HeaderSize:], e.Key)
-	copy(buf[HeaderSize+e.Header.KeySize:], e.Value)
+	if e.Header.Format == 0 {
+		e.Header.Format = FormatV1
+	}
+	value := e.Value
+	if e.Header.Codec != NoCompression {
+		if compressed, ok := compressValue(e.Header.Codec, e.Value); ok {
+			value = compressed
+		} else {
+			e.Header.Codec = NoCompression
+		}
+	}
+	e.Header.ValueSize = uint32(len(value))
+	buf = make([]byte, e.Size())
+	var offset int64
+	if e.Header.Format == FormatV2 {
+		offset = e.Header.encodeV2(buf)
+	} else {
+		offset = e.Header.encodeV1(buf)
+	}
+	if e.Header.KeyID != NoEncryption {
+		plaintext := make([]byte, len(e.Key)+len(value))
+		copy(plaintext, e.Key)
+		copy(plaintext[len(e.Key):], value)
+		encryptPayload(e.Header.KeyID, buf[offset:], buf[4:offset], plaintext)
+	} else {
+		copy(buf[offset:], e.Key)
+		copy(buf[offset+int64(e.Header.KeySize):], value)
+	}
 	e.Header.CRC = util.GetCrc32(buf[4:])
 	binary.LittleEndian.PutUint32(buf[:4], e.Header.CRC)
 	return
 }
 
-// 解码EntryHeader
+// encodeV1 写入FormatV1的定长header，返回header长度
+func (eh *EntryHeader) encodeV1(buf []byte) int64 {
+	binary.LittleEndian.PutUint32(buf[4:8], eh.KeySize)
+	binary.LittleEndian.PutUint32(buf[8:12], eh.ValueSize)
+	buf[12] = eh.flags()
+	binary.LittleEndian.PutUint64(buf[13:21], eh.Timestamp)
+	binary.LittleEndian.PutUint64(buf[21:29], eh.ExpiryTime)
+	if eh.BatchID != 0 {
+		binary.LittleEndian.PutUint64(buf[HeaderSize:HeaderSize+BatchIDSize], eh.BatchID)
+	}
+	return eh.headerSize()
+}
+
+// 解码FormatV1的EntryHeader
 func decodeEntryHeader(buf []byte) (eh *EntryHeader) {
 	eh = &EntryHeader{
 		CRC:        binary.LittleEndian.Uint32(buf[:4]),
 		KeySize:    binary.LittleEndian.Uint32(buf[4:8]),
 		ValueSize:  binary.LittleEndian.Uint32(buf[8:12]),
-		Type:       OptrType(buf[12]),
+		Type:       OptrType(buf[12] &^ flagMask),
 		Timestamp:  binary.LittleEndian.Uint64(buf[13:21]),
 		ExpiryTime: binary.LittleEndian.Uint64(buf[21:29]),
+		Format:     FormatV1,
+	}
+	if batchIDSize(buf[12]) > 0 && len(buf) >= HeaderSize+BatchIDSize {
+		eh.BatchID = binary.LittleEndian.Uint64(buf[HeaderSize : HeaderSize+BatchIDSize])
 	}
 	return
 }
 
-// 解码Entry
-func decodeEntry(buf []byte) (e *Entry) {
-	e = &Entry{
-		Header: decodeEntryHeader(buf[:29]),
+// 按format解码Entry
+func decodeEntry(buf []byte, format uint16) (e *Entry, err error) {
+	e = &Entry{}
+	var offset int64
+	var typ byte
+	if format == FormatV2 {
+		var ok bool
+		if e.Header, offset, ok = decodeEntryHeaderV2(buf); !ok {
+			return nil, constants.ErrInconsistentCRC
+		}
+		typ = buf[4]
+	} else {
+		e.Header = decodeEntryHeader(buf)
+		offset, typ = e.Header.headerSize(), buf[12]
+	}
+	end := offset + int64(e.Header.KeySize+e.Header.ValueSize) + encryptSize(typ)
+	if err = e.decodePayload(typ, buf[4:offset], buf[offset:end]); err != nil {
+		return nil, err
 	}
-	e.Key = buf[HeaderSize : HeaderSize+e.Header.KeySize]
-	e.Value = buf[HeaderSize+e.Header.KeySize : HeaderSize+e.Header.KeySize+e.Header.ValueSize]
 	return
 }
+
+// decodePayload 从header之后的数据中解析key和value，需要时解密和解压，ValueSize保持为文件中的大小
+// aad为header中CRC之后的部分，加密时参与认证
+func (e *Entry) decodePayload(typ byte, aad, payload []byte) (err error) {
+	if typ&encryptFlag != 0 {
+		if e.Header.KeyID, payload, err = decryptPayload(aad, payload); err != nil {
+			return err
+		}
+	}
+	e.Key = payload[:e.Header.KeySize]
+	e.Value = payload[e.Header.KeySize:]
+	e.Header.Blob = typ&blobFlag != 0
+	if typ&compressFlag != 0 {
+		e.Header.Codec, e.Value, err = decompressValue(e.Value)
+	}
+	return err
+}
@@ -1,9 +1,13 @@
 package data
 
 import (
+	"SouthWind6510/TinyDB/pkg/constants"
 	. "SouthWind6510/TinyDB/pkg/logger"
+	"bytes"
 	"reflect"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 func Test_encodeEntry(t *testing.T) {
@@ -30,7 +34,7 @@ func Test_encodeEntry(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			gotBuf := EncodeEntry(tt.args.e)
-			gotEntry := decodeEntry(gotBuf)
+			gotEntry, _ := decodeEntry(gotBuf, FormatV1)
 			Log.Infof("decode: %v", gotEntry)
 			if !reflect.DeepEqual(tt.args.e.Key, gotEntry.Key) || !reflect.DeepEqual(tt.args.e.Value, gotEntry.Value) {
 				t.Errorf("decodeEntry = %+v, want: %+v", gotEntry, tt.args.e)
@@ -38,3 +42,149 @@ func Test_encodeEntry(t *testing.T) {
 		})
 	}
 }
+
+func Test_encodeBatchEntry(t *testing.T) {
+	e := NewEntry([]byte("key"), []byte("value"), Insert)
+	e.Header.BatchID = 42
+	gotEntry, _ := decodeEntry(EncodeEntry(e), FormatV1)
+	if gotEntry.Header.BatchID != 42 || gotEntry.Header.Type != Insert || gotEntry.Size() != e.Size() {
+		t.Errorf("decodeEntry = %+v, want: %+v", gotEntry.Header, e.Header)
+	}
+	if string(gotEntry.Key) != "key" || string(gotEntry.Value) != "value" {
+		t.Errorf("decodeEntry = %+v, want: %+v", gotEntry, e)
+	}
+
+	commit, _ := decodeEntry(EncodeEntry(NewBatchCommit(42, true)), FormatV1)
+	if !commit.IsFinalCommit() || commit.Header.BatchID != 42 {
+		t.Errorf("decode batch commit = %+v", commit.Header)
+	}
+	if prepared, _ := decodeEntry(EncodeEntry(NewBatchCommit(42, false)), FormatV1); prepared.IsFinalCommit() {
+		t.Errorf("prepared commit decoded as final")
+	}
+}
+
+type repeatCodec struct{}
+
+func (repeatCodec) Compress(src []byte) ([]byte, error) {
+	return []byte{src[0]}, nil
+}
+
+func (repeatCodec) Decompress(src []byte) ([]byte, error) {
+	return bytes.Repeat(src, 100), nil
+}
+
+func Test_encodeCompressedEntry(t *testing.T) {
+	RegisterCodec(100, repeatCodec{})
+	value := bytes.Repeat([]byte("tinydb"), 100)
+	for _, codec := range []CodecType{Flate, Gzip, 100} {
+		if codec == 100 {
+			value = bytes.Repeat([]byte("t"), 100)
+		}
+		e := NewEntry([]byte("key"), value, Insert)
+		e.Header.Codec = codec
+		buf := EncodeEntry(e)
+		if len(buf) >= HeaderSize+len("key")+len(value) || int(e.Header.ValueSize) >= len(value) {
+			t.Errorf("codec %v: value not compressed, entry size %v", codec, len(buf))
+		}
+		gotEntry, err := decodeEntry(buf, FormatV1)
+		if err != nil {
+			t.Fatalf("codec %v: decodeEntry error: %+v", codec, err)
+		}
+		if gotEntry.Header.Codec != codec || gotEntry.Header.Type != Insert || !bytes.Equal(gotEntry.Value, value) {
+			t.Errorf("codec %v: decodeEntry = %+v", codec, gotEntry.Header)
+		}
+		if gotEntry.Size() != int64(len(buf)) {
+			t.Errorf("codec %v: entry size = %v, want %v", codec, gotEntry.Size(), len(buf))
+		}
+	}
+
+	// 压缩后不变小时按原数据写入
+	e := NewEntry([]byte("key"), []byte("value"), Insert)
+	e.Header.Codec = Gzip
+	gotEntry, _ := decodeEntry(EncodeEntry(e), FormatV1)
+	if gotEntry.Header.Codec != NoCompression || string(gotEntry.Value) != "value" {
+		t.Errorf("small value decodeEntry = %+v", gotEntry)
+	}
+}
+
+func Test_encodeEncryptedEntry(t *testing.T) {
+	if err := RegisterKey(10, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("RegisterKey error: %+v", err)
+	}
+	if err := RegisterKey(10, bytes.Repeat([]byte{2}, 32)); !errors.Is(err, constants.ErrKeyConflict) {
+		t.Errorf("register conflict key error: %v", err)
+	}
+	if err := RegisterKey(11, []byte("short")); !errors.Is(err, constants.ErrInvalidKey) {
+		t.Errorf("register invalid key error: %v", err)
+	}
+
+	value := bytes.Repeat([]byte("secret"), 100)
+	e := NewEntry([]byte("key"), value, Insert)
+	e.Header.BatchID = 42
+	e.Header.Codec = Gzip
+	e.Header.KeyID = 10
+	buf := EncodeEntry(e)
+	if bytes.Contains(buf, []byte("key")) || int64(len(buf)) != e.Size() {
+		t.Errorf("entry is not encrypted, size %v, want %v", len(buf), e.Size())
+	}
+	gotEntry, err := decodeEntry(buf, FormatV1)
+	if err != nil {
+		t.Fatalf("decodeEntry error: %+v", err)
+	}
+	if gotEntry.Header.KeyID != 10 || gotEntry.Header.Codec != Gzip || gotEntry.Header.BatchID != 42 ||
+		string(gotEntry.Key) != "key" || !bytes.Equal(gotEntry.Value, value) || gotEntry.Size() != e.Size() {
+		t.Errorf("decodeEntry = %+v", gotEntry.Header)
+	}
+
+	// header参与认证，修改后解密失败
+	buf[21]++
+	if _, err = decodeEntry(buf, FormatV1); !errors.Is(err, constants.ErrDecrypt) {
+		t.Errorf("decode tampered entry error: %v", err)
+	}
+	buf[21]--
+	buf[HeaderSize+BatchIDSize] = 12
+	if _, err = decodeEntry(buf, FormatV1); !errors.Is(err, constants.ErrUnknownKey) {
+		t.Errorf("decode entry with unknown key error: %v", err)
+	}
+}
+
+func Test_encodeEntryV2(t *testing.T) {
+	_ = RegisterKey(30, bytes.Repeat([]byte{4}, 16))
+	newEntry := func() *Entry {
+		e := NewEntry([]byte("set"), nil, Insert)
+		e.Header.Format = FormatV2
+		return e
+	}
+	e := newEntry()
+	buf := EncodeEntry(e)
+	v1Size := HeaderSize + len("set")
+	if len(buf) >= v1Size-16 || int64(len(buf)) != e.Size() {
+		t.Errorf("v2 entry size = %v, v1 size = %v", len(buf), v1Size)
+	}
+	gotEntry, err := decodeEntry(buf, FormatV2)
+	if err != nil || !reflect.DeepEqual(gotEntry.Header, e.Header) || string(gotEntry.Key) != "set" || len(gotEntry.Value) != 0 {
+		t.Errorf("decodeEntry = %+v, want %+v, err %v", gotEntry.Header, e.Header, err)
+	}
+
+	// 可选字段
+	e = newEntry()
+	e.Value = bytes.Repeat([]byte("value"), 100)
+	e.Header.ExpiryTime = 1 << 40
+	e.Header.BatchID = 42
+	e.Header.Codec = Flate
+	e.Header.KeyID = 30
+	buf = EncodeEntry(e)
+	if int64(len(buf)) != e.Size() {
+		t.Errorf("v2 entry size = %v, want %v", len(buf), e.Size())
+	}
+	if gotEntry, err = decodeEntry(buf, FormatV2); err != nil {
+		t.Fatalf("decodeEntry error: %+v", err)
+	}
+	if gotEntry.Header.ExpiryTime != 1<<40 || gotEntry.Header.BatchID != 42 || gotEntry.Header.Codec != Flate ||
+		gotEntry.Header.KeyID != 30 || !bytes.Equal(gotEntry.Value, e.Value) || gotEntry.Size() != e.Size() {
+		t.Errorf("decodeEntry = %+v", gotEntry.Header)
+	}
+	if _, _, ok := decodeEntryHeaderV2(buf[:6]); ok {
+		t.Errorf("decode truncated header should fail")
+	}
+}
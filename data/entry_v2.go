@@ -0,0 +1,90 @@
+package data
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// FormatV2的header：CRC4 + Type1 + KeySize + ValueSize + Timestamp + [ExpiryTime] + [BatchID]
+// CRC和Type之外都是uvarint，过期时间和批次id只在Type中有对应标记时写入
+const (
+	expiryFlag      = 0x10 // 标记header包含过期时间，只用于FormatV2
+	minHeaderSizeV2 = 4 + 1 + 3
+	maxHeaderSizeV2 = 4 + 1 + 2*binary.MaxVarintLen32 + 3*binary.MaxVarintLen64
+)
+
+func uvarintSize(x uint64) int64 {
+	n := int64(1)
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+func (eh *EntryHeader) headerSizeV2() int64 {
+	size := 4 + 1 + uvarintSize(uint64(eh.KeySize)) + uvarintSize(uint64(eh.ValueSize)) + uvarintSize(eh.Timestamp)
+	if eh.ExpiryTime != 0 {
+		size += uvarintSize(eh.ExpiryTime)
+	}
+	if eh.BatchID != 0 {
+		size += uvarintSize(eh.BatchID)
+	}
+	return size
+}
+
+// encodeV2 写入FormatV2的变长header，返回header长度
+func (eh *EntryHeader) encodeV2(buf []byte) int64 {
+	buf[4] = eh.flags()
+	offset := 5
+	offset += binary.PutUvarint(buf[offset:], uint64(eh.KeySize))
+	offset += binary.PutUvarint(buf[offset:], uint64(eh.ValueSize))
+	offset += binary.PutUvarint(buf[offset:], eh.Timestamp)
+	if eh.ExpiryTime != 0 {
+		buf[4] |= expiryFlag
+		offset += binary.PutUvarint(buf[offset:], eh.ExpiryTime)
+	}
+	if eh.BatchID != 0 {
+		offset += binary.PutUvarint(buf[offset:], eh.BatchID)
+	}
+	return int64(offset)
+}
+
+// decodeEntryHeaderV2 解码FormatV2的header，返回header长度，buf不完整或数据错误时ok为false
+func decodeEntryHeaderV2(buf []byte) (eh *EntryHeader, n int64, ok bool) {
+	if len(buf) < minHeaderSizeV2 {
+		return nil, 0, false
+	}
+	typ := buf[4]
+	eh = &EntryHeader{
+		CRC:    binary.LittleEndian.Uint32(buf[:4]),
+		Type:   OptrType(typ &^ flagMask),
+		Format: FormatV2,
+	}
+	offset := 5
+	next := func(max uint64) (uint64, bool) {
+		x, l := binary.Uvarint(buf[offset:])
+		if l <= 0 || x > max {
+			return 0, false
+		}
+		offset += l
+		return x, true
+	}
+	keySize, ok1 := next(math.MaxUint32)
+	valueSize, ok2 := next(math.MaxUint32)
+	timestamp, ok3 := next(math.MaxUint64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, 0, false
+	}
+	eh.KeySize, eh.ValueSize, eh.Timestamp = uint32(keySize), uint32(valueSize), timestamp
+	if typ&expiryFlag != 0 {
+		if eh.ExpiryTime, ok = next(math.MaxUint64); !ok {
+			return nil, 0, false
+		}
+	}
+	if typ&batchFlag != 0 {
+		if eh.BatchID, ok = next(math.MaxUint64); !ok {
+			return nil, 0, false
+		}
+	}
+	return eh, int64(offset), true
+}
@@ -0,0 +1,19 @@
+package data
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocateKeepSize 对应FALLOC_FL_KEEP_SIZE，只分配磁盘空间，不改变文件大小
+const fallocateKeepSize = 0x1
+
+// fallocate 预留size大小的磁盘空间，文件系统不支持时忽略
+func fallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocateKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package data
+
+import "os"
+
+// fallocate 只在Linux上预留磁盘空间，其他系统忽略
+func fallocate(file *os.File, size int64) error {
+	return nil
+}
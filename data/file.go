@@ -3,11 +3,15 @@ package data
 import (
 	"SouthWind6510/TinyDB/pkg/constants"
 	"SouthWind6510/TinyDB/util"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -20,8 +24,11 @@ const (
 	Hash
 	Set
 	ZSet
+	Blob // blob文件，保存从各类型entry中分离出的大value，不在Type2FileSufMap中
 )
 
+const BlobFileSuf = ".blob"
+
 var (
 	Type2FileSufMap = map[DataType]string{
 		String: ".str.log",
@@ -30,6 +37,13 @@ var (
 		Set:    ".set.log",
 		ZSet:   ".zset.log",
 	}
+	Type2HintSufMap = map[DataType]string{
+		String: ".str.hint",
+		List:   ".list.hint",
+		Hash:   ".hash.hint",
+		Set:    ".set.hint",
+		ZSet:   ".zset.hint",
+	}
 	FileSuf2TypeMap = map[string]DataType{
 		"str":  String,
 		"list": List,
@@ -40,14 +54,20 @@ var (
 )
 
 type File struct {
-	Fd       *os.File
-	Fid      int16
-	FileName string
-	WriteAt  int64
-	mu       sync.RWMutex
+	Fd        *os.File
+	Fid       uint32
+	FileName  string
+	WriteAt   int64
+	Version   uint16 // entry的编码格式
+	CreatedAt int64  // 文件头中的创建时间，没有文件头的旧文件为0
+	size      int64  // 文件实际大小，用于检查entry长度是否越界
+	dataStart int64  // 第一个entry的偏移，没有文件头的旧文件为0
+	legacy    bool   // 没有文件头的旧文件
+	mmap      []byte // 只读映射，只用于不再写入的存档文件
+	mu        sync.RWMutex
 }
 
-func NewFile(fd *os.File, fid int16, filename string, writeAt int64) *File {
+func NewFile(fd *os.File, fid uint32, filename string, writeAt int64) *File {
 	return &File{
 		Fd:       fd,
 		Fid:      fid,
@@ -56,56 +76,255 @@ func NewFile(fd *os.File, fid int16, filename string, writeAt int64) *File {
 	}
 }
 
-func getFileName(path string, fid int16, fileType DataType) string {
+// DataFileName fid对应的数据文件名
+func DataFileName(path string, fid uint32, fileType DataType) string {
+	if fileType == Blob {
+		return filepath.Join(path, strconv.FormatUint(uint64(fid), 10)+BlobFileSuf)
+	}
 	return filepath.Join(path, strconv.FormatUint(uint64(fid), 10)+Type2FileSufMap[fileType])
 }
 
-func OpenDataFile(path string, fid int16, fileType DataType, fileSize int64) (df *File, err error) {
-	fileName := getFileName(path, fid, fileType)
+// OpenDataFile 打开数据文件，文件大小即数据的末尾，写入时追加增长，新建的文件写入version格式的文件头
+// preallocate大于0时预留该大小的磁盘空间，不改变文件大小
+func OpenDataFile(path string, fid uint32, fileType DataType, preallocate int64, version uint16) (df *File, err error) {
+	fileName := DataFileName(path, fid, fileType)
 	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
 	}
-	stat, err := os.Stat(fileName)
+	stat, err := file.Stat()
 	if err != nil {
+		_ = file.Close()
 		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
 	}
-	if stat.Size() < fileSize {
-		err = file.Truncate(fileSize)
-		if err != nil {
+	size := stat.Size()
+	if size < preallocate {
+		if err = fallocate(file, preallocate); err != nil {
+			_ = file.Close()
 			return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
 		}
 	}
-	return NewFile(file, fid, fileName, 0), nil
+	df = NewFile(file, fid, fileName, 0)
+	df.size = size
+	if err = df.loadHeader(fileType, version); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return df, nil
+}
+
+// OpenReadOnlyDataFile 只读打开数据文件，不预分配空间
+func OpenReadOnlyDataFile(path string, fid uint32, fileType DataType) (df *File, err error) {
+	fileName := DataFileName(path, fid, fileType)
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	df = NewFile(file, fid, fileName, 0)
+	df.size = stat.Size()
+	if err = df.loadHeader(fileType, 0); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return df, nil
+}
+
+// loadHeader 读取文件头，WriteAt置为第一个entry的偏移
+// 新建或写入文件头时中断的文件写入version格式的文件头，version为0表示只读，当作没有数据；没有文件头的旧文件按FormatV1读取
+func (df *File) loadHeader(fileType DataType, version uint16) error {
+	buf := make([]byte, FileHeaderSize)
+	n, err := df.Fd.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
+	}
+	buf = buf[:n]
+	if h, ok := decodeFileHeader(buf); ok {
+		if err = checkFileHeader(h, fileType, df.FileName); err != nil {
+			return err
+		}
+		df.Version, df.CreatedAt, df.dataStart = h.Version, h.CreatedAt, FileHeaderSize
+	} else if !isTornFileHeader(buf) {
+		df.Version, df.legacy = FormatV1, true
+	} else if version == 0 {
+		df.Version, df.dataStart = LatestFormat, df.size
+	} else {
+		h := &FileHeader{Version: version, DataType: fileType, CreatedAt: time.Now().UnixMilli()}
+		if err = checkFileHeader(h, fileType, df.FileName); err != nil {
+			return err
+		}
+		if _, err = df.Fd.WriteAt(EncodeFileHeader(h), 0); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
+		}
+		df.Version, df.CreatedAt, df.dataStart, df.size = h.Version, h.CreatedAt, FileHeaderSize, FileHeaderSize
+	}
+	df.WriteAt = df.dataStart
+	return nil
+}
+
+// DataStart 第一个entry的偏移
+func (df *File) DataStart() int64 {
+	return df.dataStart
+}
+
+// Legacy 是否为没有文件头的旧文件，可以用tinydb-migrate升级
+func (df *File) Legacy() bool {
+	return df.legacy
+}
+
+// Mmap 只读映射整个文件，之后的读取直接从映射中切片，文件不能再写入；不支持mmap的系统不映射，继续用pread读取
+func (df *File) Mmap() (err error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if df.mmap != nil || df.size == 0 {
+		return nil
+	}
+	df.mmap, err = mmapFile(df.Fd, int(df.size))
+	if err != nil {
+		df.mmap = nil
+		return errors.Wrap(err, fmt.Sprintf("mmap filename: %v", df.FileName))
+	}
+	return nil
+}
+
+// Mapped 是否已映射，映射文件读出的key和value在Close之后失效
+func (df *File) Mapped() bool {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	return df.mmap != nil
+}
+
+func (df *File) munmap() (err error) {
+	if df.mmap == nil {
+		return nil
+	}
+	err = munmapFile(df.mmap)
+	df.mmap = nil
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("munmap filename: %v", df.FileName))
+	}
+	return nil
+}
+
+// read 读取offset开始的n个字节，已映射时返回映射的切片，不能修改
+func (df *File) read(offset, n int64) ([]byte, error) {
+	if df.mmap != nil {
+		if offset+n > int64(len(df.mmap)) {
+			return nil, errors.Wrap(io.EOF, fmt.Sprintf("filename: %v", df.FileName))
+		}
+		return df.mmap[offset : offset+n : offset+n], nil
+	}
+	buf := make([]byte, n)
+	if _, err := df.Fd.ReadAt(buf, offset); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
+	}
+	return buf, nil
 }
 
+// ReadEntry 按文件的编码格式读取offset处的entry
 func (df *File) ReadEntry(offset int64) (entry *Entry, err error) {
 	df.mu.RLock()
 	defer df.mu.RUnlock()
+	switch df.Version {
+	case FormatV1:
+		return df.readEntryV1(offset)
+	case FormatV2:
+		return df.readEntryV2(offset)
+	}
+	return nil, errors.Wrap(constants.ErrUnsupportedFormat, fmt.Sprintf("filename: %v, version: %v", df.FileName, df.Version))
+}
+
+func (df *File) readEntryV1(offset int64) (entry *Entry, err error) {
 	entry = &Entry{}
-	hBuf := make([]byte, HeaderSize)
-	_, err = df.Fd.ReadAt(hBuf, offset)
+	hBuf, err := df.read(offset, HeaderSize)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
+		return nil, err
 	}
 	entry.Header = decodeEntryHeader(hBuf)
 	if entry.Header.CRC == 0 {
 		return nil, constants.ErrReadNullEntry
 	}
-	kvBuf := make([]byte, entry.Header.KeySize+entry.Header.ValueSize)
-	_, err = df.Fd.ReadAt(kvBuf, offset+HeaderSize)
+	extSize := batchIDSize(hBuf[12])
+	payloadSize := int64(entry.Header.KeySize) + int64(entry.Header.ValueSize) + encryptSize(hBuf[12])
+	// 写入中断时header中的长度可能是脏数据
+	if offset+HeaderSize+extSize+payloadSize > df.size {
+		return nil, errors.Wrap(constants.ErrEntryOutOfFile, fmt.Sprintf("filename: %v, offset: %v", df.FileName, offset))
+	}
+	kvBuf, err := df.read(offset+HeaderSize, extSize+payloadSize)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
+		return nil, err
+	}
+	if extSize > 0 {
+		entry.Header.BatchID = binary.LittleEndian.Uint64(kvBuf[:extSize])
 	}
-	entry.Key = kvBuf[:entry.Header.KeySize]
-	entry.Value = kvBuf[entry.Header.KeySize:]
 	// 校验CRC
-	if crc := util.GetCrc32(append(hBuf[4:], kvBuf...)); crc != entry.Header.CRC {
+	if crc := crc32.Update(util.GetCrc32(hBuf[4:]), crc32.IEEETable, kvBuf); crc != entry.Header.CRC {
 		return nil, errors.Wrap(constants.ErrInconsistentCRC, fmt.Sprintf("want crc: %v, got crc: %v", entry.Header.CRC, crc))
 	}
+	var aad []byte
+	if encryptSize(hBuf[12]) > 0 {
+		aad = append(append(make([]byte, 0, HeaderSize-4+extSize), hBuf[4:]...), kvBuf[:extSize]...)
+	}
+	if err = entry.decodePayload(hBuf[12], aad, kvBuf[extSize:]); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v, offset: %v", df.FileName, offset))
+	}
 	return
 }
 
+func (df *File) readEntryV2(offset int64) (entry *Entry, err error) {
+	if offset >= df.size {
+		return nil, errors.Wrap(io.EOF, fmt.Sprintf("filename: %v", df.FileName))
+	}
+	n := df.size - offset
+	if n > maxHeaderSizeV2 {
+		n = maxHeaderSizeV2
+	}
+	hBuf, err := df.read(offset, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(hBuf) >= 4 && binary.LittleEndian.Uint32(hBuf[:4]) == 0 {
+		return nil, constants.ErrReadNullEntry
+	}
+	header, hLen, ok := decodeEntryHeaderV2(hBuf)
+	if !ok {
+		// 文件末尾不足一个完整的header，与FormatV1读取时的行为一致
+		if n < maxHeaderSizeV2 {
+			return nil, errors.Wrap(io.EOF, fmt.Sprintf("filename: %v, offset: %v", df.FileName, offset))
+		}
+		return nil, errors.Wrap(constants.ErrInconsistentCRC, fmt.Sprintf("filename: %v, offset: %v", df.FileName, offset))
+	}
+	entry = &Entry{Header: header}
+	typ := hBuf[4]
+	payloadSize := int64(header.KeySize) + int64(header.ValueSize) + encryptSize(typ)
+	// 写入中断时header中的长度可能是脏数据
+	if offset+hLen+payloadSize > df.size {
+		return nil, errors.Wrap(constants.ErrEntryOutOfFile, fmt.Sprintf("filename: %v, offset: %v", df.FileName, offset))
+	}
+	payload, err := df.read(offset+hLen, payloadSize)
+	if err != nil {
+		return nil, err
+	}
+	// 校验CRC
+	if crc := crc32.Update(util.GetCrc32(hBuf[4:hLen]), crc32.IEEETable, payload); crc != header.CRC {
+		return nil, errors.Wrap(constants.ErrInconsistentCRC, fmt.Sprintf("want crc: %v, got crc: %v", header.CRC, crc))
+	}
+	if err = entry.decodePayload(typ, hBuf[4:hLen:hLen], payload); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v, offset: %v", df.FileName, offset))
+	}
+	return
+}
+
+// EncodeEntry 按文件的格式编码entry
+func (df *File) EncodeEntry(e *Entry) []byte {
+	e.Header.Format = df.Version
+	return EncodeEntry(e)
+}
+
 func (df *File) Write(buf []byte) (err error) {
 	df.mu.Lock()
 	defer df.mu.Unlock()
@@ -117,9 +336,58 @@ func (df *File) Write(buf []byte) (err error) {
 		return errors.Wrap(err, fmt.Sprintf("filename: %v, write at: %v", df.FileName, df.WriteAt))
 	}
 	df.WriteAt += int64(n)
+	if df.WriteAt > df.size {
+		df.size = df.WriteAt
+	}
 	return
 }
 
+// TailSize 返回offset之后到最后一个非零字节的长度，为0说明offset之后没有数据
+func (df *File) TailSize(offset int64) (size int64, err error) {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	return df.tailSize(offset)
+}
+
+func (df *File) tailSize(offset int64) (size int64, err error) {
+	buf := make([]byte, 1<<20)
+	for pos := offset; pos < df.size; pos += int64(len(buf)) {
+		n, err := df.Fd.ReadAt(buf, pos)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
+		}
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] != 0 {
+				size = pos + int64(i) + 1 - offset
+				break
+			}
+		}
+	}
+	return size, nil
+}
+
+// TruncateTail 将文件截断到offset，返回被丢弃的非零数据长度
+// 旧版本预分配的文件末尾全部为0，截断后文件大小即数据的末尾
+func (df *File) TruncateTail(offset int64) (dropped int64, err error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if dropped, err = df.tailSize(offset); err != nil {
+		return 0, err
+	}
+	df.WriteAt = offset
+	if df.size <= offset {
+		return dropped, nil
+	}
+	if err = df.Fd.Truncate(offset); err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
+	}
+	if err = df.Fd.Sync(); err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
+	}
+	df.size = offset
+	return dropped, nil
+}
+
 func (df *File) Sync() (err error) {
 	err = df.Fd.Sync()
 	if err != nil {
@@ -137,6 +405,11 @@ func (df *File) Remove() (err error) {
 }
 
 func (df *File) Close() (err error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if err = df.munmap(); err != nil {
+		return err
+	}
 	if err = df.Fd.Close(); err != nil {
 		return errors.Wrap(err, fmt.Sprintf("filename: %v", df.FileName))
 	}
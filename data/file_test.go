@@ -1,14 +1,19 @@
 package data
 
 import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"io"
+	"os"
 	"reflect"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 func Test_getFileName(t *testing.T) {
 	type args struct {
 		path     string
-		fid      int16
+		fid      uint32
 		fileType DataType
 	}
 	tests := []struct {
@@ -28,8 +33,8 @@ func Test_getFileName(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getFileName(tt.args.path, tt.args.fid, tt.args.fileType); got != tt.want {
-				t.Errorf("getFileName() = %v, want %v", got, tt.want)
+			if got := DataFileName(tt.args.path, tt.args.fid, tt.args.fileType); got != tt.want {
+				t.Errorf("DataFileName() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -38,7 +43,7 @@ func Test_getFileName(t *testing.T) {
 func TestOpenDataFile(t *testing.T) {
 	type args struct {
 		path     string
-		fid      int16
+		fid      uint32
 		fileType DataType
 		fileSize int64
 	}
@@ -79,7 +84,7 @@ func TestOpenDataFile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			file, err := OpenDataFile(tt.args.path, tt.args.fid, tt.args.fileType, tt.args.fileSize)
+			file, err := OpenDataFile(tt.args.path, tt.args.fid, tt.args.fileType, tt.args.fileSize, FormatV1)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("OpenDataFile() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -93,7 +98,7 @@ func TestOpenDataFile(t *testing.T) {
 func TestDataFile_WriteReadEntry(t *testing.T) {
 	type args struct {
 		path     string
-		fid      int16
+		fid      uint32
 		fileType DataType
 		fileSize int64
 	}
@@ -125,13 +130,13 @@ func TestDataFile_WriteReadEntry(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			df, _ := OpenDataFile(tt.args.path, tt.args.fid, tt.args.fileType, tt.args.fileSize)
+			df, _ := OpenDataFile(tt.args.path, tt.args.fid, tt.args.fileType, tt.args.fileSize, FormatV1)
 			err := df.Write(EncodeEntry(tt.wantEntry))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Write() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			gotEntry, err := df.ReadEntry(0)
+			gotEntry, err := df.ReadEntry(df.DataStart())
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ReadEntry() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -143,3 +148,67 @@ func TestDataFile_WriteReadEntry(t *testing.T) {
 		})
 	}
 }
+
+func TestDataFile_Header(t *testing.T) {
+	path := "/Users/southwind/TinyDB/test/0"
+	df, err := OpenDataFile(path, 2, Hash, 0, LatestFormat)
+	if err != nil {
+		t.Fatalf("OpenDataFile error: %+v", err)
+	}
+	defer func() { _ = df.Remove() }()
+	if df.Legacy() || df.Version != LatestFormat || df.DataStart() != FileHeaderSize || df.WriteAt != FileHeaderSize {
+		t.Errorf("new file header: version %v, data start %v", df.Version, df.DataStart())
+	}
+	_ = df.Close()
+
+	// 文件头写入中断时重新写入
+	_ = os.Truncate(df.FileName, 10)
+	if df, err = OpenDataFile(path, 2, Hash, 0, LatestFormat); err != nil || df.Legacy() || df.DataStart() != FileHeaderSize {
+		t.Fatalf("reopen torn header file error: %+v", err)
+	}
+	_ = df.Close()
+
+	// 类型与文件名不一致
+	_ = os.Rename(df.FileName, DataFileName(path, 2, Set))
+	if _, err = OpenReadOnlyDataFile(path, 2, Set); !errors.Is(err, constants.ErrInvalidFileHeader) {
+		t.Errorf("open mismatched file error: %v", err)
+	}
+	_ = os.Rename(DataFileName(path, 2, Set), df.FileName)
+}
+
+func TestDataFile_FormatV2(t *testing.T) {
+	df, err := OpenDataFile("/Users/southwind/TinyDB/test/0", 3, ZSet, 0, FormatV2)
+	if err != nil {
+		t.Fatalf("OpenDataFile error: %+v", err)
+	}
+	defer func() { _ = df.Remove() }()
+	defer df.Close()
+	var entries []*Entry
+	for i := 0; i < 10; i++ {
+		e := NewEntry([]byte{byte(i)}, []byte{byte(i)}, Insert)
+		if i%2 == 0 {
+			e.Header.ExpiryTime = uint64(i)
+		}
+		if err = df.Write(df.EncodeEntry(e)); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	// 末尾写入不完整的entry
+	tail := df.EncodeEntry(NewEntry([]byte("torn"), []byte("entry"), Insert))
+	_ = df.Write(tail[:3])
+	offset := df.DataStart()
+	for _, want := range entries {
+		gotEntry, err := df.ReadEntry(offset)
+		if err != nil {
+			t.Fatalf("ReadEntry error: %+v", err)
+		}
+		if !reflect.DeepEqual(gotEntry, want) {
+			t.Errorf("ReadEntry = %+v, want %+v", gotEntry.Header, want.Header)
+		}
+		offset += gotEntry.Size()
+	}
+	if _, err = df.ReadEntry(offset); !errors.Is(err, io.EOF) {
+		t.Errorf("read torn tail error: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/util"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FileHeaderSize = 32 // Magic6 + Version2 + DataType1 + CreatedAt8 + 保留11 + CRC4
+	fileMagic      = "TINYDB"
+
+	// FormatV1 29字节定长header的entry编码，没有文件头的旧文件也按该格式读取
+	FormatV1 uint16 = 1
+	// FormatV2 varint变长header的entry编码，没有过期时间和批次id时不写入，适合大量小entry
+	FormatV2 uint16 = 2
+	// LatestFormat 支持的最高格式版本
+	LatestFormat = FormatV2
+)
+
+// FileHeader 数据文件开头的文件头，记录entry的编码格式，读取时按Version选择解码方式
+type FileHeader struct {
+	Version   uint16
+	DataType  DataType
+	CreatedAt int64 // 创建时间，毫秒时间戳
+}
+
+// EncodeFileHeader 编码文件头，长度为FileHeaderSize
+func EncodeFileHeader(h *FileHeader) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf, fileMagic)
+	binary.LittleEndian.PutUint16(buf[6:8], h.Version)
+	buf[8] = byte(h.DataType)
+	binary.LittleEndian.PutUint64(buf[9:17], uint64(h.CreatedAt))
+	binary.LittleEndian.PutUint32(buf[FileHeaderSize-4:], util.GetCrc32(buf[:FileHeaderSize-4]))
+	return buf
+}
+
+// decodeFileHeader 解码文件头，ok为false说明buf不是文件头，是没有文件头的旧文件
+func decodeFileHeader(buf []byte) (h *FileHeader, ok bool) {
+	if len(buf) < FileHeaderSize || string(buf[:len(fileMagic)]) != fileMagic ||
+		util.GetCrc32(buf[:FileHeaderSize-4]) != binary.LittleEndian.Uint32(buf[FileHeaderSize-4:FileHeaderSize]) {
+		return nil, false
+	}
+	return &FileHeader{
+		Version:   binary.LittleEndian.Uint16(buf[6:8]),
+		DataType:  DataType(buf[8]),
+		CreatedAt: int64(binary.LittleEndian.Uint64(buf[9:17])),
+	}, true
+}
+
+// isTornFileHeader 新建文件时写入文件头中断，文件中只有文件头的一部分
+func isTornFileHeader(buf []byte) bool {
+	if len(buf) >= FileHeaderSize {
+		return false
+	}
+	if len(buf) <= len(fileMagic) {
+		return bytes.HasPrefix([]byte(fileMagic), buf)
+	}
+	return bytes.HasPrefix(buf, []byte(fileMagic))
+}
+
+// checkFileHeader 检查文件头的版本和类型
+func checkFileHeader(h *FileHeader, fileType DataType, fileName string) error {
+	if h.Version == 0 || h.Version > LatestFormat {
+		return errors.Wrap(constants.ErrUnsupportedFormat, fmt.Sprintf("filename: %v, version: %v", fileName, h.Version))
+	}
+	if h.DataType != fileType {
+		return errors.Wrap(constants.ErrInvalidFileHeader, fmt.Sprintf("filename: %v, data type: %v", fileName, h.DataType))
+	}
+	return nil
+}
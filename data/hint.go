@@ -0,0 +1,167 @@
+package data
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/util"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HintHeaderSize = 37
+	hintCryptMagic = "TINYHE" // 加密的hint文件以该魔数开头，之后为整个文件内容的加密结果
+)
+
+// Hint 记录存档文件中entry的索引信息，Open时用于快速重建索引而无需读取value
+type Hint struct {
+	Type       OptrType // 操作类型
+	Offset     int64    // entry在数据文件中的偏移
+	Size       int64    // entry大小
+	ExpiryTime uint64   // 过期时间
+	Key        []byte   // 二进制key
+	Value      []byte   // 重建索引需要的value，如zset的score，其他类型为空
+}
+
+// NewHint 复制key和value，避免引用调用方可能复用的buf
+func NewHint(entry *Entry, offset, size int64, value []byte) *Hint {
+	return &Hint{
+		Type:       entry.Header.Type,
+		Offset:     offset,
+		Size:       size,
+		ExpiryTime: entry.Header.ExpiryTime,
+		Key:        append([]byte{}, entry.Key...),
+		Value:      append([]byte{}, value...),
+	}
+}
+
+// Entry 将hint还原为只包含索引信息的Entry
+func (h *Hint) Entry() *Entry {
+	return &Entry{
+		Header: &EntryHeader{
+			KeySize:    uint32(len(h.Key)),
+			ValueSize:  uint32(len(h.Value)),
+			Type:       h.Type,
+			ExpiryTime: h.ExpiryTime,
+		},
+		Key:   h.Key,
+		Value: h.Value,
+	}
+}
+
+// EncodeHint 编码Hint
+func EncodeHint(h *Hint) (buf []byte) {
+	buf = make([]byte, HintHeaderSize+len(h.Key)+len(h.Value))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(h.Key)))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(h.Value)))
+	buf[12] = byte(h.Type)
+	binary.LittleEndian.PutUint64(buf[13:21], uint64(h.Offset))
+	binary.LittleEndian.PutUint64(buf[21:29], uint64(h.Size))
+	binary.LittleEndian.PutUint64(buf[29:37], h.ExpiryTime)
+	copy(buf[HintHeaderSize:], h.Key)
+	copy(buf[HintHeaderSize+len(h.Key):], h.Value)
+	binary.LittleEndian.PutUint32(buf[:4], util.GetCrc32(buf[4:]))
+	return
+}
+
+// 解码Hint，返回hint及其编码长度
+func decodeHint(buf []byte) (h *Hint, n int, err error) {
+	if len(buf) < HintHeaderSize {
+		return nil, 0, constants.ErrInconsistentCRC
+	}
+	keySize := int(binary.LittleEndian.Uint32(buf[4:8]))
+	valueSize := int(binary.LittleEndian.Uint32(buf[8:12]))
+	n = HintHeaderSize + keySize + valueSize
+	if len(buf) < n {
+		return nil, 0, constants.ErrInconsistentCRC
+	}
+	if crc := util.GetCrc32(buf[4:n]); crc != binary.LittleEndian.Uint32(buf[:4]) {
+		return nil, 0, constants.ErrInconsistentCRC
+	}
+	h = &Hint{
+		Type:       OptrType(buf[12]),
+		Offset:     int64(binary.LittleEndian.Uint64(buf[13:21])),
+		Size:       int64(binary.LittleEndian.Uint64(buf[21:29])),
+		ExpiryTime: binary.LittleEndian.Uint64(buf[29:37]),
+		Key:        buf[HintHeaderSize : HintHeaderSize+keySize],
+		Value:      buf[HintHeaderSize+keySize : n],
+	}
+	return h, n, nil
+}
+
+// HintFileName fid对应的hint文件名，与数据文件位于同一目录
+func HintFileName(path string, fid uint32, fileType DataType) string {
+	return filepath.Join(path, strconv.FormatUint(uint64(fid), 10)+Type2HintSufMap[fileType])
+}
+
+// WriteHintFile 写入fid对应的hint文件，先写临时文件再rename，保证hint文件要么完整要么不存在
+// keyID不为NoEncryption时加密整个文件
+func WriteHintFile(path string, fid uint32, fileType DataType, hints []*Hint, keyID KeyID) (err error) {
+	fileName := HintFileName(path, fid, fileType)
+	size := 0
+	for _, h := range hints {
+		size += HintHeaderSize + len(h.Key) + len(h.Value)
+	}
+	buf := make([]byte, 0, size)
+	for _, h := range hints {
+		buf = append(buf, EncodeHint(h)...)
+	}
+	if keyID != NoEncryption {
+		encrypted := make([]byte, len(hintCryptMagic)+len(buf)+EncryptOverhead)
+		copy(encrypted, hintCryptMagic)
+		encryptPayload(keyID, encrypted[len(hintCryptMagic):], []byte(hintCryptMagic), buf)
+		buf = encrypted
+	}
+	file, err := os.OpenFile(fileName+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	if _, err = file.Write(buf); err != nil {
+		_ = file.Close()
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	if err = file.Close(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// ReadHintFile 读取fid对应的hint文件，文件不存在时返回的err满足os.IsNotExist
+func ReadHintFile(path string, fid uint32, fileType DataType) (hints []*Hint, err error) {
+	fileName := HintFileName(path, fid, fileType)
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) >= len(hintCryptMagic) && string(buf[:len(hintCryptMagic)]) == hintCryptMagic {
+		if _, buf, err = decryptPayload([]byte(hintCryptMagic), buf[len(hintCryptMagic):]); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+		}
+	}
+	for offset := 0; offset < len(buf); {
+		h, n, err := decodeHint(buf[offset:])
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("filename: %v, offset: %v", fileName, offset))
+		}
+		hints = append(hints, h)
+		offset += n
+	}
+	return hints, nil
+}
+
+// RemoveHintFile 删除fid对应的hint文件，文件不存在时忽略
+func RemoveHintFile(path string, fid uint32, fileType DataType) (err error) {
+	fileName := HintFileName(path, fid, fileType)
+	if err = os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_encodeHint(t *testing.T) {
+	tests := []struct {
+		name string
+		hint *Hint
+	}{
+		{
+			name: "test1",
+			hint: NewHint(NewEntry([]byte("key"), []byte("value"), Insert), 0, 37, nil),
+		},
+		{
+			name: "test2",
+			hint: NewHint(NewEntry([]byte("疯狂星期四"), []byte("50"), Insert), 1024, 48, []byte("50")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := EncodeHint(tt.hint)
+			gotHint, n, err := decodeHint(buf)
+			if err != nil {
+				t.Errorf("decodeHint() error = %v", err)
+				return
+			}
+			if n != len(buf) {
+				t.Errorf("decodeHint() n = %v, want %v", n, len(buf))
+			}
+			if !reflect.DeepEqual(gotHint, tt.hint) {
+				t.Errorf("decodeHint() = %+v, want %+v", gotHint, tt.hint)
+			}
+			buf[len(buf)-1]++
+			if _, _, err = decodeHint(buf); err == nil {
+				t.Errorf("decodeHint() want crc error")
+			}
+		})
+	}
+}
+
+func Test_encryptedHintFile(t *testing.T) {
+	path := "/Users/southwind/TinyDB/test/0"
+	_ = os.MkdirAll(path, os.ModePerm)
+	if err := RegisterKey(20, bytes.Repeat([]byte{3}, 16)); err != nil {
+		t.Fatalf("RegisterKey error: %+v", err)
+	}
+	hints := []*Hint{
+		NewHint(NewEntry([]byte("key"), []byte("value"), Insert), 0, 37, nil),
+		NewHint(NewEntry([]byte("zset"), []byte("50"), Insert), 37, 48, []byte("50")),
+	}
+	if err := WriteHintFile(path, 1, ZSet, hints, 20); err != nil {
+		t.Fatalf("WriteHintFile error: %+v", err)
+	}
+	defer func() { _ = RemoveHintFile(path, 1, ZSet) }()
+	buf, _ := os.ReadFile(HintFileName(path, 1, ZSet))
+	if bytes.Contains(buf, []byte("zset")) {
+		t.Errorf("hint file is not encrypted")
+	}
+	gotHints, err := ReadHintFile(path, 1, ZSet)
+	if err != nil {
+		t.Fatalf("ReadHintFile error: %+v", err)
+	}
+	if !reflect.DeepEqual(gotHints, hints) {
+		t.Errorf("ReadHintFile = %+v, want %+v", gotHints, hints)
+	}
+}
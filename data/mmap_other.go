@@ -0,0 +1,14 @@
+//go:build !unix
+
+package data
+
+import "os"
+
+// mmapFile 只在类Unix系统上映射文件，其他系统返回nil，读取走pread
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+type backupFile struct {
+	dataType data.DataType
+	fid      uint32
+	fileName string
+	size     int64 // 活跃文件只复制WriteAt之前的数据，-1表示复制整个文件
+}
+
+// Backup 在线备份数据到dir，dir不存在或为空目录，备份的目录可以直接Open
+// 备份期间不会merge，存档文件不会被删除；活跃文件按备份开始时的WriteAt复制，
+// 批次写入持有db.mu，所以复制的数据不会包含写了一半的批次
+func (db *TinyDB) Backup(dir string) (err error) {
+	if err = prepareBackupDir(dir); err != nil {
+		return err
+	}
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	var files []*backupFile
+	db.mu.RLock()
+	for dataType, archivedFiles := range db.archivedFiles {
+		for fid, archivedFile := range archivedFiles {
+			files = append(files, &backupFile{dataType: dataType, fid: fid, fileName: archivedFile.FileName, size: -1})
+		}
+	}
+	for dataType, activeFile := range db.activeFiles {
+		files = append(files, &backupFile{dataType: dataType, fid: activeFile.Fid, fileName: activeFile.FileName, size: activeFile.WriteAt})
+	}
+	db.mu.RUnlock()
+
+	for _, file := range files {
+		if err = copyFile(file.fileName, filepath.Join(dir, filepath.Base(file.fileName)), file.size); err != nil {
+			return err
+		}
+		if file.size >= 0 || file.dataType == data.Blob {
+			continue
+		}
+		// 存档文件的hint文件不会再修改，一起复制加快备份的Open
+		hintName := data.HintFileName(db.opt.DBPath, file.fid, file.dataType)
+		if err = copyFile(hintName, filepath.Join(dir, filepath.Base(hintName)), -1); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return err
+		}
+	}
+	// 备份目录的MANIFEST与复制的文件一致
+	m := newManifest(dir)
+	for _, file := range files {
+		if file.size >= 0 {
+			m.active[file.dataType] = file.fid
+		} else {
+			m.apply([]*manifestEdit{{op: manifestArchive, dataType: file.dataType, fid: file.fid}})
+		}
+	}
+	if err = m.rewrite(); err != nil {
+		return err
+	}
+	m.close()
+	logger.Log.Infof("backup %v files to %v", len(files), dir)
+	return nil
+}
+
+func prepareBackupDir(dir string) (err error) {
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("dir: %v", dir))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("dir: %v", dir))
+	}
+	if len(entries) > 0 {
+		return errors.Wrap(constants.ErrBackupDirNotEmpty, fmt.Sprintf("dir: %v", dir))
+	}
+	return nil
+}
+
+// copyFile 复制src的前size字节到dst并落盘，size为-1时复制整个文件
+func copyFile(src, dst string, size int64) (err error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", src))
+	}
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", dst))
+	}
+	defer dstFile.Close()
+	var reader io.Reader = srcFile
+	if size >= 0 {
+		reader = io.LimitReader(srcFile, size)
+	}
+	if _, err = io.Copy(dstFile, reader); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("copy %v to %v", src, dst))
+	}
+	if err = dstFile.Sync(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", dst))
+	}
+	return nil
+}
+
+func syncDir(dir string) (err error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("dir: %v", dir))
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("dir: %v", dir))
+	}
+	return nil
+}
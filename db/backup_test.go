@@ -0,0 +1,56 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_Backup(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+	// 写入足够多的数据，使备份包含存档文件和活跃文件
+	for i := 0; i < 100; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+	}
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte("1"), []byte("b"), []byte("2"))
+	_, _ = tinyDB.Expire([]byte("key0"), 1)
+
+	dir := "/Users/southwind/TinyDB/test/backup"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := tinyDB.Backup(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := tinyDB.Backup(dir); !errors.Is(err, constants.ErrBackupDirNotEmpty) {
+		t.Errorf("backup to non-empty dir: %v", err)
+	}
+	// 备份之后的写入不在备份中
+	_ = tinyDB.Set([]byte("after"), []byte("1"))
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+
+	opt := DefaultOptions(dir)
+	opt.FileSizeLimit = 1 << 10
+	backupDB, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 100; i++ {
+		if res, _ := backupDB.Get([]byte(fmt.Sprintf("key%v", i))); string(res) != fmt.Sprintf("value%v", i) {
+			t.Errorf("backup get key%v = %v", i, string(res))
+		}
+	}
+	if _, err = backupDB.Get([]byte("key0")); err == nil {
+		t.Errorf("expired key in backup")
+	}
+	if res, _ := backupDB.HGet([]byte("hash"), []byte("b")); res != "2" {
+		t.Errorf("backup hget = %v", res)
+	}
+	if _, err = backupDB.Get([]byte("after")); err == nil {
+		t.Errorf("write after backup is in backup")
+	}
+	backupDB.Close()
+}
@@ -0,0 +1,290 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"sort"
+	"time"
+)
+
+// WriteBatch 批量写入entry，可以包含多种类型，Commit后所有entry要么全部生效要么全部不生效
+// 每种类型的entry连续写入该类型的活跃文件，之后紧跟一条提交记录：
+// 1. 只有一种类型时写入最终提交记录
+// 2. 跨类型时先为其他类型写入等待提交记录，再在类型最大的文件中写入最终提交记录，
+// 最后为其他类型补写最终提交记录，崩溃后Open时根据类型最大的文件中的最终提交记录决定批次是否生效
+type WriteBatch struct {
+	db      *TinyDB
+	entries map[data.DataType][]*data.Entry
+	items   []batchItem // Put的顺序
+}
+
+type batchItem struct {
+	dataType data.DataType
+	index    int
+}
+
+func (db *TinyDB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		db:      db,
+		entries: make(map[data.DataType][]*data.Entry),
+	}
+}
+
+func (b *WriteBatch) Put(dataType data.DataType, entry *data.Entry) {
+	b.items = append(b.items, batchItem{dataType: dataType, index: len(b.entries[dataType])})
+	b.entries[dataType] = append(b.entries[dataType], entry)
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.items)
+}
+
+// Commit 写入所有entry，返回与Put顺序一致的entry位置，失败时已写入的数据会被回滚
+func (b *WriteBatch) Commit() (positions []*keydir.EntryPos, err error) {
+	if len(b.items) == 0 {
+		return nil, nil
+	}
+	// 单条entry本身就是原子的
+	if len(b.items) == 1 {
+		pos, err := b.db.WriteEntry(b.entries[b.items[0].dataType][0], b.items[0].dataType)
+		if err != nil {
+			return nil, err
+		}
+		return []*keydir.EntryPos{pos}, nil
+	}
+
+	db := b.db
+	if db.opt.ReadOnly {
+		return nil, constants.ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err = db.indexErr(); err != nil {
+		return nil, err
+	}
+	types := make([]data.DataType, 0, len(b.entries))
+	for dataType := range b.entries {
+		types = append(types, dataType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	finalType := types[len(types)-1]
+	db.batchID++
+	batchID := db.batchID
+
+	typePositions := make(map[data.DataType][]*keydir.EntryPos)
+	starts := make(map[data.DataType]int64)
+	defer func() {
+		if err != nil {
+			db.rollbackBatch(starts)
+		}
+	}()
+	// 大value先写入blob文件，批次回滚后这些记录不被引用，由BlobGC回收
+	separated := false
+	for _, dataType := range types {
+		for i, entry := range b.entries[dataType] {
+			if b.entries[dataType][i], err = db.separateValue(dataType, entry); err != nil {
+				return nil, err
+			}
+			separated = separated || b.entries[dataType][i].Header.Blob
+		}
+	}
+	if separated && db.opt.SyncPolicy != SyncNone {
+		if err = db.activeFiles[data.Blob].Sync(); err != nil {
+			return nil, err
+		}
+	}
+	for _, dataType := range types {
+		if err = db.initDataFile(dataType); err != nil {
+			return nil, err
+		}
+		entries := b.entries[dataType]
+		// 跨类型时其他类型需要写入等待提交和最终提交两条记录
+		commits := 1
+		if len(types) > 1 && dataType != finalType {
+			commits = 2
+		}
+		// 按文件的格式编码，切换后的新文件格式可能不同，需要重新编码
+		encode := func(file *data.File) (bufs [][]byte, size int64) {
+			size = int64(commits) * int64(len(file.EncodeEntry(data.NewBatchCommit(batchID, true))))
+			bufs = make([][]byte, len(entries))
+			for i, entry := range entries {
+				entry.Header.BatchID = batchID
+				db.compressEntry(entry)
+				entry.Header.KeyID = db.keyID
+				bufs[i] = file.EncodeEntry(entry)
+				size += int64(len(bufs[i]))
+			}
+			return bufs, size
+		}
+		// 同一批次的entry写入同一个文件
+		activeFile := db.activeFiles[dataType]
+		bufs, size := encode(activeFile)
+		if activeFile.WriteAt > activeFile.DataStart() && activeFile.WriteAt+size > db.opt.FileSizeLimit {
+			oldVersion := activeFile.Version
+			if activeFile, err = db.rotateActiveFile(dataType, activeFile.Fid+1); err != nil {
+				return nil, err
+			}
+			if activeFile.Version != oldVersion {
+				bufs, _ = encode(activeFile)
+			}
+		}
+		starts[dataType] = activeFile.WriteAt
+		for _, buf := range bufs {
+			pos := &keydir.EntryPos{Fid: activeFile.Fid, Offset: activeFile.WriteAt, Size: int64(len(buf))}
+			db.cache.remove(dataType, pos)
+			if err = activeFile.Write(buf); err != nil {
+				return nil, err
+			}
+			typePositions[dataType] = append(typePositions[dataType], pos)
+		}
+		if dataType == finalType && len(types) > 1 && db.opt.SyncPolicy != SyncNone {
+			// 最终提交前其他类型的数据必须落盘
+			for _, t := range types[:len(types)-1] {
+				if err = db.activeFiles[t].Sync(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err = activeFile.Write(activeFile.EncodeEntry(data.NewBatchCommit(batchID, dataType == finalType))); err != nil {
+			return nil, err
+		}
+	}
+	for _, dataType := range types[:len(types)-1] {
+		if err = db.writeBatchCommit(dataType, batchID); err != nil {
+			return nil, err
+		}
+	}
+	if db.opt.SyncPolicy == SyncAlways {
+		for _, dataType := range types {
+			if err = db.activeFiles[dataType].Sync(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, dataType := range types {
+		for i, entry := range b.entries[dataType] {
+			pos := typePositions[dataType][i]
+			db.markStale(dataType, entry, pos.Size)
+			db.activeHints[dataType] = append(db.activeHints[dataType], newHint(dataType, entry, pos))
+			db.touchKey(dataType, entry)
+		}
+	}
+	positions = make([]*keydir.EntryPos, len(b.items))
+	for i, item := range b.items {
+		positions[i] = typePositions[item.dataType][item.index]
+	}
+	return positions, nil
+}
+
+// writeBatchCommit 在dataType的活跃文件中写入最终提交记录，不切换文件，调用方需持有db.mu
+func (db *TinyDB) writeBatchCommit(dataType data.DataType, batchID uint64) (err error) {
+	activeFile := db.activeFiles[dataType]
+	return activeFile.Write(activeFile.EncodeEntry(data.NewBatchCommit(batchID, true)))
+}
+
+// rollbackBatch 清空各类型活跃文件中批次写入的数据，调用方需持有db.mu
+func (db *TinyDB) rollbackBatch(starts map[data.DataType]int64) {
+	for dataType, start := range starts {
+		activeFile := db.activeFiles[dataType]
+		if _, err := activeFile.TruncateTail(start); err != nil {
+			logger.Log.Errorf("rollback batch err: %+v", err)
+		}
+		activeFile.WriteAt = start
+	}
+}
+
+// initBatchID 批次id递增，重启后从当前时间和已有的最大id开始，避免与文件中未merge的批次重复
+func (db *TinyDB) initBatchID() {
+	if now := uint64(time.Now().UnixNano()); now > db.batchID {
+		db.batchID = now
+	}
+}
+
+// batchReplayer 按顺序重放一种类型的entry，批次中的entry读到提交记录后才构建索引
+type batchReplayer struct {
+	db        *TinyDB
+	committed map[uint64]struct{} // 已读到最终提交记录的批次，按类型从大到小重放，跨类型批次可以查到
+	apply     func(entry *data.Entry, pos *keydir.EntryPos)
+	pending   []*data.Entry
+	positions []*keydir.EntryPos
+	pendingID uint64
+	prepared  bool // 已读到等待提交记录
+}
+
+func newBatchReplayer(db *TinyDB, committed map[uint64]struct{}, apply func(entry *data.Entry, pos *keydir.EntryPos)) *batchReplayer {
+	return &batchReplayer{
+		db:        db,
+		committed: committed,
+		apply:     apply,
+	}
+}
+
+func (r *batchReplayer) replay(entry *data.Entry, pos *keydir.EntryPos) {
+	batchID := entry.Header.BatchID
+	if batchID > r.db.batchID {
+		r.db.batchID = batchID
+	}
+	if entry.Header.Type == data.BatchCommit {
+		if len(r.pending) == 0 || batchID != r.pendingID {
+			return
+		}
+		if entry.IsFinalCommit() {
+			r.committed[batchID] = struct{}{}
+			r.flush()
+		} else {
+			r.prepared = true
+		}
+		return
+	}
+	if len(r.pending) > 0 && (r.prepared || batchID != r.pendingID) {
+		r.discard()
+	}
+	if batchID == 0 {
+		r.apply(entry, pos)
+		return
+	}
+	r.pendingID = batchID
+	r.pending = append(r.pending, entry)
+	r.positions = append(r.positions, pos)
+}
+
+// finish 文件读取结束时处理未完成的批次，等待提交的批次在其他类型中已提交时生效，需要补写最终提交记录
+// 返回未提交批次的起始偏移，没有时返回-1
+func (r *batchReplayer) finish() (truncateAt int64, confirmID uint64) {
+	if len(r.pending) == 0 {
+		return -1, 0
+	}
+	if _, ok := r.committed[r.pendingID]; ok && r.prepared {
+		confirmID = r.pendingID
+		r.flush()
+		return -1, confirmID
+	}
+	truncateAt = r.positions[0].Offset
+	r.discard()
+	return truncateAt, 0
+}
+
+func (r *batchReplayer) flush() {
+	for i, entry := range r.pending {
+		r.apply(entry, r.positions[i])
+	}
+	r.reset()
+}
+
+func (r *batchReplayer) discard() {
+	logger.Log.Warnf("discard uncommitted batch %v, %v entries, fid: %v, offset: %v",
+		r.pendingID, len(r.pending), r.positions[0].Fid, r.positions[0].Offset)
+	r.reset()
+}
+
+func (r *batchReplayer) reset() {
+	r.pending = nil
+	r.positions = nil
+	r.pendingID = 0
+	r.prepared = false
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"os"
+	"testing"
+)
+
+// appendEntries 直接向dataType的活跃文件末尾写入entry，模拟写入中途崩溃
+func appendEntries(t *testing.T, db *TinyDB, dataType data.DataType, entries ...*data.Entry) {
+	activeFile := db.activeFiles[dataType]
+	fd, err := os.OpenFile(activeFile.FileName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	writeAt := activeFile.WriteAt
+	for _, entry := range entries {
+		buf := data.EncodeEntry(entry)
+		if _, err = fd.WriteAt(buf, writeAt); err != nil {
+			t.Fatal(err)
+		}
+		writeAt += int64(len(buf))
+	}
+}
+
+func batchEntry(key, value string, batchID uint64) *data.Entry {
+	entry := data.NewEntry([]byte(key), []byte(value), data.Insert)
+	entry.Header.BatchID = batchID
+	return entry
+}
+
+func Test_WriteBatch(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+	batch := tinyDB.NewWriteBatch()
+	batch.Put(data.String, data.NewEntry([]byte("a"), []byte("1"), data.Insert))
+	batch.Put(data.Hash, data.NewEntry(encodeSubKey([]byte("h"), []byte("f")), []byte("2"), data.Insert))
+	batch.Put(data.String, data.NewEntry([]byte("b"), []byte("3"), data.Insert))
+	positions, err := batch.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 3 {
+		t.Errorf("batch positions error: %v", positions)
+	}
+	_ = tinyDB.MSet([]byte("c"), []byte("4"), []byte("d"), []byte("5"))
+	tinyDB.Close()
+
+	tinyDB = openDB(0)
+	for key, value := range map[string]string{"a": "1", "b": "3", "c": "4", "d": "5"} {
+		if res, _ := tinyDB.Get([]byte(key)); string(res) != value {
+			t.Errorf("batch get %v = %v, want %v", key, string(res), value)
+		}
+	}
+	if res, _ := tinyDB.HGet([]byte("h"), []byte("f")); res != "2" {
+		t.Errorf("batch hget = %v", res)
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+func Test_UncommittedBatch(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+	_ = tinyDB.Set([]byte("a"), []byte("1"))
+	writeAt := tinyDB.activeFiles[data.String].WriteAt
+	tinyDB.Close()
+
+	// 批次只写入了一部分，没有提交记录
+	appendEntries(t, tinyDB, data.String, batchEntry("b", "2", 1), batchEntry("c", "3", 1))
+	tinyDB = openDB(0)
+	if _, err := tinyDB.Get([]byte("b")); err == nil {
+		t.Errorf("uncommitted batch is visible")
+	}
+	if tinyDB.activeFiles[data.String].WriteAt != writeAt {
+		t.Errorf("uncommitted batch is not truncated")
+	}
+	tinyDB.Close()
+
+	// 只有等待提交记录，其他类型中没有最终提交记录
+	appendEntries(t, tinyDB, data.String, batchEntry("b", "2", 2), data.NewBatchCommit(2, false))
+	tinyDB = openDB(0)
+	if _, err := tinyDB.Get([]byte("b")); err == nil {
+		t.Errorf("prepared batch is visible")
+	}
+	if res, _ := tinyDB.Get([]byte("a")); string(res) != "1" {
+		t.Errorf("get a = %v", string(res))
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+func Test_PreparedBatch(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+	_ = tinyDB.Set([]byte("a"), []byte("1"))
+	_, _ = tinyDB.HSet([]byte("h"), []byte("f"), []byte("1"))
+	tinyDB.Close()
+
+	// 类型最大的文件中已有最终提交记录，崩溃发生在补写其他类型的最终提交记录之前
+	appendEntries(t, tinyDB, data.String, batchEntry("b", "2", 3), data.NewBatchCommit(3, false))
+	appendEntries(t, tinyDB, data.Hash, batchEntry(string(encodeSubKey([]byte("h"), []byte("g"))), "2", 3),
+		data.NewBatchCommit(3, true))
+	tinyDB = openDB(0)
+	if res, _ := tinyDB.Get([]byte("b")); string(res) != "2" {
+		t.Errorf("prepared batch get = %v", string(res))
+	}
+	if res, _ := tinyDB.HGet([]byte("h"), []byte("g")); res != "2" {
+		t.Errorf("prepared batch hget = %v", res)
+	}
+	writeAt := tinyDB.activeFiles[data.String].WriteAt
+	tinyDB.Close()
+
+	// 已补写最终提交记录，再次打开时不需要重复补写
+	tinyDB = openDB(0)
+	if res, _ := tinyDB.Get([]byte("b")); string(res) != "2" {
+		t.Errorf("prepared batch get = %v", string(res))
+	}
+	if tinyDB.activeFiles[data.String].WriteAt != writeAt {
+		t.Errorf("batch commit is written twice")
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
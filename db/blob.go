@@ -0,0 +1,306 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// blobRef blob记录及引用它的主entry的位置
+type blobRef struct {
+	ptr *data.BlobPtr
+	pos *keydir.EntryPos
+}
+
+// separateValue value不小于BlobThreshold时写入blob文件，返回value为BlobPtr的主entry，调用方需持有db.mu
+// 只分离需要从文件读取value的String、List元素和Hash field，set和zset的value在内存索引中
+func (db *TinyDB) separateValue(dataType data.DataType, entry *data.Entry) (*data.Entry, error) {
+	if db.opt.BlobThreshold <= 0 || len(entry.Value) < db.opt.BlobThreshold || entry.Header.Blob ||
+		entry.Header.Type != data.Insert || (dataType != data.String && dataType != data.List && dataType != data.Hash) {
+		return entry, nil
+	}
+	ptr, err := db.writeBlob(data.NewBlobEntry(dataType, entry.Key, entry.Value))
+	if err != nil {
+		return nil, err
+	}
+	header := *entry.Header
+	header.Blob = true
+	header.Codec = data.NoCompression
+	return &data.Entry{Header: &header, Key: entry.Key, Value: data.EncodeBlobPtr(ptr)}, nil
+}
+
+// writeBlob 将blob记录写入活跃blob文件，调用方需持有db.mu
+func (db *TinyDB) writeBlob(blob *data.Entry) (ptr *data.BlobPtr, err error) {
+	if err = db.initDataFile(data.Blob); err != nil {
+		return nil, err
+	}
+	blob.Header.BatchID = 0
+	db.compressEntry(blob)
+	blob.Header.KeyID = db.keyID
+	blobFile := db.activeFiles[data.Blob]
+	buf := blobFile.EncodeEntry(blob)
+	if blobFile.WriteAt > blobFile.DataStart() && blobFile.WriteAt+int64(len(buf)) > db.opt.FileSizeLimit {
+		if blobFile, err = db.rotateActiveFile(data.Blob, blobFile.Fid+1); err != nil {
+			return nil, err
+		}
+		if blobFile.Version != blob.Header.Format {
+			buf = blobFile.EncodeEntry(blob)
+		}
+	}
+	ptr = &data.BlobPtr{Fid: blobFile.Fid, Offset: blobFile.WriteAt, Size: int64(len(buf))}
+	if err = blobFile.Write(buf); err != nil {
+		return nil, err
+	}
+	// 主entry写入前blob记录必须落盘
+	if db.opt.SyncPolicy == SyncAlways {
+		if err = blobFile.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return ptr, nil
+}
+
+// readBlob 从blob文件取出entry分离的value，替换entry中的BlobPtr，调用方需持有db.mu
+func (db *TinyDB) readBlob(dataType data.DataType, entry *data.Entry) (*data.Entry, error) {
+	ptr, err := data.DecodeBlobPtr(entry.Value)
+	if err != nil {
+		return nil, err
+	}
+	blobFile := db.dataFile(data.Blob, ptr.Fid)
+	if blobFile == nil {
+		return nil, errors.Wrap(constants.ErrDataFileNotFound, fmt.Sprintf("blob fid: %v", ptr.Fid))
+	}
+	blob, err := blobFile.ReadEntry(ptr.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if !data.MatchBlob(blob, dataType, entry.Key) {
+		return nil, errors.Wrap(constants.ErrBlobMismatch, fmt.Sprintf("blob fid: %v, offset: %v", ptr.Fid, ptr.Offset))
+	}
+	entry.Value = blob.Value
+	if blobFile.Mapped() {
+		entry.Value = append([]byte(nil), blob.Value...)
+	}
+	entry.Header.Blob = false
+	return entry, nil
+}
+
+// recoverBlobFile 扫描活跃blob文件得到WriteAt，截断末尾写了一半的记录
+// 没有落盘的blob记录不会被已落盘的主entry引用，截断不影响已有数据
+func (db *TinyDB) recoverBlobFile() (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	blobFile := db.activeFiles[data.Blob]
+	if blobFile == nil {
+		return nil
+	}
+	offset := blobFile.DataStart()
+	for {
+		blob, readErr := blobFile.ReadEntry(offset)
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, constants.ErrReadNullEntry) {
+			break
+		} else if readErr != nil {
+			if !isTornEntry(readErr) {
+				return readErr
+			}
+			break
+		}
+		offset += blob.Size()
+	}
+	if err = db.recoverTail(blobFile, offset); err != nil {
+		return err
+	}
+	blobFile.WriteAt = offset
+	return nil
+}
+
+// BlobGC 回收blob文件中不再被引用的value，存档blob文件中失效数据比例达到BlobGCRatio时，
+// 将仍被引用的记录追加到活跃blob文件，写入指向新位置的主entry，之后删除该文件
+// 含有非当前密钥加密的记录的文件不论失效比例都会重写
+// 与merge互斥，merge只复制主entry中的BlobPtr，不会重写value
+func (db *TinyDB) BlobGC() (err error) {
+	if db.opt.ReadOnly {
+		return constants.ErrReadOnly
+	}
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	return db.gcBlobFiles(false)
+}
+
+// gcBlobFiles 依次回收存档blob文件，rekeyOnly为true时只重写含有非当前密钥加密的记录的文件，调用方需持有db.mergeMu
+// 活跃blob文件中有这样的记录时先归档，保证轮换密钥后所有blob记录都能被重写
+func (db *TinyDB) gcBlobFiles(rekeyOnly bool) (err error) {
+	db.mu.Lock()
+	if activeFile := db.activeFiles[data.Blob]; activeFile != nil {
+		var stale bool
+		if stale, err = db.hasStaleKey(activeFile); err == nil && stale {
+			_, err = db.rotateActiveFile(data.Blob, activeFile.Fid+1)
+		}
+	}
+	files := make([]*data.File, 0, len(db.archivedFiles[data.Blob]))
+	for _, file := range db.archivedFiles[data.Blob] {
+		files = append(files, file)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Fid < files[j].Fid
+	})
+	for _, file := range files {
+		if err = db.gcBlobFile(file, rekeyOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasStaleKey blob文件中是否有不是用当前密钥加密的记录
+func (db *TinyDB) hasStaleKey(file *data.File) (bool, error) {
+	for offset := file.DataStart(); offset < file.WriteAt; {
+		blob, err := file.ReadEntry(offset)
+		if errors.Is(err, io.EOF) || errors.Is(err, constants.ErrReadNullEntry) {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		if blob.Header.KeyID != db.keyID {
+			return true, nil
+		}
+		offset += blob.Size()
+	}
+	return false, nil
+}
+
+// gcBlobFile 统计存档blob文件中仍被引用的记录，失效数据足够多或有记录不是用当前密钥加密时迁移这些记录并删除文件，
+// 调用方需持有db.mergeMu
+func (db *TinyDB) gcBlobFile(file *data.File, rekeyOnly bool) (err error) {
+	var refs []*blobRef
+	var total, live int64
+	var rekey bool
+	for offset := file.DataStart(); ; {
+		blob, err := file.ReadEntry(offset)
+		if errors.Is(err, io.EOF) || errors.Is(err, constants.ErrReadNullEntry) {
+			break
+		} else if err != nil {
+			return err
+		}
+		ptr := &data.BlobPtr{Fid: file.Fid, Offset: offset, Size: blob.Size()}
+		offset += ptr.Size
+		total += ptr.Size
+		if blob.Header.KeyID != db.keyID {
+			rekey = true
+		}
+		db.mu.RLock()
+		pos := db.blobOwner(blob, ptr)
+		db.mu.RUnlock()
+		if pos != nil {
+			refs = append(refs, &blobRef{ptr: ptr, pos: pos})
+			live += ptr.Size
+		}
+	}
+	dead := total - live
+	if !rekey && (rekeyOnly || total > 0 && (dead == 0 || float64(dead) < db.opt.BlobGCRatio*float64(total))) {
+		return nil
+	}
+	for _, ref := range refs {
+		if err = db.moveBlob(file, ref); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 迁移后的记录和主entry落盘后才能删除旧文件
+	if len(refs) > 0 {
+		for _, dataType := range []data.DataType{data.Blob, data.String, data.List, data.Hash} {
+			if activeFile := db.activeFiles[dataType]; activeFile != nil {
+				if err = activeFile.Sync(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err = db.manifest.append(&manifestEdit{op: manifestDelete, dataType: data.Blob, fid: file.Fid}); err != nil {
+		return err
+	}
+	delete(db.archivedFiles[data.Blob], file.Fid)
+	_ = file.Close()
+	if err = file.Remove(); err != nil {
+		return err
+	}
+	logger.Log.Infof("blob gc %v successful, %v bytes -> %v bytes", file.FileName, total, live)
+	return nil
+}
+
+// blobOwner 引用blob记录的主entry的位置，主entry已被覆盖或删除时返回nil，调用方需持有db.mu
+func (db *TinyDB) blobOwner(blob *data.Entry, ptr *data.BlobPtr) *keydir.EntryPos {
+	dataType, key := data.DecodeBlobKey(blob.Key)
+	var pos *keydir.EntryPos
+	var err error
+	switch dataType {
+	case data.String:
+		pos, err = db.strKeydir.Get(string(key))
+	case data.List:
+		listKey, index := decodeListKey(key)
+		pos, err = db.listKeydir.Get(string(listKey), index)
+	case data.Hash:
+		hashKey, field := decodeSubKey(key)
+		pos, err = db.hashKeydir.Get(string(hashKey), string(field))
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	entry, err := db.readEntry(dataType, pos)
+	if err != nil || !entry.Header.Blob {
+		return nil
+	}
+	if owned, err := data.DecodeBlobPtr(entry.Value); err != nil || owned.Fid != ptr.Fid || owned.Offset != ptr.Offset {
+		return nil
+	}
+	return pos
+}
+
+// moveBlob 将仍被引用的blob记录追加到活跃blob文件，并写入指向新位置的主entry，调用方需持有db.mergeMu
+func (db *TinyDB) moveBlob(file *data.File, ref *blobRef) (err error) {
+	blob, err := file.ReadEntry(ref.ptr.Offset)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 统计之后主entry可能已被覆盖
+	pos := db.blobOwner(blob, ref.ptr)
+	if pos == nil || pos.Fid != ref.pos.Fid || pos.Offset != ref.pos.Offset {
+		return nil
+	}
+	dataType, _ := data.DecodeBlobKey(blob.Key)
+	entry, err := db.readEntry(dataType, pos)
+	if err != nil {
+		return err
+	}
+	ptr, err := db.writeBlob(blob)
+	if err != nil {
+		return err
+	}
+	// 保留主entry的过期时间，批次已提交，不再需要批次信息
+	moved := data.NewEntry(entry.Key, data.EncodeBlobPtr(ptr), entry.Header.Type)
+	moved.Header.Timestamp = entry.Header.Timestamp
+	moved.Header.ExpiryTime = entry.Header.ExpiryTime
+	moved.Header.Blob = true
+	newPos, err := db.appendEntry(moved, dataType)
+	if err != nil {
+		return err
+	}
+	db.moveIndex(dataType, &mergeMove{entry: moved, oldPos: pos, newPos: newPos})
+	return nil
+}
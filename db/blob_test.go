@@ -0,0 +1,92 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_Blob(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 12
+	opt.BlobThreshold = 256
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	value := func(i, version int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("%v-%v,", i, version), 100))
+	}
+	versions := make([]int, 20)
+	for i := 0; i < 20; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), value(i, 0))
+	}
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("big"), value(100, 0), []byte("small"), []byte("1"))
+	_, _ = tinyDB.LPush([]byte("list"), false, value(200, 0), []byte("small"))
+	check := func(tinyDB *TinyDB) {
+		for i := 0; i < 20; i++ {
+			if res, err := tinyDB.Get([]byte(fmt.Sprintf("key%v", i))); string(res) != string(value(i, versions[i])) {
+				t.Errorf("Get key%v = %v, err: %+v", i, string(res), err)
+			}
+		}
+		if res, _ := tinyDB.HGetAll([]byte("hash")); res["big"] != string(value(100, 0)) || res["small"] != "1" {
+			t.Errorf("HGetAll = %v", res)
+		}
+		if res, _ := tinyDB.LRange([]byte("list"), 0, -1); len(res) != 2 || res[0] != string(value(200, 0)) || res[1] != "small" {
+			t.Errorf("LRange = %v", res)
+		}
+	}
+	check(tinyDB)
+	// 大value都在blob文件中
+	if files := tinyDB.archivedFiles[data.String]; len(files) != 0 {
+		t.Errorf("string archived files = %v, values are not separated", len(files))
+	}
+	if files := tinyDB.archivedFiles[data.Blob]; len(files) == 0 {
+		t.Errorf("no archived blob files")
+	}
+
+	// 覆盖一半的key，merge不重写value，BlobGC回收失效的value
+	for i := 0; i < 20; i += 2 {
+		versions[i] = 1
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), value(i, 1))
+	}
+	check(tinyDB)
+	if err = tinyDB.Merge(); err != nil {
+		t.Fatalf("Merge error: %+v", err)
+	}
+	check(tinyDB)
+	blobSize := func() (size int64) {
+		matches, _ := filepath.Glob(filepath.Join(opt.DBPath, "*"+data.BlobFileSuf))
+		for _, name := range matches {
+			stat, _ := os.Stat(name)
+			size += stat.Size()
+		}
+		return
+	}
+	before := blobSize()
+	// 部分有效的文件也重写，仍被引用的value迁移到活跃blob文件
+	opt.BlobGCRatio = 0.01
+	if err = tinyDB.BlobGC(); err != nil {
+		t.Fatalf("BlobGC error: %+v", err)
+	}
+	if after := blobSize(); after >= before {
+		t.Errorf("blob size %v -> %v after BlobGC", before, after)
+	}
+	check(tinyDB)
+	tinyDB.Close()
+
+	if tinyDB, err = Open(opt); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(tinyDB)
+	_ = tinyDB.Set([]byte("key0"), value(0, 2))
+	versions[0] = 2
+	check(tinyDB)
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const cacheShardNum = 16
+
+// CacheStats value缓存的统计信息
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Entries  int   // 缓存的entry数量
+	Size     int64 // 缓存的key和value总大小
+	Capacity int64
+}
+
+// cacheKey entry在文件中的位置，数据文件只追加写入，位置不变时内容不变
+type cacheKey struct {
+	dataType data.DataType
+	fid      uint32
+	offset   int64
+}
+
+type cacheItem struct {
+	key   cacheKey
+	entry *data.Entry
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	ll       *list.List // 最近访问的在前
+	items    map[cacheKey]*list.Element
+	size     int64
+	capacity int64
+}
+
+// valueCache 按entry位置缓存读取结果的分片LRU，容量按key和value的大小计算
+type valueCache struct {
+	shards   [cacheShardNum]*cacheShard
+	capacity int64
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+// newValueCache 容量不大于0时返回nil，不缓存
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	c := &valueCache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			ll:       list.New(),
+			items:    make(map[cacheKey]*list.Element),
+			capacity: capacity / cacheShardNum,
+		}
+	}
+	return c
+}
+
+func newCacheKey(dataType data.DataType, pos *keydir.EntryPos) cacheKey {
+	return cacheKey{dataType: dataType, fid: pos.Fid, offset: pos.Offset}
+}
+
+func (c *valueCache) shard(key cacheKey) *cacheShard {
+	h := uint64(key.fid)*0x9e3779b97f4a7c15 ^ uint64(key.offset)*0xbf58476d1ce4e5b9 ^ uint64(key.dataType)
+	return c.shards[(h^h>>32)%cacheShardNum]
+}
+
+// get 返回缓存entry的副本，调用方可以修改
+func (c *valueCache) get(dataType data.DataType, pos *keydir.EntryPos) *data.Entry {
+	if c == nil {
+		return nil
+	}
+	key := newCacheKey(dataType, pos)
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		c.misses.Add(1)
+		return nil
+	}
+	s.ll.MoveToFront(elem)
+	entry := elem.Value.(*cacheItem).entry
+	s.mu.Unlock()
+	c.hits.Add(1)
+	return entry.Copy()
+}
+
+// add 缓存entry的副本，超过容量时淘汰最久未访问的entry
+func (c *valueCache) add(dataType data.DataType, pos *keydir.EntryPos, entry *data.Entry) {
+	if c == nil {
+		return
+	}
+	size := entrySize(entry)
+	key := newCacheKey(dataType, pos)
+	s := c.shard(key)
+	if size > s.capacity {
+		return
+	}
+	entry = entry.Copy()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.removeElement(elem)
+	}
+	s.items[key] = s.ll.PushFront(&cacheItem{key: key, entry: entry})
+	s.size += size
+	for s.size > s.capacity {
+		s.removeElement(s.ll.Back())
+	}
+}
+
+// remove 写入pos时删除该位置的缓存，回滚的批次截断后位置会被重新写入
+func (c *valueCache) remove(dataType data.DataType, pos *keydir.EntryPos) {
+	if c == nil {
+		return
+	}
+	key := newCacheKey(dataType, pos)
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.removeElement(elem)
+	}
+}
+
+// removeFiles 删除dataType中fids对应文件的所有缓存，merge删除旧文件时调用
+func (c *valueCache) removeFiles(dataType data.DataType, fids map[uint32]struct{}) {
+	if c == nil || len(fids) == 0 {
+		return
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, elem := range s.items {
+			if _, ok := fids[key.fid]; ok && key.dataType == dataType {
+				s.removeElement(elem)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (c *valueCache) stats() (stats CacheStats) {
+	if c == nil {
+		return
+	}
+	stats.Hits, stats.Misses, stats.Capacity = c.hits.Load(), c.misses.Load(), c.capacity
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Entries += len(s.items)
+		stats.Size += s.size
+		s.mu.Unlock()
+	}
+	return
+}
+
+func (s *cacheShard) removeElement(elem *list.Element) {
+	item := s.ll.Remove(elem).(*cacheItem)
+	delete(s.items, item.key)
+	s.size -= entrySize(item.entry)
+}
+
+func entrySize(entry *data.Entry) int64 {
+	return int64(len(entry.Key) + len(entry.Value))
+}
+
+// CacheStats 返回value缓存的命中统计，未开启缓存时都为0
+func (db *TinyDB) CacheStats() CacheStats {
+	return db.cache.stats()
+}
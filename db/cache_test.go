@@ -0,0 +1,99 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_valueCache(t *testing.T) {
+	cache := newValueCache(cacheShardNum * 10)
+	pos := func(i int) *keydir.EntryPos {
+		return &keydir.EntryPos{Fid: 1, Offset: int64(i)}
+	}
+	// 同一分片中的位置
+	var offsets []int
+	for i := 0; len(offsets) < 3; i++ {
+		if cache.shard(newCacheKey(data.String, pos(i))) == cache.shard(newCacheKey(data.String, pos(0))) {
+			offsets = append(offsets, i)
+		}
+	}
+	cache.add(data.String, pos(offsets[0]), data.NewEntry([]byte("a"), []byte("1234"), data.Insert))
+	cache.add(data.String, pos(offsets[1]), data.NewEntry([]byte("b"), []byte("1234"), data.Insert))
+	if entry := cache.get(data.String, pos(offsets[0])); entry == nil || string(entry.Key) != "a" {
+		t.Errorf("get = %v", entry)
+	}
+	// 超过容量时淘汰最久未访问的b
+	cache.add(data.String, pos(offsets[2]), data.NewEntry([]byte("c"), []byte("1234"), data.Insert))
+	if entry := cache.get(data.String, pos(offsets[1])); entry != nil {
+		t.Errorf("b should be evicted")
+	}
+	if entry := cache.get(data.Hash, pos(offsets[0])); entry != nil {
+		t.Errorf("get with other data type = %v", entry)
+	}
+	// 返回的是副本
+	entry := cache.get(data.String, pos(offsets[0]))
+	entry.Value[0] = 'x'
+	if entry = cache.get(data.String, pos(offsets[0])); string(entry.Value) != "1234" {
+		t.Errorf("cached value modified: %v", string(entry.Value))
+	}
+	cache.remove(data.String, pos(offsets[0]))
+	cache.removeFiles(data.String, map[uint32]struct{}{1: {}})
+	stats := cache.stats()
+	if stats.Entries != 0 || stats.Size != 0 || stats.Hits != 3 || stats.Misses != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if newValueCache(0) != nil || newValueCache(0).get(data.String, pos(0)) != nil {
+		t.Errorf("cache should be disabled")
+	}
+}
+
+func Test_Cache(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	opt.CacheSize = 1 << 20
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 50; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+	}
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte("1"))
+	check := func(version int) {
+		for i := 0; i < 50; i++ {
+			want := fmt.Sprintf("value%v", i)
+			if i%2 == 0 {
+				want = fmt.Sprintf("value%v-%v", i, version)
+			}
+			if res, _ := tinyDB.Get([]byte(fmt.Sprintf("key%v", i))); string(res) != want {
+				t.Errorf("Get key%v = %v, want %v", i, string(res), want)
+			}
+		}
+		if res, _ := tinyDB.HGet([]byte("hash"), []byte("a")); res != fmt.Sprint(version) {
+			t.Errorf("HGet = %v, want %v", res, version)
+		}
+	}
+	for version := 1; version <= 3; version++ {
+		for i := 0; i < 50; i += 2 {
+			_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v-%v", i, version)))
+		}
+		_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte(fmt.Sprint(version)))
+		check(version)
+		check(version)
+		if err = tinyDB.Merge(); err != nil {
+			t.Fatalf("Merge error: %+v", err)
+		}
+		check(version)
+	}
+	stats := tinyDB.CacheStats()
+	if stats.Hits == 0 || stats.Misses == 0 || stats.Entries == 0 || stats.Capacity != opt.CacheSize {
+		t.Errorf("CacheStats = %+v", stats)
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
@@ -0,0 +1,365 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type FileReport struct {
+	FileName     string
+	DataType     data.DataType
+	Live         int        // 当前索引引用的entry数
+	Dead         int        // 已被覆盖或删除的entry数
+	Corrupt      int        // 损坏的数据段数
+	CorruptBytes int64      // 损坏数据的总长度
+	Repaired     bool       // 是否已修复
+	ranges       [][2]int64 // 损坏数据段[start, end)
+	positions    []*keydir.EntryPos
+}
+
+type CheckReport struct {
+	Files    []*FileReport
+	KeyCount map[data.DataType]int // 各类型未过期的key数量
+}
+
+// Corrupted 是否存在未修复的损坏数据
+func (r *CheckReport) Corrupted() bool {
+	for _, file := range r.Files {
+		if file.Corrupt > 0 && !file.Repaired {
+			return true
+		}
+	}
+	return false
+}
+
+// Check 离线校验path下的所有数据文件，统计每个文件的有效、失效和损坏entry数
+// repair为true时重写存在损坏数据的文件，跳过损坏的数据段，保证之后可以正常Open
+// 持有LOCK文件的锁，其他进程以读写模式打开该目录时返回ErrDBLocked
+func Check(path string, repair bool) (report *CheckReport, err error) {
+	opt := DefaultOptions(path)
+	// 只校验时只读打开
+	opt.ReadOnly = !repair
+	db := newTinyDB(opt)
+	if err = db.lock(); err != nil {
+		return nil, err
+	}
+	defer db.unlock()
+	defer db.closeFiles()
+	// 修复会改变entry的偏移，保存的磁盘索引不能再复用
+	if repair {
+		if err = removeIndexFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err = db.loadDataFiles(); err != nil {
+		return nil, err
+	}
+
+	report = &CheckReport{KeyCount: make(map[data.DataType]int)}
+	committed := make(map[uint64]struct{})
+	// 与buildIndexes一致，类型按从大到小重放
+	for dataType := data.ZSet; dataType >= data.String; dataType-- {
+		activeFile, ok := db.activeFiles[dataType]
+		if !ok {
+			continue
+		}
+		files := []*data.File{activeFile}
+		for _, archivedFile := range db.archivedFiles[dataType] {
+			files = append(files, archivedFile)
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Fid < files[j].Fid
+		})
+		fileReports := make([]*FileReport, len(files))
+		var fileReport *FileReport
+		dt := dataType
+		r := newBatchReplayer(db, committed, func(entry *data.Entry, pos *keydir.EntryPos) {
+			db.addIndex(dt, entry, pos)
+			fileReport.positions = append(fileReport.positions, pos)
+		})
+		for i, file := range files {
+			fileReport = &FileReport{FileName: file.FileName, DataType: dataType}
+			if err = db.checkDataFile(r, file, fileReport); err != nil {
+				return nil, err
+			}
+			fileReports[i] = fileReport
+		}
+		// 所有文件重放完成后才能判断entry是否有效
+		seen := make(map[string]struct{})
+		for i, file := range files {
+			for _, pos := range fileReports[i].positions {
+				entry, err := file.ReadEntry(pos.Offset)
+				if err != nil {
+					return nil, err
+				}
+				if _, live := db.isLiveEntry(dataType, entry, pos, seen); live {
+					fileReports[i].Live++
+				} else {
+					fileReports[i].Dead++
+				}
+			}
+			if repair && fileReports[i].Corrupt > 0 {
+				if err = db.repairDataFile(dataType, file, fileReports[i].positions); err != nil {
+					return nil, err
+				}
+				fileReports[i].Repaired = true
+			}
+		}
+		report.Files = append(report.Files, fileReports...)
+		report.KeyCount[dataType] = db.countKeys(dataType)
+	}
+	// 主entry的索引建立后才能判断blob记录是否仍被引用
+	blobReports, err := db.checkBlobFiles(repair)
+	if err != nil {
+		return nil, err
+	}
+	report.Files = append(report.Files, blobReports...)
+	return report, nil
+}
+
+// checkBlobFiles 校验所有blob文件，被主entry引用的记录为有效记录
+// 主entry按偏移引用blob记录，修复时不能移动有效记录，中间的损坏数据段替换为同样长度的失效记录，末尾的损坏数据直接截断
+func (db *TinyDB) checkBlobFiles(repair bool) (reports []*FileReport, err error) {
+	var files []*data.File
+	if activeFile, ok := db.activeFiles[data.Blob]; ok {
+		files = append(files, activeFile)
+	}
+	for _, archivedFile := range db.archivedFiles[data.Blob] {
+		files = append(files, archivedFile)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Fid < files[j].Fid
+	})
+	for _, file := range files {
+		fileReport := &FileReport{FileName: file.FileName, DataType: data.Blob}
+		if err = db.checkDataFile(nil, file, fileReport); err != nil {
+			return nil, err
+		}
+		for _, pos := range fileReport.positions {
+			blob, err := file.ReadEntry(pos.Offset)
+			if err != nil {
+				return nil, err
+			}
+			if db.blobOwner(blob, &data.BlobPtr{Fid: pos.Fid, Offset: pos.Offset, Size: pos.Size}) != nil {
+				fileReport.Live++
+			} else {
+				fileReport.Dead++
+			}
+		}
+		if repair && fileReport.Corrupt > 0 {
+			if err = repairBlobFile(file, fileReport.ranges); err != nil {
+				return nil, err
+			}
+			fileReport.Repaired = true
+		}
+		reports = append(reports, fileReport)
+	}
+	return reports, nil
+}
+
+// checkDataFile 逐条读取entry重放，遇到损坏数据时逐字节向后查找下一条有效entry，r为nil时只记录entry的位置
+func (db *TinyDB) checkDataFile(r *batchReplayer, file *data.File, report *FileReport) (err error) {
+	// 预分配的空间全部为0，最后一个非零字节之后没有数据
+	end, err := file.TailSize(0)
+	if err != nil {
+		return err
+	}
+	corruptAt := int64(-1)
+	for offset := file.DataStart(); offset < end; {
+		entry, err := file.ReadEntry(offset)
+		if err != nil {
+			if !isTornEntry(err) && !errors.Is(err, constants.ErrReadNullEntry) && !errors.Is(err, io.EOF) {
+				return err
+			}
+			if corruptAt < 0 {
+				corruptAt = offset
+			}
+			offset++
+			continue
+		}
+		if corruptAt >= 0 {
+			report.ranges = append(report.ranges, [2]int64{corruptAt, offset})
+			corruptAt = -1
+		}
+		size := entry.Size()
+		pos := &keydir.EntryPos{Fid: file.Fid, Offset: offset, Size: size}
+		if r != nil {
+			r.replay(entry, pos)
+		} else {
+			report.positions = append(report.positions, pos)
+		}
+		offset += size
+	}
+	// 未提交的批次不会生效，统计为失效entry
+	if r != nil {
+		r.finish()
+	}
+	if corruptAt >= 0 {
+		report.ranges = append(report.ranges, [2]int64{corruptAt, end})
+	}
+	report.Corrupt = len(report.ranges)
+	for _, r := range report.ranges {
+		report.CorruptBytes += r[1] - r[0]
+	}
+	return nil
+}
+
+// repairDataFile 只保留有效的entry重写文件，旧的hint文件中的偏移已失效，需要删除
+func (db *TinyDB) repairDataFile(dataType data.DataType, file *data.File, positions []*keydir.EntryPos) (err error) {
+	tmpName := file.FileName + ".repair"
+	tmpFile, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		if err != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+	// 重写后的文件都带有文件头，旧文件同时完成升级
+	header := &data.FileHeader{Version: file.Version, DataType: dataType, CreatedAt: file.CreatedAt}
+	if file.Legacy() {
+		header.CreatedAt = time.Now().UnixMilli()
+	}
+	if _, err = tmpFile.WriteAt(data.EncodeFileHeader(header), 0); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	writeAt := int64(data.FileHeaderSize)
+	for _, pos := range positions {
+		entry, err := file.ReadEntry(pos.Offset)
+		if err != nil {
+			return err
+		}
+		// 不保留提交记录，已生效的批次entry改为普通entry
+		entry.Header.BatchID = 0
+		entry.Header.Format = file.Version
+		buf := data.EncodeEntry(entry)
+		if _, err = tmpFile.WriteAt(buf, writeAt); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+		}
+		writeAt += int64(len(buf))
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	if err = os.Rename(tmpName, file.FileName); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", file.FileName))
+	}
+	return data.RemoveHintFile(db.opt.DBPath, file.Fid, dataType)
+}
+
+// repairBlobFile 按原偏移复制有效记录重写blob文件，ranges为checkDataFile找到的损坏数据段
+func repairBlobFile(file *data.File, ranges [][2]int64) (err error) {
+	tmpName := file.FileName + ".repair"
+	tmpFile, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		if err != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+	end, err := file.TailSize(0)
+	if err != nil {
+		return err
+	}
+	copyTo := func(offset, end int64) error {
+		if _, err := io.Copy(tmpFile, io.NewSectionReader(file.Fd, offset, end-offset)); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+		}
+		return nil
+	}
+	offset, truncated := int64(0), false
+	for _, r := range ranges {
+		if err = copyTo(offset, r[0]); err != nil {
+			return err
+		}
+		// 无法用一条记录填满的数据段之后的记录也无法读取，与末尾的损坏数据一样截断
+		filler := blobFiller(file, r[1]-r[0])
+		if r[1] >= end || filler == nil {
+			truncated = true
+			break
+		}
+		if _, err = tmpFile.Write(filler); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+		}
+		offset = r[1]
+	}
+	if !truncated {
+		if err = copyTo(offset, end); err != nil {
+			return err
+		}
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	if err = os.Rename(tmpName, file.FileName); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", file.FileName))
+	}
+	return nil
+}
+
+// blobFiller 编码后长度正好为size的失效blob记录，key的数据类型为Blob，不会被任何主entry引用，BlobGC时回收
+// 变长header的长度随value长度变化，凑不出size时返回nil
+func blobFiller(file *data.File, size int64) []byte {
+	for keySize := 1; keySize <= 2; keySize++ {
+		key := make([]byte, keySize)
+		key[0] = byte(data.Blob)
+		var value []byte
+		for i := 0; i < 3; i++ {
+			buf := file.EncodeEntry(data.NewEntry(key, value, data.Insert))
+			n := int64(len(value)) + size - int64(len(buf))
+			if n == int64(len(value)) {
+				return buf
+			} else if n < 0 {
+				break
+			}
+			value = make([]byte, n)
+		}
+	}
+	return nil
+}
+
+// countKeys 统计dataType中未过期的非空key数量
+func (db *TinyDB) countKeys(dataType data.DataType) (count int) {
+	now := time.Now().UnixMilli()
+	for _, key := range db.keydirKeys(dataType) {
+		if db.expireKeydirs[dataType].IsExpired(key, now) {
+			continue
+		}
+		if dataType == data.List {
+			if head, tail, err := db.getListMeta([]byte(key)); err != nil || head > tail {
+				continue
+			}
+		}
+		count++
+	}
+	return
+}
+
+// closeFiles 关闭所有文件，不做落盘
+func (db *TinyDB) closeFiles() {
+	db.closeDiskIndex()
+	if db.manifest != nil {
+		db.manifest.close()
+	}
+	for _, activeFile := range db.activeFiles {
+		_ = activeFile.Close()
+	}
+	for _, archivedFiles := range db.archivedFiles {
+		for _, archivedFile := range archivedFiles {
+			_ = archivedFile.Close()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_Check(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/check")
+	opt.FileSizeLimit = 1 << 10
+	opt.DiskIndex = true
+	_ = os.RemoveAll(opt.DBPath)
+	defer os.RemoveAll(opt.DBPath)
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 50; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+	}
+	_ = tinyDB.Set([]byte("key1"), []byte("new"))
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte("1"))
+	path := opt.DBPath
+	tinyDB.Close()
+
+	report, err := Check(path, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if report.Corrupted() || report.KeyCount[data.String] != 50 || report.KeyCount[data.Hash] != 1 {
+		t.Errorf("Check error")
+	}
+	live, dead := 0, 0
+	for _, file := range report.Files {
+		live += file.Live
+		dead += file.Dead
+	}
+	if live != 51 || dead != 1 {
+		t.Errorf("Check error, live: %v, dead: %v", live, dead)
+	}
+
+	// 破坏第一个文件中key0的数据
+	fd, err := os.OpenFile(path+"/0.str.log", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fd.WriteAt([]byte("garbage"), data.FileHeaderSize+10)
+	_ = fd.Close()
+
+	if report, _ = Check(path, false); !report.Corrupted() {
+		t.Errorf("Check error")
+	}
+	if report, _ = Check(path, true); report.Corrupted() {
+		t.Errorf("repair error")
+	}
+	// 修复后entry偏移改变，关闭时保存的磁盘索引被删除
+	if _, err = os.Stat(filepath.Join(path, indexFileName)); !os.IsNotExist(err) {
+		t.Errorf("disk index is not removed after repair: %v", err)
+	}
+	if report, _ = Check(path, false); report.Corrupted() || report.KeyCount[data.String] != 49 {
+		t.Errorf("repair error")
+	}
+
+	if tinyDB, err = Open(opt); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = tinyDB.Get([]byte("key0")); err == nil {
+		t.Errorf("repair error")
+	}
+	if res, _ := tinyDB.Get([]byte("key2")); string(res) != "value2" {
+		t.Errorf("repair error")
+	}
+	tinyDB.Close()
+}
+
+func Test_CheckBlob(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/check")
+	opt.BlobThreshold = 64
+	_ = os.RemoveAll(opt.DBPath)
+	defer os.RemoveAll(opt.DBPath)
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	values := []string{strings.Repeat("a", 200), strings.Repeat("b", 200), strings.Repeat("c", 200)}
+	for i, value := range values {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(value))
+	}
+	path := opt.DBPath
+	tinyDB.Close()
+
+	report, err := Check(path, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	live := 0
+	for _, file := range report.Files {
+		if file.DataType == data.Blob {
+			live += file.Live
+		}
+	}
+	if report.Corrupted() || live != 3 {
+		t.Errorf("Check error, blob live: %v", live)
+	}
+
+	// 破坏中间的blob记录，修复后前后的记录偏移不变，仍然可以读取
+	blobName := filepath.Join(path, "0"+data.BlobFileSuf)
+	buf, _ := os.ReadFile(blobName)
+	fd, err := os.OpenFile(blobName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fd.WriteAt([]byte("garbage"), int64(bytes.Index(buf, []byte(values[1]))))
+	_ = fd.Close()
+
+	if report, _ = Check(path, false); !report.Corrupted() {
+		t.Errorf("Check error")
+	}
+	if report, _ = Check(path, true); report.Corrupted() {
+		t.Errorf("repair error")
+	}
+	if report, _ = Check(path, false); report.Corrupted() {
+		t.Errorf("repair error")
+	}
+
+	if tinyDB, err = Open(opt); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i, value := range values {
+		res, err := tinyDB.Get([]byte(fmt.Sprintf("key%v", i)))
+		if i == 1 && err == nil || i != 1 && string(res) != value {
+			t.Errorf("Get key%v = %v, err: %v", i, string(res), err)
+		}
+	}
+	_ = tinyDB.Set([]byte("key3"), []byte(values[0]))
+	if res, _ := tinyDB.Get([]byte("key3")); string(res) != values[0] {
+		t.Errorf("Get key3 = %v", string(res))
+	}
+	tinyDB.Close()
+}
@@ -5,49 +5,92 @@ import (
 	"SouthWind6510/TinyDB/keydir"
 	"SouthWind6510/TinyDB/pkg/constants"
 	"SouthWind6510/TinyDB/pkg/logger"
+	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 type TinyDB struct {
 	activeFiles   map[data.DataType]*data.File
-	archivedFiles map[data.DataType]map[int16]*data.File
-	fileMap       map[data.DataType][]uint16
+	archivedFiles map[data.DataType]map[uint32]*data.File
 	opt           *Options
 	mu            sync.RWMutex // 读写锁
 
-	strKeydir  *keydir.StrKeydir
-	listKeydir *keydir.ListKeydir
-	hashKeydir *keydir.HashKeydir
-	setKeydir  *keydir.SetKeydir
-	zsetKeydir *keydir.ZSetKeydir
+	strKeydir  keydir.StrIndex
+	listKeydir keydir.ListIndex
+	hashKeydir keydir.HashIndex
+	setKeydir  keydir.SetIndex
+	zsetKeydir keydir.ZSetIndex
+	diskIndex  *keydir.DiskIndex // 开启DiskIndex时String、List和Hash使用的磁盘索引
+	// 各类型key的过期时间
+	expireKeydirs map[data.DataType]*keydir.ExpireKeydir
+
+	activeHints map[data.DataType][]*data.Hint // 活跃文件的hint，归档时写入hint文件
+	staleBytes  map[data.DataType]int64        // 各类型失效数据大小
+	mergeMu     sync.Mutex                     // 同一时间只允许一个merge
+	closeCh     chan struct{}
+	batchID     uint64      // 最近一次批次写入的id
+	keyID       data.KeyID  // 写入时使用的加密密钥，NoEncryption表示不加密
+	cache       *valueCache // 按位置缓存读取的entry，未开启时为nil
+	wg          sync.WaitGroup
+	lockFile    *os.File // DBPath下的LOCK文件，持有期间其他进程不能以读写模式打开
+	manifest    *manifest
+
+	txMu        sync.RWMutex                     // 事务执行时独占，普通命令共享
+	watchMu     sync.Mutex                       // 保护watchedKeys
+	watchedKeys map[string]map[*Watcher]struct{} // 被WATCH的key及其watcher
 }
 
 func Open(opt *Options) (tinyDB *TinyDB, err error) {
 	logger.Log.Infof("Open TinyDB with options: %+v", opt)
+	if opt.FormatVersion < data.FormatV1 || opt.FormatVersion > data.LatestFormat {
+		return nil, errors.Wrap(constants.ErrUnsupportedFormat, fmt.Sprintf("format version: %v", opt.FormatVersion))
+	}
+	if opt.Compression != data.NoCompression {
+		if _, err = data.GetCodec(opt.Compression); err != nil {
+			return nil, err
+		}
+	}
 	// 创建不存在的目录
-	if _, err = os.Stat(opt.DBPath); os.IsNotExist(err) {
+	if _, err = os.Stat(opt.DBPath); os.IsNotExist(err) && !opt.ReadOnly {
 		if err := os.MkdirAll(opt.DBPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
-	tinyDB = &TinyDB{
-		activeFiles:   make(map[data.DataType]*data.File),
-		archivedFiles: make(map[data.DataType]map[int16]*data.File),
-		opt:           opt,
-		strKeydir:     keydir.NewStrKeydir(),
-		listKeydir:    keydir.NewListKeydir(),
-		hashKeydir:    keydir.NewHashKeydir(),
-		setKeydir:     keydir.NewSetKeydir(),
-		zsetKeydir:    keydir.NewZSetKeydir(),
+	keyID, err := LoadKeys(opt.EncryptionKeyFile, opt.EncryptionKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	tinyDB = newTinyDB(opt)
+	tinyDB.keyID = keyID
+	if err = tinyDB.lock(); err != nil {
+		return nil, err
 	}
+	// 打开失败时释放锁，返回值tinyDB此时为nil
+	defer func(db *TinyDB) {
+		if err != nil {
+			db.closeFiles()
+			db.unlock()
+		}
+	}(tinyDB)
 
+	if err = tinyDB.openDiskIndex(); err != nil {
+		return nil, err
+	}
+	// 完成上次未完成的merge
+	err = tinyDB.recoverMerge()
+	if err != nil {
+		return nil, err
+	}
 	// 加载文件目录
 	err = tinyDB.loadDataFiles()
 	if err != nil {
@@ -60,11 +103,75 @@ func Open(opt *Options) (tinyDB *TinyDB, err error) {
 		return nil, err
 	}
 	logger.Log.Infof("Build indexes successful")
-	// TODO 异步GC
+	if err = tinyDB.recoverBlobFile(); err != nil {
+		return nil, err
+	}
+	// 删除重启期间过期的key
+	err = tinyDB.deleteExpiredKeys()
+	if err != nil {
+		return nil, err
+	}
+	// 只读模式不启动后台任务
+	if opt.ReadOnly {
+		return
+	}
+	// 异步merge
+	if opt.MergeInterval > 0 {
+		tinyDB.wg.Add(1)
+		go tinyDB.mergeLoop()
+	}
+	// 每秒落盘
+	if opt.SyncPolicy == SyncEverySec {
+		tinyDB.wg.Add(1)
+		go tinyDB.syncLoop()
+	}
+	// 主动清理过期key
+	if opt.ExpireInterval > 0 && opt.ExpireSampleSize > 0 {
+		tinyDB.wg.Add(1)
+		go tinyDB.expireLoop()
+	}
 	return
 }
 
+func newTinyDB(opt *Options) *TinyDB {
+	indexes := opt.Indexes
+	if indexes == nil {
+		indexes = keydir.MemIndexFactory{Ordered: opt.OrderedIndex}
+	}
+	tinyDB := &TinyDB{
+		activeFiles:   make(map[data.DataType]*data.File),
+		archivedFiles: make(map[data.DataType]map[uint32]*data.File),
+		opt:           opt,
+		strKeydir:     indexes.NewStrIndex(),
+		listKeydir:    indexes.NewListIndex(),
+		hashKeydir:    indexes.NewHashIndex(),
+		setKeydir:     indexes.NewSetIndex(),
+		zsetKeydir:    indexes.NewZSetIndex(),
+		expireKeydirs: make(map[data.DataType]*keydir.ExpireKeydir),
+		activeHints:   make(map[data.DataType][]*data.Hint),
+		staleBytes:    make(map[data.DataType]int64),
+		cache:         newValueCache(opt.CacheSize),
+		closeCh:       make(chan struct{}),
+		watchedKeys:   make(map[string]map[*Watcher]struct{}),
+	}
+	for dataType := range data.Type2FileSufMap {
+		tinyDB.expireKeydirs[dataType] = keydir.NewExpireKeydir()
+	}
+	return tinyDB
+}
+
 func (db *TinyDB) Close() {
+	close(db.closeCh)
+	db.wg.Wait()
+	// 等待正在进行的merge结束
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	defer db.unlock()
+	if db.opt.ReadOnly {
+		db.closeFiles()
+		return
+	}
+	db.saveDiskIndex()
 	for _, activeFile := range db.activeFiles {
 		_ = activeFile.Sync()
 		_ = activeFile.Close()
@@ -75,7 +182,11 @@ func (db *TinyDB) Close() {
 			}
 		}
 	}
-	for _, archivedFiles := range db.archivedFiles {
+	db.manifest.close()
+	if os.Getenv(constants.DebugEnv) == "1" {
+		_ = os.Remove(filepath.Join(db.opt.DBPath, manifestFileName))
+	}
+	for dataType, archivedFiles := range db.archivedFiles {
 		for _, archivedFile := range archivedFiles {
 			_ = archivedFile.Sync()
 			_ = archivedFile.Close()
@@ -84,48 +195,254 @@ func (db *TinyDB) Close() {
 				if err != nil {
 					logger.Log.Errorf("%+v", err)
 				}
+				if dataType == data.Blob {
+					continue
+				}
+				err = data.RemoveHintFile(db.opt.DBPath, archivedFile.Fid, dataType)
+				if err != nil {
+					logger.Log.Errorf("%+v", err)
+				}
+			}
+		}
+	}
+}
+
+// syncLoop 每秒将活跃文件落盘，不持有db.mu，避免阻塞写入
+func (db *TinyDB) syncLoop() {
+	defer db.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			db.mu.RLock()
+			files := make([]*data.File, 0, len(db.activeFiles))
+			for dataType, activeFile := range db.activeFiles {
+				// blob文件先落盘，主entry落盘时引用的blob记录已经落盘
+				if dataType == data.Blob {
+					files = append([]*data.File{activeFile}, files...)
+				} else {
+					files = append(files, activeFile)
+				}
+			}
+			db.mu.RUnlock()
+			for _, file := range files {
+				// 文件可能已被归档并在merge后关闭
+				if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+					logger.Log.Errorf("sync data file err: %+v", err)
+				}
 			}
 		}
 	}
 }
 
+// loadDataFiles 按MANIFEST加载数据文件，没有MANIFEST时扫描目录并生成
 func (db *TinyDB) loadDataFiles() (err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if !manifestExists(db.opt.DBPath) {
+		return db.scanDataFiles()
+	}
+	db.manifest, err = readManifest(db.opt.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.mmapArchivedFiles()
+	dataTypes := []data.DataType{data.Blob}
+	for dataType := range data.Type2FileSufMap {
+		dataTypes = append(dataTypes, dataType)
+	}
+	for _, dataType := range dataTypes {
+		for _, fid := range db.manifest.fids(dataType) {
+			// 第1版MANIFEST中的fid为int16，回绕后的文件需要改名
+			if db.manifest.version == 1 && fid > math.MaxInt16 {
+				if err = db.renameLegacyFile(fid, dataType); err != nil {
+					return err
+				}
+			}
+			dataFile, err := db.openDataFile(fid, dataType)
+			if err != nil {
+				return err
+			}
+			if fid == db.manifest.active[dataType] {
+				db.activeFiles[dataType] = dataFile
+				continue
+			}
+			if db.archivedFiles[dataType] == nil {
+				db.archivedFiles[dataType] = make(map[uint32]*data.File)
+			}
+			db.archivedFiles[dataType][fid] = dataFile
+		}
+	}
+	if db.opt.ReadOnly {
+		return nil
+	}
+	if err = db.removeStaleFiles(); err != nil {
+		return err
+	}
+	return db.manifest.rewrite()
+}
+
+// scanDataFiles 从旧版本升级时没有MANIFEST，按文件名加载数据文件，fid最大的文件作为活跃文件
+func (db *TinyDB) scanDataFiles() (err error) {
+	defer db.mmapArchivedFiles()
 	fileInfos, err := os.ReadDir(db.opt.DBPath)
 	if err != nil {
 		return err
 	}
 	// 将所有文件按照类型存入存档map中
 	for _, fileInfo := range fileInfos {
-		strs := strings.Split(fileInfo.Name(), ".")
-		fid, _ := strconv.ParseInt(strs[0], 10, 64)
-		fileType := data.FileSuf2TypeMap[strs[1]]
-		dataFile, err := data.OpenDataFile(db.opt.DBPath, int16(fid), fileType, db.opt.FileSizeLimit)
-		if err != nil {
-			return err
+		if fileInfo.IsDir() {
+			continue
 		}
-		if db.archivedFiles[fileType] == nil {
-			db.archivedFiles[fileType] = make(map[int16]*data.File)
+		for fileType, suffix := range data.Type2FileSufMap {
+			fid, legacy, ok := parseFid(fileInfo.Name(), suffix)
+			if !ok {
+				continue
+			}
+			if legacy {
+				if err = db.renameLegacyFile(fid, fileType); err != nil {
+					return err
+				}
+			}
+			dataFile, err := db.openDataFile(fid, fileType)
+			if err != nil {
+				return err
+			}
+			if db.archivedFiles[fileType] == nil {
+				db.archivedFiles[fileType] = make(map[uint32]*data.File)
+			}
+			db.archivedFiles[fileType][fid] = dataFile
 		}
-		db.archivedFiles[fileType][int16(fid)] = dataFile
 	}
 
-	// fid最大的文件作为活跃文件
+	// fid最大的文件作为活跃文件，merge后fid可能不连续
+	db.manifest = newManifest(db.opt.DBPath)
 	for k, v := range db.archivedFiles {
-		fid := int16(len(v)) - 1
+		var fid uint32
+		for f := range v {
+			if f > fid {
+				fid = f
+			}
+		}
 		db.activeFiles[k] = v[fid]
 		delete(v, fid)
+		edits := []*manifestEdit{{op: manifestActive, dataType: k, fid: fid}}
+		for f := range v {
+			edits = append(edits, &manifestEdit{op: manifestArchive, dataType: k, fid: f})
+		}
+		db.manifest.apply(edits)
 	}
-	return
+	if db.opt.ReadOnly {
+		return nil
+	}
+	return db.manifest.rewrite()
+}
+
+// renameLegacyFile 旧版本的fid为int16，超过32767后回绕为负数，文件名是负数转换成的uint64，
+// 按uint16解析后接在32767之后，需要改为新的文件名
+func (db *TinyDB) renameLegacyFile(fid uint32, dataType data.DataType) (err error) {
+	if db.opt.ReadOnly {
+		return constants.ErrNeedRecovery
+	}
+	legacyName := strconv.FormatUint(uint64(int16(uint16(fid))), 10)
+	for _, fileName := range []string{
+		data.DataFileName(db.opt.DBPath, fid, dataType),
+		data.HintFileName(db.opt.DBPath, fid, dataType),
+	} {
+		suffix := strings.TrimPrefix(filepath.Base(fileName), strconv.FormatUint(uint64(fid), 10))
+		oldName := filepath.Join(db.opt.DBPath, legacyName+suffix)
+		if _, err = os.Stat(oldName); os.IsNotExist(err) {
+			continue
+		}
+		logger.Log.Infof("rename legacy file %v to %v", oldName, fileName)
+		if err = os.Rename(oldName, fileName); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("filename: %v", oldName))
+		}
+	}
+	return nil
+}
+
+// mmapArchivedFiles 开启MmapArchived时映射所有存档文件，映射失败时回退到pread
+func (db *TinyDB) mmapArchivedFiles() {
+	for _, archivedFiles := range db.archivedFiles {
+		for _, archivedFile := range archivedFiles {
+			db.mmapArchivedFile(archivedFile)
+		}
+	}
+}
+
+func (db *TinyDB) mmapArchivedFile(file *data.File) {
+	if !db.opt.MmapArchived {
+		return
+	}
+	if err := file.Mmap(); err != nil {
+		logger.Log.Warnf("mmap archived file err, read by pread instead: %+v", err)
+	}
+}
+
+func (db *TinyDB) openDataFile(fid uint32, dataType data.DataType) (*data.File, error) {
+	fileName := data.DataFileName(db.opt.DBPath, fid, dataType)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil, errors.Wrap(constants.ErrDataFileNotFound, fmt.Sprintf("filename: %v", fileName))
+	}
+	if db.opt.ReadOnly {
+		return data.OpenReadOnlyDataFile(db.opt.DBPath, fid, dataType)
+	}
+	return data.OpenDataFile(db.opt.DBPath, fid, dataType, db.preallocateSize(), db.opt.FormatVersion)
+}
+
+// removeStaleFiles 删除不在MANIFEST中的数据文件和hint文件，它们是轮转或merge中途崩溃留下的
+func (db *TinyDB) removeStaleFiles() (err error) {
+	fileInfos, err := os.ReadDir(db.opt.DBPath)
+	if err != nil {
+		return err
+	}
+	suffixes := map[string]data.DataType{data.BlobFileSuf: data.Blob}
+	for dataType := range data.Type2FileSufMap {
+		suffixes[data.Type2FileSufMap[dataType]] = dataType
+		suffixes[data.Type2HintSufMap[dataType]] = dataType
+	}
+	for _, fileInfo := range fileInfos {
+		for suffix, dataType := range suffixes {
+			fid, _, ok := parseFid(fileInfo.Name(), suffix)
+			if !ok || db.activeFiles[dataType] != nil && db.activeFiles[dataType].Fid == fid {
+				continue
+			}
+			if _, archived := db.archivedFiles[dataType][fid]; archived {
+				continue
+			}
+			logger.Log.Warnf("remove stale file %v", fileInfo.Name())
+			if err = os.Remove(filepath.Join(db.opt.DBPath, fileInfo.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // buildIndexes 读取活跃文件和存档文件数据，构建索引
-// 要按顺序读！！！
+// 存档文件优先从hint文件加载，只有活跃文件和缺少hint的文件需要逐条读取entry
+// 要按顺序读！！！跨类型批次的最终提交记录在类型最大的文件中，类型按从大到小重放
+// 复用磁盘索引时String、List和Hash只读取活跃文件，恢复hint和写入位置
 func (db *TinyDB) buildIndexes() (err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	for dataType, activeFile := range db.activeFiles {
+	reused, err := db.reuseDiskIndex()
+	if err != nil {
+		return err
+	}
+	if reused {
+		logger.Log.Infof("Reuse disk index of strings, lists and hashes")
+	}
+	committed := make(map[uint64]struct{})
+	for dataType := data.ZSet; dataType >= data.String; dataType-- {
+		activeFile, ok := db.activeFiles[dataType]
+		if !ok {
+			continue
+		}
 		files := make([]*data.File, 0)
 		files = append(files, activeFile)
 		for _, archivedFile := range db.archivedFiles[dataType] {
@@ -135,41 +452,157 @@ func (db *TinyDB) buildIndexes() (err error) {
 		sort.Slice(files, func(i, j int) bool {
 			return files[i].Fid < files[j].Fid
 		})
+		var hints []*data.Hint
+		dt := dataType
+		skipIndex := reused && isDiskIndexType(dataType)
+		r := newBatchReplayer(db, committed, func(entry *data.Entry, pos *keydir.EntryPos) {
+			if !skipIndex {
+				db.markStale(dt, entry, pos.Size)
+				db.addIndex(dt, entry, pos)
+			}
+			hints = append(hints, newHint(dt, entry, pos))
+		})
 		for i := 0; i < len(files); i++ {
-			offset := int64(0)
-			// 读取活跃文件数据
-			for {
-				entry, err := files[i].ReadEntry(offset)
-				if errors.Is(err, io.EOF) || errors.Is(err, constants.ErrReadNullEntry) {
-					break
-				} else if err != nil {
-					return err
+			hints = nil
+			if files[i] != activeFile && skipIndex {
+				continue
+			}
+			if files[i] != activeFile {
+				fileHints, err := data.ReadHintFile(db.opt.DBPath, files[i].Fid, dataType)
+				if err == nil {
+					for _, hint := range fileHints {
+						pos := &keydir.EntryPos{Fid: files[i].Fid, Offset: hint.Offset, Size: hint.Size}
+						r.replay(hint.Entry(), pos)
+					}
+					continue
+				}
+				if !os.IsNotExist(err) {
+					logger.Log.Warnf("read hint file err, scan data file instead: %+v", err)
+				}
+			}
+			offset, confirmID, err := db.scanDataFile(r, files[i])
+			if files[i] == activeFile {
+				if isTornEntry(err) {
+					err = nil
+				}
+				if err == nil {
+					err = db.recoverTail(files[i], offset)
 				}
-				size := int64(data.HeaderSize + entry.Header.KeySize + entry.Header.ValueSize)
-				pos := &keydir.EntryPos{Fid: activeFile.Fid, Offset: offset, Size: size}
-				db.addIndex(dataType, entry, pos)
-				offset += size
 			}
-			if i == len(files)-1 {
+			if err != nil {
+				return err
+			}
+			if files[i] == activeFile {
 				// 更新活跃文件WriteAt
 				files[i].WriteAt = offset
+				db.activeHints[dataType] = hints
+				// 批次在其他类型中已提交，补写最终提交记录，之后不再依赖其他类型的提交记录
+				if confirmID != 0 && !db.opt.ReadOnly {
+					if err = db.writeBatchCommit(dataType, confirmID); err != nil {
+						return err
+					}
+				}
+			} else if db.opt.ReadOnly {
+				continue
+			} else if err = data.WriteHintFile(db.opt.DBPath, files[i].Fid, dataType, hints, db.keyID); err != nil {
+				logger.Log.Warnf("write hint file err: %+v", err)
 			}
 		}
 	}
+	db.initBatchID()
 	return nil
 }
 
+// scanDataFile 逐条读取文件中的entry重放，返回有效数据末尾的偏移，未提交的批次不计入有效数据
+func (db *TinyDB) scanDataFile(r *batchReplayer, file *data.File) (offset int64, confirmID uint64, err error) {
+	for offset = file.DataStart(); ; {
+		entry, readErr := file.ReadEntry(offset)
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, constants.ErrReadNullEntry) {
+			break
+		} else if readErr != nil {
+			// 返回已读取的部分，活跃文件末尾损坏时可以截断后继续打开
+			err = readErr
+			break
+		}
+		size := entry.Size()
+		r.replay(entry, &keydir.EntryPos{Fid: file.Fid, Offset: offset, Size: size})
+		offset += size
+	}
+	truncateAt, confirmID := r.finish()
+	if truncateAt >= 0 {
+		offset = truncateAt
+	}
+	return offset, confirmID, err
+}
+
+// isTornEntry 写入中断会导致entry长度越界或CRC校验失败
+func isTornEntry(err error) bool {
+	return errors.Is(err, constants.ErrInconsistentCRC) || errors.Is(err, constants.ErrEntryOutOfFile) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// recoverTail 活跃文件offset之后应没有数据，否则说明崩溃时有entry未写完，截断至最后一个有效entry
+// 旧版本预分配的文件末尾全部为0，同样截断；只读模式不截断，之后的数据被忽略
+func (db *TinyDB) recoverTail(file *data.File, offset int64) (err error) {
+	if db.opt.StrictRecovery || db.opt.ReadOnly {
+		size, err := file.TailSize(offset)
+		if err != nil {
+			return err
+		}
+		if size > 0 && db.opt.StrictRecovery {
+			return errors.Wrap(constants.ErrCorruptedTail, fmt.Sprintf("filename: %v, offset: %v", file.FileName, offset))
+		}
+		if db.opt.ReadOnly {
+			if size > 0 {
+				logger.Log.Warnf("ignore corrupted tail of %v at offset %v in read-only mode", file.FileName, offset)
+			}
+			return nil
+		}
+	}
+	dropped, err := file.TruncateTail(offset)
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		logger.Log.Warnf("truncate corrupted tail of %v at offset %v, %v bytes dropped", file.FileName, offset, dropped)
+	}
+	return nil
+}
+
+// newHint zset重建索引需要score，listMeta需要head和tail，其他类型只需要key
+func newHint(dataType data.DataType, entry *data.Entry, pos *keydir.EntryPos) *data.Hint {
+	var value []byte
+	if dataType == data.ZSet || entry.Header.Type == data.InsertListMeta {
+		value = entry.Value
+	}
+	return data.NewHint(entry, pos.Offset, pos.Size, value)
+}
+
 func (db *TinyDB) addIndex(dataType data.DataType, entry *data.Entry, pos *keydir.EntryPos) {
+	switch entry.Header.Type {
+	case data.Expire:
+		db.setExpire(dataType, string(entry.Key), int64(entry.Header.ExpiryTime))
+		return
+	case data.DeleteKey:
+		db.removeKey(dataType, string(entry.Key))
+		return
+	case data.BatchCommit:
+		return
+	}
 	switch dataType {
 	case data.String:
 		if entry.Header.Type == data.Insert {
 			db.strKeydir.Set(string(entry.Key), pos)
+			db.setExpire(dataType, string(entry.Key), int64(entry.Header.ExpiryTime))
 		} else if entry.Header.Type == data.Delete {
-			db.strKeydir.Del(string(entry.Key))
+			db.removeKey(dataType, string(entry.Key))
 		}
 	case data.List:
 		if entry.Header.Type == data.InsertListMeta {
 			db.listKeydir.Set(string(entry.Key), MetaIndex, pos)
+			if head, tail := decodeListMeta(entry.Value); head > tail {
+				db.expireKeydirs[dataType].Del(string(entry.Key))
+			}
 		} else if entry.Header.Type == data.Insert {
 			key, index := decodeListKey(entry.Key)
 			db.listKeydir.Set(string(key), index, pos)
@@ -184,6 +617,7 @@ func (db *TinyDB) addIndex(dataType data.DataType, entry *data.Entry, pos *keydi
 		} else if entry.Header.Type == data.Delete {
 			key, field := decodeSubKey(entry.Key)
 			db.hashKeydir.Del(string(key), string(field))
+			db.clearExpireIfEmpty(dataType, string(key))
 		}
 	case data.Set:
 		if entry.Header.Type == data.Insert {
@@ -192,6 +626,7 @@ func (db *TinyDB) addIndex(dataType data.DataType, entry *data.Entry, pos *keydi
 		} else if entry.Header.Type == data.Delete {
 			key, field := decodeSubKey(entry.Key)
 			db.setKeydir.Del(string(key), string(field))
+			db.clearExpireIfEmpty(dataType, string(key))
 		}
 	case data.ZSet:
 		if entry.Header.Type == data.Insert {
@@ -205,6 +640,7 @@ func (db *TinyDB) addIndex(dataType data.DataType, entry *data.Entry, pos *keydi
 		} else if entry.Header.Type == data.Delete {
 			key, member := decodeSubKey(entry.Key)
 			db.zsetKeydir.DeleteWithoutScore(string(key), string(member))
+			db.clearExpireIfEmpty(dataType, string(key))
 		}
 	}
 }
@@ -214,56 +650,216 @@ func (db *TinyDB) initDataFile(dataType data.DataType) (err error) {
 	if db.activeFiles[dataType] != nil {
 		return
 	}
-	file, err := data.OpenDataFile(db.opt.DBPath, 0, dataType, db.opt.FileSizeLimit)
+	file, err := data.OpenDataFile(db.opt.DBPath, 0, dataType, db.preallocateSize(), db.opt.FormatVersion)
 	if err != nil {
 		return
 	}
+	if err = db.manifest.append(&manifestEdit{op: manifestActive, dataType: dataType, fid: 0}); err != nil {
+		_ = file.Close()
+		_ = file.Remove()
+		return err
+	}
 	db.activeFiles[dataType] = file
 	return nil
 }
 
+// preallocateSize 新建数据文件时预留的空间大小
+func (db *TinyDB) preallocateSize() int64 {
+	if db.opt.Preallocate {
+		return db.opt.FileSizeLimit
+	}
+	return 0
+}
+
 func (db *TinyDB) WriteEntry(entry *data.Entry, dataType data.DataType) (pos *keydir.EntryPos, err error) {
+	if db.opt.ReadOnly {
+		return nil, constants.ErrReadOnly
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	err = db.initDataFile(dataType)
-	if err != nil {
+	if entry, err = db.separateValue(dataType, entry); err != nil {
+		return nil, err
+	}
+	if pos, err = db.appendEntry(entry, dataType); err != nil {
 		return nil, err
 	}
-	buf := data.EncodeEntry(entry)
+	db.touchKey(dataType, entry)
+	return
+}
+
+// appendEntry 将entry写入dataType的活跃文件，记录hint和失效数据，调用方需持有db.mu
+func (db *TinyDB) appendEntry(entry *data.Entry, dataType data.DataType) (pos *keydir.EntryPos, err error) {
+	if err = db.indexErr(); err != nil {
+		return nil, err
+	}
+	if err = db.initDataFile(dataType); err != nil {
+		return nil, err
+	}
+	db.compressEntry(entry)
+	entry.Header.KeyID = db.keyID
 	activeFile := db.activeFiles[dataType]
-	if activeFile.WriteAt+int64(len(buf)) > db.opt.FileSizeLimit {
-		if err = activeFile.Sync(); err != nil {
+	buf := activeFile.EncodeEntry(entry)
+	if activeFile.WriteAt > activeFile.DataStart() && activeFile.WriteAt+int64(len(buf)) > db.opt.FileSizeLimit {
+		if activeFile, err = db.rotateActiveFile(dataType, activeFile.Fid+1); err != nil {
 			return nil, err
 		}
-		// 新建活跃文件
-		newFile, err := data.OpenDataFile(db.opt.DBPath, activeFile.Fid+1, dataType, db.opt.FileSizeLimit)
-		if err != nil {
-			return nil, err
+		// 新文件的格式可能不同
+		if activeFile.Version != entry.Header.Format {
+			buf = activeFile.EncodeEntry(entry)
 		}
-		if db.archivedFiles[dataType] == nil {
-			db.archivedFiles[dataType] = make(map[int16]*data.File)
-		}
-		db.archivedFiles[dataType][activeFile.Fid] = activeFile
-		db.activeFiles[dataType] = newFile
-		activeFile = newFile
 	}
 	pos = &keydir.EntryPos{Fid: activeFile.Fid, Offset: activeFile.WriteAt, Size: int64(len(buf))}
+	db.cache.remove(dataType, pos)
 	if err = activeFile.Write(buf); err != nil {
 		return nil, err
 	}
+	if db.opt.SyncPolicy == SyncAlways {
+		if err = activeFile.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	db.markStale(dataType, entry, pos.Size)
+	db.activeHints[dataType] = append(db.activeHints[dataType], newHint(dataType, entry, pos))
 	return
 }
 
+// compressEntry 按Options设置entry的压缩算法，EncodeEntry时压缩
+// 已压缩的entry保持原算法，merge时不解压，保证merge结果不大于输入
+func (db *TinyDB) compressEntry(entry *data.Entry) {
+	if entry.Header.Codec == data.NoCompression && db.opt.Compression != data.NoCompression && entry.Header.Type != data.BatchCommit &&
+		!entry.Header.Blob && len(entry.Value) >= db.opt.CompressThreshold {
+		entry.Header.Codec = db.opt.Compression
+	}
+}
+
+// rotateActiveFile 将活跃文件归档，并以fid新建活跃文件，调用方需持有db.mu
+func (db *TinyDB) rotateActiveFile(dataType data.DataType, fid uint32) (*data.File, error) {
+	activeFile := db.activeFiles[dataType]
+	if err := activeFile.Sync(); err != nil {
+		return nil, err
+	}
+	newFile, err := data.OpenDataFile(db.opt.DBPath, fid, dataType, db.preallocateSize(), db.opt.FormatVersion)
+	if err != nil {
+		return nil, err
+	}
+	// 写入MANIFEST后新文件才生效，之前崩溃时新文件会在Open时被删除
+	if err = db.manifest.append(&manifestEdit{op: manifestActive, dataType: dataType, fid: fid}); err != nil {
+		_ = newFile.Close()
+		_ = newFile.Remove()
+		return nil, err
+	}
+	// hint文件只用于加速启动，写入失败时Open会回退到读取数据文件；blob文件不需要hint
+	if dataType != data.Blob {
+		if err = data.WriteHintFile(db.opt.DBPath, activeFile.Fid, dataType, db.activeHints[dataType], db.keyID); err != nil {
+			logger.Log.Warnf("write hint file err: %+v", err)
+		}
+	}
+	db.activeHints[dataType] = nil
+	if db.archivedFiles[dataType] == nil {
+		db.archivedFiles[dataType] = make(map[uint32]*data.File)
+	}
+	db.archivedFiles[dataType][activeFile.Fid] = activeFile
+	db.mmapArchivedFile(activeFile)
+	db.activeFiles[dataType] = newFile
+	return newFile, nil
+}
+
 func (db *TinyDB) ReadEntry(dataType data.DataType, pos *keydir.EntryPos) (entry *data.Entry, err error) {
-	var dataFile *data.File
-	if db.activeFiles[dataType].Fid == pos.Fid {
-		dataFile = db.activeFiles[dataType]
-	} else {
-		dataFile = db.archivedFiles[dataType][pos.Fid]
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if entry = db.cache.get(dataType, pos); entry != nil {
+		return entry, nil
+	}
+	if entry, err = db.readEntry(dataType, pos); err != nil {
+		return nil, err
+	}
+	if entry.Header.Blob {
+		if entry, err = db.readBlob(dataType, entry); err != nil {
+			return nil, err
+		}
+	}
+	// 持有读锁时加入缓存，merge删除文件前会先清理对应的缓存
+	db.cache.add(dataType, pos, entry)
+	return
+}
+
+// readIndexed 读取索引中记录的entry，查找索引后、加锁读取前merge可能已将entry移到新文件并删除旧文件，
+// 此时重新查找索引后重试，索引没有变化时说明文件确实不存在
+func (db *TinyDB) readIndexed(dataType data.DataType, lookup func() (*keydir.EntryPos, error)) (*data.Entry, error) {
+	var last keydir.EntryPos
+	for retry := false; ; retry = true {
+		pos, err := lookup()
+		if err != nil {
+			return nil, err
+		}
+		if retry && *pos == last {
+			return nil, errors.Wrap(constants.ErrDataFileNotFound, fmt.Sprintf("fid: %v", pos.Fid))
+		}
+		entry, err := db.ReadEntry(dataType, pos)
+		if !errors.Is(err, constants.ErrDataFileNotFound) {
+			return entry, err
+		}
+		last = *pos
+	}
+}
+
+func (db *TinyDB) readStr(key string) (*data.Entry, error) {
+	return db.readIndexed(data.String, func() (*keydir.EntryPos, error) {
+		return db.strKeydir.Get(key)
+	})
+}
+
+func (db *TinyDB) readList(key string, index int) (*data.Entry, error) {
+	return db.readIndexed(data.List, func() (*keydir.EntryPos, error) {
+		return db.listKeydir.Get(key, index)
+	})
+}
+
+func (db *TinyDB) readHash(key, field string) (*data.Entry, error) {
+	return db.readIndexed(data.Hash, func() (*keydir.EntryPos, error) {
+		return db.hashKeydir.Get(key, field)
+	})
+}
+
+// readEntry 读取pos处的entry，分离到blob文件的value不读取，调用方需持有db.mu
+func (db *TinyDB) readEntry(dataType data.DataType, pos *keydir.EntryPos) (entry *data.Entry, err error) {
+	dataFile := db.dataFile(dataType, pos.Fid)
+	// 读取期间文件可能已被merge删除
+	if dataFile == nil {
+		return nil, constants.ErrDataFileNotFound
 	}
 	entry, err = dataFile.ReadEntry(pos.Offset)
 	if err != nil {
 		return nil, err
 	}
+	// 映射中的key和value在merge删除文件后失效，返回前复制
+	if dataFile.Mapped() {
+		entry = entry.Copy()
+	}
 	return
 }
+
+// dataFile fid对应的活跃文件或存档文件，不存在时返回nil，调用方需持有db.mu
+func (db *TinyDB) dataFile(dataType data.DataType, fid uint32) *data.File {
+	if db.activeFiles[dataType] != nil && db.activeFiles[dataType].Fid == fid {
+		return db.activeFiles[dataType]
+	}
+	return db.archivedFiles[dataType][fid]
+}
+
+// keydirKeys 返回dataType索引中的所有key，包括已过期的key
+func (db *TinyDB) keydirKeys(dataType data.DataType) []string {
+	switch dataType {
+	case data.String:
+		return db.strKeydir.Keys()
+	case data.List:
+		return db.listKeydir.Keys()
+	case data.Hash:
+		return db.hashKeydir.Keys()
+	case data.Set:
+		return db.setKeydir.Keys()
+	case data.ZSet:
+		return db.zsetKeydir.Keys()
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const indexFileName = "INDEX"
+
+// diskIndexTypes 使用磁盘索引的类型
+var diskIndexTypes = []data.DataType{data.String, data.List, data.Hash}
+
+func isDiskIndexType(dataType data.DataType) bool {
+	return dataType == data.String || dataType == data.List || dataType == data.Hash
+}
+
+// openDiskIndex 开启DiskIndex时用磁盘索引替换String、List和Hash的内存索引，上次正常关闭时保存的索引由buildIndexes判断能否复用
+// 只读模式不修改DBPath，在临时目录中创建索引文件；未开启时删除之前留下的索引文件，之后的写入不会同步到该文件
+func (db *TinyDB) openDiskIndex() (err error) {
+	path := filepath.Join(db.opt.DBPath, indexFileName)
+	if !db.opt.DiskIndex {
+		if !db.opt.ReadOnly {
+			return removeIndexFile(db.opt.DBPath)
+		}
+		return nil
+	}
+	if db.opt.ReadOnly {
+		tmpFile, err := os.CreateTemp("", "tinydb-index-")
+		if err != nil {
+			return err
+		}
+		_ = tmpFile.Close()
+		path = tmpFile.Name()
+	}
+	if db.diskIndex, err = keydir.OpenDiskIndex(path, db.opt.IndexCacheSize, db.keyID); err != nil {
+		return err
+	}
+	db.strKeydir = db.diskIndex.NewStrIndex()
+	db.listKeydir = db.diskIndex.NewListIndex()
+	db.hashKeydir = db.diskIndex.NewHashIndex()
+	return nil
+}
+
+// removeIndexFile 删除保存的磁盘索引，不经过磁盘索引的写入和离线修改entry偏移的工具需要调用
+func removeIndexFile(path string) error {
+	if err := os.Remove(filepath.Join(path, indexFileName)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale disk index")
+	}
+	return nil
+}
+
+// closeDiskIndex 关闭并删除磁盘索引文件
+func (db *TinyDB) closeDiskIndex() {
+	if db.diskIndex == nil {
+		return
+	}
+	if err := db.diskIndex.Close(); err != nil {
+		logger.Log.Errorf("close disk index err: %+v", err)
+	}
+	db.diskIndex = nil
+}
+
+// saveDiskIndex 正常关闭时保存磁盘索引和数据文件的状态，下次打开时数据文件没有变化则跳过重建
+func (db *TinyDB) saveDiskIndex() {
+	if db.diskIndex == nil {
+		return
+	}
+	if os.Getenv(constants.DebugEnv) == "1" || db.indexErr() != nil {
+		db.closeDiskIndex()
+		return
+	}
+	// 数据文件先落盘，索引不会领先于数据
+	for _, dataType := range diskIndexTypes {
+		if activeFile := db.activeFiles[dataType]; activeFile != nil {
+			if err := activeFile.Sync(); err != nil {
+				logger.Log.Errorf("sync %v before saving disk index err: %+v", activeFile.FileName, err)
+				db.closeDiskIndex()
+				return
+			}
+		}
+	}
+	if err := db.diskIndex.Save(db.encodeIndexState()); err != nil {
+		logger.Log.Errorf("save disk index err: %+v", err)
+	}
+	db.diskIndex = nil
+}
+
+// indexErr 磁盘索引读写失败后返回ErrIndexFailed，之后的写入无法反映到索引中，全部拒绝
+func (db *TinyDB) indexErr() error {
+	if db.diskIndex == nil {
+		return nil
+	}
+	return db.diskIndex.Err()
+}
+
+// indexFileState 保存索引时一种类型的数据文件状态和buildIndexes中除索引外的统计
+type indexFileState struct {
+	active     bool
+	activeFid  uint32
+	writeAt    int64
+	archived   []uint32 // 从小到大排列
+	staleBytes int64
+	expires    map[string]int64
+}
+
+// encodeIndexState 编码String、List和Hash的状态，按类型依次为
+// Active + ActiveFid + WriteAt + Count + Fid... + StaleBytes + Count + (KeySize + Key + ExpireAt)...
+func (db *TinyDB) encodeIndexState() []byte {
+	var buf []byte
+	for _, dataType := range diskIndexTypes {
+		state := db.indexFileState(dataType)
+		if state.active {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = binary.AppendUvarint(buf, uint64(state.activeFid))
+		buf = binary.AppendVarint(buf, state.writeAt)
+		buf = binary.AppendUvarint(buf, uint64(len(state.archived)))
+		for _, fid := range state.archived {
+			buf = binary.AppendUvarint(buf, uint64(fid))
+		}
+		buf = binary.AppendVarint(buf, state.staleBytes)
+		buf = binary.AppendUvarint(buf, uint64(db.expireKeydirs[dataType].Len()))
+		db.expireKeydirs[dataType].Each(func(key string, expireAt int64) {
+			buf = binary.AppendUvarint(buf, uint64(len(key)))
+			buf = append(buf, key...)
+			buf = binary.AppendVarint(buf, expireAt)
+		})
+	}
+	return buf
+}
+
+func decodeIndexState(buf []byte) ([]*indexFileState, error) {
+	errCorrupted := errors.Wrap(constants.ErrCorruptedIndex, "disk index state")
+	var ok bool
+	uvarint := func() uint64 {
+		v, l := binary.Uvarint(buf)
+		if l <= 0 {
+			ok = false
+			return 0
+		}
+		buf = buf[l:]
+		return v
+	}
+	varint := func() int64 {
+		v, l := binary.Varint(buf)
+		if l <= 0 {
+			ok = false
+			return 0
+		}
+		buf = buf[l:]
+		return v
+	}
+	states := make([]*indexFileState, 0, len(diskIndexTypes))
+	for range diskIndexTypes {
+		if len(buf) == 0 {
+			return nil, errCorrupted
+		}
+		ok = true
+		state := &indexFileState{active: buf[0] == 1, expires: make(map[string]int64)}
+		buf = buf[1:]
+		state.activeFid = uint32(uvarint())
+		state.writeAt = varint()
+		count := uvarint()
+		for i := uint64(0); ok && i < count; i++ {
+			state.archived = append(state.archived, uint32(uvarint()))
+		}
+		state.staleBytes = varint()
+		count = uvarint()
+		for i := uint64(0); ok && i < count; i++ {
+			keySize := uvarint()
+			if !ok || uint64(len(buf)) < keySize {
+				return nil, errCorrupted
+			}
+			key := string(buf[:keySize])
+			buf = buf[keySize:]
+			state.expires[key] = varint()
+		}
+		if !ok {
+			return nil, errCorrupted
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (db *TinyDB) indexFileState(dataType data.DataType) *indexFileState {
+	state := &indexFileState{staleBytes: db.staleBytes[dataType]}
+	if activeFile := db.activeFiles[dataType]; activeFile != nil {
+		state.active = true
+		state.activeFid = activeFile.Fid
+		state.writeAt = activeFile.WriteAt
+	}
+	for fid := range db.archivedFiles[dataType] {
+		state.archived = append(state.archived, fid)
+	}
+	sort.Slice(state.archived, func(i, j int) bool {
+		return state.archived[i] < state.archived[j]
+	})
+	return state
+}
+
+// reuseDiskIndex 复用上次正常关闭时保存的磁盘索引，String、List和Hash的数据文件与保存时一致才可复用，
+// 复用时恢复过期时间和失效数据统计，buildIndexes不再重放这些类型；不一致时清空索引，由buildIndexes重建
+func (db *TinyDB) reuseDiskIndex() (bool, error) {
+	if db.diskIndex == nil || db.diskIndex.State() == nil {
+		return false, nil
+	}
+	states, err := decodeIndexState(db.diskIndex.State())
+	if err == nil {
+		err = db.checkIndexState(states)
+	}
+	if err != nil {
+		logger.Log.Infof("disk index is stale, rebuild it: %v", err)
+		return false, db.diskIndex.Reset()
+	}
+	for i, dataType := range diskIndexTypes {
+		db.staleBytes[dataType] = states[i].staleBytes
+		for key, expireAt := range states[i].expires {
+			db.setExpire(dataType, key, expireAt)
+		}
+	}
+	return true, nil
+}
+
+// checkIndexState 比较数据文件列表，活跃文件按entry读取到末尾，确认保存索引后没有追加数据
+func (db *TinyDB) checkIndexState(states []*indexFileState) error {
+	for i, dataType := range diskIndexTypes {
+		want, got := states[i], db.indexFileState(dataType)
+		if want.active != got.active || want.activeFid != got.activeFid || len(want.archived) != len(got.archived) {
+			return errors.Errorf("%v files changed", data.Type2FileSufMap[dataType])
+		}
+		for j := range want.archived {
+			if want.archived[j] != got.archived[j] {
+				return errors.Errorf("%v files changed", data.Type2FileSufMap[dataType])
+			}
+		}
+		if !want.active {
+			continue
+		}
+		activeFile := db.activeFiles[dataType]
+		offset := activeFile.DataStart()
+		for {
+			entry, err := activeFile.ReadEntry(offset)
+			if errors.Is(err, io.EOF) || errors.Is(err, constants.ErrReadNullEntry) {
+				break
+			} else if err != nil {
+				return err
+			}
+			offset += entry.Size()
+		}
+		if offset != want.writeAt {
+			return errors.Errorf("%v size changed from %v to %v", activeFile.FileName, want.writeAt, offset)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LoadKeys 从密钥文件和环境变量加载AES密钥并注册，返回写入时使用的密钥id，都为空时不加密
+// 每个密钥的格式为id:十六进制密钥，id为1~255，密钥之间以换行、空格或逗号分隔
+// 最后一个密钥用于写入，之前的密钥只用于读取轮换前写入的数据，环境变量中的密钥在文件之后
+func LoadKeys(keyFile, keyEnv string) (active data.KeyID, err error) {
+	var content []string
+	if keyFile != "" {
+		buf, err := os.ReadFile(keyFile)
+		if err != nil {
+			return data.NoEncryption, errors.Wrap(err, fmt.Sprintf("key file: %v", keyFile))
+		}
+		content = append(content, string(buf))
+	}
+	if keyEnv != "" {
+		value, ok := os.LookupEnv(keyEnv)
+		if !ok {
+			return data.NoEncryption, errors.Wrap(constants.ErrInvalidKey, fmt.Sprintf("env %v not set", keyEnv))
+		}
+		content = append(content, value)
+	}
+	for _, c := range content {
+		fields := strings.FieldsFunc(c, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+		})
+		for _, field := range fields {
+			if active, err = registerKey(field); err != nil {
+				return data.NoEncryption, err
+			}
+		}
+	}
+	if (keyFile != "" || keyEnv != "") && active == data.NoEncryption {
+		return data.NoEncryption, errors.Wrap(constants.ErrInvalidKey, "no key found")
+	}
+	return active, nil
+}
+
+func registerKey(field string) (data.KeyID, error) {
+	idStr, keyStr, ok := strings.Cut(field, ":")
+	if !ok {
+		return data.NoEncryption, errors.Wrap(constants.ErrInvalidKey, "key should be id:hex")
+	}
+	id, err := strconv.ParseUint(idStr, 10, 8)
+	if err != nil {
+		return data.NoEncryption, errors.Wrap(constants.ErrInvalidKey, fmt.Sprintf("key id: %v", idStr))
+	}
+	key, err := hex.DecodeString(keyStr)
+	if err != nil {
+		return data.NoEncryption, errors.Wrap(constants.ErrInvalidKey, fmt.Sprintf("key id: %v, %v", id, err))
+	}
+	if err = data.RegisterKey(data.KeyID(id), key); err != nil {
+		return data.NoEncryption, err
+	}
+	return data.KeyID(id), nil
+}
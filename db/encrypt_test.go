@@ -0,0 +1,114 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Encryption(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	key1 := "1:" + strings.Repeat("01", 32)
+	key2 := "2:" + strings.Repeat("02", 32)
+	_ = os.WriteFile(keyFile, []byte(key1+"\n"), 0600)
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	opt.EncryptionKeyFile = keyFile
+	// 大value写入blob文件，轮换密钥后同样需要重写
+	opt.BlobThreshold = 64
+	blobValue := strings.Repeat("secret-blob,", 20)
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 20; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("secret%v", i)))
+	}
+	_ = tinyDB.Set([]byte("blob"), []byte(blobValue))
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("field"), []byte("secret"), []byte("b"), []byte("2"))
+	_, _ = tinyDB.ZAdd([]byte("zset"), "", "", "", "", []byte("1"), []byte("member"))
+	check := func(tinyDB *TinyDB) {
+		for i := 0; i < 20; i++ {
+			if res, _ := tinyDB.Get([]byte(fmt.Sprintf("key%v", i))); string(res) != fmt.Sprintf("secret%v", i) {
+				t.Errorf("Get key%v = %v", i, string(res))
+			}
+		}
+		if res, _ := tinyDB.Get([]byte("blob")); string(res) != blobValue {
+			t.Errorf("Get blob = %v", string(res))
+		}
+		if res, _ := tinyDB.HGet([]byte("hash"), []byte("field")); res != "secret" {
+			t.Errorf("HGet = %v", res)
+		}
+		if res, _ := tinyDB.ZMScore([]byte("zset"), []byte("member")); res[0] != float64(1) {
+			t.Errorf("ZMScore = %v", res)
+		}
+	}
+	// 数据文件和hint文件中都没有明文
+	checkFiles := func(wantKeyID data.KeyID) {
+		matches, _ := filepath.Glob(filepath.Join(opt.DBPath, "*.*"))
+		for _, name := range matches {
+			buf, _ := os.ReadFile(name)
+			if bytes.Contains(buf, []byte("secret")) || bytes.Contains(buf, []byte("member")) {
+				t.Errorf("%v contains plaintext", filepath.Base(name))
+			}
+		}
+		for dataType, file := range tinyDB.activeFiles {
+			files := []*data.File{file}
+			for _, archivedFile := range tinyDB.archivedFiles[dataType] {
+				files = append(files, archivedFile)
+			}
+			for _, file := range files {
+				for offset := file.DataStart(); ; {
+					entry, err := file.ReadEntry(offset)
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						t.Fatalf("ReadEntry error: %+v", err)
+					}
+					if entry.Header.Type != data.BatchCommit && entry.Header.KeyID != wantKeyID {
+						t.Errorf("%v offset %v key id = %v, want %v", file.FileName, offset, entry.Header.KeyID, wantKeyID)
+					}
+					offset += entry.Size()
+				}
+			}
+		}
+	}
+	check(tinyDB)
+	checkFiles(1)
+	tinyDB.Close()
+
+	// 轮换密钥：追加新密钥后重新打开并merge，之后只需要新密钥
+	// 密钥在进程内全局注册，无法验证删除旧密钥后打开，只检查数据都已用新密钥重写
+	_ = os.WriteFile(keyFile, []byte(key1+"\n"+key2+"\n"), 0600)
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(tinyDB)
+	if err = tinyDB.Merge(); err != nil {
+		t.Fatalf("Merge error: %+v", err)
+	}
+	check(tinyDB)
+	checkFiles(2)
+	tinyDB.Close()
+
+	_ = os.Setenv("TINYDB_TEST_KEYS", key2)
+	opt.EncryptionKeyFile = ""
+	opt.EncryptionKeyEnv = "TINYDB_TEST_KEYS"
+	if tinyDB, err = Open(opt); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(tinyDB)
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
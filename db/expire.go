@@ -0,0 +1,249 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TTLNoExpire = -1 // key存在但没有设置过期时间
+	TTLNotExist = -2 // key不存在
+)
+
+// Expire 设置key的过期时间，expireAt为毫秒时间戳，key不存在时返回0
+// 同名key可能存在于多种类型中，按String、List、Hash、Set、ZSet的顺序同时设置
+func (db *TinyDB) Expire(key []byte, expireAt int64) (res int, err error) {
+	for dataType := data.String; dataType <= data.ZSet; dataType++ {
+		if !db.keyExists(dataType, key) {
+			continue
+		}
+		res = 1
+		// 过期时间已经过去，直接删除
+		if expireAt <= time.Now().UnixMilli() {
+			err = db.deleteKey(dataType, key)
+		} else {
+			err = db.writeExpire(dataType, key, expireAt)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return
+}
+
+// Persist 取消key的过期时间，key不存在或没有设置过期时间时返回0
+func (db *TinyDB) Persist(key []byte) (res int, err error) {
+	for dataType := data.String; dataType <= data.ZSet; dataType++ {
+		if !db.keyExists(dataType, key) {
+			continue
+		}
+		if _, err := db.expireKeydirs[dataType].Get(string(key)); err != nil {
+			continue
+		}
+		if err = db.writeExpire(dataType, key, 0); err != nil {
+			return 0, err
+		}
+		res = 1
+	}
+	return
+}
+
+// TTL 返回key剩余的过期时间，单位毫秒，key不存在时返回TTLNotExist，没有设置过期时间时返回TTLNoExpire
+// 同名key存在于多种类型中时，按String、List、Hash、Set、ZSet的顺序返回第一个设置了过期时间的类型
+func (db *TinyDB) TTL(key []byte) (res int64, err error) {
+	res = TTLNotExist
+	for dataType := data.String; dataType <= data.ZSet; dataType++ {
+		if !db.keyExists(dataType, key) {
+			continue
+		}
+		expireAt, err := db.expireKeydirs[dataType].Get(string(key))
+		if err != nil {
+			res = TTLNoExpire
+			continue
+		}
+		return expireAt - time.Now().UnixMilli(), nil
+	}
+	return
+}
+
+// writeExpire 持久化key的过期时间，expireAt为0表示取消过期
+func (db *TinyDB) writeExpire(dataType data.DataType, key []byte, expireAt int64) (err error) {
+	entry := data.NewEntry(key, []byte{}, data.Expire)
+	entry.Header.ExpiryTime = uint64(expireAt)
+	if _, err = db.WriteEntry(entry, dataType); err != nil {
+		return err
+	}
+	db.setExpire(dataType, string(key), expireAt)
+	return nil
+}
+
+func (db *TinyDB) setExpire(dataType data.DataType, key string, expireAt int64) {
+	if expireAt == 0 {
+		db.expireKeydirs[dataType].Del(key)
+	} else {
+		db.expireKeydirs[dataType].Set(key, expireAt)
+	}
+}
+
+// expireIfNeeded key已过期时删除key，所有读写key的操作都需要先调用，保证过期key对外不可见
+func (db *TinyDB) expireIfNeeded(dataType data.DataType, key []byte) bool {
+	if !db.expireKeydirs[dataType].IsExpired(string(key), time.Now().UnixMilli()) {
+		return false
+	}
+	// 只读模式只从索引中删除
+	if db.opt.ReadOnly {
+		db.removeKey(dataType, string(key))
+		return true
+	}
+	if err := db.deleteKey(dataType, key); err != nil {
+		logger.Log.Errorf("delete expired key err: %+v", err)
+	}
+	return true
+}
+
+// deleteExpiredKeys 删除所有已过期的key，Open时调用，避免重启后过期key重新出现
+func (db *TinyDB) deleteExpiredKeys() (err error) {
+	now := time.Now().UnixMilli()
+	for dataType, expireKeydir := range db.expireKeydirs {
+		for _, key := range expireKeydir.GetExpiredKeys(now) {
+			if db.opt.ReadOnly {
+				db.removeKey(dataType, key)
+				continue
+			}
+			if err = db.deleteKey(dataType, []byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expireLoop 定期抽样删除过期key，避免长期不访问的过期key占用内存
+func (db *TinyDB) expireLoop() {
+	defer db.wg.Done()
+	ticker := time.NewTicker(db.opt.ExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			// 不在事务执行过程中删除key
+			db.txMu.RLock()
+			db.activeExpireCycle()
+			db.txMu.RUnlock()
+		}
+	}
+}
+
+// activeExpireCycle 对每种类型抽样检查ExpireSampleSize个key并删除已过期的key，
+// 过期比例超过1/4时继续抽样，直到超出ExpireTimeBudget
+func (db *TinyDB) activeExpireCycle() {
+	start := time.Now()
+	for dataType, expireKeydir := range db.expireKeydirs {
+		for {
+			keys := expireKeydir.Sample(db.opt.ExpireSampleSize)
+			if len(keys) == 0 {
+				break
+			}
+			now := time.Now().UnixMilli()
+			expired := 0
+			for _, key := range keys {
+				// 抽样后key可能被重新设置，删除前再检查一次
+				if !expireKeydir.IsExpired(key, now) {
+					continue
+				}
+				if err := db.deleteKey(dataType, []byte(key)); err != nil {
+					logger.Log.Errorf("delete expired key err: %+v", err)
+					return
+				}
+				expired++
+			}
+			if expired*4 <= len(keys) || time.Since(start) >= db.opt.ExpireTimeBudget {
+				break
+			}
+		}
+		if time.Since(start) >= db.opt.ExpireTimeBudget {
+			return
+		}
+	}
+}
+
+// deleteKey 持久化删除key及其所有元素
+func (db *TinyDB) deleteKey(dataType data.DataType, key []byte) (err error) {
+	optrType := data.DeleteKey
+	if dataType == data.String {
+		optrType = data.Delete
+	}
+	entry := data.NewEntry(key, []byte{}, optrType)
+	if _, err = db.WriteEntry(entry, dataType); err != nil {
+		return err
+	}
+	db.removeKey(dataType, string(key))
+	return nil
+}
+
+// removeKey 从索引中删除key及其过期时间
+func (db *TinyDB) removeKey(dataType data.DataType, key string) {
+	switch dataType {
+	case data.String:
+		db.strKeydir.Del(key)
+	case data.List:
+		db.listKeydir.DelKey(key)
+	case data.Hash:
+		db.hashKeydir.DelKey(key)
+	case data.Set:
+		db.setKeydir.DelKey(key)
+	case data.ZSet:
+		db.zsetKeydir.DelKey(key)
+	}
+	db.expireKeydirs[dataType].Del(key)
+}
+
+// keyExists 判断key在dataType中是否存在，已过期的key视为不存在
+func (db *TinyDB) keyExists(dataType data.DataType, key []byte) bool {
+	if db.expireIfNeeded(dataType, key) {
+		return false
+	}
+	switch dataType {
+	case data.String:
+		_, err := db.strKeydir.Get(string(key))
+		return err == nil
+	case data.List:
+		length, err := db.LLen(key)
+		return err == nil && length > 0
+	case data.Hash:
+		count, err := db.hashKeydir.GetFieldCount(string(key))
+		return err == nil && count > 0
+	case data.Set:
+		count, err := db.setKeydir.GetMemberCount(string(key))
+		return err == nil && count > 0
+	case data.ZSet:
+		return db.zsetKeydir.GetMemberCount(string(key)) > 0
+	}
+	return false
+}
+
+// clearExpireIfEmpty 集合类型的key元素被全部删除后key不再存在，过期时间随之失效
+// 写入和重放时都要调用，保证重启前后状态一致
+func (db *TinyDB) clearExpireIfEmpty(dataType data.DataType, key string) {
+	var count int
+	var err error
+	switch dataType {
+	case data.Hash:
+		count, err = db.hashKeydir.GetFieldCount(key)
+	case data.Set:
+		count, err = db.setKeydir.GetMemberCount(key)
+	case data.ZSet:
+		count = int(db.zsetKeydir.GetMemberCount(key))
+	default:
+		return
+	}
+	if errors.Is(err, constants.ErrKeyNotFound) || count == 0 {
+		db.expireKeydirs[dataType].Del(key)
+	}
+}
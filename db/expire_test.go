@@ -0,0 +1,115 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Expire(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+
+	now := time.Now().UnixMilli()
+	_ = tinyDB.SetEX([]byte("str"), []byte("1"), now+50)
+	_ = tinyDB.SetEX([]byte("nx"), []byte("1"), now+50)
+	_ = tinyDB.SetEX([]byte("keep"), []byte("1"), now+time.Hour.Milliseconds())
+	if res, _ := tinyDB.TTL([]byte("keep")); res <= 0 {
+		t.Errorf("TTL error")
+	}
+	if res, _ := tinyDB.TTL([]byte("none")); res != TTLNotExist {
+		t.Errorf("TTL error")
+	}
+
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte("1"))
+	if res, _ := tinyDB.TTL([]byte("hash")); res != TTLNoExpire {
+		t.Errorf("TTL error")
+	}
+	if res, _ := tinyDB.Expire([]byte("hash"), now+time.Hour.Milliseconds()); res != 1 {
+		t.Errorf("Expire error")
+	}
+	if res, _ := tinyDB.Persist([]byte("hash")); res != 1 {
+		t.Errorf("Persist error")
+	}
+	if res, _ := tinyDB.TTL([]byte("hash")); res != TTLNoExpire {
+		t.Errorf("Persist error")
+	}
+	_, _ = tinyDB.Expire([]byte("hash"), now+50)
+
+	// 同名key存在于多种类型中时，结果不随map遍历顺序变化
+	_, _ = tinyDB.HSet([]byte("multi"), []byte("a"), []byte("1"))
+	_, _ = tinyDB.Expire([]byte("multi"), now+2*time.Hour.Milliseconds())
+	_ = tinyDB.SetEX([]byte("multi"), []byte("1"), now+time.Hour.Milliseconds())
+	for i := 0; i < 20; i++ {
+		if res, _ := tinyDB.TTL([]byte("multi")); res <= 0 || res > time.Hour.Milliseconds() {
+			t.Fatalf("TTL multi = %v", res)
+		}
+	}
+
+	_, _ = tinyDB.SAdd([]byte("set"), []byte("a"))
+	if res, _ := tinyDB.Expire([]byte("set"), now-1); res != 1 {
+		t.Errorf("Expire error")
+	}
+	if res, _ := tinyDB.SCard([]byte("set")); res != 0 {
+		t.Errorf("Expire error")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	// 已过期但还没有被删除的key不影响SETNX
+	if res := tinyDB.SetNX([]byte("nx"), []byte("2")); res != 1 {
+		t.Errorf("SetNX on expired key = %v", res)
+	}
+	if _, err := tinyDB.Get([]byte("str")); err == nil {
+		t.Errorf("SetEX error")
+	}
+
+	// 重启后过期时间仍然有效
+	tinyDB.Close()
+	tinyDB = openDB(0)
+	if res, _ := tinyDB.HLen([]byte("hash")); res != 0 {
+		t.Errorf("Expire error")
+	}
+	if res, _ := tinyDB.TTL([]byte("keep")); res <= 0 {
+		t.Errorf("TTL error")
+	}
+	if res, _ := tinyDB.GetEX([]byte("keep"), 0, true); string(res) != "1" {
+		t.Errorf("GetEX error")
+	}
+	if res, _ := tinyDB.TTL([]byte("keep")); res != TTLNoExpire {
+		t.Errorf("GetEX error")
+	}
+
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+func Test_ActiveExpire(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "1")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	opt.ExpireInterval = 10 * time.Millisecond
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tinyDB.Close()
+
+	expireAt := time.Now().Add(20 * time.Millisecond).UnixMilli()
+	for i := 0; i < 100; i++ {
+		_ = tinyDB.SetEX([]byte(fmt.Sprintf("key%v", i)), []byte("1"), expireAt)
+	}
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte("1"))
+	_, _ = tinyDB.Expire([]byte("hash"), expireAt)
+
+	time.Sleep(200 * time.Millisecond)
+	// 未访问的过期key也应从索引中删除
+	if n := tinyDB.expireKeydirs[data.String].Len(); n != 0 {
+		t.Errorf("active expire error, %v keys left", n)
+	}
+	if _, err := tinyDB.hashKeydir.GetFieldCount("hash"); err == nil {
+		t.Errorf("active expire error")
+	}
+}
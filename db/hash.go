@@ -4,27 +4,29 @@ import (
 	"SouthWind6510/TinyDB/data"
 	"SouthWind6510/TinyDB/pkg/constants"
 	"strconv"
+
+	"github.com/pkg/errors"
 )
 
 func (db *TinyDB) HSet(key []byte, args ...[]byte) (res int, err error) {
+	db.expireIfNeeded(data.Hash, key)
+	batch := db.NewWriteBatch()
 	for i := 0; i+1 < len(args); i += 2 {
-		entry := data.NewEntry(encodeSubKey(key, args[i]), args[i+1], data.Insert)
-		pos, err := db.WriteEntry(entry, data.Hash)
-		if err != nil {
-			continue
-		}
-		db.hashKeydir.Set(string(key), string(args[i]), pos)
-		res++
+		batch.Put(data.Hash, data.NewEntry(encodeSubKey(key, args[i]), args[i+1], data.Insert))
 	}
-	return
+	positions, err := batch.Commit()
+	if err != nil {
+		return 0, err
+	}
+	for i, pos := range positions {
+		db.hashKeydir.Set(string(key), string(args[2*i]), pos)
+	}
+	return len(positions), nil
 }
 
 func (db *TinyDB) HGet(key []byte, field []byte) (res interface{}, err error) {
-	pos, err := db.hashKeydir.Get(string(key), string(field))
-	if err != nil {
-		return nil, err
-	}
-	entry, err := db.ReadEntry(data.Hash, pos)
+	db.expireIfNeeded(data.Hash, key)
+	entry, err := db.readHash(string(key), string(field))
 	if err != nil {
 		return nil, err
 	}
@@ -32,17 +34,14 @@ func (db *TinyDB) HGet(key []byte, field []byte) (res interface{}, err error) {
 }
 
 func (db *TinyDB) HGetAll(key []byte) (res map[string]string, err error) {
+	db.expireIfNeeded(data.Hash, key)
 	res = make(map[string]string)
 	fields, err := db.hashKeydir.GetFields(string(key))
 	if err != nil {
 		return nil, err
 	}
 	for _, field := range fields {
-		pos, err := db.hashKeydir.Get(string(key), field)
-		if err != nil {
-			continue
-		}
-		entry, err := db.ReadEntry(data.Hash, pos)
+		entry, err := db.readHash(string(key), field)
 		if err != nil {
 			continue
 		}
@@ -52,19 +51,39 @@ func (db *TinyDB) HGetAll(key []byte) (res map[string]string, err error) {
 }
 
 func (db *TinyDB) HDel(key []byte, args ...[]byte) (res int, err error) {
+	db.expireIfNeeded(data.Hash, key)
+	// 只为存在的field写删除标记，返回实际删除的数量
+	var fields []string
+	deleted := make(map[string]struct{})
+	batch := db.NewWriteBatch()
 	for _, field := range args {
-		entry := data.NewEntry(encodeSubKey(key, field), []byte{}, data.Delete)
-		_, err := db.WriteEntry(entry, data.Hash)
-		if err != nil {
+		if _, ok := deleted[string(field)]; ok {
+			continue
+		}
+		if _, err = db.hashKeydir.Get(string(key), string(field)); errors.Is(err, constants.ErrKeyNotFound) {
 			continue
+		} else if err != nil {
+			return 0, err
 		}
-		db.hashKeydir.Del(string(key), string(field))
-		res++
+		deleted[string(field)] = struct{}{}
+		fields = append(fields, string(field))
+		batch.Put(data.Hash, data.NewEntry(encodeSubKey(key, field), []byte{}, data.Delete))
 	}
-	return
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	if _, err = batch.Commit(); err != nil {
+		return 0, err
+	}
+	for _, field := range fields {
+		db.hashKeydir.Del(string(key), field)
+	}
+	db.clearExpireIfEmpty(data.Hash, string(key))
+	return len(fields), nil
 }
 
 func (db *TinyDB) HExists(key []byte, field []byte) (res int, err error) {
+	db.expireIfNeeded(data.Hash, key)
 	_, err = db.hashKeydir.Get(string(key), string(field))
 	if err == constants.ErrKeyNotFound {
 		return 0, nil
@@ -76,24 +95,23 @@ func (db *TinyDB) HExists(key []byte, field []byte) (res int, err error) {
 }
 
 func (db *TinyDB) HLen(key []byte) (res int, err error) {
+	db.expireIfNeeded(data.Hash, key)
 	return db.hashKeydir.GetFieldCount(string(key))
 }
 
 func (db *TinyDB) HKeys(key []byte) (res []string, err error) {
+	db.expireIfNeeded(data.Hash, key)
 	return db.hashKeydir.GetFields(string(key))
 }
 
 func (db *TinyDB) HVals(key []byte) (res []string, err error) {
+	db.expireIfNeeded(data.Hash, key)
 	fields, err := db.hashKeydir.GetFields(string(key))
 	if err != nil {
 		return nil, err
 	}
 	for _, field := range fields {
-		pos, err := db.hashKeydir.Get(string(key), field)
-		if err != nil {
-			continue
-		}
-		entry, err := db.ReadEntry(data.Hash, pos)
+		entry, err := db.readHash(string(key), field)
 		if err != nil {
 			continue
 		}
@@ -103,11 +121,8 @@ func (db *TinyDB) HVals(key []byte) (res []string, err error) {
 }
 
 func (db *TinyDB) HIncrBy(key []byte, field []byte, incr int) (res int, err error) {
-	pos, err := db.hashKeydir.Get(string(key), string(field))
-	if err != nil {
-		return 0, err
-	}
-	entry, err := db.ReadEntry(data.Hash, pos)
+	db.expireIfNeeded(data.Hash, key)
+	entry, err := db.readHash(string(key), string(field))
 	if err != nil {
 		return 0, err
 	}
@@ -117,7 +132,7 @@ func (db *TinyDB) HIncrBy(key []byte, field []byte, incr int) (res int, err erro
 	}
 	res = cur + incr
 	entry = data.NewEntry(encodeSubKey(key, field), []byte(strconv.Itoa(res)), data.Insert)
-	pos, err = db.WriteEntry(entry, data.Hash)
+	pos, err := db.WriteEntry(entry, data.Hash)
 	if err != nil {
 		return 0, err
 	}
@@ -126,12 +141,9 @@ func (db *TinyDB) HIncrBy(key []byte, field []byte, incr int) (res int, err erro
 }
 
 func (db *TinyDB) HMGet(key []byte, fields ...[]byte) (res []string, err error) {
+	db.expireIfNeeded(data.Hash, key)
 	for _, field := range fields {
-		pos, err := db.hashKeydir.Get(string(key), string(field))
-		if err != nil {
-			continue
-		}
-		entry, err := db.ReadEntry(data.Hash, pos)
+		entry, err := db.readHash(string(key), string(field))
 		if err != nil {
 			continue
 		}
@@ -141,14 +153,7 @@ func (db *TinyDB) HMGet(key []byte, fields ...[]byte) (res []string, err error)
 }
 
 func (db *TinyDB) HMSet(key []byte, args ...[]byte) (err error) {
-	for i := 0; i+1 < len(args); i += 2 {
-		entry := data.NewEntry(encodeSubKey(key, args[i]), args[i+1], data.Insert)
-		pos, err := db.WriteEntry(entry, data.Hash)
-		if err != nil {
-			continue
-		}
-		db.hashKeydir.Set(string(key), string(args[i]), pos)
-	}
+	_, err = db.HSet(key, args...)
 	return
 }
 
@@ -53,7 +53,11 @@ func Test_Hash(t *testing.T) {
 		t.Errorf("HVals error")
 	}
 
-	if res, _ := tinyDB.HDel([]byte("hash"), []byte("a"), []byte("b"), []byte("c"), []byte("d")); res != 4 {
+	// 不存在和重复的field不计入删除数量
+	if res, _ := tinyDB.HDel([]byte("hash"), []byte("a"), []byte("a"), []byte("x")); res != 1 {
+		t.Errorf("HDel error")
+	}
+	if res, _ := tinyDB.HDel([]byte("hash"), []byte("a"), []byte("b"), []byte("c"), []byte("d")); res != 3 {
 		t.Errorf("HDel error")
 	}
 	if res, _ := tinyDB.HLen([]byte("hash")); res != 0 {
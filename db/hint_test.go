@@ -0,0 +1,45 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_Hint(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+
+	for i := 0; i < 100; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+	}
+	_ = tinyDB.GetDel([]byte("key1"))
+	_, _ = tinyDB.ZAdd([]byte("zset"), "", "", "", "", []byte("1.5"), []byte("a"))
+	tinyDB.Close()
+
+	// 归档文件都应该生成了hint文件
+	if _, err := os.Stat(data.HintFileName(tinyDB.opt.DBPath, 0, data.String)); err != nil {
+		t.Errorf("hint file not found: %v", err)
+	}
+
+	tinyDB = openDB(0)
+	for i := 0; i < 100; i++ {
+		res, err := tinyDB.Get([]byte(fmt.Sprintf("key%v", i)))
+		if i == 1 {
+			if err != constants.ErrKeyNotFound {
+				t.Errorf("Get deleted key error")
+			}
+			continue
+		}
+		if string(res) != fmt.Sprintf("value%v", i) {
+			t.Errorf("Get key%v = %v", i, string(res))
+		}
+	}
+	if res, _ := tinyDB.ZMScore([]byte("zset"), []byte("a")); res[0] != 1.5 {
+		t.Errorf("ZMScore error")
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
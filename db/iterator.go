@@ -0,0 +1,167 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"bytes"
+)
+
+// IteratorOptions 遍历的数据类型、key前缀和方向
+type IteratorOptions struct {
+	DataType data.DataType
+	Prefix   []byte // 只遍历有该前缀的key，为空时遍历所有key
+	Reverse  bool   // 按key降序遍历
+}
+
+// Iterator 按key顺序遍历某个数据类型中存在的key，需要开启Options.OrderedIndex或使用支持有序遍历的索引
+// 不持有快照，每次移动都从当前key重新查找下一个key，遍历期间可以并发写入，
+// 遍历开始前存在且期间没有被删除的key一定会被访问到，期间写入的key可能访问不到
+type Iterator struct {
+	db    *TinyDB
+	opt   IteratorOptions
+	key   string
+	valid bool
+}
+
+// NewIterator 创建迭代器并定位到第一个key
+func (db *TinyDB) NewIterator(opt IteratorOptions) (*Iterator, error) {
+	// 索引不支持有序遍历时返回ErrUnorderedIndex
+	if err := db.seekKeys(opt.DataType, nil, false, func(string) bool { return false }); err != nil {
+		return nil, err
+	}
+	it := &Iterator{db: db, opt: opt}
+	it.Rewind()
+	return it, nil
+}
+
+// Rewind 定位到第一个key，Reverse时为最后一个key
+func (it *Iterator) Rewind() {
+	if len(it.opt.Prefix) == 0 {
+		it.seek(nil, true)
+		return
+	}
+	if !it.opt.Reverse {
+		start := string(it.opt.Prefix)
+		it.seek(&start, true)
+		return
+	}
+	// 降序时从前缀的后继开始，后继本身没有该前缀，会被跳过
+	if end := prefixSuccessor(it.opt.Prefix); end != nil {
+		start := string(end)
+		it.seek(&start, true)
+	} else {
+		it.seek(nil, true)
+	}
+}
+
+// Seek 定位到第一个不小于key的key，Reverse时为第一个不大于key的key
+func (it *Iterator) Seek(key []byte) {
+	// 从前缀范围之外开始时直接从范围边界开始
+	if len(it.opt.Prefix) > 0 {
+		if !it.opt.Reverse && bytes.Compare(key, it.opt.Prefix) < 0 {
+			key = it.opt.Prefix
+		} else if end := prefixSuccessor(it.opt.Prefix); it.opt.Reverse && end != nil && bytes.Compare(key, end) > 0 {
+			key = end
+		}
+	}
+	start := string(key)
+	it.seek(&start, true)
+}
+
+// Next 移动到下一个key
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	start := it.key
+	it.seek(&start, false)
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() []byte {
+	return []byte(it.key)
+}
+
+// Value 读取当前key的值，移动时只查找key，调用时才读取，返回值与对应的读取命令一致：
+// String为[]byte，List为所有元素[]string，Hash为map[string]string，Set为[]string，
+// ZSet为按score升序的member、score交替排列的[]interface{}；key在定位后被删除时返回ErrKeyNotFound
+func (it *Iterator) Value() (interface{}, error) {
+	key := []byte(it.key)
+	if !it.valid || !it.db.keyExists(it.opt.DataType, key) {
+		return nil, constants.ErrKeyNotFound
+	}
+	switch it.opt.DataType {
+	case data.String:
+		return it.db.Get(key)
+	case data.List:
+		return it.db.LRange(key, 0, -1)
+	case data.Hash:
+		return it.db.HGetAll(key)
+	case data.Set:
+		return it.db.SMembers(key)
+	case data.ZSet:
+		return it.db.ZRange(key, 0, -1, false, false, 1)
+	}
+	return nil, constants.ErrUnsupportedCommand
+}
+
+// seek 从start开始查找第一个存在的key，inclusive为false时跳过start本身
+func (it *Iterator) seek(start *string, inclusive bool) {
+	for {
+		var next string
+		found := false
+		err := it.db.seekKeys(it.opt.DataType, start, it.opt.Reverse, func(key string) bool {
+			if start != nil && !inclusive && key == *start {
+				return true
+			}
+			if !bytes.HasPrefix([]byte(key), it.opt.Prefix) {
+				// 降序时跳过前缀的后继，之后的key都小于前缀
+				return it.opt.Reverse && key > string(it.opt.Prefix)
+			}
+			next, found = key, true
+			return false
+		})
+		if err != nil || !found {
+			it.key, it.valid = "", false
+			return
+		}
+		// 查找时持有keydir的锁，在锁外检查是否过期
+		if it.db.keyExists(it.opt.DataType, []byte(next)) {
+			it.key, it.valid = next, true
+			return
+		}
+		start, inclusive = &next, false
+	}
+}
+
+// seekKeys 按key顺序遍历dataType的keydir
+func (db *TinyDB) seekKeys(dataType data.DataType, start *string, reverse bool, fn func(key string) bool) error {
+	switch dataType {
+	case data.String:
+		return db.strKeydir.Seek(start, reverse, fn)
+	case data.List:
+		return db.listKeydir.Seek(start, reverse, fn)
+	case data.Hash:
+		return db.hashKeydir.Seek(start, reverse, fn)
+	case data.Set:
+		return db.setKeydir.Seek(start, reverse, fn)
+	case data.ZSet:
+		return db.zsetKeydir.Seek(start, reverse, fn)
+	}
+	return constants.ErrUnsupportedCommand
+}
+
+// prefixSuccessor 大于所有以prefix开头的key的最小key，prefix全为0xff时返回nil
+func prefixSuccessor(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Iterator(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 12
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = tinyDB.NewIterator(IteratorOptions{DataType: data.String}); !errors.Is(err, constants.ErrUnorderedIndex) {
+		t.Errorf("NewIterator without OrderedIndex err = %v", err)
+	}
+	tinyDB.Close()
+
+	opt.OrderedIndex = true
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 100; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i)))
+	}
+	_ = tinyDB.Set([]byte("other"), []byte("x"))
+	_ = tinyDB.SetEX([]byte("key100"), []byte("x"), time.Now().UnixMilli()-1)
+	_, _ = tinyDB.HSet([]byte("hash1"), []byte("a"), []byte("1"))
+	_, _ = tinyDB.HSet([]byte("hash2"), []byte("a"), []byte("1"))
+	_, _ = tinyDB.HDel([]byte("hash2"), []byte("a"))
+
+	collect := func(opt IteratorOptions) (keys []string) {
+		it, err := tinyDB.NewIterator(opt)
+		if err != nil {
+			t.Fatalf("NewIterator error: %+v", err)
+		}
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return
+	}
+	keys := collect(IteratorOptions{DataType: data.String, Prefix: []byte("key")})
+	if len(keys) != 100 || keys[0] != "key000" || keys[99] != "key099" {
+		t.Errorf("prefix keys = %v", keys)
+	}
+	keys = collect(IteratorOptions{DataType: data.String, Prefix: []byte("key"), Reverse: true})
+	if len(keys) != 100 || keys[0] != "key099" || keys[99] != "key000" {
+		t.Errorf("reverse prefix keys = %v", keys)
+	}
+	if keys = collect(IteratorOptions{DataType: data.String}); len(keys) != 101 || keys[100] != "other" {
+		t.Errorf("all keys = %v", keys)
+	}
+	if keys = collect(IteratorOptions{DataType: data.Hash}); !reflect.DeepEqual(keys, []string{"hash1"}) {
+		t.Errorf("hash keys = %v", keys)
+	}
+
+	// 各类型的value在调用Value时读取
+	_, _ = tinyDB.LPush([]byte("list"), false, []byte("a"), []byte("b"))
+	_, _ = tinyDB.SAdd([]byte("set"), []byte("a"))
+	_, _ = tinyDB.ZAdd([]byte("zset"), "", "", "", "", []byte("1"), []byte("a"))
+	for dataType, want := range map[data.DataType]interface{}{
+		data.List: []string{"a", "b"},
+		data.Hash: map[string]string{"a": "1"},
+		data.Set:  []string{"a"},
+		data.ZSet: []interface{}{"a", 1.0},
+	} {
+		it, err := tinyDB.NewIterator(IteratorOptions{DataType: dataType})
+		if err != nil {
+			t.Fatalf("NewIterator error: %+v", err)
+		}
+		if value, err := it.Value(); !reflect.DeepEqual(value, want) || err != nil {
+			t.Errorf("Value of type %v = %v, %v", dataType, value, err)
+		}
+	}
+
+	it, _ := tinyDB.NewIterator(IteratorOptions{DataType: data.String, Prefix: []byte("key")})
+	it.Seek([]byte("key050"))
+	if value, err := it.Value(); !it.Valid() || string(it.Key()) != "key050" || !reflect.DeepEqual(value, []byte("50")) || err != nil {
+		t.Errorf("Seek = %v, %v, %v", string(it.Key()), value, err)
+	}
+	// 遍历期间删除和写入key
+	_ = tinyDB.GetDel([]byte("key051"))
+	_ = tinyDB.Set([]byte("key0505"), []byte("x"))
+	it.Next()
+	if string(it.Key()) != "key0505" {
+		t.Errorf("Next after write = %v", string(it.Key()))
+	}
+	it.Next()
+	if string(it.Key()) != "key052" {
+		t.Errorf("Next after delete = %v", string(it.Key()))
+	}
+	it, _ = tinyDB.NewIterator(IteratorOptions{DataType: data.String, Prefix: []byte("key"), Reverse: true})
+	it.Seek([]byte("z"))
+	if string(it.Key()) != "key099" {
+		t.Errorf("reverse Seek = %v", string(it.Key()))
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
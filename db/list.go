@@ -2,6 +2,7 @@ package db
 
 import (
 	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
 	"SouthWind6510/TinyDB/pkg/constants"
 	"SouthWind6510/TinyDB/util"
 	"encoding/binary"
@@ -21,7 +22,7 @@ type ListMeta struct {
 }
 
 func (db *TinyDB) getListMeta(key []byte) (head, tail uint32, err error) {
-	pos, err := db.listKeydir.Get(string(key), MetaIndex)
+	entry, err := db.readList(string(key), MetaIndex)
 	if errors.Is(err, constants.ErrKeyNotFound) {
 		head = ListLenLimit / 2
 		tail = ListLenLimit/2 - 1
@@ -29,36 +30,42 @@ func (db *TinyDB) getListMeta(key []byte) (head, tail uint32, err error) {
 	} else if err != nil {
 		return 0, 0, err
 	}
-	entry, err := db.ReadEntry(data.List, pos)
-	if err != nil {
-		return 0, 0, err
-	}
-	head = binary.LittleEndian.Uint32(entry.Value[:4])
-	tail = binary.LittleEndian.Uint32(entry.Value[4:])
+	head, tail = decodeListMeta(entry.Value)
 	return
 }
 
-// 更新ListMeta
-func (db *TinyDB) saveListMeta(key []byte, head, tail uint32) {
-	// TODO 失败怎么办
+func decodeListMeta(buf []byte) (head, tail uint32) {
+	if len(buf) < 8 {
+		return 0, 0
+	}
+	return binary.LittleEndian.Uint32(buf[:4]), binary.LittleEndian.Uint32(buf[4:8])
+}
+
+func newListMetaEntry(key []byte, head, tail uint32) *data.Entry {
 	buf := make([]byte, 8)
 	binary.LittleEndian.PutUint32(buf[:4], head)
 	binary.LittleEndian.PutUint32(buf[4:], tail)
-	entry := data.NewEntry(key, buf, data.InsertListMeta)
-	pos, err := db.WriteEntry(entry, data.List)
-	if err != nil {
-		return
-	}
+	return data.NewEntry(key, buf, data.InsertListMeta)
+}
+
+// setListMeta 更新ListMeta索引，list为空时过期时间失效
+func (db *TinyDB) setListMeta(key []byte, head, tail uint32, pos *keydir.EntryPos) {
 	db.listKeydir.Set(string(key), MetaIndex, pos)
+	if head > tail {
+		db.expireKeydirs[data.List].Del(string(key))
+	}
 }
 
 func (db *TinyDB) LPush(key []byte, isLeft bool, values ...[]byte) (len int, err error) {
+	db.expireIfNeeded(data.List, key)
 	head, tail, err := db.getListMeta(key)
 	if err != nil {
 		return 0, err
 	}
 
-	// 写入list节点
+	// list节点和ListMeta在同一批次中写入
+	batch := db.NewWriteBatch()
+	var indexes []int
 	for _, value := range values {
 		var index int
 		index = int(tail) + 1
@@ -69,30 +76,36 @@ func (db *TinyDB) LPush(key []byte, isLeft bool, values ...[]byte) (len int, err
 			err = constants.ErrListLengthLimitExceeded
 			break
 		}
-		entry := data.NewEntry(encodeListKey(key, index), value, data.Insert)
-		pos, err := db.WriteEntry(entry, data.List)
-		if err != nil {
-			continue
-		}
-		db.listKeydir.Set(string(key), index, pos)
+		batch.Put(data.List, data.NewEntry(encodeListKey(key, index), value, data.Insert))
+		indexes = append(indexes, index)
 		if isLeft {
 			head--
 		} else {
 			tail++
 		}
 	}
-
-	db.saveListMeta(key, head, tail)
+	batch.Put(data.List, newListMetaEntry(key, head, tail))
+	positions, commitErr := batch.Commit()
+	if commitErr != nil {
+		return 0, commitErr
+	}
+	for i, index := range indexes {
+		db.listKeydir.Set(string(key), index, positions[i])
+	}
+	db.setListMeta(key, head, tail, positions[batch.Len()-1])
 	return int(tail - head + 1), err
 }
 
 func (db *TinyDB) LPop(key []byte, count int, isLeft bool) (res []string, err error) {
+	db.expireIfNeeded(data.List, key)
 	res = make([]string, 0)
 	head, tail, err := db.getListMeta(key)
 	if err != nil {
 		return res, err
 	}
 
+	batch := db.NewWriteBatch()
+	var indexes []int
 	for i := 0; i < count; i++ {
 		if tail < head {
 			break
@@ -106,30 +119,30 @@ func (db *TinyDB) LPop(key []byte, count int, isLeft bool) (res []string, err er
 			index = int(tail)
 			tail--
 		}
-		pos, err := db.listKeydir.Get(string(key), index)
-		if err != nil {
-			continue
-		}
-		entry, err := db.ReadEntry(data.List, pos)
+		entry, err := db.readList(string(key), index)
 		if err != nil {
 			continue
 		}
 		res = append(res, string(entry.Value))
 
 		// 删除节点
-		entry = data.NewEntry(encodeListKey(key, index), []byte{}, data.Delete)
-		pos, err = db.WriteEntry(entry, data.List)
-		if err != nil {
-			continue
-		}
-		db.listKeydir.Set(string(key), index, pos)
+		batch.Put(data.List, data.NewEntry(encodeListKey(key, index), []byte{}, data.Delete))
+		indexes = append(indexes, index)
 	}
-
-	db.saveListMeta(key, head, tail)
+	batch.Put(data.List, newListMetaEntry(key, head, tail))
+	positions, err := batch.Commit()
+	if err != nil {
+		return make([]string, 0), err
+	}
+	for _, index := range indexes {
+		db.listKeydir.Del(string(key), index)
+	}
+	db.setListMeta(key, head, tail, positions[batch.Len()-1])
 	return
 }
 
 func (db *TinyDB) LIndex(key []byte, offset int) (res interface{}, err error) {
+	db.expireIfNeeded(data.List, key)
 	head, tail, err := db.getListMeta(key)
 	if err != nil {
 		return nil, err
@@ -142,11 +155,7 @@ func (db *TinyDB) LIndex(key []byte, offset int) (res interface{}, err error) {
 	if index < int(head) || index > int(tail) {
 		return nil, constants.ErrListIndexOutOfRange
 	}
-	pos, err := db.listKeydir.Get(string(key), index)
-	if err != nil {
-		return nil, err
-	}
-	entry, err := db.ReadEntry(data.List, pos)
+	entry, err := db.readList(string(key), index)
 	if err != nil {
 		return nil, err
 	}
@@ -154,6 +163,7 @@ func (db *TinyDB) LIndex(key []byte, offset int) (res interface{}, err error) {
 }
 
 func (db *TinyDB) LLen(key []byte) (len int, err error) {
+	db.expireIfNeeded(data.List, key)
 	head, tail, err := db.getListMeta(key)
 	if err != nil {
 		return
@@ -162,6 +172,7 @@ func (db *TinyDB) LLen(key []byte) (len int, err error) {
 }
 
 func (db *TinyDB) LRange(key []byte, sOffset, eOffset int) (res []string, err error) {
+	db.expireIfNeeded(data.List, key)
 	res = make([]string, 0)
 	head, tail, err := db.getListMeta(key)
 	if err != nil || head > tail {
@@ -178,11 +189,7 @@ func (db *TinyDB) LRange(key []byte, sOffset, eOffset int) (res []string, err er
 	}
 
 	for index := start; index <= end; index++ {
-		pos, err := db.listKeydir.Get(string(key), index)
-		if err != nil {
-			continue
-		}
-		entry, err := db.ReadEntry(data.List, pos)
+		entry, err := db.readList(string(key), index)
 		if err != nil {
 			continue
 		}
@@ -192,6 +199,7 @@ func (db *TinyDB) LRange(key []byte, sOffset, eOffset int) (res []string, err er
 }
 
 func (db *TinyDB) LSet(key []byte, offset int, value []byte) (err error) {
+	db.expireIfNeeded(data.List, key)
 	head, tail, err := db.getListMeta(key)
 	if err != nil {
 		return
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const lockFileName = "LOCK"
+
+// lock 对DBPath下的LOCK文件加文件锁，读写模式加排他锁，只读模式加共享锁
+// 锁随进程退出自动释放，不会因为崩溃残留
+// 只读模式不创建LOCK文件，目录可以是只读的；LOCK文件不存在说明没有以读写模式打开过，不加锁
+func (db *TinyDB) lock() (err error) {
+	fileName := filepath.Join(db.opt.DBPath, lockFileName)
+	flag := os.O_RDONLY | os.O_CREATE
+	if db.opt.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(fileName, flag, 0666)
+	if db.opt.ReadOnly && os.IsNotExist(err) {
+		logger.Log.Warnf("%v does not exist, open in read-only mode without lock", fileName)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	if err = flock(file, !db.opt.ReadOnly); err != nil {
+		_ = file.Close()
+		if errors.Is(err, constants.ErrDBLocked) {
+			return errors.Wrap(err, fmt.Sprintf("dir: %v", db.opt.DBPath))
+		}
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	db.lockFile = file
+	return nil
+}
+
+func (db *TinyDB) unlock() {
+	if db.lockFile == nil {
+		return
+	}
+	if err := funlock(db.lockFile); err != nil {
+		logger.Log.Errorf("unlock %v err: %v", db.lockFile.Name(), err)
+	}
+	_ = db.lockFile.Close()
+	db.lockFile = nil
+}
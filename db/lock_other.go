@@ -0,0 +1,14 @@
+//go:build !unix
+
+package db
+
+import "os"
+
+// flock 只在类Unix系统上加锁，其他系统忽略，需要调用方保证同一时间只有一个进程以读写模式打开
+func flock(file *os.File, exclusive bool) error {
+	return nil
+}
+
+func funlock(file *os.File) error {
+	return nil
+}
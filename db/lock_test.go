@@ -0,0 +1,70 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Lock(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+	_ = tinyDB.Set([]byte("a"), []byte("1"))
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	if _, err := Open(opt); !errors.Is(err, constants.ErrDBLocked) {
+		t.Errorf("open locked db: %v", err)
+	}
+	opt.ReadOnly = true
+	if _, err := Open(opt); !errors.Is(err, constants.ErrDBLocked) {
+		t.Errorf("open locked db in read-only mode: %v", err)
+	}
+	tinyDB.Close()
+
+	// 只读模式可以同时打开多个
+	readDB1, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readDB2, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := readDB2.Get([]byte("a")); string(res) != "1" {
+		t.Errorf("read-only get = %v", string(res))
+	}
+	if err = readDB1.Set([]byte("b"), []byte("2")); !errors.Is(err, constants.ErrReadOnly) {
+		t.Errorf("read-only set: %v", err)
+	}
+	if _, err = readDB1.HSet([]byte("h"), []byte("a"), []byte("1"), []byte("b"), []byte("2")); !errors.Is(err, constants.ErrReadOnly) {
+		t.Errorf("read-only batch: %v", err)
+	}
+	opt.ReadOnly = false
+	if _, err = Open(opt); !errors.Is(err, constants.ErrDBLocked) {
+		t.Errorf("open db with read-only instances: %v", err)
+	}
+	readDB1.Close()
+	readDB2.Close()
+
+	// 只读模式不创建LOCK文件
+	lockName := filepath.Join(opt.DBPath, lockFileName)
+	_ = os.Remove(lockName)
+	opt.ReadOnly = true
+	readDB1, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(lockName); !os.IsNotExist(err) {
+		t.Errorf("read-only open creates LOCK: %v", err)
+	}
+	readDB1.Close()
+
+	tinyDB = openDB(0)
+	if res, _ := tinyDB.Get([]byte("a")); string(res) != "1" {
+		t.Errorf("get after read-only = %v", string(res))
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package db
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flock 非阻塞地加flock，exclusive为false时加共享锁，已被其他进程锁住时返回ErrDBLocked
+func flock(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return constants.ErrDBLocked
+	}
+	return err
+}
+
+func funlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"SouthWind6510/TinyDB/util"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	manifestFileName    = "MANIFEST"
+	manifestTmpName     = "MANIFEST.tmp"
+	manifestMagic       = "TINYMF" // 文件开头的魔数，之后2字节为版本号，第1版没有魔数
+	manifestVersion     = 2
+	manifestHeaderSize  = 8    // CRC4 + Size4
+	manifestEditSize    = 6    // op1 + DataType1 + Fid4
+	manifestEditSizeV1  = 4    // op1 + DataType1 + Fid2，第1版fid为int16
+	manifestCompactSize = 1000 // 追加的记录数超过该值时重写为快照
+)
+
+type manifestOp uint8
+
+const (
+	manifestActive  manifestOp = iota + 1 // 新建活跃文件，原活跃文件转为存档文件
+	manifestArchive                       // 加入存档文件，用于merge结果
+	manifestDelete                        // 删除存档文件
+)
+
+type manifestEdit struct {
+	op       manifestOp
+	dataType data.DataType
+	fid      uint32
+}
+
+// manifest 记录每种类型的活跃文件和存档文件，Open时以它为准加载数据文件
+// 文件由若干条记录组成，每条记录包含一次变更的所有edit，CRC校验通过的记录才生效，
+// 所以一次文件轮转或一次merge的文件替换要么全部生效要么全部不生效
+type manifest struct {
+	path     string
+	file     *os.File // 追加写入，只读模式为nil
+	active   map[data.DataType]uint32
+	archived map[data.DataType]map[uint32]struct{}
+	records  int // 文件中的记录数
+	version  int // 读取到的文件版本，重写后为manifestVersion
+}
+
+func newManifest(path string) *manifest {
+	return &manifest{
+		path:     path,
+		active:   make(map[data.DataType]uint32),
+		archived: make(map[data.DataType]map[uint32]struct{}),
+	}
+}
+
+func manifestExists(path string) bool {
+	_, err := os.Stat(filepath.Join(path, manifestFileName))
+	return err == nil
+}
+
+// readManifest 读取path下的MANIFEST，末尾不完整的记录是写入中断导致的，忽略
+func readManifest(path string) (m *manifest, err error) {
+	fileName := filepath.Join(path, manifestFileName)
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	m = newManifest(path)
+	m.version = 1
+	offset, editSize := 0, manifestEditSizeV1
+	if len(buf) >= len(manifestMagic)+2 && string(buf[:len(manifestMagic)]) == manifestMagic {
+		m.version = int(binary.LittleEndian.Uint16(buf[len(manifestMagic):]))
+		offset, editSize = len(manifestMagic)+2, manifestEditSize
+	}
+	for offset < len(buf) {
+		edits, n, ok := decodeManifestRecord(buf[offset:], editSize)
+		if !ok {
+			logger.Log.Warnf("ignore corrupted manifest record at offset %v, %v bytes", offset, len(buf)-offset)
+			break
+		}
+		m.apply(edits)
+		m.records++
+		offset += n
+	}
+	return m, nil
+}
+
+func (m *manifest) apply(edits []*manifestEdit) {
+	for _, edit := range edits {
+		if m.archived[edit.dataType] == nil {
+			m.archived[edit.dataType] = make(map[uint32]struct{})
+		}
+		switch edit.op {
+		case manifestActive:
+			if fid, ok := m.active[edit.dataType]; ok && fid != edit.fid {
+				m.archived[edit.dataType][fid] = struct{}{}
+			}
+			m.active[edit.dataType] = edit.fid
+		case manifestArchive:
+			m.archived[edit.dataType][edit.fid] = struct{}{}
+		case manifestDelete:
+			delete(m.archived[edit.dataType], edit.fid)
+		}
+	}
+}
+
+// snapshot 当前状态对应的edit，存档文件在前
+func (m *manifest) snapshot() (edits []*manifestEdit) {
+	for dataType, fids := range m.archived {
+		for fid := range fids {
+			edits = append(edits, &manifestEdit{op: manifestArchive, dataType: dataType, fid: fid})
+		}
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].dataType != edits[j].dataType {
+			return edits[i].dataType < edits[j].dataType
+		}
+		return edits[i].fid < edits[j].fid
+	})
+	for dataType, fid := range m.active {
+		edits = append(edits, &manifestEdit{op: manifestActive, dataType: dataType, fid: fid})
+	}
+	return edits
+}
+
+// rewrite 将当前状态写入临时文件再rename，之后的变更追加到新文件
+func (m *manifest) rewrite() (err error) {
+	tmpName := filepath.Join(m.path, manifestTmpName)
+	file, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	header := make([]byte, len(manifestMagic)+2)
+	copy(header, manifestMagic)
+	binary.LittleEndian.PutUint16(header[len(manifestMagic):], manifestVersion)
+	if _, err = file.Write(append(header, encodeManifestRecord(m.snapshot())...)); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	fileName := filepath.Join(m.path, manifestFileName)
+	if err = os.Rename(tmpName, fileName); err != nil {
+		_ = file.Close()
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", fileName))
+	}
+	if err = syncDir(m.path); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if m.file != nil {
+		_ = m.file.Close()
+	}
+	m.file = file
+	m.records = 1
+	m.version = manifestVersion
+	return nil
+}
+
+// append 追加一条记录并落盘，落盘后变更才生效
+func (m *manifest) append(edits ...*manifestEdit) (err error) {
+	if m.records >= manifestCompactSize {
+		// 重写的快照需要包含edits，重写失败时恢复原状态
+		active, archived := m.copyState()
+		m.apply(edits)
+		if err = m.rewrite(); err != nil {
+			m.active, m.archived = active, archived
+		}
+		return err
+	}
+	if _, err = m.file.Write(encodeManifestRecord(edits)); err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", m.file.Name()))
+	}
+	m.apply(edits)
+	m.records++
+	return nil
+}
+
+func (m *manifest) copyState() (map[data.DataType]uint32, map[data.DataType]map[uint32]struct{}) {
+	active := make(map[data.DataType]uint32, len(m.active))
+	for dataType, fid := range m.active {
+		active[dataType] = fid
+	}
+	archived := make(map[data.DataType]map[uint32]struct{}, len(m.archived))
+	for dataType, fids := range m.archived {
+		archived[dataType] = make(map[uint32]struct{}, len(fids))
+		for fid := range fids {
+			archived[dataType][fid] = struct{}{}
+		}
+	}
+	return active, archived
+}
+
+// fids dataType的所有数据文件
+func (m *manifest) fids(dataType data.DataType) (fids []uint32) {
+	for fid := range m.archived[dataType] {
+		fids = append(fids, fid)
+	}
+	if fid, ok := m.active[dataType]; ok {
+		fids = append(fids, fid)
+	}
+	return fids
+}
+
+func (m *manifest) close() {
+	if m.file != nil {
+		_ = m.file.Close()
+		m.file = nil
+	}
+}
+
+func encodeManifestRecord(edits []*manifestEdit) []byte {
+	buf := make([]byte, manifestHeaderSize+manifestEditSize*len(edits))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(edits)*manifestEditSize))
+	for i, edit := range edits {
+		b := buf[manifestHeaderSize+i*manifestEditSize:]
+		b[0] = byte(edit.op)
+		b[1] = byte(edit.dataType)
+		binary.LittleEndian.PutUint32(b[2:6], edit.fid)
+	}
+	binary.LittleEndian.PutUint32(buf[:4], util.GetCrc32(buf[4:]))
+	return buf
+}
+
+func decodeManifestRecord(buf []byte, editSize int) (edits []*manifestEdit, n int, ok bool) {
+	if len(buf) < manifestHeaderSize {
+		return nil, 0, false
+	}
+	size := int(binary.LittleEndian.Uint32(buf[4:8]))
+	n = manifestHeaderSize + size
+	if size%editSize != 0 || len(buf) < n || util.GetCrc32(buf[4:n]) != binary.LittleEndian.Uint32(buf[:4]) {
+		return nil, 0, false
+	}
+	for b := buf[manifestHeaderSize:n]; len(b) > 0; b = b[editSize:] {
+		edit := &manifestEdit{op: manifestOp(b[0]), dataType: data.DataType(b[1])}
+		if editSize == manifestEditSizeV1 {
+			edit.fid = uint32(binary.LittleEndian.Uint16(b[2:4]))
+		} else {
+			edit.fid = binary.LittleEndian.Uint32(b[2:6])
+		}
+		edits = append(edits, edit)
+	}
+	return edits, n, true
+}
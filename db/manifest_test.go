@@ -0,0 +1,174 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/util"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Manifest(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	path := "/Users/southwind/TinyDB/test/manifest"
+	_ = os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	opt := DefaultOptions(path)
+	opt.FileSizeLimit = 1 << 10
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+	}
+	// merge后fid不连续
+	if err = tinyDB.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	_ = tinyDB.Set([]byte("key0"), []byte("new"))
+	activeFid := tinyDB.activeFiles[data.String].Fid
+	tinyDB.Close()
+
+	// 不在MANIFEST中的数据文件会被删除，无关文件保留
+	stale := filepath.Join(path, fmt.Sprintf("%v.str.log", activeFid+1))
+	other := filepath.Join(path, "foo.str.log.bak")
+	_ = os.WriteFile(stale, []byte("stale"), 0666)
+	_ = os.WriteFile(other, []byte("other"), 0666)
+	// MANIFEST末尾写入中断
+	fd, _ := os.OpenFile(filepath.Join(path, manifestFileName), os.O_WRONLY|os.O_APPEND, 0666)
+	_, _ = fd.Write([]byte{1, 2, 3})
+	_ = fd.Close()
+
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tinyDB.activeFiles[data.String].Fid != activeFid {
+		t.Errorf("active fid = %v, want %v", tinyDB.activeFiles[data.String].Fid, activeFid)
+	}
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale file is not removed")
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Errorf("other file is removed")
+	}
+	for i := 1; i < 100; i++ {
+		if res, _ := tinyDB.Get([]byte(fmt.Sprintf("key%v", i))); string(res) != fmt.Sprintf("value%v", i) {
+			t.Errorf("get key%v = %v", i, string(res))
+		}
+	}
+	if res, _ := tinyDB.Get([]byte("key0")); string(res) != "new" {
+		t.Errorf("get key0 = %v", string(res))
+	}
+	var archivedFid uint32
+	for fid := range tinyDB.archivedFiles[data.String] {
+		archivedFid = fid
+	}
+	tinyDB.Close()
+
+	// MANIFEST中的文件缺失时拒绝打开
+	_ = os.Remove(data.DataFileName(path, archivedFid, data.String))
+	if _, err = Open(opt); !errors.Is(err, constants.ErrDataFileNotFound) {
+		t.Errorf("open with missing data file: %v", err)
+	}
+}
+
+// Test_LegacyFid 旧版本fid为int16，回绕后的文件名为负数转换成的uint64
+func Test_LegacyFid(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	path := "/Users/southwind/TinyDB/test/legacy"
+	_ = os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	opt := DefaultOptions(path)
+	opt.FileSizeLimit = 1 << 10
+	// 在两个目录中分别写入旧值和新值，再拼成fid为32767和-32768的旧版本目录
+	for i, value := range []string{"old", "new"} {
+		dir := filepath.Join(path, fmt.Sprintf("%v", i))
+		tinyDB, err := Open(DefaultOptions(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = tinyDB.Set([]byte("key"), []byte(value))
+		_ = tinyDB.Set([]byte(value), []byte(value))
+		tinyDB.Close()
+	}
+	legacyName := filepath.Join(path, "18446744073709518848.str.log")
+	_ = os.Rename(filepath.Join(path, "0", "0.str.log"), filepath.Join(path, "32767.str.log"))
+	_ = os.Rename(filepath.Join(path, "1", "0.str.log"), legacyName)
+
+	check := func() {
+		tinyDB, err := Open(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tinyDB.Close()
+		if tinyDB.activeFiles[data.String].Fid != 32768 {
+			t.Errorf("active fid = %v, want 32768", tinyDB.activeFiles[data.String].Fid)
+		}
+		for key, want := range map[string]string{"key": "new", "old": "old", "new": "new"} {
+			if res, _ := tinyDB.Get([]byte(key)); string(res) != want {
+				t.Errorf("get %v = %v, want %v", key, string(res), want)
+			}
+		}
+		if _, err = os.Stat(legacyName); !os.IsNotExist(err) {
+			t.Errorf("legacy file is not renamed")
+		}
+	}
+	// 没有MANIFEST
+	check()
+
+	// 第1版MANIFEST，fid为2字节
+	_ = os.Rename(filepath.Join(path, "32768.str.log"), legacyName)
+	v1 := func(edits ...[]byte) []byte {
+		body := bytes.Join(edits, nil)
+		buf := make([]byte, manifestHeaderSize, manifestHeaderSize+len(body))
+		binary.LittleEndian.PutUint32(buf[4:8], uint32(len(body)))
+		buf = append(buf, body...)
+		binary.LittleEndian.PutUint32(buf[:4], util.GetCrc32(buf[4:]))
+		return buf
+	}
+	record := v1([]byte{byte(manifestActive), byte(data.String), 0xff, 0x7f}, []byte{byte(manifestActive), byte(data.String), 0x00, 0x80})
+	_ = os.WriteFile(filepath.Join(path, manifestFileName), record, 0666)
+	check()
+	m, err := readManifest(path)
+	if err != nil || m.version != manifestVersion {
+		t.Errorf("manifest is not migrated: %v", err)
+	}
+}
+
+func Test_ManifestCompactFail(t *testing.T) {
+	path := t.TempDir()
+	m := newManifest(path)
+	if err := m.rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	if err := m.append(&manifestEdit{op: manifestActive, dataType: data.String, fid: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// 重写失败时内存状态不包含未落盘的edit
+	m.records = manifestCompactSize
+	tmpName := filepath.Join(path, manifestTmpName)
+	_ = os.Mkdir(tmpName, os.ModePerm)
+	if err := m.append(&manifestEdit{op: manifestActive, dataType: data.String, fid: 2}); err == nil {
+		t.Fatal("append should fail")
+	}
+	if m.active[data.String] != 1 || len(m.archived[data.String]) != 0 {
+		t.Errorf("state after failed rewrite = %v, %v", m.active, m.archived)
+	}
+	_ = os.Remove(tmpName)
+	if err := m.append(&manifestEdit{op: manifestActive, dataType: data.String, fid: 2}); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readManifest(path)
+	if err != nil || saved.active[data.String] != 2 || len(saved.archived[data.String]) != 1 {
+		t.Errorf("saved manifest = %v, %v, %v", saved.active, saved.archived, err)
+	}
+	saved.close()
+}
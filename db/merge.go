@@ -0,0 +1,520 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mergeDirName = "merge"
+	mergeFinName = "MERGEFIN" // 旧版本merge完成的标记，有MANIFEST之后不再写入
+)
+
+// mergeMove 记录merge前后entry位置的变化，用于迁移索引
+type mergeMove struct {
+	entry  *data.Entry
+	oldPos *keydir.EntryPos
+	newPos *keydir.EntryPos
+}
+
+// Merge 依次合并所有类型的存档文件，只保留仍有效的entry，之后用当前密钥重写仍使用旧密钥的blob记录
+func (db *TinyDB) Merge() (err error) {
+	if db.opt.ReadOnly {
+		return constants.ErrReadOnly
+	}
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	for dataType := range data.Type2FileSufMap {
+		if err = db.mergeDataType(dataType); err != nil {
+			return err
+		}
+	}
+	return db.gcBlobFiles(true)
+}
+
+// mergeLoop 定期检查各类型失效数据大小，超过阈值时自动merge
+func (db *TinyDB) mergeLoop() {
+	defer db.wg.Done()
+	ticker := time.NewTicker(db.opt.MergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			for dataType := range data.Type2FileSufMap {
+				db.mu.RLock()
+				stale := db.staleBytes[dataType]
+				db.mu.RUnlock()
+				if stale < db.opt.MergeThreshold {
+					continue
+				}
+				db.mergeMu.Lock()
+				err := db.mergeDataType(dataType)
+				db.mergeMu.Unlock()
+				if err != nil {
+					logger.Log.Errorf("merge %v files err: %+v", data.Type2FileSufMap[dataType], err)
+				}
+			}
+		}
+	}
+}
+
+// mergeDataType 合并dataType的所有存档文件，调用方需持有db.mergeMu
+// 1. 归档当前活跃文件，新活跃文件的fid预留出merge输出文件的fid，保证重放顺序
+// 2. 将有效entry写入merge目录，写完后移入数据目录
+// 3. 加锁在MANIFEST中用新文件替换旧文件，之后删除旧文件并迁移索引
+func (db *TinyDB) mergeDataType(dataType data.DataType) (err error) {
+	db.mu.Lock()
+	// 磁盘索引失败后无法迁移索引
+	if err = db.indexErr(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	activeFile := db.activeFiles[dataType]
+	if activeFile == nil || (activeFile.WriteAt == activeFile.DataStart() && len(db.archivedFiles[dataType]) == 0) {
+		db.mu.Unlock()
+		return nil
+	}
+	files := make([]*data.File, 0, len(db.archivedFiles[dataType])+1)
+	for _, archivedFile := range db.archivedFiles[dataType] {
+		files = append(files, archivedFile)
+	}
+	files = append(files, activeFile)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Fid < files[j].Fid
+	})
+	maxFid := activeFile.Fid
+	// 开启加密后未加密的entry重写时变大，merge结果可能多于输入文件数，预留两倍的fid
+	reserved := 2 * uint32(len(files))
+	if uint64(maxFid)+uint64(reserved)+1 > math.MaxUint32 {
+		db.mu.Unlock()
+		return constants.ErrMergeFidExhausted
+	}
+	_, err = db.rotateActiveFile(dataType, maxFid+reserved+1)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	logger.Log.Infof("start merge %v files, fid <= %v", data.Type2FileSufMap[dataType], maxFid)
+
+	mergePath := filepath.Join(db.opt.DBPath, mergeDirName)
+	if err = os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(mergePath, os.ModePerm); err != nil {
+		return err
+	}
+
+	// 写入有效entry
+	var mergedFiles []*data.File
+	var moves []*mergeMove
+	mergedHints := make(map[uint32][]*data.Hint)
+	var inputSize, outputSize int64
+	seen := make(map[string]struct{})
+	nextFid := maxFid + 1
+	mergedFile, err := data.OpenDataFile(mergePath, nextFid, dataType, db.preallocateSize(), db.opt.FormatVersion)
+	if err != nil {
+		return err
+	}
+	mergedFiles = append(mergedFiles, mergedFile)
+	for _, file := range files {
+		offset := file.DataStart()
+		for {
+			entry, err := file.ReadEntry(offset)
+			if errors.Is(err, io.EOF) || errors.Is(err, constants.ErrReadNullEntry) {
+				break
+			} else if err != nil {
+				db.closeMergedFiles(mergedFiles)
+				return err
+			}
+			size := entry.Size()
+			pos := &keydir.EntryPos{Fid: file.Fid, Offset: offset, Size: size}
+			offset += size
+			oldPos, live := db.isLiveEntry(dataType, entry, pos, seen)
+			if !live {
+				continue
+			}
+			// moveIndex在旧文件解除映射后执行，需要复制
+			if file.Mapped() {
+				entry = entry.Copy()
+			}
+			// 有效entry所在的批次都已提交，merge后不再需要批次信息
+			entry.Header.BatchID = 0
+			db.compressEntry(entry)
+			// 用当前密钥重写，merge完成后不再有entry使用轮换前的密钥
+			entry.Header.KeyID = db.keyID
+			buf := mergedFile.EncodeEntry(entry)
+			if mergedFile.WriteAt > mergedFile.DataStart() && mergedFile.WriteAt+int64(len(buf)) > db.opt.FileSizeLimit {
+				if err = mergedFile.Sync(); err != nil {
+					db.closeMergedFiles(mergedFiles)
+					return err
+				}
+				nextFid++
+				if nextFid > maxFid+reserved {
+					db.closeMergedFiles(mergedFiles)
+					return constants.ErrMergeFidExhausted
+				}
+				mergedFile, err = data.OpenDataFile(mergePath, nextFid, dataType, db.preallocateSize(), db.opt.FormatVersion)
+				if err != nil {
+					db.closeMergedFiles(mergedFiles)
+					return err
+				}
+				mergedFiles = append(mergedFiles, mergedFile)
+			}
+			newPos := &keydir.EntryPos{Fid: mergedFile.Fid, Offset: mergedFile.WriteAt, Size: int64(len(buf))}
+			if err = mergedFile.Write(buf); err != nil {
+				db.closeMergedFiles(mergedFiles)
+				return err
+			}
+			outputSize += newPos.Size
+			mergedHints[mergedFile.Fid] = append(mergedHints[mergedFile.Fid], newHint(dataType, entry, newPos))
+			if oldPos != nil {
+				moves = append(moves, &mergeMove{entry: entry, oldPos: oldPos, newPos: newPos})
+			}
+		}
+		inputSize += offset - file.DataStart()
+	}
+	for _, file := range mergedFiles {
+		if err = file.Sync(); err != nil {
+			db.closeMergedFiles(mergedFiles)
+			return err
+		}
+		_ = file.Close()
+		if err = data.WriteHintFile(mergePath, file.Fid, dataType, mergedHints[file.Fid], db.keyID); err != nil {
+			return err
+		}
+	}
+	// 移入数据目录，写入MANIFEST之前崩溃时这些文件会在Open时被删除
+	var edits []*manifestEdit
+	for _, file := range mergedFiles {
+		if err = os.Rename(file.FileName, filepath.Join(db.opt.DBPath, filepath.Base(file.FileName))); err != nil {
+			return err
+		}
+		hintName := data.HintFileName(mergePath, file.Fid, dataType)
+		if err = os.Rename(hintName, filepath.Join(db.opt.DBPath, filepath.Base(hintName))); err != nil {
+			return err
+		}
+		edits = append(edits, &manifestEdit{op: manifestArchive, dataType: dataType, fid: file.Fid})
+	}
+	if err = syncDir(db.opt.DBPath); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var oldFiles []*data.File
+	oldFids := make(map[uint32]struct{})
+	for fid, file := range db.archivedFiles[dataType] {
+		if fid <= maxFid {
+			oldFiles = append(oldFiles, file)
+			oldFids[fid] = struct{}{}
+			edits = append(edits, &manifestEdit{op: manifestDelete, dataType: dataType, fid: fid})
+		}
+	}
+	// 写入MANIFEST后merge结果生效，之后崩溃时未删除的旧文件会在Open时被删除
+	if err = db.manifest.append(edits...); err != nil {
+		return err
+	}
+	for _, file := range mergedFiles {
+		newFile, err := data.OpenDataFile(db.opt.DBPath, file.Fid, dataType, 0, db.opt.FormatVersion)
+		if err != nil {
+			return err
+		}
+		db.mmapArchivedFile(newFile)
+		db.archivedFiles[dataType][file.Fid] = newFile
+	}
+	db.cache.removeFiles(dataType, oldFids)
+	for _, file := range oldFiles {
+		_ = file.Close()
+		delete(db.archivedFiles[dataType], file.Fid)
+		if err = file.Remove(); err != nil {
+			return err
+		}
+		if err = data.RemoveHintFile(db.opt.DBPath, file.Fid, dataType); err != nil {
+			return err
+		}
+	}
+	for _, move := range moves {
+		db.moveIndex(dataType, move)
+	}
+	if err = os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	db.staleBytes[dataType] -= inputSize - outputSize
+	if db.staleBytes[dataType] < 0 {
+		db.staleBytes[dataType] = 0
+	}
+	logger.Log.Infof("merge %v files successful, %v bytes -> %v bytes", data.Type2FileSufMap[dataType], inputSize, outputSize)
+	return nil
+}
+
+func (db *TinyDB) closeMergedFiles(files []*data.File) {
+	for _, file := range files {
+		_ = file.Close()
+	}
+}
+
+// isLiveEntry 判断entry是否仍被索引引用，oldPos为索引中记录的位置，set和zset索引不记录位置
+// set和zset的entry没有位置信息，只保留与当前索引状态一致的Insert，seen用于去重
+func (db *TinyDB) isLiveEntry(dataType data.DataType, entry *data.Entry, pos *keydir.EntryPos, seen map[string]struct{}) (oldPos *keydir.EntryPos, live bool) {
+	var err error
+	switch entry.Header.Type {
+	case data.Expire:
+		// 只保留与当前过期时间一致的记录
+		expireAt, err := db.expireKeydirs[dataType].Get(string(entry.Key))
+		return nil, err == nil && expireAt == int64(entry.Header.ExpiryTime)
+	case data.DeleteKey, data.BatchCommit:
+		return nil, false
+	}
+	switch dataType {
+	case data.String:
+		oldPos, err = db.strKeydir.Get(string(entry.Key))
+	case data.List:
+		if entry.Header.Type == data.InsertListMeta {
+			oldPos, err = db.listKeydir.Get(string(entry.Key), MetaIndex)
+		} else {
+			key, index := decodeListKey(entry.Key)
+			oldPos, err = db.listKeydir.Get(string(key), index)
+		}
+	case data.Hash:
+		key, field := decodeSubKey(entry.Key)
+		oldPos, err = db.hashKeydir.Get(string(key), string(field))
+	case data.Set:
+		if entry.Header.Type != data.Insert {
+			return nil, false
+		}
+		if _, ok := seen[string(entry.Key)]; ok {
+			return nil, false
+		}
+		key, member := decodeSubKey(entry.Key)
+		if !db.setKeydir.IsExists(string(key), string(member)) {
+			return nil, false
+		}
+		seen[string(entry.Key)] = struct{}{}
+		return nil, true
+	case data.ZSet:
+		if entry.Header.Type != data.Insert {
+			return nil, false
+		}
+		if _, ok := seen[string(entry.Key)]; ok {
+			return nil, false
+		}
+		key, member := decodeSubKey(entry.Key)
+		score, err := db.zsetKeydir.GetScore(string(key), string(member))
+		if err != nil || fmt.Sprintf("%v", score) != string(entry.Value) {
+			return nil, false
+		}
+		seen[string(entry.Key)] = struct{}{}
+		return nil, true
+	}
+	if err != nil || oldPos.Fid != pos.Fid || oldPos.Offset != pos.Offset {
+		return nil, false
+	}
+	return oldPos, true
+}
+
+// moveIndex 索引仍指向merge前的位置时更新为新位置，否则说明merge期间已被覆盖
+func (db *TinyDB) moveIndex(dataType data.DataType, move *mergeMove) {
+	switch dataType {
+	case data.String:
+		db.strKeydir.CompareAndSwap(string(move.entry.Key), move.oldPos, move.newPos)
+	case data.List:
+		if move.entry.Header.Type == data.InsertListMeta {
+			db.listKeydir.CompareAndSwap(string(move.entry.Key), MetaIndex, move.oldPos, move.newPos)
+		} else {
+			key, index := decodeListKey(move.entry.Key)
+			db.listKeydir.CompareAndSwap(string(key), index, move.oldPos, move.newPos)
+		}
+	case data.Hash:
+		key, field := decodeSubKey(move.entry.Key)
+		db.hashKeydir.CompareAndSwap(string(key), string(field), move.oldPos, move.newPos)
+	}
+}
+
+// markStale 统计写入entry后失效的数据大小，包括被覆盖的旧entry和删除标记本身
+func (db *TinyDB) markStale(dataType data.DataType, entry *data.Entry, size int64) {
+	var stale int64
+	switch entry.Header.Type {
+	case data.Expire:
+		// 取消过期时间的记录本身也是失效数据
+		if entry.Header.ExpiryTime == 0 {
+			db.staleBytes[dataType] += size
+		}
+		return
+	case data.DeleteKey:
+		db.staleBytes[dataType] += size + db.keySize(dataType, string(entry.Key))
+		return
+	}
+	switch dataType {
+	case data.String:
+		if pos, err := db.strKeydir.Get(string(entry.Key)); err == nil {
+			stale += pos.Size
+		}
+	case data.List:
+		index := MetaIndex
+		key := entry.Key
+		if entry.Header.Type != data.InsertListMeta {
+			key, index = decodeListKey(entry.Key)
+		}
+		if pos, err := db.listKeydir.Get(string(key), index); err == nil {
+			stale += pos.Size
+		}
+	case data.Hash:
+		key, field := decodeSubKey(entry.Key)
+		if pos, err := db.hashKeydir.Get(string(key), string(field)); err == nil {
+			stale += pos.Size
+		}
+	case data.Set:
+		key, member := decodeSubKey(entry.Key)
+		if db.setKeydir.IsExists(string(key), string(member)) {
+			stale += setEntrySize(key, member)
+		}
+	case data.ZSet:
+		key, member := decodeSubKey(entry.Key)
+		if score, err := db.zsetKeydir.GetScore(string(key), string(member)); err == nil {
+			stale += zsetEntrySize(key, member, score)
+		}
+	}
+	if entry.Header.Type == data.Delete {
+		stale += size
+	}
+	db.staleBytes[dataType] += stale
+}
+
+// keySize 统计key所有元素的entry大小
+func (db *TinyDB) keySize(dataType data.DataType, key string) (size int64) {
+	switch dataType {
+	case data.List:
+		for _, pos := range db.listKeydir.GetPositions(key) {
+			size += pos.Size
+		}
+	case data.Hash:
+		for _, pos := range db.hashKeydir.GetPositions(key) {
+			size += pos.Size
+		}
+	case data.Set:
+		members, _ := db.setKeydir.GetMembers(key)
+		for _, member := range members {
+			size += setEntrySize([]byte(key), []byte(member))
+		}
+	case data.ZSet:
+		members, scores := db.zsetKeydir.GetMembers(key)
+		for i, member := range members {
+			size += zsetEntrySize([]byte(key), []byte(member), scores[i])
+		}
+	}
+	return
+}
+
+// set的entry value为空，大小可以直接算出
+func setEntrySize(key, member []byte) int64 {
+	return int64(data.HeaderSize + 8 + len(key) + len(member))
+}
+
+// zset的entry value为score的文本
+func zsetEntrySize(key, member []byte, score float64) int64 {
+	return int64(data.HeaderSize + 8 + len(key) + len(member) + len(fmt.Sprintf("%v", score)))
+}
+
+// recoverMerge Open时处理merge目录：有MANIFEST时merge目录中都是未生效的结果，直接丢弃；
+// 旧版本的数据目录有MERGEFIN标记则完成文件替换，否则丢弃未完成的merge结果
+func (db *TinyDB) recoverMerge() (err error) {
+	mergePath := filepath.Join(db.opt.DBPath, mergeDirName)
+	if _, err = os.Stat(mergePath); os.IsNotExist(err) {
+		return nil
+	}
+	if manifestExists(db.opt.DBPath) {
+		if db.opt.ReadOnly {
+			return nil
+		}
+		logger.Log.Warnf("discard unfinished merge")
+		return os.RemoveAll(mergePath)
+	}
+	buf, err := os.ReadFile(filepath.Join(mergePath, mergeFinName))
+	if os.IsNotExist(err) {
+		// 未完成的merge不影响旧文件，只读模式可以忽略
+		if db.opt.ReadOnly {
+			return nil
+		}
+		logger.Log.Warnf("discard unfinished merge")
+		return os.RemoveAll(mergePath)
+	} else if err != nil {
+		return err
+	}
+	if db.opt.ReadOnly {
+		return constants.ErrNeedRecovery
+	}
+	var dataType data.DataType
+	var legacyMaxFid int16
+	if _, err = fmt.Sscanf(string(buf), "%d %d", &dataType, &legacyMaxFid); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("parse %v", mergeFinName))
+	}
+	maxFid := uint32(uint16(legacyMaxFid))
+	// 删除已被合并的旧文件及其hint文件
+	suffix, hintSuffix := data.Type2FileSufMap[dataType], data.Type2HintSufMap[dataType]
+	fileInfos, err := os.ReadDir(db.opt.DBPath)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		fid, _, ok := parseFid(fileInfo.Name(), suffix)
+		if !ok {
+			fid, _, ok = parseFid(fileInfo.Name(), hintSuffix)
+		}
+		if !ok || fid > maxFid {
+			continue
+		}
+		if err = os.Remove(filepath.Join(db.opt.DBPath, fileInfo.Name())); err != nil {
+			return err
+		}
+	}
+	// 移入merge结果
+	fileInfos, err = os.ReadDir(mergePath)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		_, _, isData := parseFid(fileInfo.Name(), suffix)
+		_, _, isHint := parseFid(fileInfo.Name(), hintSuffix)
+		if !isData && !isHint {
+			continue
+		}
+		if err = os.Rename(filepath.Join(mergePath, fileInfo.Name()), filepath.Join(db.opt.DBPath, fileInfo.Name())); err != nil {
+			return err
+		}
+	}
+	logger.Log.Infof("recover merge of %v files, fid <= %v", suffix, maxFid)
+	return os.RemoveAll(mergePath)
+}
+
+// parseFid 解析形如 1.str.log 或 1.str.hint 的文件名
+// 旧版本int16回绕后的文件名是负数转换成的uint64，legacy为true，fid按uint16解析
+func parseFid(name string, suffix string) (fid uint32, legacy bool, ok bool) {
+	if len(name) <= len(suffix) || name[len(name)-len(suffix):] != suffix {
+		return 0, false, false
+	}
+	n, err := strconv.ParseUint(name[:len(name)-len(suffix)], 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+	if n <= math.MaxUint32 {
+		return uint32(n), false, true
+	}
+	if n > math.MaxUint64+math.MinInt16 {
+		return uint32(uint16(n)), true, true
+	}
+	return 0, false, false
+}
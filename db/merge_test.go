@@ -0,0 +1,183 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func Test_Merge(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+
+	for i := 0; i < 100; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+	}
+	for i := 0; i < 100; i += 2 {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("new%v", i)))
+	}
+	_ = tinyDB.GetDel([]byte("key1"))
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte("1"), []byte("b"), []byte("2"))
+	_, _ = tinyDB.HDel([]byte("hash"), []byte("a"))
+	_, _ = tinyDB.SAdd([]byte("set"), []byte("a"), []byte("b"))
+	_, _ = tinyDB.SRem([]byte("set"), []byte("a"))
+	_, _ = tinyDB.ZAdd([]byte("zset"), "", "", "", "", []byte("1"), []byte("a"), []byte("2"), []byte("b"))
+	_, _ = tinyDB.ZIncrBy([]byte("zset"), 2, []byte("a"))
+	_, _ = tinyDB.LPush([]byte("list"), false, []byte("a"), []byte("b"), []byte("c"))
+	_, _ = tinyDB.LPop([]byte("list"), 1, true)
+
+	if err := tinyDB.Merge(); err != nil {
+		t.Fatalf("Merge error: %+v", err)
+	}
+	check := func(tinyDB *TinyDB) {
+		for i := 0; i < 100; i++ {
+			want := fmt.Sprintf("value%v", i)
+			if i%2 == 0 {
+				want = fmt.Sprintf("new%v", i)
+			}
+			res, err := tinyDB.Get([]byte(fmt.Sprintf("key%v", i)))
+			if i == 1 {
+				if err != constants.ErrKeyNotFound {
+					t.Errorf("Get deleted key error")
+				}
+				continue
+			}
+			if string(res) != want {
+				t.Errorf("Get key%v = %v, want %v", i, string(res), want)
+			}
+		}
+		if res, _ := tinyDB.HGetAll([]byte("hash")); len(res) != 1 || res["b"] != "2" {
+			t.Errorf("HGetAll error")
+		}
+		if res, _ := tinyDB.SMembers([]byte("set")); len(res) != 1 || res[0] != "b" {
+			t.Errorf("SMembers error")
+		}
+		if res, _ := tinyDB.ZMScore([]byte("zset"), []byte("a"), []byte("b")); res[0] != float64(3) || res[1] != float64(2) {
+			t.Errorf("ZMScore error")
+		}
+		if res, _ := tinyDB.LRange([]byte("list"), 0, -1); len(res) != 2 || res[0] != "b" {
+			t.Errorf("LRange error")
+		}
+	}
+	check(tinyDB)
+	tinyDB.Close()
+
+	// 重启后索引从merge后的文件重建
+	tinyDB = openDB(0)
+	check(tinyDB)
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+func Test_MmapArchived(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	opt.MmapArchived = true
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+	}
+	if tinyDB.activeFiles[data.String].Mapped() {
+		t.Errorf("active file should not be mapped")
+	}
+	for _, file := range tinyDB.archivedFiles[data.String] {
+		if !file.Mapped() {
+			t.Errorf("archived file %v is not mapped", file.Fid)
+		}
+	}
+	// merge前读取的value在文件解除映射后仍然有效
+	before, _ := tinyDB.Get([]byte("key0"))
+	for i := 0; i < 100; i += 2 {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("new%v", i)))
+	}
+	if err = tinyDB.Merge(); err != nil {
+		t.Fatalf("Merge error: %+v", err)
+	}
+	if string(before) != "value0" {
+		t.Errorf("value read before merge = %v", string(before))
+	}
+	check := func(tinyDB *TinyDB) {
+		for _, file := range tinyDB.archivedFiles[data.String] {
+			if !file.Mapped() {
+				t.Errorf("archived file %v is not mapped", file.Fid)
+			}
+		}
+		for i := 0; i < 100; i++ {
+			want := fmt.Sprintf("value%v", i)
+			if i%2 == 0 {
+				want = fmt.Sprintf("new%v", i)
+			}
+			if res, _ := tinyDB.Get([]byte(fmt.Sprintf("key%v", i))); string(res) != want {
+				t.Errorf("Get key%v = %v, want %v", i, string(res), want)
+			}
+		}
+	}
+	check(tinyDB)
+	tinyDB.Close()
+
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(tinyDB)
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+func Test_MergeConcurrentRead(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+	for i := 0; i < 200; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+		_, _ = tinyDB.HSet([]byte("hash"), []byte(fmt.Sprintf("f%v", i)), []byte(fmt.Sprint(i)))
+	}
+	_, _ = tinyDB.LPush([]byte("list"), false, []byte("a"), []byte("b"), []byte("c"))
+
+	// merge移动entry并删除旧文件期间读取不能失败
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := 0; i < 200; i++ {
+					if res, err := tinyDB.Get([]byte(fmt.Sprintf("key%v", i))); err != nil || string(res) != fmt.Sprintf("value%v", i) {
+						t.Errorf("Get key%v = %v, %v", i, string(res), err)
+						return
+					}
+				}
+				if _, err := tinyDB.HGet([]byte("hash"), []byte("f7")); err != nil {
+					t.Errorf("HGet error: %v", err)
+					return
+				}
+				if _, err := tinyDB.LIndex([]byte("list"), 1); err != nil {
+					t.Errorf("LIndex error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := tinyDB.Merge(); err != nil {
+			t.Errorf("Merge error: %+v", err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const migrateTmpSuffix = ".migrate"
+
+// Migrate 为opt.DBPath下没有文件头的旧数据文件原地加上FormatV1文件头，返回升级的文件，运行前需要停止服务
+// 只加文件头，不重新编码entry，zset的score仍是文本；需要FormatV2编码时设置FormatVersion后执行Merge重写
+// 先以读写模式打开一次，完成旧版本目录的恢复，包括未完成的merge、int16文件名、MANIFEST和活跃文件末尾的截断
+// 之后逐个重写旧文件，每个文件的替换是原子的，中途失败时重新执行即可
+func Migrate(opt *Options) (migrated []string, err error) {
+	migrateOpt := *opt
+	migrateOpt.ReadOnly = false
+	migrateOpt.MergeInterval = 0
+	migrateOpt.ExpireInterval = 0
+	// 升级后索引文件会被删除，不需要建立磁盘索引
+	migrateOpt.DiskIndex = false
+	tinyDB, err := Open(&migrateOpt)
+	if err != nil {
+		return nil, err
+	}
+	tinyDB.Close()
+
+	db := newTinyDB(&migrateOpt)
+	if err = db.lock(); err != nil {
+		return nil, err
+	}
+	defer db.unlock()
+	defer db.closeFiles()
+	// 升级会改变entry的偏移，保存的磁盘索引不能再复用
+	if err = removeIndexFile(db.opt.DBPath); err != nil {
+		return nil, err
+	}
+	// 上次中断留下的临时文件
+	tmpFiles, err := filepath.Glob(filepath.Join(db.opt.DBPath, "*"+migrateTmpSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmpFile := range tmpFiles {
+		if err = os.Remove(tmpFile); err != nil {
+			return nil, err
+		}
+	}
+	if err = db.loadDataFiles(); err != nil {
+		return nil, err
+	}
+	for dataType, activeFile := range db.activeFiles {
+		files := []*data.File{activeFile}
+		for _, archivedFile := range db.archivedFiles[dataType] {
+			files = append(files, archivedFile)
+		}
+		for _, file := range files {
+			if !file.Legacy() {
+				continue
+			}
+			if err = db.migrateDataFile(dataType, file); err != nil {
+				return migrated, err
+			}
+			logger.Log.Infof("migrate %v to format version %v", file.FileName, data.FormatV1)
+			migrated = append(migrated, file.FileName)
+		}
+	}
+	return migrated, nil
+}
+
+// migrateDataFile 在原数据之前加上文件头写入临时文件再替换原文件，entry的偏移改变，需要删除hint文件
+func (db *TinyDB) migrateDataFile(dataType data.DataType, file *data.File) (err error) {
+	stat, err := file.Fd.Stat()
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", file.FileName))
+	}
+	tmpName := file.FileName + migrateTmpSuffix
+	tmpFile, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		if err != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+	// 旧文件中的entry都是FormatV1编码，创建时间使用最后修改时间
+	header := &data.FileHeader{Version: data.FormatV1, DataType: dataType, CreatedAt: stat.ModTime().UnixMilli()}
+	if _, err = tmpFile.Write(data.EncodeFileHeader(header)); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	if _, err = io.Copy(tmpFile, io.NewSectionReader(file.Fd, 0, stat.Size())); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", tmpName))
+	}
+	// 先删除hint文件，替换前中断时旧文件仍然完整，重新打开时会重建hint文件
+	if err = data.RemoveHintFile(db.opt.DBPath, file.Fid, dataType); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, file.FileName); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", file.FileName))
+	}
+	return syncDir(db.opt.DBPath)
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Migrate(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/migrate")
+	opt.FileSizeLimit = 1 << 10
+	_ = os.RemoveAll(opt.DBPath)
+	defer os.RemoveAll(opt.DBPath)
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 50; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprintf("value%v", i)))
+	}
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte("1"))
+	tinyDB.Close()
+
+	// 去掉文件头和hint文件，模拟旧版本的数据目录
+	logFiles, _ := filepath.Glob(filepath.Join(opt.DBPath, "*.log"))
+	for _, name := range logFiles {
+		buf, _ := os.ReadFile(name)
+		_ = os.WriteFile(name, buf[data.FileHeaderSize:], 0666)
+	}
+	hintFiles, _ := filepath.Glob(filepath.Join(opt.DBPath, "*.hint"))
+	for _, name := range hintFiles {
+		_ = os.Remove(name)
+	}
+	check := func() {
+		tinyDB, err := Open(opt)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		defer tinyDB.Close()
+		for i := 0; i < 50; i++ {
+			if res, _ := tinyDB.Get([]byte(fmt.Sprintf("key%v", i))); string(res) != fmt.Sprintf("value%v", i) {
+				t.Errorf("Get key%v = %v", i, string(res))
+			}
+		}
+		if res, _ := tinyDB.HGet([]byte("hash"), []byte("a")); res != "1" {
+			t.Errorf("HGet = %v", res)
+		}
+	}
+	// 旧文件按FormatV1读取
+	check()
+
+	// 升级前保存的磁盘索引指向旧的偏移，调用方开启DiskIndex时也不读取
+	_ = os.WriteFile(filepath.Join(opt.DBPath, indexFileName), []byte("stale"), 0666)
+	diskIndexOpt := *opt
+	diskIndexOpt.DiskIndex = true
+	migrated, err := Migrate(&diskIndexOpt)
+	if err != nil {
+		t.Fatalf("Migrate error: %+v", err)
+	}
+	if _, err = os.Stat(filepath.Join(opt.DBPath, indexFileName)); !os.IsNotExist(err) {
+		t.Errorf("disk index is not removed after migration: %v", err)
+	}
+	if len(migrated) != len(logFiles) {
+		t.Errorf("migrated %v files, want %v", len(migrated), len(logFiles))
+	}
+	for _, name := range logFiles {
+		file, err := data.OpenReadOnlyDataFile(opt.DBPath, fidOf(t, name), typeOf(name))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if file.Legacy() || file.Version != data.FormatV1 || file.CreatedAt == 0 {
+			t.Errorf("%v is not migrated", filepath.Base(name))
+		}
+		_ = file.Close()
+	}
+	check()
+	// 再次执行没有需要升级的文件
+	if migrated, err = Migrate(opt); err != nil || len(migrated) != 0 {
+		t.Errorf("Migrate again = %v, %v", migrated, err)
+	}
+	check()
+}
+
+func fidOf(t *testing.T, name string) uint32 {
+	fid, _, ok := parseFid(filepath.Base(name), data.Type2FileSufMap[typeOf(name)])
+	if !ok {
+		t.Fatalf("parse fid of %v", name)
+	}
+	return fid
+}
+
+func typeOf(name string) data.DataType {
+	ext := filepath.Ext(name[:len(name)-len(".log")])
+	return data.FileSuf2TypeMap[ext[1:]]
+}
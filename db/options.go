@@ -1,13 +1,100 @@
 package db
 
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"strings"
+	"time"
+)
+
+// SyncPolicy 数据落盘策略，对应Redis的appendfsync
+type SyncPolicy int8
+
+const (
+	SyncEverySec SyncPolicy = iota // 后台每秒落盘一次，崩溃时最多丢失1秒的数据
+	SyncAlways                     // 每次写入后落盘
+	SyncNone                       // 由操作系统决定落盘时机
+)
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncEverySec: "everysec",
+	SyncAlways:   "always",
+	SyncNone:     "none",
+}
+
+func (p SyncPolicy) String() string {
+	return syncPolicyNames[p]
+}
+
+// ParseSyncPolicy 将always、everysec、none转换为SyncPolicy
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	for policy, policyName := range syncPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return policy, nil
+		}
+	}
+	return 0, constants.ErrInvalidSyncPolicy
+}
+
 type Options struct {
-	DBPath        string
-	FileSizeLimit int64
+	DBPath         string
+	FileSizeLimit  int64
+	SyncPolicy     SyncPolicy
+	MergeInterval  time.Duration // 检查是否需要merge的间隔，为0时不自动merge
+	MergeThreshold int64         // 某类型失效数据达到该大小时自动merge
+
+	ExpireInterval   time.Duration // 主动清理过期key的间隔，为0时只在访问时删除过期key
+	ExpireSampleSize int           // 每轮每种类型抽样检查的key数量
+	ExpireTimeBudget time.Duration // 每次清理最多占用的时间
+
+	StrictRecovery bool // 活跃文件末尾数据损坏时拒绝打开，默认截断损坏数据后继续打开
+	ReadOnly       bool // 只读打开，持有共享锁，可以与其他只读实例同时打开，不修改任何文件
+	Preallocate    bool // 新建数据文件时预留FileSizeLimit大小的磁盘空间，只在Linux上生效，不改变文件大小
+	MmapArchived   bool // 只读映射存档文件，读取时不需要系统调用，活跃文件仍使用pread
+
+	// 新建数据文件使用的entry编码格式，data.FormatV2的header更小，已有文件保持原格式，merge时按该格式重写
+	FormatVersion uint16
+
+	Compression       data.CodecType // value的压缩算法，默认不压缩，merge时压缩之前未压缩的value
+	CompressThreshold int            // value小于该大小时不压缩
+
+	// 加密密钥文件和保存密钥的环境变量名，都为空时不加密，格式见LoadKeys
+	// 轮换密钥时在末尾追加新密钥，重新打开后执行Merge，Merge同时重写使用旧密钥的blob记录，完成后即可删除旧密钥
+	EncryptionKeyFile string
+	EncryptionKeyEnv  string
+
+	OrderedIndex bool // 使用B树索引key，支持NewIterator按key顺序遍历，默认使用map
+	// 自定义各数据类型的索引实现，为nil时根据OrderedIndex使用内置的内存索引
+	Indexes keydir.IndexFactory
+	// String、List和Hash的索引保存在DBPath下的INDEX文件中，内存中只缓存IndexCacheSize大小的B+树节点，
+	// 用于key数量超过内存的数据集，优先于Indexes，正常关闭时保存索引文件，下次打开时数据文件没有变化则复用，否则重建
+	DiskIndex      bool
+	IndexCacheSize int64
+
+	CacheSize int64 // 读取value的LRU缓存容量，按key和value的大小计算，为0时不缓存
+
+	// String、List元素和Hash field的value不小于BlobThreshold时写入单独的blob文件，主entry只保存位置，为0时不分离
+	// merge只复制位置，blob文件由BlobGC回收，失效数据比例达到BlobGCRatio的文件会被重写
+	BlobThreshold int
+	BlobGCRatio   float64
 }
 
 func DefaultOptions(path string) *Options {
 	return &Options{
-		DBPath:        path,
-		FileSizeLimit: 1 << 26, // 默认64M
+		DBPath:         path,
+		FileSizeLimit:  1 << 26, // 默认64M
+		SyncPolicy:     SyncEverySec,
+		MergeInterval:  time.Minute,
+		MergeThreshold: 1 << 28, // 默认256M
+		FormatVersion:  data.FormatV1,
+
+		ExpireInterval:   100 * time.Millisecond,
+		ExpireSampleSize: 20,
+		ExpireTimeBudget: 25 * time.Millisecond,
+
+		CompressThreshold: 1 << 9,
+
+		BlobGCRatio: 0.5,
 	}
 }
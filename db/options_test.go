@@ -0,0 +1,329 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func Test_SyncPolicy(t *testing.T) {
+	for _, name := range []string{"always", "everysec", "NONE"} {
+		policy, err := ParseSyncPolicy(name)
+		if err != nil || !strings.EqualFold(policy.String(), name) {
+			t.Errorf("ParseSyncPolicy error, name: %v, policy: %v", name, policy)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Errorf("ParseSyncPolicy error")
+	}
+
+	_ = os.Setenv(constants.DebugEnv, "1")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	opt.SyncPolicy = SyncAlways
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tinyDB.Close()
+	if err = tinyDB.Set([]byte("a"), []byte("1")); err != nil {
+		t.Errorf("Set with SyncAlways error: %v", err)
+	}
+}
+
+func Test_Compression(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 12
+	opt.Compression = data.Gzip
+	opt.CompressThreshold = 64
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	value := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf(`{"id":%v,"name":"tinydb"}`, i), 20))
+	}
+	for i := 0; i < 20; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), value(i))
+	}
+	_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), value(0), []byte("b"), []byte("small"))
+	// 20个value原始大小约10K，压缩后不会写满一个文件
+	if len(tinyDB.archivedFiles[data.String]) != 0 {
+		t.Errorf("values are not compressed, archived files: %v", len(tinyDB.archivedFiles[data.String]))
+	}
+	check := func(tinyDB *TinyDB) {
+		for i := 0; i < 20; i++ {
+			if res, _ := tinyDB.Get([]byte(fmt.Sprintf("key%v", i))); string(res) != string(value(i)) {
+				t.Errorf("Get key%v = %v", i, string(res))
+			}
+		}
+		if res, _ := tinyDB.HGet([]byte("hash"), []byte("a")); res != string(value(0)) {
+			t.Errorf("HGet a = %v", res)
+		}
+		if res, _ := tinyDB.HGet([]byte("hash"), []byte("b")); res != "small" {
+			t.Errorf("HGet b = %v", res)
+		}
+	}
+	check(tinyDB)
+	tinyDB.Close()
+
+	// 关闭压缩后仍能读取已压缩的数据，merge时保持压缩
+	opt.Compression = data.NoCompression
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(tinyDB)
+	if err = tinyDB.Merge(); err != nil {
+		t.Fatalf("Merge error: %+v", err)
+	}
+	check(tinyDB)
+
+	opt.Compression = 200
+	if _, err = Open(opt); !errors.Is(err, constants.ErrUnknownCodec) {
+		t.Errorf("Open with unknown codec error: %v", err)
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+func Test_FormatVersion(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 20; i++ {
+		_, _ = tinyDB.SAdd([]byte("set"), []byte(fmt.Sprintf("v1-%v", i)))
+	}
+	tinyDB.Close()
+
+	// 切换到FormatV2后，已有的活跃文件继续使用FormatV1，新文件和merge后的文件使用FormatV2
+	opt.FormatVersion = data.FormatV2
+	if tinyDB, err = Open(opt); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 100; i++ {
+		_, _ = tinyDB.SAdd([]byte("set"), []byte(fmt.Sprintf("v2-%v", i)))
+	}
+	_ = tinyDB.MSet([]byte("a"), []byte("1"), []byte("b"), []byte("2"))
+	_ = tinyDB.SetEX([]byte("c"), []byte("3"), time.Now().Add(time.Hour).UnixMilli())
+	if tinyDB.activeFiles[data.Set].Version != data.FormatV2 {
+		t.Errorf("active file version = %v", tinyDB.activeFiles[data.Set].Version)
+	}
+	check := func(tinyDB *TinyDB) {
+		if res, _ := tinyDB.SMembers([]byte("set")); len(res) != 120 {
+			t.Errorf("SMembers len = %v", len(res))
+		}
+		if res, _ := tinyDB.Get([]byte("b")); string(res) != "2" {
+			t.Errorf("Get b = %v", string(res))
+		}
+		if res, _ := tinyDB.Get([]byte("c")); string(res) != "3" {
+			t.Errorf("Get c = %v", string(res))
+		}
+	}
+	check(tinyDB)
+	tinyDB.Close()
+
+	if tinyDB, err = Open(opt); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(tinyDB)
+	if err = tinyDB.Merge(); err != nil {
+		t.Fatalf("Merge error: %+v", err)
+	}
+	check(tinyDB)
+	for _, file := range tinyDB.archivedFiles[data.Set] {
+		if file.Version != data.FormatV2 {
+			t.Errorf("%v version = %v", file.FileName, file.Version)
+		}
+	}
+
+	opt.FormatVersion = data.LatestFormat + 1
+	if _, err = Open(opt); !errors.Is(err, constants.ErrUnsupportedFormat) {
+		t.Errorf("Open with unsupported format error: %v", err)
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+// countingStrIndex 统计写入次数的String索引
+type countingStrIndex struct {
+	keydir.StrIndex
+	sets int
+}
+
+func (i *countingStrIndex) Set(key string, pos *keydir.EntryPos) {
+	i.sets++
+	i.StrIndex.Set(key, pos)
+}
+
+type countingIndexes struct {
+	keydir.MemIndexFactory
+	str *countingStrIndex
+}
+
+func (f *countingIndexes) NewStrIndex() keydir.StrIndex {
+	f.str = &countingStrIndex{StrIndex: f.MemIndexFactory.NewStrIndex()}
+	return f.str
+}
+
+func Test_Indexes(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	indexes := &countingIndexes{}
+	opt.Indexes = indexes
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 10; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%v", i)), []byte(fmt.Sprint(i)))
+	}
+	if res, _ := tinyDB.Get([]byte("key3")); string(res) != "3" || indexes.str.sets != 10 {
+		t.Errorf("Get = %v, sets = %v", string(res), indexes.str.sets)
+	}
+	if _, err = tinyDB.NewIterator(IteratorOptions{DataType: data.String}); !errors.Is(err, constants.ErrUnorderedIndex) {
+		t.Errorf("NewIterator with map index err = %v", err)
+	}
+	tinyDB.Close()
+
+	// 重新打开时通过自定义索引重建
+	indexes.Ordered = true
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if indexes.str.sets != 10 {
+		t.Errorf("sets after rebuild = %v", indexes.str.sets)
+	}
+	it, err := tinyDB.NewIterator(IteratorOptions{DataType: data.String})
+	if err != nil || !it.Valid() || string(it.Key()) != "key0" {
+		t.Errorf("NewIterator with ordered index err = %v", err)
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+func Test_DiskIndex(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 12
+	opt.DiskIndex = true
+	opt.IndexCacheSize = 1 << 14
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 2000; i++ {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i)))
+		_, _ = tinyDB.HSet([]byte(fmt.Sprintf("hash%v", i%10)), []byte(fmt.Sprint(i)), []byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < 2000; i += 2 {
+		_ = tinyDB.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(-i)))
+	}
+	_, _ = tinyDB.LPush([]byte("list"), false, []byte("a"), []byte("b"), []byte("c"))
+	_, _ = tinyDB.Expire([]byte("hash5"), time.Now().Add(time.Hour).UnixMilli())
+	check := func() {
+		for i := 0; i < 2000; i++ {
+			want := fmt.Sprint(i)
+			if i%2 == 0 {
+				want = fmt.Sprint(-i)
+			}
+			if res, _ := tinyDB.Get([]byte(fmt.Sprintf("key%04d", i))); string(res) != want {
+				t.Fatalf("Get key%04d = %v, want %v", i, string(res), want)
+			}
+		}
+		if res, _ := tinyDB.HLen([]byte("hash3")); res != 200 {
+			t.Errorf("HLen = %v", res)
+		}
+		if res, _ := tinyDB.LRange([]byte("list"), 0, -1); !reflect.DeepEqual(res, []string{"a", "b", "c"}) {
+			t.Errorf("LRange = %v", res)
+		}
+		if res, _ := tinyDB.TTL([]byte("hash5")); res <= 0 {
+			t.Errorf("TTL = %v", res)
+		}
+	}
+	check()
+	if err = tinyDB.Merge(); err != nil {
+		t.Fatalf("Merge error: %+v", err)
+	}
+	check()
+	it, err := tinyDB.NewIterator(IteratorOptions{DataType: data.Hash, Reverse: true})
+	if err != nil || string(it.Key()) != "hash9" {
+		t.Errorf("NewIterator = %v, %v", string(it.Key()), err)
+	}
+	tinyDB.Close()
+	// 正常关闭后保存索引
+	indexPath := filepath.Join(opt.DBPath, indexFileName)
+	saved := func() bool {
+		d, err := keydir.OpenDiskIndex(indexPath, 0, data.NoEncryption)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		state := d.State()
+		if err = d.Save(state); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return state != nil
+	}
+	if !saved() {
+		t.Errorf("index is not saved")
+	}
+
+	// 只读模式不修改保存的索引
+	opt.ReadOnly = true
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check()
+	tinyDB.Close()
+
+	// 复用保存的索引
+	opt.ReadOnly = false
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check()
+	_ = tinyDB.Set([]byte("key0000"), []byte("stale"))
+	tinyDB.Close()
+
+	// 不使用磁盘索引时删除索引文件，之后的写入不会同步到索引中
+	opt.DiskIndex = false
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Errorf("stale index file is not removed: %v", err)
+	}
+	_ = tinyDB.Set([]byte("key0000"), []byte("0"))
+	tinyDB.Close()
+
+	opt.DiskIndex = true
+	tinyDB, err = Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check()
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+	if _, err = os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Errorf("index file is not removed: %v", err)
+	}
+}
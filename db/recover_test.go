@@ -0,0 +1,92 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"errors"
+	"os"
+	"testing"
+)
+
+func Test_RecoverTail(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+	_ = tinyDB.Set([]byte("a"), []byte("1"))
+	_ = tinyDB.Set([]byte("b"), []byte("2"))
+	activeFile := tinyDB.activeFiles[data.String]
+	fileName, writeAt := activeFile.FileName, activeFile.WriteAt
+	tinyDB.Close()
+
+	// 模拟写入中断，只写入entry的前一部分
+	buf := data.EncodeEntry(data.NewEntry([]byte("c"), []byte("3"), data.Insert))
+	fd, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fd.WriteAt(buf[:len(buf)-1], writeAt)
+	_ = fd.Close()
+
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 10
+	opt.StrictRecovery = true
+	if _, err = Open(opt); !errors.Is(err, constants.ErrCorruptedTail) {
+		t.Errorf("strict recovery error: %v", err)
+	}
+
+	tinyDB = openDB(0)
+	if res, _ := tinyDB.Get([]byte("b")); string(res) != "2" {
+		t.Errorf("recover tail error")
+	}
+	if _, err = tinyDB.Get([]byte("c")); err == nil {
+		t.Errorf("recover tail error")
+	}
+	if tinyDB.activeFiles[data.String].WriteAt != writeAt {
+		t.Errorf("recover tail error")
+	}
+	_ = tinyDB.Set([]byte("c"), []byte("4"))
+	tinyDB.Close()
+
+	tinyDB = openDB(0)
+	if res, _ := tinyDB.Get([]byte("c")); string(res) != "4" {
+		t.Errorf("recover tail error")
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
+
+func Test_AppendOnlyFile(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	for _, preallocate := range []bool{false, true} {
+		opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+		opt.FileSizeLimit = 1 << 10
+		opt.Preallocate = preallocate
+		tinyDB, err := Open(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = tinyDB.HSet([]byte("hash"), []byte("a"), []byte("1"))
+		activeFile := tinyDB.activeFiles[data.Hash]
+		fileName, writeAt := activeFile.FileName, activeFile.WriteAt
+		// 文件大小即数据的末尾
+		if stat, _ := os.Stat(fileName); stat.Size() != writeAt {
+			t.Errorf("preallocate %v: file size = %v, want %v", preallocate, stat.Size(), writeAt)
+		}
+		tinyDB.Close()
+
+		// 旧版本预分配的文件末尾全部为0，打开时截断
+		_ = os.Truncate(fileName, opt.FileSizeLimit)
+		tinyDB, err = Open(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat, _ := os.Stat(fileName); stat.Size() != writeAt {
+			t.Errorf("preallocate %v: legacy file size = %v, want %v", preallocate, stat.Size(), writeAt)
+		}
+		if res, _ := tinyDB.HGet([]byte("hash"), []byte("a")); res != "1" {
+			t.Errorf("preallocate %v: hget = %v", preallocate, res)
+		}
+		_ = os.Setenv(constants.DebugEnv, "1")
+		tinyDB.Close()
+		_ = os.Setenv(constants.DebugEnv, "0")
+	}
+}
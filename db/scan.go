@@ -0,0 +1,148 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/keydir"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/util"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultScanCount = 10
+	scanTypeShift    = 61 // SCAN游标的高3位为正在遍历的类型
+	scanPosMask      = 1<<scanTypeShift - 1
+)
+
+// ScanOptions SCAN、HSCAN、SSCAN和ZSCAN的过滤条件
+type ScanOptions struct {
+	Match string          // glob模式，为空时不过滤
+	Count int             // 每次大约检查的元素数量，不大于0时为10，返回的数量可能更多或更少
+	Types []data.DataType // SCAN只遍历这些类型的key，为空时遍历所有类型
+}
+
+func (opt *ScanOptions) count() int {
+	if opt.Count <= 0 {
+		return defaultScanCount
+	}
+	return opt.Count
+}
+
+func (opt *ScanOptions) match(s string) bool {
+	return opt.Match == "" || util.GlobMatch(opt.Match, s)
+}
+
+func (opt *ScanOptions) hasType(dataType data.DataType) bool {
+	if len(opt.Types) == 0 {
+		return true
+	}
+	for _, t := range opt.Types {
+		if t == dataType {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan 遍历所有类型中存在的key，cursor为0时从头开始，返回的next为0时遍历结束
+// 游标的高3位为正在遍历的类型，其余位为索引返回的类型内游标，服务端不保存遍历状态
+// 遍历期间一直存在的key一定会被返回，同名key存在于多种类型时会返回多次
+func (db *TinyDB) Scan(cursor uint64, opt ScanOptions) (next uint64, keys []string, err error) {
+	dataType, pos := data.DataType(cursor>>scanTypeShift), cursor&scanPosMask
+	count, examined := opt.count(), 0
+	for ; dataType <= data.ZSet; dataType, pos = dataType+1, 0 {
+		if !opt.hasType(dataType) {
+			continue
+		}
+		if examined >= count {
+			return uint64(dataType) << scanTypeShift, keys, nil
+		}
+		var batch []string
+		if pos, err = db.scanKeys(dataType, pos, count-examined, func(key string) {
+			batch = append(batch, key)
+		}); err != nil {
+			return 0, nil, err
+		}
+		examined += len(batch)
+		for _, key := range batch {
+			if opt.match(key) && db.keyExists(dataType, []byte(key)) {
+				keys = append(keys, key)
+			}
+		}
+		if pos != 0 {
+			return uint64(dataType)<<scanTypeShift | pos, keys, nil
+		}
+	}
+	return 0, keys, nil
+}
+
+// scanKeys 从pos开始增量遍历dataType索引中的key，next为0时该类型遍历结束
+func (db *TinyDB) scanKeys(dataType data.DataType, pos uint64, count int, fn func(key string)) (next uint64, err error) {
+	switch dataType {
+	case data.String:
+		return db.strKeydir.Scan(pos, count, fn)
+	case data.List:
+		return db.listKeydir.Scan(pos, count, fn)
+	case data.Hash:
+		return db.hashKeydir.Scan(pos, count, fn)
+	case data.Set:
+		return db.setKeydir.Scan(pos, count, fn)
+	case data.ZSet:
+		return db.zsetKeydir.Scan(pos, count, fn)
+	}
+	return 0, nil
+}
+
+// HScan 遍历hash的field，返回field和value交替排列的列表，key不存在时返回空列表
+func (db *TinyDB) HScan(key []byte, cursor uint64, opt ScanOptions) (next uint64, res []string, err error) {
+	db.expireIfNeeded(data.Hash, key)
+	var fields []string
+	next, err = db.hashKeydir.ScanFields(string(key), cursor, opt.count(), func(field string, pos *keydir.EntryPos) {
+		if opt.match(field) {
+			fields = append(fields, field)
+		}
+	})
+	if errors.Is(err, constants.ErrKeyNotFound) {
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	// 持有索引的锁时不能读取数据文件，遍历完成后再读取value
+	for _, field := range fields {
+		entry, err := db.readHash(string(key), field)
+		if err != nil {
+			continue
+		}
+		res = append(res, field, string(entry.Value))
+	}
+	return
+}
+
+// SScan 遍历set的member
+func (db *TinyDB) SScan(key []byte, cursor uint64, opt ScanOptions) (next uint64, res []string, err error) {
+	db.expireIfNeeded(data.Set, key)
+	next, err = db.setKeydir.ScanMembers(string(key), cursor, opt.count(), func(member string) {
+		if opt.match(member) {
+			res = append(res, member)
+		}
+	})
+	if errors.Is(err, constants.ErrKeyNotFound) {
+		return 0, nil, nil
+	}
+	return
+}
+
+// ZScan 遍历zset的member，返回member和score交替排列的列表
+func (db *TinyDB) ZScan(key []byte, cursor uint64, opt ScanOptions) (next uint64, res []interface{}, err error) {
+	db.expireIfNeeded(data.ZSet, key)
+	next, err = db.zsetKeydir.ScanMembers(string(key), cursor, opt.count(), func(member string, score float64) {
+		if opt.match(member) {
+			res = append(res, member, score)
+		}
+	})
+	if errors.Is(err, constants.ErrKeyNotFound) {
+		return 0, nil, nil
+	}
+	return
+}
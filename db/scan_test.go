@@ -0,0 +1,127 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_Scan(t *testing.T) {
+	for _, index := range []string{"map", "ordered", "disk"} {
+		_ = os.Setenv(constants.DebugEnv, "0")
+		opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+		opt.FileSizeLimit = 1 << 12
+		opt.OrderedIndex = index == "ordered"
+		opt.DiskIndex = index == "disk"
+		tinyDB, err := Open(opt)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		for i := 0; i < 200; i++ {
+			_ = tinyDB.Set([]byte(fmt.Sprintf("str%v", i)), []byte("v"))
+		}
+		for i := 0; i < 50; i++ {
+			_, _ = tinyDB.HSet([]byte(fmt.Sprintf("hash%v", i)), []byte("a"), []byte("1"))
+			_, _ = tinyDB.SAdd([]byte(fmt.Sprintf("set%v", i)), []byte("a"))
+		}
+
+		// 遍历期间删除和写入其他key，遍历开始前存在且没有被删除的key都要返回
+		seen := make(map[string]int)
+		var cursor uint64
+		for round := 0; ; round++ {
+			var keys []string
+			cursor, keys, err = tinyDB.Scan(cursor, ScanOptions{Count: 7})
+			if err != nil {
+				t.Fatalf("Scan error: %+v", err)
+			}
+			for _, key := range keys {
+				seen[key]++
+			}
+			_ = tinyDB.Set([]byte(fmt.Sprintf("new%v", round)), []byte("v"))
+			_ = tinyDB.GetDel([]byte(fmt.Sprintf("str%v", 100+round)))
+			if cursor == 0 {
+				break
+			}
+		}
+		for i := 0; i < 100; i++ {
+			if seen[fmt.Sprintf("str%v", i)] == 0 {
+				t.Errorf("index: %v, str%v is missing", index, i)
+			}
+		}
+		for i := 0; i < 50; i++ {
+			if seen[fmt.Sprintf("hash%v", i)] == 0 || seen[fmt.Sprintf("set%v", i)] == 0 {
+				t.Errorf("index: %v, hash%v or set%v is missing", index, i, i)
+			}
+		}
+
+		// MATCH和TYPE
+		matched := 0
+		for cursor = 0; ; {
+			var keys []string
+			cursor, keys, _ = tinyDB.Scan(cursor, ScanOptions{Match: "hash1*", Types: []data.DataType{data.Hash}})
+			matched += len(keys)
+			if cursor == 0 {
+				break
+			}
+		}
+		if matched != 11 {
+			t.Errorf("index: %v, matched = %v", index, matched)
+		}
+		_ = os.Setenv(constants.DebugEnv, "1")
+		tinyDB.Close()
+	}
+}
+
+func Test_HScan(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	opt := DefaultOptions("/Users/southwind/TinyDB/test/0")
+	opt.FileSizeLimit = 1 << 12
+	tinyDB, err := Open(opt)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 100; i++ {
+		_, _ = tinyDB.HSet([]byte("hash"), []byte(fmt.Sprintf("f%v", i)), []byte(fmt.Sprint(i)))
+		_, _ = tinyDB.SAdd([]byte("set"), []byte(fmt.Sprintf("m%v", i)))
+		_, _ = tinyDB.ZAdd([]byte("zset"), "", "", "", "", []byte(fmt.Sprint(i)), []byte(fmt.Sprintf("m%v", i)))
+	}
+	fields := make(map[string]string)
+	for cursor := uint64(0); ; {
+		var res []string
+		if cursor, res, err = tinyDB.HScan([]byte("hash"), cursor, ScanOptions{Count: 15}); err != nil {
+			t.Fatalf("HScan error: %+v", err)
+		}
+		for i := 0; i < len(res); i += 2 {
+			fields[res[i]] = res[i+1]
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(fields) != 100 || fields["f42"] != "42" {
+		t.Errorf("HScan fields = %v", len(fields))
+	}
+	members := 0
+	for cursor := uint64(0); ; {
+		var res []string
+		cursor, res, _ = tinyDB.SScan([]byte("set"), cursor, ScanOptions{Match: "m?"})
+		members += len(res)
+		if cursor == 0 {
+			break
+		}
+	}
+	if members != 10 {
+		t.Errorf("SScan members = %v", members)
+	}
+	cursor, res, _ := tinyDB.ZScan([]byte("zset"), 0, ScanOptions{Match: "m42", Count: 1000})
+	if cursor != 0 || len(res) != 2 || res[0] != "m42" || res[1] != float64(42) {
+		t.Errorf("ZScan = %v, %v", cursor, res)
+	}
+	if cursor, res, err := tinyDB.ZScan([]byte("missing"), 0, ScanOptions{}); cursor != 0 || len(res) != 0 || err != nil {
+		t.Errorf("ZScan missing key = %v, %v, %v", cursor, res, err)
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
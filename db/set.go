@@ -2,63 +2,95 @@ package db
 
 import (
 	"SouthWind6510/TinyDB/data"
-	"SouthWind6510/TinyDB/util"
 )
 
 func (db *TinyDB) SAdd(key []byte, args ...[]byte) (res int, err error) {
+	db.expireIfNeeded(data.Set, key)
+	batch := db.NewWriteBatch()
+	members := make([]string, 0, len(args))
+	added := make(map[string]struct{})
 	for _, member := range args {
-		if db.setKeydir.IsExists(string(key), string(member)) {
+		if _, ok := added[string(member)]; ok || db.setKeydir.IsExists(string(key), string(member)) {
 			continue
 		}
-		entry := data.NewEntry(encodeSubKey(key, member), []byte{}, data.Insert)
-		_, err := db.WriteEntry(entry, data.Set)
-		if err != nil {
-			continue
-		}
-		db.setKeydir.Set(string(key), string(member))
-		res++
+		added[string(member)] = struct{}{}
+		batch.Put(data.Set, data.NewEntry(encodeSubKey(key, member), []byte{}, data.Insert))
+		members = append(members, string(member))
 	}
-	return
+	if _, err = batch.Commit(); err != nil {
+		return 0, err
+	}
+	for _, member := range members {
+		db.setKeydir.Set(string(key), member)
+	}
+	return len(members), nil
 }
 
 func (db *TinyDB) SRem(key []byte, args ...[]byte) (res int, err error) {
+	db.expireIfNeeded(data.Set, key)
+	// 只为存在的member写删除标记，返回实际删除的数量
+	var members [][]byte
+	deleted := make(map[string]struct{})
 	for _, member := range args {
-		entry := data.NewEntry(encodeSubKey(key, member), []byte{}, data.Delete)
-		_, err := db.WriteEntry(entry, data.Set)
-		if err != nil {
+		if _, ok := deleted[string(member)]; ok || !db.setKeydir.IsExists(string(key), string(member)) {
 			continue
 		}
-		db.setKeydir.Del(string(key), string(member))
-		res++
+		deleted[string(member)] = struct{}{}
+		members = append(members, member)
 	}
-	return
+	if len(members) == 0 {
+		return 0, nil
+	}
+	if err = db.deleteSetMembers(key, members...); err != nil {
+		return 0, err
+	}
+	return len(members), nil
 }
 
 func (db *TinyDB) SPop(key []byte, count int) (res []string, err error) {
-	sz, err := db.setKeydir.GetMemberCount(string(key))
+	db.expireIfNeeded(data.Set, key)
+	res, err = db.setKeydir.RandMembers(string(key), count)
 	if err != nil {
 		return nil, err
 	}
-	res = make([]string, util.MinInt(count, sz))
-	for i := 0; i < util.MinInt(count, sz); i++ {
-		pop, err := db.setKeydir.Pop(string(key))
-		if err != nil {
-			continue
-		}
-		res[i] = pop
+	members := make([][]byte, len(res))
+	for i, member := range res {
+		members[i] = []byte(member)
+	}
+	if err = db.deleteSetMembers(key, members...); err != nil {
+		return nil, err
 	}
 	return
 }
 
+// deleteSetMembers 原子地删除key的多个member
+func (db *TinyDB) deleteSetMembers(key []byte, members ...[]byte) (err error) {
+	batch := db.NewWriteBatch()
+	for _, member := range members {
+		batch.Put(data.Set, data.NewEntry(encodeSubKey(key, member), []byte{}, data.Delete))
+	}
+	if _, err = batch.Commit(); err != nil {
+		return err
+	}
+	for _, member := range members {
+		db.setKeydir.Del(string(key), string(member))
+	}
+	db.clearExpireIfEmpty(data.Set, string(key))
+	return nil
+}
+
 func (db *TinyDB) SCard(key []byte) (res int, err error) {
+	db.expireIfNeeded(data.Set, key)
 	return db.setKeydir.GetMemberCount(string(key))
 }
 
 func (db *TinyDB) SMembers(key []byte) (res []string, err error) {
+	db.expireIfNeeded(data.Set, key)
 	return db.setKeydir.GetMembers(string(key))
 }
 
 func (db *TinyDB) SIsMember(key []byte, member []byte) (res int, err error) {
+	db.expireIfNeeded(data.Set, key)
 	exists := db.setKeydir.IsExists(string(key), string(member))
 	if exists {
 		return 1, nil
@@ -67,6 +99,7 @@ func (db *TinyDB) SIsMember(key []byte, member []byte) (res int, err error) {
 }
 
 func (db *TinyDB) SMIsMember(keys []byte, members ...[]byte) (res []int, err error) {
+	db.expireIfNeeded(data.Set, keys)
 	res = make([]int, len(members))
 	for i, member := range members {
 		res[i] = 0
@@ -78,6 +111,7 @@ func (db *TinyDB) SMIsMember(keys []byte, members ...[]byte) (res []int, err err
 }
 
 func (db *TinyDB) SRandMember(key []byte, count int) (res []string, err error) {
+	db.expireIfNeeded(data.Set, key)
 	if count > 0 {
 		return db.setKeydir.RandMembers(string(key), count)
 	}
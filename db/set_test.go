@@ -31,7 +31,10 @@ func Test_Set(t *testing.T) {
 	}
 
 	// 2 3 4 5
-	if res, _ := tinyDB.SRem([]byte("set1"), []byte("1")); res != 1 {
+	if res, _ := tinyDB.SRem([]byte("set1"), []byte("1"), []byte("1"), []byte("6")); res != 1 {
+		t.Error("SRem failed")
+	}
+	if res, _ := tinyDB.SRem([]byte("set1"), []byte("1")); res != 0 {
 		t.Error("SRem failed")
 	}
 
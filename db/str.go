@@ -7,19 +7,35 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 func (db *TinyDB) Set(key, value []byte) (err error) {
+	return db.SetEX(key, value, 0)
+}
+
+// SetEX 写入key并设置过期时间，expireAt为毫秒时间戳，为0表示不过期
+func (db *TinyDB) SetEX(key, value []byte, expireAt int64) (err error) {
 	entry := data.NewEntry(key, value, data.Insert)
+	entry.Header.ExpiryTime = uint64(expireAt)
 	pos, err := db.WriteEntry(entry, data.String)
 	if err != nil {
 		return err
 	}
 	db.strKeydir.Set(string(key), pos)
+	db.setExpire(data.String, string(key), expireAt)
 	return
 }
 
+// SetKeepTTL 写入key并保留原有的过期时间
+func (db *TinyDB) SetKeepTTL(key, value []byte) (err error) {
+	db.expireIfNeeded(data.String, key)
+	expireAt, _ := db.expireKeydirs[data.String].Get(string(key))
+	return db.SetEX(key, value, expireAt)
+}
+
 func (db *TinyDB) SetNX(key, value []byte) (res int) {
+	db.expireIfNeeded(data.String, key)
 	_, err := db.strKeydir.Get(string(key))
 	if errors.Is(err, constants.ErrKeyNotFound) {
 		return util.BoolToInt(db.Set(key, value) == nil)
@@ -29,17 +45,35 @@ func (db *TinyDB) SetNX(key, value []byte) (res int) {
 
 func (db *TinyDB) MSetNX(args ...[]byte) (res int) {
 	for i := 0; i < len(args); i += 2 {
+		db.expireIfNeeded(data.String, args[i])
 		_, err := db.strKeydir.Get(string(args[i]))
 		if !errors.Is(err, constants.ErrKeyNotFound) {
 			return 0
 		}
 	}
-	for i := 0; i < len(args); i += 2 {
-		_ = db.Set(args[i], args[i+1])
+	if err := db.MSet(args...); err != nil {
+		return 0
 	}
 	return 1
 }
 
+// MSet 原子地写入多个key，args为key value对
+func (db *TinyDB) MSet(args ...[]byte) (err error) {
+	batch := db.NewWriteBatch()
+	for i := 0; i+1 < len(args); i += 2 {
+		batch.Put(data.String, data.NewEntry(args[i], args[i+1], data.Insert))
+	}
+	positions, err := batch.Commit()
+	if err != nil {
+		return err
+	}
+	for i, pos := range positions {
+		db.strKeydir.Set(string(args[2*i]), pos)
+		db.setExpire(data.String, string(args[2*i]), 0)
+	}
+	return nil
+}
+
 func (db *TinyDB) SetRange(key, value []byte, offset int) (res int, err error) {
 	bytes, err := db.Get(key)
 	str := string(bytes)
@@ -53,7 +87,7 @@ func (db *TinyDB) SetRange(key, value []byte, offset int) (res int, err error) {
 	newRunes := append(runes[:offset], []rune(string(value))...)
 	newRunes = append(newRunes, runes[offset+len(value):]...)
 	newString := string(newRunes)
-	_ = db.Set(key, []byte(newString))
+	_ = db.SetKeepTTL(key, []byte(newString))
 	return len(newString), nil
 }
 
@@ -67,7 +101,7 @@ func (db *TinyDB) Incr(key []byte, incr int64) (res int64, err error) {
 		return 0, err
 	}
 	res += incr
-	_ = db.Set(key, []byte(fmt.Sprintf("%v", res)))
+	_ = db.SetKeepTTL(key, []byte(fmt.Sprintf("%v", res)))
 	return res, nil
 }
 
@@ -81,7 +115,7 @@ func (db *TinyDB) IncrByFloat(key []byte, incr float64) (res float64, err error)
 		return 0, err
 	}
 	res += incr
-	_ = db.Set(key, []byte(fmt.Sprintf("%v", res)))
+	_ = db.SetKeepTTL(key, []byte(fmt.Sprintf("%v", res)))
 	return res, nil
 }
 
@@ -91,16 +125,13 @@ func (db *TinyDB) Append(key, value []byte) (res int, err error) {
 		bytes = []byte("")
 	}
 	bytes = append(bytes, value...)
-	_ = db.Set(key, bytes)
+	_ = db.SetKeepTTL(key, bytes)
 	return len(string(bytes)), nil
 }
 
 func (db *TinyDB) Get(key []byte) ([]byte, error) {
-	pos, err := db.strKeydir.Get(string(key))
-	if err != nil {
-		return nil, err
-	}
-	entry, err := db.ReadEntry(data.String, pos)
+	db.expireIfNeeded(data.String, key)
+	entry, err := db.readStr(string(key))
 	if err != nil {
 		return nil, err
 	}
@@ -133,8 +164,25 @@ func (db *TinyDB) GetDel(key []byte) interface{} {
 	if errors.Is(err, constants.ErrKeyNotFound) {
 		return nil
 	}
-	entry := data.NewEntry(key, []byte{}, data.Delete)
-	_, _ = db.WriteEntry(entry, data.String)
-	db.strKeydir.Del(string(key))
+	_ = db.deleteKey(data.String, key)
 	return string(res)
 }
+
+// GetEX 获取key的值并修改过期时间，expireAt为毫秒时间戳，persist为true时取消过期时间
+func (db *TinyDB) GetEX(key []byte, expireAt int64, persist bool) ([]byte, error) {
+	res, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if expireAt > 0 && expireAt <= time.Now().UnixMilli() {
+		err = db.deleteKey(data.String, key)
+	} else if expireAt > 0 {
+		err = db.writeExpire(data.String, key, expireAt)
+	} else if _, getErr := db.expireKeydirs[data.String].Get(string(key)); persist && getErr == nil {
+		err = db.writeExpire(data.String, key, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/data"
+)
+
+// Watcher 乐观锁，监视的key被修改后标记为dirty，事务不再执行
+// key不区分类型，任意类型中的同名key被修改都会触发
+type Watcher struct {
+	db    *TinyDB
+	keys  map[string]struct{}
+	dirty bool
+}
+
+func (db *TinyDB) NewWatcher() *Watcher {
+	return &Watcher{
+		db:   db,
+		keys: make(map[string]struct{}),
+	}
+}
+
+func (w *Watcher) Watch(keys ...[]byte) {
+	w.db.watchMu.Lock()
+	defer w.db.watchMu.Unlock()
+	for _, key := range keys {
+		k := string(key)
+		w.keys[k] = struct{}{}
+		if w.db.watchedKeys[k] == nil {
+			w.db.watchedKeys[k] = make(map[*Watcher]struct{})
+		}
+		w.db.watchedKeys[k][w] = struct{}{}
+	}
+}
+
+// Unwatch 取消监视所有key并清除dirty标记
+func (w *Watcher) Unwatch() {
+	w.db.watchMu.Lock()
+	defer w.db.watchMu.Unlock()
+	for k := range w.keys {
+		delete(w.db.watchedKeys[k], w)
+		if len(w.db.watchedKeys[k]) == 0 {
+			delete(w.db.watchedKeys, k)
+		}
+	}
+	w.keys = make(map[string]struct{})
+	w.dirty = false
+}
+
+// Dirty 监视的key是否已被修改
+func (w *Watcher) Dirty() bool {
+	w.db.watchMu.Lock()
+	defer w.db.watchMu.Unlock()
+	return w.dirty
+}
+
+// Do 执行普通命令，与Exec互斥
+func (db *TinyDB) Do(fn func()) {
+	db.txMu.RLock()
+	defer db.txMu.RUnlock()
+	fn()
+}
+
+// Exec 独占执行事务，执行期间其他命令不会穿插执行；w中监视的key已被修改时不执行，返回false
+// 执行后w取消监视所有key，w为nil时不检查
+func (db *TinyDB) Exec(w *Watcher, fn func()) bool {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	if w != nil {
+		defer w.Unwatch()
+		if w.Dirty() {
+			return false
+		}
+	}
+	fn()
+	return true
+}
+
+// touchKey 写入entry后标记监视该key的watcher
+func (db *TinyDB) touchKey(dataType data.DataType, entry *data.Entry) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if len(db.watchedKeys) == 0 || entry.Header.Type == data.BatchCommit {
+		return
+	}
+	for w := range db.watchedKeys[string(userKey(dataType, entry))] {
+		w.dirty = true
+	}
+}
+
+// userKey 从entry中解析出用户的key
+func userKey(dataType data.DataType, entry *data.Entry) []byte {
+	switch entry.Header.Type {
+	case data.Expire, data.DeleteKey, data.InsertListMeta:
+		return entry.Key
+	}
+	switch dataType {
+	case data.List:
+		key, _ := decodeListKey(entry.Key)
+		return key
+	case data.Hash, data.Set, data.ZSet:
+		key, _ := decodeSubKey(entry.Key)
+		return key
+	default:
+		return entry.Key
+	}
+}
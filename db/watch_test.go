@@ -0,0 +1,54 @@
+package db
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"os"
+	"testing"
+)
+
+func Test_Watch(t *testing.T) {
+	_ = os.Setenv(constants.DebugEnv, "0")
+	tinyDB := openDB(0)
+	w := tinyDB.NewWatcher()
+	w.Watch([]byte("str"), []byte("hash"), []byte("list"))
+	_ = tinyDB.Set([]byte("other"), []byte("1"))
+	if w.Dirty() {
+		t.Errorf("watcher is dirty without modification")
+	}
+	executed := false
+	if !tinyDB.Exec(w, func() { executed = true }) || !executed {
+		t.Errorf("exec error")
+	}
+
+	// 任意类型中的同名key被修改都会使事务失败
+	modify := []func(){
+		func() { _ = tinyDB.Set([]byte("str"), []byte("1")) },
+		func() { _, _ = tinyDB.HSet([]byte("hash"), []byte("f"), []byte("1")) },
+		func() { _, _ = tinyDB.LPush([]byte("list"), true, []byte("1")) },
+		func() { _, _ = tinyDB.SAdd([]byte("str"), []byte("m")) },
+		func() { _, _ = tinyDB.Expire([]byte("hash"), 1) },
+	}
+	for i, fn := range modify {
+		w.Watch([]byte("str"), []byte("hash"), []byte("list"))
+		fn()
+		if !w.Dirty() {
+			t.Errorf("modify %v: watcher is not dirty", i)
+		}
+		executed = false
+		if tinyDB.Exec(w, func() { executed = true }) || executed {
+			t.Errorf("modify %v: exec should be aborted", i)
+		}
+		if w.Dirty() {
+			t.Errorf("modify %v: watcher is not reset after exec", i)
+		}
+	}
+
+	w.Watch([]byte("str"))
+	w.Unwatch()
+	_ = tinyDB.Set([]byte("str"), []byte("2"))
+	if w.Dirty() || len(tinyDB.watchedKeys) != 0 {
+		t.Errorf("unwatch error")
+	}
+	_ = os.Setenv(constants.DebugEnv, "1")
+	tinyDB.Close()
+}
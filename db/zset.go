@@ -14,23 +14,56 @@ import (
 )
 
 func (db *TinyDB) ZSetInsertEntry(key []byte, member []byte, score float64) (err error) {
-	entry := data.NewEntry(encodeSubKey(key, member), []byte(fmt.Sprintf("%v", score)), data.Insert)
-	_, err = db.WriteEntry(entry, data.ZSet)
+	_, err = db.WriteEntry(newZSetInsertEntry(key, member, score), data.ZSet)
 	return
 }
 
 func (db *TinyDB) ZSetDeleteEntry(key []byte, member []byte) (err error) {
-	entry := data.NewEntry(encodeSubKey(key, member), []byte{}, data.Delete)
-	_, err = db.WriteEntry(entry, data.ZSet)
+	_, err = db.WriteEntry(newZSetDeleteEntry(key, member), data.ZSet)
 	return
 }
 
+func newZSetInsertEntry(key []byte, member []byte, score float64) *data.Entry {
+	return data.NewEntry(encodeSubKey(key, member), []byte(fmt.Sprintf("%v", score)), data.Insert)
+}
+
+func newZSetDeleteEntry(key []byte, member []byte) *data.Entry {
+	return data.NewEntry(encodeSubKey(key, member), []byte{}, data.Delete)
+}
+
+// deleteZSetMembers 原子地删除key的多个member，scores为member当前的score
+func (db *TinyDB) deleteZSetMembers(key []byte, members []string, scores []float64) (err error) {
+	batch := db.NewWriteBatch()
+	for _, member := range members {
+		batch.Put(data.ZSet, newZSetDeleteEntry(key, []byte(member)))
+	}
+	if _, err = batch.Commit(); err != nil {
+		return err
+	}
+	for i, member := range members {
+		db.zsetKeydir.Del(string(key), member, scores[i])
+	}
+	db.clearExpireIfEmpty(data.ZSet, string(key))
+	return nil
+}
+
 // ZAdd
 // opt1: NX | XX
 // opt2: GT | LT
 // opt3: CH
 // opt4: INCR
 func (db *TinyDB) ZAdd(key []byte, opt1, opt2, opt3, opt4 string, args ...[]byte) (res int, err error) {
+	db.expireIfNeeded(data.ZSet, key)
+	type zaddOp struct {
+		member   string
+		score    float64
+		oldScore float64
+		exists   bool
+	}
+	var ops []*zaddOp
+	// 同一个member可能出现多次，以本批次中最后写入的score为准
+	added := make(map[string]*zaddOp)
+	batch := db.NewWriteBatch()
 	for i := 0; i+1 < len(args); i += 2 {
 		var score float64
 		// redis 协议要求score取值为[2^53, -2^53]
@@ -45,12 +78,19 @@ func (db *TinyDB) ZAdd(key []byte, opt1, opt2, opt3, opt4 string, args ...[]byte
 				continue
 			}
 		}
-		getScore, err := db.zsetKeydir.GetScore(string(key), string(args[i+1]))
-		if err != nil && !errors.Is(err, constants.ErrKeyNotFound) && !errors.Is(err, constants.ErrMemberNotExist) {
-			logger.Log.Errorf("zadd get score err: %v", err)
-			continue
+		member := string(args[i+1])
+		var getScore float64
+		var exists bool
+		if op, ok := added[member]; ok {
+			getScore, exists = op.score, true
+		} else {
+			getScore, err = db.zsetKeydir.GetScore(string(key), member)
+			if err != nil && !errors.Is(err, constants.ErrKeyNotFound) && !errors.Is(err, constants.ErrMemberNotExist) {
+				logger.Log.Errorf("zadd get score err: %v", err)
+				continue
+			}
+			exists = err == nil
 		}
-		exists := err == nil
 		// 只添加不更新
 		if opt1 == "nx" && exists {
 			continue
@@ -70,37 +110,45 @@ func (db *TinyDB) ZAdd(key []byte, opt1, opt2, opt3, opt4 string, args ...[]byte
 		if opt4 == "incr" {
 			score += getScore
 		}
-		// 持久化
-		err = db.ZSetInsertEntry(key, args[i+1], score)
-		if err != nil {
-			logger.Log.Errorf("zadd insert entry err: %v", err)
-			continue
-		}
-		// 更新索引
-		if exists && score != getScore {
-			db.zsetKeydir.Update(string(key), string(args[i+1]), getScore, score)
-		} else {
-			db.zsetKeydir.Set(string(key), string(args[i+1]), score)
-		}
+		batch.Put(data.ZSet, newZSetInsertEntry(key, args[i+1], score))
+		op := &zaddOp{member: member, score: score, oldScore: getScore, exists: exists}
+		ops = append(ops, op)
+		added[member] = op
 		if opt3 == "ch" && (!exists || score != getScore) {
 			res++
 		} else if !exists {
 			res++
 		}
 	}
-	return
+	// 持久化
+	if _, err = batch.Commit(); err != nil {
+		logger.Log.Errorf("zadd insert entry err: %v", err)
+		return 0, err
+	}
+	// 更新索引
+	for _, op := range ops {
+		if op.exists && op.score != op.oldScore {
+			db.zsetKeydir.Update(string(key), op.member, op.oldScore, op.score)
+		} else {
+			db.zsetKeydir.Set(string(key), op.member, op.score)
+		}
+	}
+	return res, nil
 }
 
 func (db *TinyDB) ZCard(key []byte) (res int64, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	return db.zsetKeydir.GetMemberCount(string(key)), nil
 }
 
 // ZCount score在区间内的member数，仅支持闭区间
 func (db *TinyDB) ZCount(key []byte, min, max float64) (res int64, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	return db.zsetKeydir.GetCountByScore(string(key), min, max), nil
 }
 
 func (db *TinyDB) ZIncrBy(key []byte, increment float64, member []byte) (res float64, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	getScore, err := db.zsetKeydir.GetScore(string(key), string(member))
 	if err != nil && !errors.Is(err, constants.ErrKeyNotFound) {
 		return
@@ -120,6 +168,7 @@ func (db *TinyDB) ZIncrBy(key []byte, increment float64, member []byte) (res flo
 }
 
 func (db *TinyDB) ZMScore(key []byte, members ...[]byte) (res []interface{}, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	res = make([]interface{}, len(members))
 	for i, member := range members {
 		res[i], err = db.zsetKeydir.GetScore(string(key), string(member))
@@ -131,28 +180,34 @@ func (db *TinyDB) ZMScore(key []byte, members ...[]byte) (res []interface{}, err
 }
 
 func (db *TinyDB) ZPop(key []byte, isLeft bool, count int) (res []interface{}, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	length := db.zsetKeydir.GetMemberCount(string(key))
-	res = make([]interface{}, util.MinInt(count, int(length))*2)
-	for i := 0; i < len(res); i += 2 {
-		rank := int64(-1)
-		if isLeft {
-			rank = int64(0)
-		}
-		member, score, _ := db.zsetKeydir.GetMemberByRank(string(key), rank)
-		// 持久化
-		err = db.ZSetDeleteEntry(key, []byte(member))
-		if err != nil {
-			continue
-		}
-		// 更新索引
-		db.zsetKeydir.Del(string(key), member, score)
-		res[i] = member
-		res[i+1] = score
+	n := int64(util.MinInt(count, int(length)))
+	if n <= 0 {
+		return make([]interface{}, 0), nil
+	}
+	var members []string
+	var scores []float64
+	if isLeft {
+		members, scores, err = db.zsetKeydir.GetRangeByRank(string(key), 0, n-1, false)
+	} else {
+		members, scores, err = db.zsetKeydir.GetRangeByRank(string(key), -n, -1, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = db.deleteZSetMembers(key, members, scores); err != nil {
+		return nil, err
+	}
+	res = make([]interface{}, 0, 2*len(members))
+	for i, member := range members {
+		res = append(res, member, scores[i])
 	}
 	return
 }
 
 func (db *TinyDB) ZRandMember(key []byte, count int, withScores bool) (res []interface{}, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	length := db.zsetKeydir.GetMemberCount(string(key))
 	if count > 0 {
 		res = make([]interface{}, util.MinInt(count, int(length))*(1+util.BoolToInt(withScores)))
@@ -183,6 +238,7 @@ func (db *TinyDB) ZRandMember(key []byte, count int, withScores bool) (res []int
 }
 
 func (db *TinyDB) ZRange(key []byte, start, end float64, byScore, rev bool, withScores int) (res []interface{}, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	var members []string
 	var scores []float64
 	if byScore {
@@ -203,6 +259,7 @@ func (db *TinyDB) ZRange(key []byte, start, end float64, byScore, rev bool, with
 }
 
 func (db *TinyDB) ZRank(key []byte, member []byte, withScore bool) (res []interface{}, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	rank, score, err := db.zsetKeydir.GetRank(string(key), string(member))
 	if err != nil {
 		return nil, err
@@ -215,30 +272,35 @@ func (db *TinyDB) ZRank(key []byte, member []byte, withScore bool) (res []interf
 }
 
 func (db *TinyDB) ZRem(key []byte, members ...[]byte) (res int64, err error) {
+	db.expireIfNeeded(data.ZSet, key)
+	var exists []string
+	var scores []float64
 	for _, member := range members {
-		// 持久化
-		err = db.ZSetDeleteEntry(key, member)
+		score, err := db.zsetKeydir.GetScore(string(key), string(member))
 		if err != nil {
 			continue
 		}
-		// 更新索引
-		if db.zsetKeydir.DeleteWithoutScore(string(key), string(member)) {
-			res++
-		}
+		exists = append(exists, string(member))
+		scores = append(scores, score)
 	}
-	return
+	if err = db.deleteZSetMembers(key, exists, scores); err != nil {
+		return 0, err
+	}
+	return int64(len(exists)), nil
 }
 
 func (db *TinyDB) ZRemRange(key []byte, start, end float64, byScore bool) (res int64, err error) {
+	db.expireIfNeeded(data.ZSet, key)
 	var members []string
+	var scores []float64
 	if byScore {
-		members = db.zsetKeydir.DeleteRangeByScore(string(key), start, end)
+		members, scores, _ = db.zsetKeydir.GetRangeByScore(string(key), start, end, false)
 	} else {
-		members = db.zsetKeydir.DeleteRangeByRank(string(key), int64(start), int64(end))
+		members, scores, _ = db.zsetKeydir.GetRangeByRank(string(key), int64(start), int64(end), false)
 	}
 	// 持久化
-	for _, member := range members {
-		_ = db.ZSetDeleteEntry(key, []byte(member))
+	if err = db.deleteZSetMembers(key, members, scores); err != nil {
+		return 0, err
 	}
 	return int64(len(members)), nil
 }
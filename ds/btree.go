@@ -0,0 +1,322 @@
+package ds
+
+import "sort"
+
+const DefaultBTreeDegree = 32
+
+// 参考CLRS第18章，插入时预先分裂满节点，删除时预先补足子节点，只需自上而下遍历一次
+
+type bTreeItem struct {
+	key   string
+	value interface{}
+}
+
+type bTreeNode struct {
+	items    []bTreeItem
+	children []*bTreeNode // 叶子节点为空，否则比items多一个
+}
+
+// BTree 以string为key的B树，key按字典序排列，支持按范围顺序或倒序遍历，不是并发安全的
+type BTree struct {
+	degree int // 除根节点外每个节点有degree-1到2*degree-1个item
+	root   *bTreeNode
+	length int
+}
+
+// NewBTree 创建一个B树，degree小于2时使用DefaultBTreeDegree
+func NewBTree(degree int) *BTree {
+	if degree < 2 {
+		degree = DefaultBTreeDegree
+	}
+	return &BTree{degree: degree}
+}
+
+func (t *BTree) Len() int {
+	return t.length
+}
+
+func (t *BTree) maxItems() int {
+	return 2*t.degree - 1
+}
+
+func (t *BTree) minItems() int {
+	return t.degree - 1
+}
+
+func (t *BTree) Get(key string) (value interface{}, ok bool) {
+	for n := t.root; n != nil; {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].value, true
+		}
+		if n.leaf() {
+			return nil, false
+		}
+		n = n.children[i]
+	}
+	return nil, false
+}
+
+// Set 插入或替换key，返回被替换的value
+func (t *BTree) Set(key string, value interface{}) (old interface{}, replaced bool) {
+	item := bTreeItem{key: key, value: value}
+	if t.root == nil {
+		t.root = &bTreeNode{items: []bTreeItem{item}}
+		t.length++
+		return nil, false
+	}
+	if len(t.root.items) >= t.maxItems() {
+		mid, right := t.root.split(t.maxItems() / 2)
+		t.root = &bTreeNode{items: []bTreeItem{mid}, children: []*bTreeNode{t.root, right}}
+	}
+	if old, replaced = t.root.insert(item, t.maxItems()); !replaced {
+		t.length++
+	}
+	return
+}
+
+// Delete 删除key，返回被删除的value
+func (t *BTree) Delete(key string) (value interface{}, ok bool) {
+	if t.root == nil {
+		return nil, false
+	}
+	item, ok := t.root.remove(key, false, t.minItems())
+	if len(t.root.items) == 0 {
+		if t.root.leaf() {
+			t.root = nil
+		} else {
+			t.root = t.root.children[0]
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	t.length--
+	return item.value, true
+}
+
+// Ascend 按key升序遍历所有元素，fn返回false时停止
+func (t *BTree) Ascend(fn func(key string, value interface{}) bool) {
+	if t.root != nil {
+		t.root.ascend(nil, fn)
+	}
+}
+
+// AscendGreaterOrEqual 按key升序遍历不小于pivot的元素，fn返回false时停止
+func (t *BTree) AscendGreaterOrEqual(pivot string, fn func(key string, value interface{}) bool) {
+	if t.root != nil {
+		t.root.ascend(&pivot, fn)
+	}
+}
+
+// Descend 按key降序遍历所有元素，fn返回false时停止
+func (t *BTree) Descend(fn func(key string, value interface{}) bool) {
+	if t.root != nil {
+		t.root.descend(nil, fn)
+	}
+}
+
+// DescendLessOrEqual 按key降序遍历不大于pivot的元素，fn返回false时停止
+func (t *BTree) DescendLessOrEqual(pivot string, fn func(key string, value interface{}) bool) {
+	if t.root != nil {
+		t.root.descend(&pivot, fn)
+	}
+}
+
+func (n *bTreeNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// find 返回第一个不小于key的item的下标，found表示该item的key等于key
+func (n *bTreeNode) find(key string) (i int, found bool) {
+	i = sort.Search(len(n.items), func(i int) bool {
+		return n.items[i].key >= key
+	})
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+// split 以第i个item分裂节点，返回该item和右半部分组成的新节点
+func (n *bTreeNode) split(i int) (bTreeItem, *bTreeNode) {
+	item := n.items[i]
+	right := &bTreeNode{items: append([]bTreeItem(nil), n.items[i+1:]...)}
+	for j := i; j < len(n.items); j++ {
+		n.items[j] = bTreeItem{}
+	}
+	n.items = n.items[:i]
+	if !n.leaf() {
+		right.children = append([]*bTreeNode(nil), n.children[i+1:]...)
+		for j := i + 1; j < len(n.children); j++ {
+			n.children[j] = nil
+		}
+		n.children = n.children[:i+1]
+	}
+	return item, right
+}
+
+// insert 插入item，经过的满子节点先分裂，保证叶子节点有空间
+func (n *bTreeNode) insert(item bTreeItem, maxItems int) (old interface{}, replaced bool) {
+	i, found := n.find(item.key)
+	if found {
+		old = n.items[i].value
+		n.items[i].value = item.value
+		return old, true
+	}
+	if n.leaf() {
+		n.items = insertItemAt(n.items, i, item)
+		return nil, false
+	}
+	if len(n.children[i].items) >= maxItems {
+		mid, right := n.children[i].split(maxItems / 2)
+		n.items = insertItemAt(n.items, i, mid)
+		n.children = insertChildAt(n.children, i+1, right)
+		if item.key == mid.key {
+			old = n.items[i].value
+			n.items[i].value = item.value
+			return old, true
+		} else if item.key > mid.key {
+			i++
+		}
+	}
+	return n.children[i].insert(item, maxItems)
+}
+
+// remove 删除key，max为true时删除最大的item，经过的子节点item数不足时先从兄弟节点借或合并
+func (n *bTreeNode) remove(key string, max bool, minItems int) (bTreeItem, bool) {
+	var i int
+	var found bool
+	if max {
+		i = len(n.items)
+		if n.leaf() {
+			item := n.items[i-1]
+			n.items = removeItemAt(n.items, i-1)
+			return item, true
+		}
+	} else {
+		i, found = n.find(key)
+		if n.leaf() {
+			if !found {
+				return bTreeItem{}, false
+			}
+			item := n.items[i]
+			n.items = removeItemAt(n.items, i)
+			return item, true
+		}
+	}
+	if len(n.children[i].items) <= minItems {
+		n.growChild(i, minItems)
+		return n.remove(key, max, minItems)
+	}
+	if found {
+		// 用左子树中最大的item替换被删除的item
+		item := n.items[i]
+		n.items[i], _ = n.children[i].remove("", true, minItems)
+		return item, true
+	}
+	return n.children[i].remove(key, max, minItems)
+}
+
+// growChild 第i个子节点item数不足，从左右兄弟借一个item，兄弟也不足时与兄弟合并
+func (n *bTreeNode) growChild(i int, minItems int) {
+	if i > 0 && len(n.children[i-1].items) > minItems {
+		child, left := n.children[i], n.children[i-1]
+		child.items = insertItemAt(child.items, 0, n.items[i-1])
+		n.items[i-1] = left.items[len(left.items)-1]
+		left.items = removeItemAt(left.items, len(left.items)-1)
+		if !left.leaf() {
+			child.children = insertChildAt(child.children, 0, left.children[len(left.children)-1])
+			left.children = removeChildAt(left.children, len(left.children)-1)
+		}
+		return
+	}
+	if i < len(n.items) && len(n.children[i+1].items) > minItems {
+		child, right := n.children[i], n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.items[0]
+		right.items = removeItemAt(right.items, 0)
+		if !right.leaf() {
+			child.children = append(child.children, right.children[0])
+			right.children = removeChildAt(right.children, 0)
+		}
+		return
+	}
+	if i >= len(n.items) {
+		i--
+	}
+	child, right := n.children[i], n.children[i+1]
+	child.items = append(child.items, n.items[i])
+	child.items = append(child.items, right.items...)
+	child.children = append(child.children, right.children...)
+	n.items = removeItemAt(n.items, i)
+	n.children = removeChildAt(n.children, i+1)
+}
+
+func (n *bTreeNode) ascend(pivot *string, fn func(key string, value interface{}) bool) bool {
+	i := 0
+	if pivot != nil {
+		i, _ = n.find(*pivot)
+	}
+	for ; i < len(n.items); i++ {
+		if !n.leaf() && !n.children[i].ascend(pivot, fn) {
+			return false
+		}
+		// 之后的item和子树都大于pivot
+		pivot = nil
+		if !fn(n.items[i].key, n.items[i].value) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.items)].ascend(pivot, fn)
+	}
+	return true
+}
+
+func (n *bTreeNode) descend(pivot *string, fn func(key string, value interface{}) bool) bool {
+	i := len(n.items)
+	if pivot != nil {
+		var found bool
+		if i, found = n.find(*pivot); found {
+			if !fn(n.items[i].key, n.items[i].value) {
+				return false
+			}
+			pivot = nil
+		}
+	}
+	// 依次遍历第i个子树和第i-1个item
+	for ; i >= 0; i-- {
+		if !n.leaf() && !n.children[i].descend(pivot, fn) {
+			return false
+		}
+		pivot = nil
+		if i > 0 && !fn(n.items[i-1].key, n.items[i-1].value) {
+			return false
+		}
+	}
+	return true
+}
+
+func insertItemAt(items []bTreeItem, i int, item bTreeItem) []bTreeItem {
+	items = append(items, bTreeItem{})
+	copy(items[i+1:], items[i:])
+	items[i] = item
+	return items
+}
+
+func removeItemAt(items []bTreeItem, i int) []bTreeItem {
+	copy(items[i:], items[i+1:])
+	items[len(items)-1] = bTreeItem{}
+	return items[:len(items)-1]
+}
+
+func insertChildAt(children []*bTreeNode, i int, child *bTreeNode) []*bTreeNode {
+	children = append(children, nil)
+	copy(children[i+1:], children[i:])
+	children[i] = child
+	return children
+}
+
+func removeChildAt(children []*bTreeNode, i int) []*bTreeNode {
+	copy(children[i:], children[i+1:])
+	children[len(children)-1] = nil
+	return children[:len(children)-1]
+}
@@ -0,0 +1,88 @@
+package ds
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestBTree(t *testing.T) {
+	tree := NewBTree(2)
+	want := make(map[string]int)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("%04d", rnd.Intn(2000))
+		if rnd.Intn(3) == 0 {
+			_, ok := tree.Delete(key)
+			if _, exist := want[key]; ok != exist {
+				t.Fatalf("Delete %v = %v, want %v", key, ok, exist)
+			}
+			delete(want, key)
+		} else {
+			_, replaced := tree.Set(key, i)
+			if _, exist := want[key]; replaced != exist {
+				t.Fatalf("Set %v replaced = %v, want %v", key, replaced, exist)
+			}
+			want[key] = i
+		}
+	}
+	if tree.Len() != len(want) {
+		t.Fatalf("Len = %v, want %v", tree.Len(), len(want))
+	}
+	keys := make([]string, 0, len(want))
+	for key, value := range want {
+		keys = append(keys, key)
+		if got, ok := tree.Get(key); !ok || got != value {
+			t.Errorf("Get %v = %v, want %v", key, got, value)
+		}
+	}
+	sort.Strings(keys)
+
+	collect := func(iterate func(fn func(key string, value interface{}) bool)) (res []string) {
+		iterate(func(key string, value interface{}) bool {
+			res = append(res, key)
+			return true
+		})
+		return
+	}
+	check := func(name string, got, want []string) {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v = %v, want %v", name, got, want)
+		}
+	}
+	check("Ascend", collect(tree.Ascend), keys)
+	reversed := make([]string, len(keys))
+	for i, key := range keys {
+		reversed[len(keys)-1-i] = key
+	}
+	check("Descend", collect(tree.Descend), reversed)
+	for _, pivot := range []string{"", "0000", "0500", "05005", "1999", "2000", keys[len(keys)/2]} {
+		i := sort.SearchStrings(keys, pivot)
+		check("AscendGreaterOrEqual "+pivot, collect(func(fn func(key string, value interface{}) bool) {
+			tree.AscendGreaterOrEqual(pivot, fn)
+		}), keys[i:])
+		j := len(keys) - i
+		if i < len(keys) && keys[i] == pivot {
+			j--
+		}
+		check("DescendLessOrEqual "+pivot, collect(func(fn func(key string, value interface{}) bool) {
+			tree.DescendLessOrEqual(pivot, fn)
+		}), reversed[j:])
+	}
+	// 提前停止
+	var count int
+	tree.Ascend(func(key string, value interface{}) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Errorf("Ascend stopped after %v items", count)
+	}
+	for _, key := range keys {
+		tree.Delete(key)
+	}
+	if tree.Len() != 0 || tree.root != nil {
+		t.Errorf("tree is not empty after deleting all keys")
+	}
+}
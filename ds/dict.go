@@ -0,0 +1,144 @@
+package ds
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+)
+
+const dictMinSize = 4
+
+// 参考Redis的dict，元素数量超过桶数量时扩容一倍，少于桶数量的1/8时缩容一半
+// Scan按反向二进制顺序遍历桶，两次调用之间扩容或缩容时，遍历期间一直存在的元素不会被遗漏，但可能重复返回
+
+var dictSeed = maphash.MakeSeed()
+
+type dictEntry struct {
+	key   string
+	value interface{}
+	next  *dictEntry
+}
+
+// Dict 以string为key、支持增量遍历的哈希表，不是并发安全的
+type Dict struct {
+	buckets []*dictEntry // 数量为2的幂，按hash的低位分桶
+	length  int
+}
+
+func NewDict() *Dict {
+	return &Dict{buckets: make([]*dictEntry, dictMinSize)}
+}
+
+func (d *Dict) Len() int {
+	return d.length
+}
+
+func (d *Dict) bucket(key string) uint64 {
+	return maphash.String(dictSeed, key) & uint64(len(d.buckets)-1)
+}
+
+func (d *Dict) Get(key string) (value interface{}, ok bool) {
+	for e := d.buckets[d.bucket(key)]; e != nil; e = e.next {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	return nil, false
+}
+
+// Set 插入或替换key，返回是否替换了已有的key
+func (d *Dict) Set(key string, value interface{}) (replaced bool) {
+	b := d.bucket(key)
+	for e := d.buckets[b]; e != nil; e = e.next {
+		if e.key == key {
+			e.value = value
+			return true
+		}
+	}
+	d.buckets[b] = &dictEntry{key: key, value: value, next: d.buckets[b]}
+	d.length++
+	if d.length > len(d.buckets) {
+		d.resize(len(d.buckets) * 2)
+	}
+	return false
+}
+
+// Delete 删除key，返回被删除的value
+func (d *Dict) Delete(key string) (value interface{}, ok bool) {
+	b := d.bucket(key)
+	for prev, e := (*dictEntry)(nil), d.buckets[b]; e != nil; prev, e = e, e.next {
+		if e.key != key {
+			continue
+		}
+		if prev == nil {
+			d.buckets[b] = e.next
+		} else {
+			prev.next = e.next
+		}
+		d.length--
+		if len(d.buckets) > dictMinSize && d.length < len(d.buckets)/8 {
+			d.resize(len(d.buckets) / 2)
+		}
+		return e.value, true
+	}
+	return nil, false
+}
+
+func (d *Dict) resize(size int) {
+	old := d.buckets
+	d.buckets = make([]*dictEntry, size)
+	for _, e := range old {
+		for e != nil {
+			next := e.next
+			b := d.bucket(e.key)
+			e.next = d.buckets[b]
+			d.buckets[b] = e
+			e = next
+		}
+	}
+}
+
+// Each 遍历所有元素，fn返回false时停止，遍历期间不能修改Dict
+func (d *Dict) Each(fn func(key string, value interface{}) bool) {
+	d.eachFrom(0, fn)
+}
+
+// RandomEach 从随机的桶开始遍历所有元素，用于随机取出元素
+func (d *Dict) RandomEach(fn func(key string, value interface{}) bool) {
+	d.eachFrom(rand.Intn(len(d.buckets)), fn)
+}
+
+func (d *Dict) eachFrom(start int, fn func(key string, value interface{}) bool) {
+	for i := range d.buckets {
+		for e := d.buckets[(start+i)&(len(d.buckets)-1)]; e != nil; e = e.next {
+			if !fn(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// Scan 从cursor开始遍历桶，返回至少count个元素或遍历了count*10个桶后停止，返回下一次的cursor，为0时遍历结束
+// cursor小于桶数量，遍历期间不能修改Dict
+func (d *Dict) Scan(cursor uint64, count int, fn func(key string, value interface{})) uint64 {
+	if d.length == 0 {
+		return 0
+	}
+	if count <= 0 {
+		count = 1
+	}
+	mask := uint64(len(d.buckets) - 1)
+	for emitted, visited := 0, 0; ; {
+		for e := d.buckets[cursor&mask]; e != nil; e = e.next {
+			fn(e.key, e.value)
+			emitted++
+		}
+		// 反向二进制加1：高位先进位，扩容后同一桶拆出的桶在之后遍历
+		cursor |= ^mask
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		visited++
+		if cursor == 0 || emitted >= count || visited >= count*10 {
+			return cursor
+		}
+	}
+}
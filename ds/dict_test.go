@@ -0,0 +1,81 @@
+package ds
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestDict(t *testing.T) {
+	d := NewDict()
+	want := make(map[string]int)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("%04d", rnd.Intn(2000))
+		if rnd.Intn(3) == 0 {
+			_, ok := d.Delete(key)
+			if _, exist := want[key]; ok != exist {
+				t.Fatalf("Delete %v = %v, want %v", key, ok, exist)
+			}
+			delete(want, key)
+		} else {
+			replaced := d.Set(key, i)
+			if _, exist := want[key]; replaced != exist {
+				t.Fatalf("Set %v replaced = %v, want %v", key, replaced, exist)
+			}
+			want[key] = i
+		}
+	}
+	if d.Len() != len(want) {
+		t.Fatalf("Len = %v, want %v", d.Len(), len(want))
+	}
+	for key, value := range want {
+		if got, ok := d.Get(key); !ok || got != value {
+			t.Errorf("Get %v = %v, want %v", key, got, value)
+		}
+	}
+	count := 0
+	d.RandomEach(func(key string, value interface{}) bool {
+		count++
+		return true
+	})
+	if count != len(want) {
+		t.Errorf("RandomEach visited %v items, want %v", count, len(want))
+	}
+}
+
+func TestDictScan(t *testing.T) {
+	d := NewDict()
+	for i := 0; i < 1000; i++ {
+		d.Set(fmt.Sprintf("old%v", i), i)
+	}
+	// 遍历期间插入大量元素触发扩容，再删除触发缩容，一直存在的元素都要返回
+	seen := make(map[string]int)
+	var cursor uint64
+	for round := 0; ; round++ {
+		cursor = d.Scan(cursor, 10, func(key string, value interface{}) {
+			seen[key]++
+		})
+		if cursor == 0 {
+			break
+		}
+		switch {
+		case round < 50:
+			for i := 0; i < 100; i++ {
+				d.Set(fmt.Sprintf("new%v-%v", round, i), i)
+			}
+		case round < 100:
+			for i := 0; i < 100; i++ {
+				d.Delete(fmt.Sprintf("new%v-%v", round-50, i))
+			}
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if seen[fmt.Sprintf("old%v", i)] == 0 {
+			t.Errorf("old%v is missing", i)
+		}
+	}
+	if cursor = NewDict().Scan(0, 10, func(string, interface{}) {}); cursor != 0 {
+		t.Errorf("Scan empty dict cursor = %v", cursor)
+	}
+}
@@ -56,7 +56,7 @@ type SkipList struct {
 	length   int64
 	level    int
 	skipSpan int
-	members  map[string]float64
+	members  *Dict // member到节点
 }
 
 // NewSkipList 创建一个跳表，skipSpan表示平均每隔多少个节点增加一级索引，默认2
@@ -68,7 +68,7 @@ func NewSkipList(skipSpan int) *SkipList {
 		header:   NewSkipListNode("", 0, SkipListMaxLevel, nil),
 		level:    1,
 		skipSpan: skipSpan,
-		members:  make(map[string]float64, 0),
+		members:  NewDict(),
 	}
 }
 
@@ -131,7 +131,7 @@ func (zsl *SkipList) Insert(member string, score float64) *skipListNode {
 	}
 	// 5. 更新长度
 	zsl.length++
-	zsl.members[member] = score
+	zsl.members.Set(member, node)
 	// 6. 更新尾节点
 	if node.level[0].forward == nil {
 		zsl.tail = node
@@ -155,7 +155,7 @@ func (zsl *SkipList) DeleteNode(node *skipListNode, pre []*skipListNode) bool {
 	} else {
 		zsl.tail = node.backward
 	}
-	delete(zsl.members, node.member)
+	zsl.members.Delete(node.member)
 	// 2. 更新上层前置节点的跨度
 	for i := len(node.level); i < zsl.level; i++ {
 		pre[i].level[i].span--
@@ -213,12 +213,19 @@ func (zsl *SkipList) GetRank(member string, score float64) (rank int64) {
 }
 
 func (zsl *SkipList) GetScore(member string) (score float64, err error) {
-	if score, ok := zsl.members[member]; ok {
-		return score, nil
+	if node, ok := zsl.members.Get(member); ok {
+		return node.(*skipListNode).score, nil
 	}
 	return 0, constants.ErrMemberNotExist
 }
 
+// Scan 从cursor开始增量遍历所有member，返回下一次的cursor，为0时遍历结束，见Dict.Scan
+func (zsl *SkipList) Scan(cursor uint64, count int, fn func(member string, score float64)) uint64 {
+	return zsl.members.Scan(cursor, count, func(member string, node interface{}) {
+		fn(member, node.(*skipListNode).score)
+	})
+}
+
 func (zsl *SkipList) IsInRange(min, max float64) bool {
 	zsl.mu.RLock()
 	defer zsl.mu.RUnlock()
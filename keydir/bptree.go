@@ -0,0 +1,667 @@
+package keydir
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	bpPageSize    = 4096 // 节点编码超过该大小时分裂
+	posSize       = 20   // EntryPos编码长度，Fid4 + Offset8 + Size8
+	bpHeaderMagic = "TINYIDX1"
+	bpHeaderSize  = 25 // Magic8 + MetaOffset8 + MetaSize4 + CRC4 + KeyID1
+)
+
+// 磁盘B+树，节点编码后写入索引文件，只在内存中缓存最近访问的节点
+// 文件第一页为header，正常关闭时所有节点写入文件后在末尾写入meta，header记录meta的位置和校验和；
+// 打开时header有效则复用索引并清空header，运行期间崩溃后header无效，重新打开时重建，因此节点不需要崩溃恢复和校验
+// 开启加密时节点和meta加密后写入，文件中不出现明文key
+// 删除时不合并节点，空出的空间在浪费超过一半时通过重建回收
+
+// bpExtent 节点在文件中的位置，节点变大超过容量时重新分配到文件末尾
+type bpExtent struct {
+	offset int64
+	cap    int32
+	size   int32
+}
+
+type bpNode struct {
+	id       uint32
+	leaf     bool
+	keys     []string
+	values   []EntryPos // 叶子节点key对应的位置
+	children []uint32   // 内部节点的子节点，比keys多一个，children[i]中的key小于keys[i]
+	dirty    bool
+	size     int // 编码后的大小
+	elem     *list.Element
+}
+
+// bpStore 多个B+树共享的节点存储和LRU缓存，不是并发安全的
+type bpStore struct {
+	fd       *os.File
+	extents  []bpExtent // 下标为节点id
+	fileSize int64
+	nodes    map[uint32]*bpNode
+	lru      *list.List // 最近访问的在前
+	size     int64      // 缓存节点的总大小
+	capacity int64
+	err      error      // 第一次读写文件的错误，之后缓存可能与文件不一致，所有操作都返回该错误
+	keyID    data.KeyID // 加密节点使用的密钥，NoEncryption表示不加密
+}
+
+func openBPStore(path string, capacity int64, keyID data.KeyID) (*bpStore, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("filename: %v", path))
+	}
+	return &bpStore{
+		fd:       fd,
+		fileSize: bpPageSize,
+		nodes:    make(map[uint32]*bpNode),
+		lru:      list.New(),
+		capacity: capacity,
+		keyID:    keyID,
+	}, nil
+}
+
+// reset 清空索引文件和缓存，之前的节点全部作废
+func (s *bpStore) reset() error {
+	if err := s.fd.Truncate(0); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("filename: %v", s.fd.Name()))
+	}
+	s.extents = nil
+	s.fileSize = bpPageSize
+	s.nodes = make(map[uint32]*bpNode)
+	s.lru.Init()
+	s.size = 0
+	s.err = nil
+	return nil
+}
+
+// newNode 分配新节点，写出前只在缓存中
+func (s *bpStore) newNode(leaf bool) *bpNode {
+	n := &bpNode{id: uint32(len(s.extents)), leaf: leaf}
+	s.extents = append(s.extents, bpExtent{offset: -1})
+	s.markDirty(n)
+	return n
+}
+
+// node 读取节点，不在缓存中时从文件读取并加入缓存
+func (s *bpStore) node(id uint32) (*bpNode, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if n, ok := s.nodes[id]; ok {
+		s.lru.MoveToFront(n.elem)
+		return n, nil
+	}
+	ext := s.extents[id]
+	buf := make([]byte, ext.size)
+	if _, err := s.fd.ReadAt(buf, ext.offset); err != nil {
+		return nil, s.fail(errors.Wrap(err, fmt.Sprintf("read index node %v", id)))
+	}
+	plain, err := s.decrypt(nodeAAD(id), buf)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	n, err := decodeBPNode(id, plain)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	n.size = len(plain)
+	if err = s.cache(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// markDirty 节点被修改，已被淘汰的节点重新加入缓存
+func (s *bpStore) markDirty(n *bpNode) {
+	n.dirty = true
+	size := n.encodedSize()
+	if _, ok := s.nodes[n.id]; ok {
+		s.size += int64(size - n.size)
+		n.size = size
+		s.lru.MoveToFront(n.elem)
+		return
+	}
+	n.size = size
+	// 修改过程中不淘汰，超出容量的部分在读取节点或修改完成时淘汰
+	n.elem = s.lru.PushFront(n)
+	s.nodes[n.id] = n
+	s.size += int64(n.size)
+}
+
+func (s *bpStore) cache(n *bpNode) error {
+	n.elem = s.lru.PushFront(n)
+	s.nodes[n.id] = n
+	s.size += int64(n.size)
+	return s.evict()
+}
+
+// evict 淘汰最久未访问的节点，修改过的节点写入文件，至少保留最近访问的节点
+func (s *bpStore) evict() error {
+	for s.size > s.capacity && s.lru.Len() > 1 {
+		n := s.lru.Back().Value.(*bpNode)
+		if n.dirty {
+			if err := s.write(n); err != nil {
+				return s.fail(err)
+			}
+		}
+		s.lru.Remove(n.elem)
+		delete(s.nodes, n.id)
+		s.size -= int64(n.size)
+		n.elem = nil
+	}
+	return nil
+}
+
+// write 将节点写入文件，超过原有容量时在文件末尾分配新空间
+func (s *bpStore) write(n *bpNode) error {
+	buf, err := s.encrypt(nodeAAD(n.id), n.encode())
+	if err != nil {
+		return err
+	}
+	ext := &s.extents[n.id]
+	if ext.offset < 0 || len(buf) > int(ext.cap) {
+		ext.cap = int32((len(buf) + bpPageSize - 1) / bpPageSize * bpPageSize)
+		ext.offset = s.fileSize
+		s.fileSize += int64(ext.cap)
+	}
+	ext.size = int32(len(buf))
+	if _, err := s.fd.WriteAt(buf, ext.offset); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("write index node %v", n.id))
+	}
+	n.dirty = false
+	return nil
+}
+
+// flush 将缓存中修改过的节点全部写入文件
+func (s *bpStore) flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	for _, n := range s.nodes {
+		if !n.dirty {
+			continue
+		}
+		if err := s.write(n); err != nil {
+			return s.fail(err)
+		}
+	}
+	return nil
+}
+
+// writeMeta 在文件末尾写入meta，落盘后再写入header，header写入前崩溃时文件不会被复用
+func (s *bpStore) writeMeta(meta []byte) error {
+	buf, err := s.encrypt([]byte(bpHeaderMagic), append(s.appendExtents(nil), meta...))
+	if err != nil {
+		return err
+	}
+	if _, err = s.fd.WriteAt(buf, s.fileSize); err != nil {
+		return errors.Wrap(err, "write index meta")
+	}
+	if err = s.fd.Sync(); err != nil {
+		return errors.Wrap(err, "sync index file")
+	}
+	header := make([]byte, 0, bpHeaderSize)
+	header = append(header, bpHeaderMagic...)
+	header = binary.LittleEndian.AppendUint64(header, uint64(s.fileSize))
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(buf)))
+	header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(buf))
+	header = append(header, byte(s.keyID))
+	if _, err = s.fd.WriteAt(header, 0); err != nil {
+		return errors.Wrap(err, "write index header")
+	}
+	return errors.Wrap(s.fd.Sync(), "sync index file")
+}
+
+// readMeta 读取正常关闭时写入的meta并恢复节点位置，header无效或密钥改变时返回nil
+func (s *bpStore) readMeta() ([]byte, error) {
+	header := make([]byte, bpHeaderSize)
+	if _, err := s.fd.ReadAt(header, 0); err != nil || string(header[:len(bpHeaderMagic)]) != bpHeaderMagic ||
+		data.KeyID(header[24]) != s.keyID {
+		return nil, nil
+	}
+	offset := int64(binary.LittleEndian.Uint64(header[8:]))
+	buf := make([]byte, binary.LittleEndian.Uint32(header[16:]))
+	if offset < bpPageSize {
+		return nil, errors.Wrap(constants.ErrCorruptedIndex, "meta offset")
+	}
+	if _, err := s.fd.ReadAt(buf, offset); err != nil {
+		return nil, errors.Wrap(err, "read index meta")
+	}
+	if crc32.ChecksumIEEE(buf) != binary.LittleEndian.Uint32(header[20:]) {
+		return nil, errors.Wrap(constants.ErrCorruptedIndex, "meta crc")
+	}
+	meta, err := s.decrypt([]byte(bpHeaderMagic), buf)
+	if err != nil {
+		return nil, err
+	}
+	if meta, err = s.decodeExtents(meta, offset); err != nil {
+		return nil, err
+	}
+	s.fileSize = offset
+	return meta, nil
+}
+
+// clearHeader 复用索引后清空header，之后的修改不会同步到meta，崩溃后重新打开时重建
+func (s *bpStore) clearHeader() error {
+	if _, err := s.fd.WriteAt(make([]byte, bpHeaderSize), 0); err != nil {
+		return errors.Wrap(err, "clear index header")
+	}
+	return errors.Wrap(s.fd.Sync(), "sync index file")
+}
+
+// wasted 删除和节点变大后空出的空间大小
+func (s *bpStore) wasted() int64 {
+	used := int64(bpPageSize)
+	for _, ext := range s.extents {
+		used += int64(ext.cap)
+	}
+	return s.fileSize - used
+}
+
+// appendExtents 编码节点位置，Count + (Offset + Cap + Size)...
+func (s *bpStore) appendExtents(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s.extents)))
+	for _, ext := range s.extents {
+		buf = binary.AppendUvarint(buf, uint64(ext.offset))
+		buf = binary.AppendUvarint(buf, uint64(ext.cap))
+		buf = binary.AppendUvarint(buf, uint64(ext.size))
+	}
+	return buf
+}
+
+// decodeExtents 解码节点位置，节点必须在meta之前，返回剩余的数据
+func (s *bpStore) decodeExtents(buf []byte, end int64) ([]byte, error) {
+	errCorrupted := errors.Wrap(constants.ErrCorruptedIndex, "meta extents")
+	count, buf, ok := readUvarint(buf)
+	if !ok || count > uint64(len(buf)) {
+		return nil, errCorrupted
+	}
+	extents := make([]bpExtent, count)
+	for i := range extents {
+		var offset, capacity, size uint64
+		if offset, buf, ok = readUvarint(buf); !ok {
+			return nil, errCorrupted
+		}
+		if capacity, buf, ok = readUvarint(buf); !ok {
+			return nil, errCorrupted
+		}
+		if size, buf, ok = readUvarint(buf); !ok {
+			return nil, errCorrupted
+		}
+		if offset < bpPageSize || size > capacity || offset+capacity > uint64(end) {
+			return nil, errCorrupted
+		}
+		extents[i] = bpExtent{offset: int64(offset), cap: int32(capacity), size: int32(size)}
+	}
+	s.extents = extents
+	return buf, nil
+}
+
+func readUvarint(buf []byte) (uint64, []byte, bool) {
+	v, l := binary.Uvarint(buf)
+	if l <= 0 {
+		return 0, buf, false
+	}
+	return v, buf[l:], true
+}
+
+// nodeAAD 节点id参与认证，不同节点的密文不能互换，meta以header magic认证
+func nodeAAD(id uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, id)
+}
+
+func (s *bpStore) encrypt(aad, buf []byte) ([]byte, error) {
+	if s.keyID == data.NoEncryption {
+		return buf, nil
+	}
+	return data.Seal(s.keyID, aad, buf)
+}
+
+func (s *bpStore) decrypt(aad, buf []byte) ([]byte, error) {
+	if s.keyID == data.NoEncryption {
+		return buf, nil
+	}
+	return data.Unseal(aad, buf)
+}
+
+// fail 记录第一次出错的原因
+func (s *bpStore) fail(err error) error {
+	if s.err == nil {
+		s.err = errors.Wrap(constants.ErrIndexFailed, err.Error())
+	}
+	return s.err
+}
+
+func (s *bpStore) close() error {
+	return s.fd.Close()
+}
+
+func (s *bpStore) remove() error {
+	return os.Remove(s.fd.Name())
+}
+
+func (n *bpNode) encodedSize() int {
+	size := 1 + binary.MaxVarintLen32
+	for _, key := range n.keys {
+		size += binary.MaxVarintLen32 + len(key)
+	}
+	if n.leaf {
+		return size + len(n.keys)*posSize
+	}
+	return size + len(n.children)*4
+}
+
+// encode 编码节点，Leaf1 + Count + (KeySize + Key)... + Values或Children
+func (n *bpNode) encode() []byte {
+	buf := make([]byte, 0, n.encodedSize())
+	if n.leaf {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(n.keys)))
+	for _, key := range n.keys {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+	}
+	if n.leaf {
+		for _, pos := range n.values {
+			buf = binary.LittleEndian.AppendUint32(buf, pos.Fid)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(pos.Offset))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(pos.Size))
+		}
+	} else {
+		for _, child := range n.children {
+			buf = binary.LittleEndian.AppendUint32(buf, child)
+		}
+	}
+	return buf
+}
+
+func decodeBPNode(id uint32, buf []byte) (*bpNode, error) {
+	errCorrupted := errors.Wrap(constants.ErrCorruptedIndex, fmt.Sprintf("node: %v", id))
+	if len(buf) < 1 {
+		return nil, errCorrupted
+	}
+	n := &bpNode{id: id, leaf: buf[0] == 1}
+	count, l := binary.Uvarint(buf[1:])
+	if l <= 0 {
+		return nil, errCorrupted
+	}
+	buf = buf[1+l:]
+	n.keys = make([]string, count)
+	for i := range n.keys {
+		keySize, l := binary.Uvarint(buf)
+		if l <= 0 || uint64(len(buf)-l) < keySize {
+			return nil, errCorrupted
+		}
+		n.keys[i] = string(buf[l : l+int(keySize)])
+		buf = buf[l+int(keySize):]
+	}
+	if n.leaf {
+		if len(buf) != int(count)*posSize {
+			return nil, errCorrupted
+		}
+		n.values = make([]EntryPos, count)
+		for i := range n.values {
+			n.values[i] = EntryPos{
+				Fid:    binary.LittleEndian.Uint32(buf[i*posSize:]),
+				Offset: int64(binary.LittleEndian.Uint64(buf[i*posSize+4:])),
+				Size:   int64(binary.LittleEndian.Uint64(buf[i*posSize+12:])),
+			}
+		}
+		return n, nil
+	}
+	if len(buf) != (int(count)+1)*4 {
+		return nil, errCorrupted
+	}
+	n.children = make([]uint32, count+1)
+	for i := range n.children {
+		n.children[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return n, nil
+}
+
+// bpTree 以string为key、EntryPos为value的B+树，key按字典序排列
+type bpTree struct {
+	store  *bpStore
+	root   uint32
+	length int
+}
+
+func newBPTree(store *bpStore) *bpTree {
+	t := &bpTree{store: store}
+	t.reset()
+	return t
+}
+
+// reset 分配新的根节点，store清空后调用
+func (t *bpTree) reset() {
+	t.root = t.store.newNode(true).id
+	t.length = 0
+}
+
+// childIndex 内部节点中key所在子树的下标
+func (n *bpNode) childIndex(key string) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return n.keys[i] > key
+	})
+}
+
+// search 叶子节点中第一个不小于key的下标
+func (n *bpNode) search(key string) (int, bool) {
+	i := sort.SearchStrings(n.keys, key)
+	return i, i < len(n.keys) && n.keys[i] == key
+}
+
+func (t *bpTree) get(key string) (pos *EntryPos, ok bool, err error) {
+	n, err := t.store.node(t.root)
+	for err == nil && !n.leaf {
+		n, err = t.store.node(n.children[n.childIndex(key)])
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if i, found := n.search(key); found {
+		value := n.values[i]
+		return &value, true, nil
+	}
+	return nil, false, nil
+}
+
+func (t *bpTree) set(key string, pos EntryPos) (replaced bool, err error) {
+	root, err := t.store.node(t.root)
+	if err != nil {
+		return false, err
+	}
+	replaced, right, sep, err := t.insert(root, key, pos)
+	if err != nil {
+		return false, err
+	}
+	if right != nil {
+		newRoot := t.store.newNode(false)
+		newRoot.keys = []string{sep}
+		newRoot.children = []uint32{root.id, right.id}
+		t.store.markDirty(newRoot)
+		t.root = newRoot.id
+	}
+	if !replaced {
+		t.length++
+	}
+	return replaced, t.store.evict()
+}
+
+// insert 插入key，节点超过页大小时分裂，返回分裂出的右节点和右节点的最小key
+func (t *bpTree) insert(n *bpNode, key string, pos EntryPos) (replaced bool, right *bpNode, sep string, err error) {
+	if n.leaf {
+		i, found := n.search(key)
+		if found {
+			n.values[i] = pos
+			t.store.markDirty(n)
+			return true, nil, "", nil
+		}
+		n.keys = append(n.keys, "")
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = key
+		n.values = append(n.values, EntryPos{})
+		copy(n.values[i+1:], n.values[i:])
+		n.values[i] = pos
+	} else {
+		i := n.childIndex(key)
+		child, err := t.store.node(n.children[i])
+		if err != nil {
+			return false, nil, "", err
+		}
+		var childRight *bpNode
+		var childSep string
+		if replaced, childRight, childSep, err = t.insert(child, key, pos); err != nil || childRight == nil {
+			return replaced, nil, "", err
+		}
+		n.keys = append(n.keys, "")
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = childSep
+		n.children = append(n.children, 0)
+		copy(n.children[i+2:], n.children[i+1:])
+		n.children[i+1] = childRight.id
+	}
+	t.store.markDirty(n)
+	if n.size <= bpPageSize || len(n.keys) < 2 {
+		return replaced, nil, "", nil
+	}
+	right, sep = t.split(n)
+	return replaced, right, sep, nil
+}
+
+func (t *bpTree) split(n *bpNode) (right *bpNode, sep string) {
+	mid := len(n.keys) / 2
+	right = t.store.newNode(n.leaf)
+	if n.leaf {
+		right.keys = append([]string(nil), n.keys[mid:]...)
+		right.values = append([]EntryPos(nil), n.values[mid:]...)
+		n.keys, n.values = n.keys[:mid:mid], n.values[:mid:mid]
+		sep = right.keys[0]
+	} else {
+		sep = n.keys[mid]
+		right.keys = append([]string(nil), n.keys[mid+1:]...)
+		right.children = append([]uint32(nil), n.children[mid+1:]...)
+		n.keys, n.children = n.keys[:mid:mid], n.children[:mid+1:mid+1]
+	}
+	t.store.markDirty(n)
+	t.store.markDirty(right)
+	return right, sep
+}
+
+// del 从叶子节点中删除key，不合并节点
+func (t *bpTree) del(key string) (ok bool, err error) {
+	n, err := t.store.node(t.root)
+	for err == nil && !n.leaf {
+		n, err = t.store.node(n.children[n.childIndex(key)])
+	}
+	if err != nil {
+		return false, err
+	}
+	i, found := n.search(key)
+	if !found {
+		return false, nil
+	}
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	n.values = append(n.values[:i], n.values[i+1:]...)
+	t.store.markDirty(n)
+	t.length--
+	return true, t.store.evict()
+}
+
+// seek 从不小于start（reverse时不大于start）的key开始按顺序遍历，start为nil时从头（reverse时从尾）开始，fn返回false时停止
+func (t *bpTree) seek(start *string, reverse bool, fn func(key string, pos *EntryPos) bool) error {
+	root, err := t.store.node(t.root)
+	if err != nil {
+		return err
+	}
+	if reverse {
+		_, err = t.descend(root, start, fn)
+	} else {
+		_, err = t.ascend(root, start, fn)
+	}
+	return err
+}
+
+func (t *bpTree) ascend(n *bpNode, pivot *string, fn func(key string, pos *EntryPos) bool) (bool, error) {
+	// 遍历期间不修改节点，n被淘汰后内容不变
+	keys, values, children := n.keys, n.values, n.children
+	if n.leaf {
+		i := 0
+		if pivot != nil {
+			i, _ = n.search(*pivot)
+		}
+		for ; i < len(keys); i++ {
+			value := values[i]
+			if !fn(keys[i], &value) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	i := 0
+	if pivot != nil {
+		i = n.childIndex(*pivot)
+	}
+	for ; i < len(children); i++ {
+		child, err := t.store.node(children[i])
+		if err != nil {
+			return false, err
+		}
+		if next, err := t.ascend(child, pivot, fn); !next || err != nil {
+			return false, err
+		}
+		// 之后的子树都大于pivot
+		pivot = nil
+	}
+	return true, nil
+}
+
+func (t *bpTree) descend(n *bpNode, pivot *string, fn func(key string, pos *EntryPos) bool) (bool, error) {
+	keys, values, children := n.keys, n.values, n.children
+	if n.leaf {
+		i := len(keys) - 1
+		if pivot != nil {
+			j, found := n.search(*pivot)
+			if i = j - 1; found {
+				i = j
+			}
+		}
+		for ; i >= 0; i-- {
+			value := values[i]
+			if !fn(keys[i], &value) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	i := len(children) - 1
+	if pivot != nil {
+		i = n.childIndex(*pivot)
+	}
+	for ; i >= 0; i-- {
+		child, err := t.store.node(children[i])
+		if err != nil {
+			return false, err
+		}
+		if next, err := t.descend(child, pivot, fn); !next || err != nil {
+			return false, err
+		}
+		pivot = nil
+	}
+	return true, nil
+}
@@ -0,0 +1,712 @@
+package keydir
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"SouthWind6510/TinyDB/pkg/logger"
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// DefaultIndexCacheSize 磁盘索引默认的节点缓存大小
+const DefaultIndexCacheSize = 1 << 26
+
+// DiskIndex 保存在磁盘B+树中的String、List和Hash索引，内存中只缓存最近访问的节点，
+// 适合key数量超过内存的数据集，每次查找未命中缓存时需要额外读取索引文件
+// Set和ZSet的member本身保存在内存中，仍使用内存索引
+type DiskIndex struct {
+	mu    sync.Mutex // 三种索引共享节点缓存
+	store *bpStore
+	str   *bpTree
+	list  *bpTree
+	hash  *bpTree
+	// 按hash排列的key，用于增量遍历
+	strKeys  diskKeySet
+	listKeys diskKeySet
+	hashKeys diskKeySet
+	state    []byte // 上次Save时保存的调用方数据，索引为空时为nil
+}
+
+// OpenDiskIndex 打开索引文件，上次通过Save正常关闭时复用其中的索引，否则清空文件，由调用方重建索引
+// cacheSize为节点缓存的大小，不大于0时使用DefaultIndexCacheSize，keyID不为NoEncryption时节点加密后写入
+func OpenDiskIndex(path string, cacheSize int64, keyID data.KeyID) (*DiskIndex, error) {
+	if cacheSize <= 0 {
+		cacheSize = DefaultIndexCacheSize
+	}
+	store, err := openBPStore(path, cacheSize, keyID)
+	if err != nil {
+		return nil, err
+	}
+	d := &DiskIndex{
+		store:    store,
+		str:      &bpTree{store: store},
+		list:     &bpTree{store: store},
+		hash:     &bpTree{store: store},
+		strKeys:  diskKeySet{tree: &bpTree{store: store}},
+		listKeys: diskKeySet{tree: &bpTree{store: store}},
+		hashKeys: diskKeySet{tree: &bpTree{store: store}},
+	}
+	if d.load() {
+		return d, nil
+	}
+	if err = d.Reset(); err != nil {
+		_ = store.close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DiskIndex) trees() []*bpTree {
+	return []*bpTree{d.str, d.list, d.hash, d.strKeys.tree, d.listKeys.tree, d.hashKeys.tree}
+}
+
+// load 读取上次Save写入的meta，恢复各B树的根节点，浪费的空间超过一半时放弃复用
+func (d *DiskIndex) load() bool {
+	meta, err := d.store.readMeta()
+	if err != nil {
+		logger.Log.Warnf("load disk index err, rebuild it: %+v", err)
+		return false
+	}
+	if meta == nil {
+		return false
+	}
+	for _, t := range d.trees() {
+		var root, length uint64
+		ok := false
+		if root, meta, ok = readUvarint(meta); ok {
+			length, meta, ok = readUvarint(meta)
+		}
+		if !ok || root >= uint64(len(d.store.extents)) {
+			logger.Log.Warnf("disk index meta is corrupted, rebuild it")
+			return false
+		}
+		t.root, t.length = uint32(root), int(length)
+	}
+	if wasted := d.store.wasted(); wasted > d.store.fileSize/2 {
+		logger.Log.Infof("disk index wasted %v bytes, rebuild it", wasted)
+		return false
+	}
+	if err = d.store.clearHeader(); err != nil {
+		logger.Log.Warnf("%+v", err)
+		return false
+	}
+	d.state = append([]byte{}, meta...)
+	return true
+}
+
+// State 返回上次Save时保存的调用方数据，调用方据此判断复用的索引是否与数据一致，为nil时索引为空
+func (d *DiskIndex) State() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.state
+}
+
+// Reset 清空索引，复用的索引与数据不一致时由调用方重建
+func (d *DiskIndex) Reset() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.store.reset(); err != nil {
+		return err
+	}
+	for _, t := range d.trees() {
+		t.reset()
+	}
+	d.state = nil
+	return nil
+}
+
+// Save 将所有节点和调用方数据state写入索引文件后关闭，下次打开时复用，出错时删除索引文件
+func (d *DiskIndex) Save(state []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.store.flush()
+	if err == nil {
+		var meta []byte
+		for _, t := range d.trees() {
+			meta = binary.AppendUvarint(meta, uint64(t.root))
+			meta = binary.AppendUvarint(meta, uint64(t.length))
+		}
+		err = d.store.writeMeta(append(meta, state...))
+	}
+	if err != nil {
+		_ = d.store.close()
+		_ = d.store.remove()
+		return err
+	}
+	return d.store.close()
+}
+
+// Close 关闭并删除索引文件
+func (d *DiskIndex) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.store.close(); err != nil {
+		return err
+	}
+	return d.store.remove()
+}
+
+func (d *DiskIndex) NewStrIndex() StrIndex {
+	return &DiskStrKeydir{d: d}
+}
+
+func (d *DiskIndex) NewListIndex() ListIndex {
+	return &DiskListKeydir{fields: diskFieldIndex{d: d, tree: d.list, keys: d.listKeys}}
+}
+
+func (d *DiskIndex) NewHashIndex() HashIndex {
+	return &DiskHashKeydir{fields: diskFieldIndex{d: d, tree: d.hash, keys: d.hashKeys}}
+}
+
+func (d *DiskIndex) NewSetIndex() SetIndex {
+	return NewSetKeydir(true)
+}
+
+func (d *DiskIndex) NewZSetIndex() ZSetIndex {
+	return NewZSetKeydir(true)
+}
+
+// Err 读写索引文件失败后索引可能与数据不一致，返回ErrIndexFailed，db据此拒绝之后的写入，重新打开时重建索引
+func (d *DiskIndex) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.store.err
+}
+
+// logIndexErr 没有返回值的写入方法只记录日志，错误已记录在bpStore中，之后的读写都会返回该错误
+func logIndexErr(err error) {
+	if err != nil {
+		logger.Log.Errorf("disk index err: %+v", err)
+	}
+}
+
+// samePos 磁盘索引每次读取都返回新的EntryPos，按位置比较
+func samePos(a, b *EntryPos) bool {
+	return a != nil && b != nil && *a == *b
+}
+
+type DiskStrKeydir struct {
+	d *DiskIndex
+}
+
+func (i *DiskStrKeydir) Set(key string, pos *EntryPos) {
+	i.d.mu.Lock()
+	defer i.d.mu.Unlock()
+
+	replaced, err := i.d.str.set(key, *pos)
+	if err == nil && !replaced {
+		err = i.d.strKeys.add(key)
+	}
+	logIndexErr(err)
+}
+
+func (i *DiskStrKeydir) Get(key string) (pos *EntryPos, err error) {
+	i.d.mu.Lock()
+	defer i.d.mu.Unlock()
+
+	pos, ok, err := i.d.str.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, constants.ErrKeyNotFound
+	}
+	return pos, nil
+}
+
+func (i *DiskStrKeydir) Del(key string) {
+	i.d.mu.Lock()
+	defer i.d.mu.Unlock()
+
+	ok, err := i.d.str.del(key)
+	if err == nil && ok {
+		err = i.d.strKeys.del(key)
+	}
+	logIndexErr(err)
+}
+
+func (i *DiskStrKeydir) CompareAndSwap(key string, old, new *EntryPos) bool {
+	i.d.mu.Lock()
+	defer i.d.mu.Unlock()
+
+	pos, _, err := i.d.str.get(key)
+	if err != nil || !samePos(pos, old) {
+		logIndexErr(err)
+		return false
+	}
+	_, err = i.d.str.set(key, *new)
+	logIndexErr(err)
+	return err == nil
+}
+
+func (i *DiskStrKeydir) Keys() (keys []string) {
+	_ = i.Seek(nil, false, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return
+}
+
+func (i *DiskStrKeydir) Seek(start *string, reverse bool, fn func(key string) bool) error {
+	i.d.mu.Lock()
+	defer i.d.mu.Unlock()
+
+	return i.d.str.seek(start, reverse, func(key string, pos *EntryPos) bool {
+		return fn(key)
+	})
+}
+
+func (i *DiskStrKeydir) Scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	i.d.mu.Lock()
+	defer i.d.mu.Unlock()
+
+	return i.d.strKeys.scan(cursor, count, fn)
+}
+
+// diskKeySet 按key的hash排列的key集合，B树key为8字节大端序的hash加key，
+// 增量遍历的cursor为下一个key的hash，不需要保存状态，hash相同的key一起返回
+type diskKeySet struct {
+	tree *bpTree
+}
+
+// scanHash 增量遍历使用的hash，取60位，不会超出db层SCAN游标的位置部分
+func scanHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64() >> 4
+}
+
+func hashedKey(prefix string, h uint64, key string) string {
+	buf := make([]byte, 0, len(prefix)+8+len(key))
+	buf = append(buf, prefix...)
+	buf = binary.BigEndian.AppendUint64(buf, h)
+	return string(append(buf, key...))
+}
+
+func (s diskKeySet) add(key string) error {
+	_, err := s.tree.set(hashedKey("", scanHash(key), key), EntryPos{})
+	return err
+}
+
+func (s diskKeySet) del(key string) error {
+	_, err := s.tree.del(hashedKey("", scanHash(key), key))
+	return err
+}
+
+func (s diskKeySet) scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	return scanHashed(s.tree, "", cursor, count, func(key string, pos *EntryPos) {
+		fn(key)
+	})
+}
+
+// scanHashed 遍历tree中prefix之后为8字节hash的B树key，从hash不小于cursor的key开始，
+// 至少返回count个，之后继续返回与最后一个hash相同的key，next为下一个key的hash，遍历完时为0
+func scanHashed(tree *bpTree, prefix string, cursor uint64, count int, fn func(item string, pos *EntryPos)) (next uint64, err error) {
+	start := hashedKey(prefix, cursor, "")
+	var last uint64
+	emitted := 0
+	err = tree.seek(&start, false, func(hashed string, pos *EntryPos) bool {
+		if !strings.HasPrefix(hashed, prefix) {
+			return false
+		}
+		if len(hashed) < len(prefix)+8 {
+			return true
+		}
+		h := binary.BigEndian.Uint64([]byte(hashed[len(prefix) : len(prefix)+8]))
+		if emitted >= count && h != last {
+			next = h
+			return false
+		}
+		fn(hashed[len(prefix)+8:], pos)
+		last = h
+		emitted++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// diskFieldIndex 以key和field组合为B树key的二级索引，key转义后以\x00\x01结尾，保证同一key的field连续且key之间保持字典序
+// 每个key有一条field为空的计数记录，Offset为field数量，排在该key所有field之前
+type diskFieldIndex struct {
+	d    *DiskIndex
+	tree *bpTree
+	keys diskKeySet // 有field的key
+}
+
+// encodeFieldKey 转义key中的\x00为\x00\xff，拼接结束符和field
+func encodeFieldKey(key, field string) string {
+	var b strings.Builder
+	b.Grow(len(key) + len(field) + 2)
+	for j := 0; j < len(key); j++ {
+		if key[j] == 0 {
+			b.WriteString("\x00\xff")
+		} else {
+			b.WriteByte(key[j])
+		}
+	}
+	b.WriteString("\x00\x01")
+	b.WriteString(field)
+	return b.String()
+}
+
+func decodeFieldKey(fieldKey string) (key, field string) {
+	var b strings.Builder
+	for j := 0; j < len(fieldKey); j++ {
+		if fieldKey[j] != 0 {
+			b.WriteByte(fieldKey[j])
+			continue
+		}
+		if j+1 < len(fieldKey) && fieldKey[j+1] == 0x01 {
+			return b.String(), fieldKey[j+2:]
+		}
+		b.WriteByte(0)
+		j++
+	}
+	return b.String(), ""
+}
+
+// keyEnd 大于key所有field的最小组合key
+func keyEnd(key string) string {
+	countKey := encodeFieldKey(key, "")
+	return countKey[:len(countKey)-1] + "\x02"
+}
+
+func (f *diskFieldIndex) set(key, field string, pos *EntryPos) {
+	replaced, err := f.tree.set(encodeFieldKey(key, field), *pos)
+	if err == nil && !replaced {
+		err = f.addCount(key, 1)
+	}
+	logIndexErr(err)
+}
+
+func (f *diskFieldIndex) get(key, field string) (*EntryPos, error) {
+	pos, ok, err := f.tree.get(encodeFieldKey(key, field))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, constants.ErrKeyNotFound
+	}
+	return pos, nil
+}
+
+func (f *diskFieldIndex) del(key, field string) {
+	ok, err := f.tree.del(encodeFieldKey(key, field))
+	if err == nil && ok {
+		err = f.addCount(key, -1)
+	}
+	logIndexErr(err)
+}
+
+func (f *diskFieldIndex) compareAndSwap(key, field string, old, new *EntryPos) bool {
+	fieldKey := encodeFieldKey(key, field)
+	pos, _, err := f.tree.get(fieldKey)
+	if err != nil || !samePos(pos, old) {
+		logIndexErr(err)
+		return false
+	}
+	_, err = f.tree.set(fieldKey, *new)
+	logIndexErr(err)
+	return err == nil
+}
+
+// count key的field数量，key不存在时返回0
+func (f *diskFieldIndex) count(key string) (int, error) {
+	pos, ok, err := f.tree.get(encodeFieldKey(key, ""))
+	if err != nil || !ok {
+		return 0, err
+	}
+	return int(pos.Offset), nil
+}
+
+// addCount 更新key的field数量，减为0时删除计数记录
+func (f *diskFieldIndex) addCount(key string, delta int) error {
+	count, err := f.count(key)
+	if err != nil {
+		return err
+	}
+	countKey := encodeFieldKey(key, "")
+	if count+delta <= 0 {
+		if _, err = f.tree.del(countKey); err != nil {
+			return err
+		}
+		return f.keys.del(key)
+	}
+	if _, err = f.tree.set(countKey, EntryPos{Offset: int64(count + delta)}); err != nil || count > 0 {
+		return err
+	}
+	return f.keys.add(key)
+}
+
+// each 按field顺序遍历key的所有field
+func (f *diskFieldIndex) each(key string, fn func(field string, pos *EntryPos) bool) error {
+	countKey := encodeFieldKey(key, "")
+	return f.tree.seek(&countKey, false, func(fieldKey string, pos *EntryPos) bool {
+		if !strings.HasPrefix(fieldKey, countKey) {
+			return false
+		}
+		if fieldKey == countKey {
+			return true
+		}
+		return fn(fieldKey[len(countKey):], pos)
+	})
+}
+
+func (f *diskFieldIndex) delKey(key string) {
+	var fieldKeys []string
+	err := f.each(key, func(field string, pos *EntryPos) bool {
+		fieldKeys = append(fieldKeys, encodeFieldKey(key, field))
+		return true
+	})
+	fieldKeys = append(fieldKeys, encodeFieldKey(key, ""))
+	for _, fieldKey := range fieldKeys {
+		if err != nil {
+			break
+		}
+		_, err = f.tree.del(fieldKey)
+	}
+	if err == nil {
+		err = f.keys.del(key)
+	}
+	logIndexErr(err)
+}
+
+func (f *diskFieldIndex) positions(key string) (positions []*EntryPos) {
+	logIndexErr(f.each(key, func(field string, pos *EntryPos) bool {
+		positions = append(positions, pos)
+		return true
+	}))
+	return
+}
+
+// seek 按key顺序遍历有field的key，每个key只访问一次，访问后从该key所有field之后（reverse时之前）重新查找
+func (f *diskFieldIndex) seek(start *string, reverse bool, fn func(key string) bool) error {
+	var cursor *string
+	if start != nil {
+		c := encodeFieldKey(*start, "")
+		if reverse {
+			c = keyEnd(*start)
+		}
+		cursor = &c
+	}
+	for {
+		var key string
+		found := false
+		err := f.tree.seek(cursor, reverse, func(fieldKey string, pos *EntryPos) bool {
+			// reverse时从上一个key的计数记录开始，跳过该记录
+			if reverse && cursor != nil && fieldKey == *cursor {
+				return true
+			}
+			key, _ = decodeFieldKey(fieldKey)
+			found = true
+			return false
+		})
+		if err != nil || !found {
+			return err
+		}
+		if !fn(key) {
+			return nil
+		}
+		c := keyEnd(key)
+		if reverse {
+			c = encodeFieldKey(key, "")
+		}
+		cursor = &c
+	}
+}
+
+type DiskListKeydir struct {
+	fields diskFieldIndex
+}
+
+// listField index按大端序编码并翻转符号位，保证-1（listMeta）排在最前
+func listField(index int) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(index)^(1<<63))
+	return string(buf)
+}
+
+func (i *DiskListKeydir) Set(key string, index int, pos *EntryPos) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	i.fields.set(key, listField(index), pos)
+}
+
+func (i *DiskListKeydir) Get(key string, index int) (pos *EntryPos, err error) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.get(key, listField(index))
+}
+
+func (i *DiskListKeydir) Del(key string, index int) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	i.fields.del(key, listField(index))
+}
+
+func (i *DiskListKeydir) CompareAndSwap(key string, index int, old, new *EntryPos) bool {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.compareAndSwap(key, listField(index), old, new)
+}
+
+func (i *DiskListKeydir) DelKey(key string) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	i.fields.delKey(key)
+}
+
+func (i *DiskListKeydir) GetPositions(key string) []*EntryPos {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.positions(key)
+}
+
+func (i *DiskListKeydir) Keys() (keys []string) {
+	_ = i.Seek(nil, false, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return
+}
+
+func (i *DiskListKeydir) Seek(start *string, reverse bool, fn func(key string) bool) error {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.seek(start, reverse, fn)
+}
+
+func (i *DiskListKeydir) Scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.keys.scan(cursor, count, fn)
+}
+
+// DiskHashKeydir field前加8字节的hash，同一key的field按hash排列，HSCAN的cursor为下一个field的hash
+type DiskHashKeydir struct {
+	fields diskFieldIndex
+}
+
+func hashedField(field string) string {
+	return hashedKey("", scanHash(field), field)
+}
+
+func (i *DiskHashKeydir) Set(key string, field string, pos *EntryPos) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	i.fields.set(key, hashedField(field), pos)
+}
+
+func (i *DiskHashKeydir) Get(key string, field string) (pos *EntryPos, err error) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.get(key, hashedField(field))
+}
+
+func (i *DiskHashKeydir) Del(key string, field string) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	i.fields.del(key, hashedField(field))
+}
+
+func (i *DiskHashKeydir) GetFields(key string) (fields []string, err error) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	err = i.fields.each(key, func(field string, pos *EntryPos) bool {
+		fields = append(fields, field[8:])
+		return true
+	})
+	if err == nil && fields == nil {
+		return nil, constants.ErrKeyNotFound
+	}
+	return
+}
+
+func (i *DiskHashKeydir) GetFieldCount(key string) (int, error) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	count, err := i.fields.count(key)
+	if err == nil && count == 0 {
+		return 0, constants.ErrKeyNotFound
+	}
+	return count, err
+}
+
+func (i *DiskHashKeydir) CompareAndSwap(key string, field string, old, new *EntryPos) bool {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.compareAndSwap(key, hashedField(field), old, new)
+}
+
+func (i *DiskHashKeydir) DelKey(key string) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	i.fields.delKey(key)
+}
+
+func (i *DiskHashKeydir) GetPositions(key string) []*EntryPos {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.positions(key)
+}
+
+func (i *DiskHashKeydir) Keys() (keys []string) {
+	_ = i.Seek(nil, false, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return
+}
+
+func (i *DiskHashKeydir) Seek(start *string, reverse bool, fn func(key string) bool) error {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.seek(start, reverse, fn)
+}
+
+func (i *DiskHashKeydir) Scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	return i.fields.keys.scan(cursor, count, fn)
+}
+
+func (i *DiskHashKeydir) ScanFields(key string, cursor uint64, count int, fn func(field string, pos *EntryPos)) (uint64, error) {
+	i.fields.d.mu.Lock()
+	defer i.fields.d.mu.Unlock()
+
+	if n, err := i.fields.count(key); err != nil || n == 0 {
+		if err == nil {
+			err = constants.ErrKeyNotFound
+		}
+		return 0, err
+	}
+	return scanHashed(i.fields.tree, encodeFieldKey(key, ""), cursor, count, fn)
+}
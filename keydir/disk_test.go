@@ -0,0 +1,300 @@
+package keydir
+
+import (
+	"SouthWind6510/TinyDB/data"
+	"SouthWind6510/TinyDB/pkg/constants"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDiskStrKeydir(t *testing.T) {
+	// 缓存只能放下几个节点，大部分读写都要经过文件
+	d, err := OpenDiskIndex(filepath.Join(t.TempDir(), "INDEX"), 4*bpPageSize, data.NoEncryption)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer d.Close()
+	index := d.NewStrIndex()
+	expected := make(map[string]EntryPos)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", r.Intn(5000))
+		if r.Intn(4) == 0 {
+			index.Del(key)
+			delete(expected, key)
+			continue
+		}
+		pos := EntryPos{Fid: uint32(i), Offset: int64(i), Size: int64(len(key))}
+		index.Set(key, &pos)
+		expected[key] = pos
+	}
+	if d.store.fileSize == 0 {
+		t.Errorf("no node is written to file")
+	}
+	keys := make([]string, 0, len(expected))
+	for key, pos := range expected {
+		keys = append(keys, key)
+		if got, err := index.Get(key); err != nil || *got != pos {
+			t.Fatalf("Get %v = %v, %v, want %v", key, got, err, pos)
+		}
+	}
+	if _, err = index.Get("missing"); !errors.Is(err, constants.ErrKeyNotFound) {
+		t.Errorf("Get missing err = %v", err)
+	}
+	sort.Strings(keys)
+	if got := index.Keys(); !reflect.DeepEqual(got, keys) {
+		t.Errorf("Keys len = %v, want %v", len(got), len(keys))
+	}
+	start := "key02500"
+	var got []string
+	_ = index.Seek(&start, true, func(key string) bool {
+		got = append(got, key)
+		return len(got) < 10
+	})
+	want := keys[:sort.SearchStrings(keys, "key02501")]
+	want = want[len(want)-10:]
+	for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+		want[i], want[j] = want[j], want[i]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reverse Seek = %v, want %v", got, want)
+	}
+	old := expected[keys[0]]
+	if index.CompareAndSwap(keys[0], &EntryPos{Fid: 1 << 30}, &EntryPos{}) || !index.CompareAndSwap(keys[0], &old, &EntryPos{Fid: 7}) {
+		t.Errorf("CompareAndSwap error")
+	}
+}
+
+func TestDiskHashKeydir(t *testing.T) {
+	d, err := OpenDiskIndex(filepath.Join(t.TempDir(), "INDEX"), 4*bpPageSize, data.NoEncryption)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer d.Close()
+	index := d.NewHashIndex()
+	// key之间互为前缀或包含\x00
+	hashKeys := []string{"a", "a\x00", "a\x00b", "ab", "b"}
+	for _, key := range hashKeys {
+		for i := 0; i < 300; i++ {
+			index.Set(key, fmt.Sprintf("f%03d", i), &EntryPos{Fid: 1, Offset: int64(i)})
+		}
+	}
+	for i := 0; i < 300; i++ {
+		index.Del("ab", fmt.Sprintf("f%03d", i))
+	}
+	index.DelKey("b")
+	if count, err := index.GetFieldCount("a\x00"); count != 300 || err != nil {
+		t.Errorf("GetFieldCount = %v, %v", count, err)
+	}
+	if _, err = index.GetFieldCount("ab"); !errors.Is(err, constants.ErrKeyNotFound) {
+		t.Errorf("GetFieldCount of empty key err = %v", err)
+	}
+	if fields, _ := index.GetFields("a"); len(fields) != 300 {
+		t.Errorf("GetFields len = %v", len(fields))
+	}
+	// HSCAN按field的hash遍历
+	seen := make(map[string]int)
+	for cursor := uint64(0); ; {
+		if cursor, err = index.ScanFields("a\x00", cursor, 7, func(field string, pos *EntryPos) {
+			seen[field]++
+		}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != 300 || seen["f123"] != 1 {
+		t.Errorf("ScanFields fields = %v", len(seen))
+	}
+	if pos, err := index.Get("a\x00b", "f123"); err != nil || pos.Offset != 123 {
+		t.Errorf("Get = %v, %v", pos, err)
+	}
+	if got := index.Keys(); !reflect.DeepEqual(got, []string{"a", "a\x00", "a\x00b"}) {
+		t.Errorf("Keys = %q", got)
+	}
+	var got []string
+	start := "a\x00a"
+	_ = index.Seek(&start, true, func(key string) bool {
+		got = append(got, key)
+		return true
+	})
+	if !reflect.DeepEqual(got, []string{"a\x00", "a"}) {
+		t.Errorf("reverse Seek = %q", got)
+	}
+
+	list := d.NewListIndex()
+	for i := -1; i < 10; i++ {
+		list.Set("list", i, &EntryPos{Offset: int64(i)})
+	}
+	if positions := list.GetPositions("list"); len(positions) != 11 || positions[0].Offset != -1 {
+		t.Errorf("GetPositions = %v", positions)
+	}
+}
+
+func TestDiskScan(t *testing.T) {
+	d, err := OpenDiskIndex(filepath.Join(t.TempDir(), "INDEX"), 4*bpPageSize, data.NoEncryption)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer d.Close()
+	str, hash := d.NewStrIndex(), d.NewHashIndex()
+	for i := 0; i < 1000; i++ {
+		str.Set(fmt.Sprintf("key%v", i), &EntryPos{})
+		hash.Set(fmt.Sprintf("hash%v", i%10), fmt.Sprint(i), &EntryPos{})
+	}
+	// 遍历期间写入和删除其他key，一直存在的key都要返回
+	seen := make(map[string]int)
+	var cursor uint64
+	for round := 0; ; round++ {
+		if cursor, err = str.Scan(cursor, 10, func(key string) {
+			seen[key]++
+		}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if cursor == 0 {
+			break
+		}
+		str.Set(fmt.Sprintf("new%v", round), &EntryPos{})
+		str.Del(fmt.Sprintf("key%v", 500+round))
+	}
+	for i := 0; i < 500; i++ {
+		if seen[fmt.Sprintf("key%v", i)] != 1 {
+			t.Errorf("key%v returned %v times", i, seen[fmt.Sprintf("key%v", i)])
+		}
+	}
+	hash.DelKey("hash3")
+	var keys []string
+	if cursor, err = hash.Scan(0, 100, func(key string) {
+		keys = append(keys, key)
+	}); cursor != 0 || err != nil || len(keys) != 9 {
+		t.Errorf("Scan hash keys = %v, %v, %v", keys, cursor, err)
+	}
+}
+
+func TestDiskIndexFailed(t *testing.T) {
+	d, err := OpenDiskIndex(filepath.Join(t.TempDir(), "INDEX"), 2*bpPageSize, data.NoEncryption)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	index := d.NewStrIndex()
+	for i := 0; i < 1000; i++ {
+		index.Set(fmt.Sprintf("key%v", i), &EntryPos{Offset: int64(i)})
+	}
+	// 索引文件读写失败后，之后的读取都返回错误，不能返回与数据不一致的结果
+	_ = d.store.fd.Close()
+	for i := 1000; i < 2000; i++ {
+		index.Set(fmt.Sprintf("key%v", i), &EntryPos{Offset: int64(i)})
+	}
+	if err = d.Err(); !errors.Is(err, constants.ErrIndexFailed) {
+		t.Fatalf("Err = %v", err)
+	}
+	if _, err = index.Get("key1"); !errors.Is(err, constants.ErrIndexFailed) {
+		t.Errorf("Get err = %v", err)
+	}
+	if err = index.Seek(nil, false, func(string) bool { return true }); !errors.Is(err, constants.ErrIndexFailed) {
+		t.Errorf("Seek err = %v", err)
+	}
+}
+
+func TestDiskIndexEncrypted(t *testing.T) {
+	if err := data.RegisterKey(30, bytes.Repeat([]byte{5}, 32)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	path := filepath.Join(t.TempDir(), "INDEX")
+	d, err := OpenDiskIndex(path, 2*bpPageSize, 30)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	index := d.NewStrIndex()
+	for i := 0; i < 1000; i++ {
+		index.Set(fmt.Sprintf("secret%04d", i), &EntryPos{Offset: int64(i)})
+	}
+	for i := 0; i < 1000; i += 7 {
+		if pos, err := index.Get(fmt.Sprintf("secret%04d", i)); err != nil || pos.Offset != int64(i) {
+			t.Fatalf("Get secret%04d = %v, %+v", i, pos, err)
+		}
+	}
+	// 缓存放不下所有节点，大部分节点已写入文件，文件中不能出现明文key
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(buf) == 0 || bytes.Contains(buf, []byte("secret")) {
+		t.Errorf("INDEX size %v, contains plaintext key: %v", len(buf), bytes.Contains(buf, []byte("secret")))
+	}
+	if err = d.Save([]byte("secret state")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if buf, _ = os.ReadFile(path); bytes.Contains(buf, []byte("secret")) {
+		t.Errorf("saved INDEX contains plaintext")
+	}
+	// 密钥改变时不复用索引
+	if d, err = OpenDiskIndex(path, 2*bpPageSize, data.NoEncryption); err != nil || d.State() != nil {
+		t.Fatalf("OpenDiskIndex without key = %q, %+v", d.State(), err)
+	}
+	_ = d.Close()
+}
+
+func TestDiskIndexSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "INDEX")
+	d, err := OpenDiskIndex(path, 2*bpPageSize, data.NoEncryption)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	str, hash := d.NewStrIndex(), d.NewHashIndex()
+	for i := 0; i < 1000; i++ {
+		str.Set(fmt.Sprintf("key%v", i), &EntryPos{Offset: int64(i)})
+		hash.Set(fmt.Sprintf("hash%v", i%10), fmt.Sprint(i), &EntryPos{Offset: int64(i)})
+	}
+	if err = d.Save([]byte("state")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// 正常关闭后复用索引
+	d, err = OpenDiskIndex(path, 2*bpPageSize, data.NoEncryption)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if string(d.State()) != "state" {
+		t.Fatalf("State = %q", d.State())
+	}
+	str, hash = d.NewStrIndex(), d.NewHashIndex()
+	for i := 0; i < 1000; i++ {
+		if pos, err := str.Get(fmt.Sprintf("key%v", i)); err != nil || pos.Offset != int64(i) {
+			t.Fatalf("Get key%v = %v, %+v", i, pos, err)
+		}
+	}
+	if n, err := hash.GetFieldCount("hash3"); err != nil || n != 100 {
+		t.Errorf("Len hash3 = %v", n)
+	}
+	var keys []string
+	if _, err = str.Scan(0, 2000, func(key string) {
+		keys = append(keys, key)
+	}); err != nil || len(keys) != 1000 {
+		t.Errorf("Scan = %v keys, %v", len(keys), err)
+	}
+	str.Del("key1")
+
+	// 复用后没有正常关闭，索引不再可信，重新打开时为空
+	_ = d.store.close()
+	d, err = OpenDiskIndex(path, 2*bpPageSize, data.NoEncryption)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if d.State() != nil {
+		t.Errorf("State after crash = %q", d.State())
+	}
+	if _, err = d.NewStrIndex().Get("key2"); !errors.Is(err, constants.ErrKeyNotFound) {
+		t.Errorf("Get after crash err = %v", err)
+	}
+	_ = d.Close()
+}
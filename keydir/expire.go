@@ -0,0 +1,96 @@
+package keydir
+
+import (
+	"SouthWind6510/TinyDB/pkg/constants"
+	"sync"
+)
+
+type ExpireKeydir struct {
+	mu     sync.RWMutex
+	keydir map[string]int64 // key的过期时间，毫秒时间戳
+}
+
+func NewExpireKeydir() *ExpireKeydir {
+	return &ExpireKeydir{
+		keydir: make(map[string]int64),
+	}
+}
+
+func (i *ExpireKeydir) Set(key string, expireAt int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.keydir[key] = expireAt
+}
+
+func (i *ExpireKeydir) Get(key string) (expireAt int64, err error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	expireAt, ok := i.keydir[key]
+	if !ok {
+		return 0, constants.ErrKeyNotFound
+	}
+	return expireAt, nil
+}
+
+func (i *ExpireKeydir) Del(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.keydir, key)
+}
+
+// IsExpired key设置了过期时间且在now之前已过期
+func (i *ExpireKeydir) IsExpired(key string, now int64) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	expireAt, ok := i.keydir[key]
+	return ok && expireAt <= now
+}
+
+// GetExpiredKeys 返回在now之前已过期的所有key
+func (i *ExpireKeydir) GetExpiredKeys(now int64) (keys []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for key, expireAt := range i.keydir {
+		if expireAt <= now {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// Sample 随机返回至多n个设置了过期时间的key
+func (i *ExpireKeydir) Sample(n int) (keys []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	// map遍历顺序随机，直接取前n个
+	for key := range i.keydir {
+		if len(keys) >= n {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func (i *ExpireKeydir) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.keydir)
+}
+
+// Each 遍历所有key的过期时间，遍历期间不能修改
+func (i *ExpireKeydir) Each(fn func(key string, expireAt int64)) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for key, expireAt := range i.keydir {
+		fn(key, expireAt)
+	}
+}
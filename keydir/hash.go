@@ -1,60 +1,76 @@
 package keydir
 
 import (
+	"SouthWind6510/TinyDB/ds"
 	"SouthWind6510/TinyDB/pkg/constants"
 	"sync"
 )
 
-type hashFieldMap map[string]*EntryPos
-
 type HashKeydir struct {
 	mu     sync.RWMutex
-	keydir map[string]hashFieldMap //key的field的位置
+	keydir keyMap //key的field的位置
 }
 
-func NewHashKeydir() *HashKeydir {
+// NewHashKeydir ordered为true时使用B树索引key，支持按key顺序遍历
+func NewHashKeydir(ordered bool) *HashKeydir {
 	return &HashKeydir{
-		keydir: make(map[string]hashFieldMap),
+		keydir: newKeyMap(ordered),
+	}
+}
+
+// fields key的field到位置的哈希表，key不存在时返回nil
+func (i *HashKeydir) fields(key string) *ds.Dict {
+	if v, ok := i.keydir.get(key); ok {
+		return v.(*ds.Dict)
 	}
+	return nil
 }
 
 func (i *HashKeydir) Set(key string, field string, pos *EntryPos) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	if i.keydir[key] == nil {
-		i.keydir[key] = make(hashFieldMap)
+	if i.fields(key) == nil {
+		i.keydir.set(key, ds.NewDict())
 	}
-	i.keydir[key][field] = pos
+	i.fields(key).Set(field, pos)
 }
 
 func (i *HashKeydir) Get(key string, field string) (pos *EntryPos, err error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil || i.keydir[key][field] == nil {
+	if i.fields(key) == nil {
 		return nil, constants.ErrKeyNotFound
 	}
-	return i.keydir[key][field], nil
+	v, ok := i.fields(key).Get(field)
+	if !ok {
+		return nil, constants.ErrKeyNotFound
+	}
+	return v.(*EntryPos), nil
 }
 
 func (i *HashKeydir) Del(key string, field string) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	delete(i.keydir[key], field)
+	if i.fields(key) != nil {
+		i.fields(key).Delete(field)
+	}
 }
 
 func (i *HashKeydir) GetFields(key string) (fields []string, err error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil {
+	if i.fields(key) == nil {
 		return nil, constants.ErrKeyNotFound
 	}
-	for field := range i.keydir[key] {
+	fields = make([]string, 0, i.fields(key).Len())
+	i.fields(key).Each(func(field string, v interface{}) bool {
 		fields = append(fields, field)
-	}
+		return true
+	})
 	return
 }
 
@@ -62,8 +78,100 @@ func (i *HashKeydir) GetFieldCount(key string) (int, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil {
+	if i.fields(key) == nil {
+		return 0, constants.ErrKeyNotFound
+	}
+	return i.fields(key).Len(), nil
+}
+
+// CompareAndSwap key的field位置仍为old时更新为new，用于merge后迁移索引
+func (i *HashKeydir) CompareAndSwap(key string, field string, old, new *EntryPos) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.fields(key) == nil {
+		return false
+	}
+	if v, ok := i.fields(key).Get(field); !ok || v.(*EntryPos) != old {
+		return false
+	}
+	i.fields(key).Set(field, new)
+	return true
+}
+
+// DelKey 删除key的所有field
+func (i *HashKeydir) DelKey(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.keydir.del(key)
+}
+
+// GetPositions 返回key的所有field的位置
+func (i *HashKeydir) GetPositions(key string) (positions []*EntryPos) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.fields(key) == nil {
+		return nil
+	}
+	i.fields(key).Each(func(field string, v interface{}) bool {
+		positions = append(positions, v.(*EntryPos))
+		return true
+	})
+	return
+}
+
+// Keys 返回所有非空的key
+func (i *HashKeydir) Keys() (keys []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	i.keydir.each(func(key string, v interface{}) bool {
+		if v.(*ds.Dict).Len() > 0 {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return
+}
+
+// Seek 按key顺序遍历所有非空的key，从不小于start（reverse时不大于start）的key开始，fn返回false时停止
+// 遍历期间持有读锁，fn中不能再访问keydir，只有有序索引支持
+func (i *HashKeydir) Seek(start *string, reverse bool, fn func(key string) bool) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.seek(start, reverse, func(key string, v interface{}) bool {
+		if v.(*ds.Dict).Len() == 0 {
+			return true
+		}
+		return fn(key)
+	})
+}
+
+// Scan 从cursor开始增量遍历所有非空的key，返回下一次的cursor，为0时遍历结束
+// 遍历期间持有读锁，fn中不能再访问keydir
+func (i *HashKeydir) Scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.scan(cursor, count, func(key string, v interface{}) {
+		if v.(*ds.Dict).Len() > 0 {
+			fn(key)
+		}
+	}), nil
+}
+
+// ScanFields 从cursor开始增量遍历key的field，key不存在时返回ErrKeyNotFound
+func (i *HashKeydir) ScanFields(key string, cursor uint64, count int, fn func(field string, pos *EntryPos)) (uint64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.fields(key) == nil {
 		return 0, constants.ErrKeyNotFound
 	}
-	return len(i.keydir[key]), nil
+	return i.fields(key).Scan(cursor, count, func(field string, v interface{}) {
+		fn(field, v.(*EntryPos))
+	}), nil
 }
@@ -0,0 +1,94 @@
+package keydir
+
+import (
+	"SouthWind6510/TinyDB/ds"
+	"SouthWind6510/TinyDB/pkg/constants"
+)
+
+// keyMap keydir中顶层key到数据的映射，默认为哈希表，有序索引另外使用B树保存key的顺序，不是并发安全的
+type keyMap interface {
+	get(key string) (value interface{}, ok bool)
+	set(key string, value interface{})
+	del(key string)
+	len() int
+	// each 无序遍历所有key，fn返回false时停止
+	each(fn func(key string, value interface{}) bool)
+	// scan 从cursor开始增量遍历，返回下一次的cursor，为0时遍历结束，见ds.Dict.Scan
+	scan(cursor uint64, count int, fn func(key string, value interface{})) uint64
+	// seek 从不小于start的key开始升序遍历，reverse时从不大于start的key开始降序遍历，
+	// start为nil时从最小（reverse时最大）的key开始，fn返回false时停止，只有有序索引支持
+	seek(start *string, reverse bool, fn func(key string, value interface{}) bool) error
+}
+
+func newKeyMap(ordered bool) keyMap {
+	if ordered {
+		return &treeKeyMap{hashKeyMap: hashKeyMap{dict: ds.NewDict()}, tree: ds.NewBTree(ds.DefaultBTreeDegree)}
+	}
+	return &hashKeyMap{dict: ds.NewDict()}
+}
+
+type hashKeyMap struct {
+	dict *ds.Dict
+}
+
+func (m *hashKeyMap) get(key string) (interface{}, bool) {
+	return m.dict.Get(key)
+}
+
+func (m *hashKeyMap) set(key string, value interface{}) {
+	m.dict.Set(key, value)
+}
+
+func (m *hashKeyMap) del(key string) {
+	m.dict.Delete(key)
+}
+
+func (m *hashKeyMap) len() int {
+	return m.dict.Len()
+}
+
+func (m *hashKeyMap) each(fn func(key string, value interface{}) bool) {
+	m.dict.Each(fn)
+}
+
+func (m *hashKeyMap) scan(cursor uint64, count int, fn func(key string, value interface{})) uint64 {
+	return m.dict.Scan(cursor, count, fn)
+}
+
+func (m *hashKeyMap) seek(start *string, reverse bool, fn func(key string, value interface{}) bool) error {
+	return constants.ErrUnorderedIndex
+}
+
+// treeKeyMap 查找和增量遍历使用哈希表，B树只用于按key顺序遍历
+type treeKeyMap struct {
+	hashKeyMap
+	tree *ds.BTree
+}
+
+func (m *treeKeyMap) set(key string, value interface{}) {
+	m.dict.Set(key, value)
+	m.tree.Set(key, value)
+}
+
+func (m *treeKeyMap) del(key string) {
+	m.dict.Delete(key)
+	m.tree.Delete(key)
+}
+
+func (m *treeKeyMap) each(fn func(key string, value interface{}) bool) {
+	m.tree.Ascend(fn)
+}
+
+func (m *treeKeyMap) seek(start *string, reverse bool, fn func(key string, value interface{}) bool) error {
+	switch {
+	case start == nil && reverse:
+		m.tree.Descend(fn)
+	case start == nil:
+		m.tree.Ascend(fn)
+	case reverse:
+		m.tree.DescendLessOrEqual(*start, fn)
+	default:
+		m.tree.AscendGreaterOrEqual(*start, fn)
+	}
+	return nil
+}
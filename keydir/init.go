@@ -1,7 +1,7 @@
 package keydir
 
 type EntryPos struct {
-	Fid    int16
+	Fid    uint32
 	Offset int64
 	Size   int64
 }
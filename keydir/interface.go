@@ -0,0 +1,118 @@
+package keydir
+
+// 各数据类型的内存索引接口，db只通过接口访问索引，可以通过IndexFactory替换实现
+// 实现需要并发安全；Seek按key顺序遍历，不支持有序遍历的实现返回constants.ErrUnorderedIndex
+// Scan从cursor开始增量遍历约count个key，返回下一次的cursor，为0时遍历结束，cursor不需要服务端保存状态，
+// 两次调用之间修改索引时，遍历期间一直存在的key一定会被返回，但可能重复返回
+
+// StrIndex String的key到entry位置的索引
+type StrIndex interface {
+	Set(key string, pos *EntryPos)
+	Get(key string) (pos *EntryPos, err error)
+	Del(key string)
+	CompareAndSwap(key string, old, new *EntryPos) bool
+	Keys() []string
+	Seek(start *string, reverse bool, fn func(key string) bool) error
+	Scan(cursor uint64, count int, fn func(key string)) (next uint64, err error)
+}
+
+// ListIndex List的key和index到entry位置的索引，index为-1表示listMeta
+type ListIndex interface {
+	Set(key string, index int, pos *EntryPos)
+	Get(key string, index int) (pos *EntryPos, err error)
+	Del(key string, index int)
+	CompareAndSwap(key string, index int, old, new *EntryPos) bool
+	DelKey(key string)
+	GetPositions(key string) []*EntryPos
+	Keys() []string
+	Seek(start *string, reverse bool, fn func(key string) bool) error
+	Scan(cursor uint64, count int, fn func(key string)) (next uint64, err error)
+}
+
+// HashIndex Hash的key和field到entry位置的索引
+type HashIndex interface {
+	Set(key string, field string, pos *EntryPos)
+	Get(key string, field string) (pos *EntryPos, err error)
+	Del(key string, field string)
+	GetFields(key string) ([]string, error)
+	GetFieldCount(key string) (int, error)
+	CompareAndSwap(key string, field string, old, new *EntryPos) bool
+	DelKey(key string)
+	GetPositions(key string) []*EntryPos
+	Keys() []string
+	Seek(start *string, reverse bool, fn func(key string) bool) error
+	Scan(cursor uint64, count int, fn func(key string)) (next uint64, err error)
+	// ScanFields 增量遍历key的field，key不存在时返回constants.ErrKeyNotFound
+	ScanFields(key string, cursor uint64, count int, fn func(field string, pos *EntryPos)) (next uint64, err error)
+}
+
+// SetIndex Set的member索引，member保存在内存中
+type SetIndex interface {
+	Set(key string, member string)
+	Del(key string, member string)
+	IsExists(key string, member string) bool
+	GetMemberCount(key string) (int, error)
+	GetMembers(key string) ([]string, error)
+	RandMember(key string) (string, error)
+	RandMembers(key string, count int) ([]string, error)
+	DelKey(key string)
+	Keys() []string
+	Seek(start *string, reverse bool, fn func(key string) bool) error
+	Scan(cursor uint64, count int, fn func(key string)) (next uint64, err error)
+	ScanMembers(key string, cursor uint64, count int, fn func(member string)) (next uint64, err error)
+}
+
+// ZSetIndex ZSet的member和score索引，按score排序
+type ZSetIndex interface {
+	Set(key string, member string, score float64)
+	Del(key string, member string, score float64)
+	Update(key string, member string, score float64, updateScore float64)
+	GetScore(key string, member string) (float64, error)
+	GetMemberCount(key string) int64
+	GetCountByScore(key string, min, max float64) int64
+	GetMemberByRank(key string, rank int64) (member string, score float64, err error)
+	GetRangeByRank(key string, start, end int64, rev bool) (members []string, scores []float64, err error)
+	GetRangeByScore(key string, min, max float64, rev bool) (members []string, scores []float64, err error)
+	GetRank(key string, member string) (rank int64, score float64, err error)
+	DeleteWithoutScore(key string, member string) bool
+	GetMembers(key string) (members []string, scores []float64)
+	DelKey(key string)
+	Keys() []string
+	Seek(start *string, reverse bool, fn func(key string) bool) error
+	Scan(cursor uint64, count int, fn func(key string)) (next uint64, err error)
+	ScanMembers(key string, cursor uint64, count int, fn func(member string, score float64)) (next uint64, err error)
+}
+
+// IndexFactory 打开数据库时创建各数据类型的索引
+type IndexFactory interface {
+	NewStrIndex() StrIndex
+	NewListIndex() ListIndex
+	NewHashIndex() HashIndex
+	NewSetIndex() SetIndex
+	NewZSetIndex() ZSetIndex
+}
+
+// MemIndexFactory 内置的内存索引，Ordered为true时使用B树索引key，支持有序遍历，否则使用map
+type MemIndexFactory struct {
+	Ordered bool
+}
+
+func (f MemIndexFactory) NewStrIndex() StrIndex {
+	return NewStrKeydir(f.Ordered)
+}
+
+func (f MemIndexFactory) NewListIndex() ListIndex {
+	return NewListKeydir(f.Ordered)
+}
+
+func (f MemIndexFactory) NewHashIndex() HashIndex {
+	return NewHashKeydir(f.Ordered)
+}
+
+func (f MemIndexFactory) NewSetIndex() SetIndex {
+	return NewSetKeydir(f.Ordered)
+}
+
+func (f MemIndexFactory) NewZSetIndex() ZSetIndex {
+	return NewZSetKeydir(f.Ordered)
+}
@@ -9,24 +9,32 @@ type listIndexMap map[int]*EntryPos
 
 type ListKeydir struct {
 	mu     sync.RWMutex
-	keydir map[string]listIndexMap //key的index的位置
+	keydir keyMap //key的index的位置
 }
 
-func NewListKeydir() *ListKeydir {
+// NewListKeydir ordered为true时使用B树索引key，支持按key顺序遍历
+func NewListKeydir(ordered bool) *ListKeydir {
 	return &ListKeydir{
-		keydir: make(map[string]listIndexMap),
+		keydir: newKeyMap(ordered),
 	}
 }
 
+func (i *ListKeydir) indexes(key string) listIndexMap {
+	if v, ok := i.keydir.get(key); ok {
+		return v.(listIndexMap)
+	}
+	return nil
+}
+
 // Set index为-1时表示listMeta
 func (i *ListKeydir) Set(key string, index int, pos *EntryPos) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	if i.keydir[key] == nil {
-		i.keydir[key] = make(listIndexMap)
+	if i.indexes(key) == nil {
+		i.keydir.set(key, make(listIndexMap))
 	}
-	i.keydir[key][index] = pos
+	i.indexes(key)[index] = pos
 }
 
 // Get index为-1表示listMeta
@@ -34,15 +42,80 @@ func (i *ListKeydir) Get(key string, index int) (pos *EntryPos, err error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil || i.keydir[key][index] == nil {
+	if i.indexes(key) == nil || i.indexes(key)[index] == nil {
 		return nil, constants.ErrKeyNotFound
 	}
-	return i.keydir[key][index], nil
+	return i.indexes(key)[index], nil
 }
 
 func (i *ListKeydir) Del(key string, index int) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	delete(i.keydir[key], index)
+	delete(i.indexes(key), index)
+}
+
+// CompareAndSwap key的index位置仍为old时更新为new，用于merge后迁移索引
+func (i *ListKeydir) CompareAndSwap(key string, index int, old, new *EntryPos) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.indexes(key) == nil || i.indexes(key)[index] != old {
+		return false
+	}
+	i.indexes(key)[index] = new
+	return true
+}
+
+// DelKey 删除key的所有节点及listMeta
+func (i *ListKeydir) DelKey(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.keydir.del(key)
+}
+
+// GetPositions 返回key的所有节点及listMeta的位置
+func (i *ListKeydir) GetPositions(key string) (positions []*EntryPos) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for _, pos := range i.indexes(key) {
+		positions = append(positions, pos)
+	}
+	return
+}
+
+// Keys 返回所有存在listMeta的key，list是否为空需要读取listMeta判断
+func (i *ListKeydir) Keys() (keys []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	i.keydir.each(func(key string, v interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return
+}
+
+// Seek 按key顺序遍历所有存在listMeta的key，从不小于start（reverse时不大于start）的key开始，fn返回false时停止
+// 遍历期间持有读锁，fn中不能再访问keydir，只有有序索引支持
+func (i *ListKeydir) Seek(start *string, reverse bool, fn func(key string) bool) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.seek(start, reverse, func(key string, v interface{}) bool {
+		return fn(key)
+	})
+}
+
+// Scan 从cursor开始增量遍历存在listMeta的key，返回下一次的cursor，为0时遍历结束
+// 遍历期间持有读锁，fn中不能再访问keydir
+func (i *ListKeydir) Scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.scan(cursor, count, func(key string, v interface{}) {
+		fn(key)
+	}), nil
 }
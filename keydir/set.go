@@ -1,41 +1,49 @@
 package keydir
 
 import (
+	"SouthWind6510/TinyDB/ds"
 	"SouthWind6510/TinyDB/pkg/constants"
 	"sync"
 )
 
-type setFieldMap map[string]struct{}
-
 type SetKeydir struct {
 	mu     sync.RWMutex
-	keydir map[string]setFieldMap //key的field是否存在
+	keydir keyMap //key的field是否存在
 }
 
-func NewSetKeydir() *SetKeydir {
+// NewSetKeydir ordered为true时使用B树索引key，支持按key顺序遍历
+func NewSetKeydir(ordered bool) *SetKeydir {
 	return &SetKeydir{
-		keydir: make(map[string]setFieldMap),
+		keydir: newKeyMap(ordered),
 	}
 }
 
+// members key的member集合，value为nil，key不存在时返回nil
+func (i *SetKeydir) members(key string) *ds.Dict {
+	if v, ok := i.keydir.get(key); ok {
+		return v.(*ds.Dict)
+	}
+	return nil
+}
+
 func (i *SetKeydir) Set(key string, field string) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	if i.keydir[key] == nil {
-		i.keydir[key] = make(setFieldMap)
+	if i.members(key) == nil {
+		i.keydir.set(key, ds.NewDict())
 	}
-	i.keydir[key][field] = struct{}{}
+	i.members(key).Set(field, nil)
 }
 
 func (i *SetKeydir) Get(key string, field string) (err error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil {
+	if i.members(key) == nil {
 		return constants.ErrKeyNotFound
 	}
-	if _, ok := i.keydir[key][field]; !ok {
+	if _, ok := i.members(key).Get(field); !ok {
 		return constants.ErrKeyNotFound
 	}
 	return nil
@@ -45,44 +53,44 @@ func (i *SetKeydir) Del(key string, field string) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	delete(i.keydir[key], field)
+	if i.members(key) != nil {
+		i.members(key).Delete(field)
+	}
 }
 
 func (i *SetKeydir) GetMemberCount(key string) (int, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil {
+	if i.members(key) == nil {
 		return 0, constants.ErrKeyNotFound
 	}
-	return len(i.keydir[key]), nil
+	return i.members(key).Len(), nil
 }
 
 func (i *SetKeydir) Pop(key string) (string, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	if i.keydir[key] == nil {
-		return "", constants.ErrKeyNotFound
+	field, err := i.randMember(key)
+	if err == nil {
+		i.members(key).Delete(field)
 	}
-	for field := range i.keydir[key] {
-		delete(i.keydir[key], field)
-		return field, nil
-	}
-	return "", constants.ErrKeyNotFound
+	return field, err
 }
 
 func (i *SetKeydir) GetMembers(key string) ([]string, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil {
+	if i.members(key) == nil {
 		return nil, constants.ErrKeyNotFound
 	}
-	fields := make([]string, 0, len(i.keydir[key]))
-	for field := range i.keydir[key] {
+	fields := make([]string, 0, i.members(key).Len())
+	i.members(key).Each(func(field string, v interface{}) bool {
 		fields = append(fields, field)
-	}
+		return true
+	})
 	return fields, nil
 }
 
@@ -90,44 +98,111 @@ func (i *SetKeydir) IsExists(key string, field string) bool {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil {
-		return false
-	}
-	if _, ok := i.keydir[key][field]; !ok {
+	if i.members(key) == nil {
 		return false
 	}
-	return true
+	_, ok := i.members(key).Get(field)
+	return ok
 }
 
 func (i *SetKeydir) RandMember(key string) (string, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil {
+	return i.randMember(key)
+}
+
+func (i *SetKeydir) randMember(key string) (member string, err error) {
+	if i.members(key) == nil {
 		return "", constants.ErrKeyNotFound
 	}
-	for field := range i.keydir[key] {
-		return field, nil
-	}
-	return "", constants.ErrKeyNotFound
+	err = constants.ErrKeyNotFound
+	i.members(key).RandomEach(func(field string, v interface{}) bool {
+		member, err = field, nil
+		return false
+	})
+	return
 }
 
 func (i *SetKeydir) RandMembers(key string, count int) (res []string, err error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if i.keydir[key] == nil {
+	if i.members(key) == nil {
 		return nil, constants.ErrKeyNotFound
 	}
-	if count > len(i.keydir[key]) {
-		count = len(i.keydir[key])
+	if count > i.members(key).Len() {
+		count = i.members(key).Len()
 	}
 	res = make([]string, 0, count)
-	for field := range i.keydir[key] {
-		res = append(res, field)
+	i.members(key).RandomEach(func(field string, v interface{}) bool {
 		if len(res) == count {
-			break
+			return false
 		}
-	}
+		res = append(res, field)
+		return true
+	})
+	return
+}
+
+// DelKey 删除key的所有member
+func (i *SetKeydir) DelKey(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.keydir.del(key)
+}
+
+// Keys 返回所有非空的key
+func (i *SetKeydir) Keys() (keys []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	i.keydir.each(func(key string, v interface{}) bool {
+		if v.(*ds.Dict).Len() > 0 {
+			keys = append(keys, key)
+		}
+		return true
+	})
 	return
 }
+
+// Seek 按key顺序遍历所有非空的key，从不小于start（reverse时不大于start）的key开始，fn返回false时停止
+// 遍历期间持有读锁，fn中不能再访问keydir，只有有序索引支持
+func (i *SetKeydir) Seek(start *string, reverse bool, fn func(key string) bool) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.seek(start, reverse, func(key string, v interface{}) bool {
+		if v.(*ds.Dict).Len() == 0 {
+			return true
+		}
+		return fn(key)
+	})
+}
+
+// Scan 从cursor开始增量遍历所有非空的key，返回下一次的cursor，为0时遍历结束
+// 遍历期间持有读锁，fn中不能再访问keydir
+func (i *SetKeydir) Scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.scan(cursor, count, func(key string, v interface{}) {
+		if v.(*ds.Dict).Len() > 0 {
+			fn(key)
+		}
+	}), nil
+}
+
+// ScanMembers 从cursor开始增量遍历key的member，key不存在时返回ErrKeyNotFound
+func (i *SetKeydir) ScanMembers(key string, cursor uint64, count int, fn func(member string)) (uint64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.members(key) == nil {
+		return 0, constants.ErrKeyNotFound
+	}
+	return i.members(key).Scan(cursor, count, func(member string, v interface{}) {
+		fn(member)
+	}), nil
+}
@@ -7,12 +7,13 @@ import (
 
 type StrKeydir struct {
 	mu     sync.RWMutex
-	keydir map[string]*EntryPos
+	keydir keyMap
 }
 
-func NewStrKeydir() *StrKeydir {
+// NewStrKeydir ordered为true时使用B树索引key，支持按key顺序遍历
+func NewStrKeydir(ordered bool) *StrKeydir {
 	return &StrKeydir{
-		keydir: make(map[string]*EntryPos),
+		keydir: newKeyMap(ordered),
 	}
 }
 
@@ -20,22 +21,69 @@ func (i *StrKeydir) Set(key string, pos *EntryPos) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	i.keydir[key] = pos
+	i.keydir.set(key, pos)
 }
 
 func (i *StrKeydir) Get(key string) (pos *EntryPos, err error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
-	if _, ok := i.keydir[key]; !ok {
+	v, ok := i.keydir.get(key)
+	if !ok {
 		return nil, constants.ErrKeyNotFound
 	}
-	return i.keydir[key], nil
+	return v.(*EntryPos), nil
 }
 
 func (i *StrKeydir) Del(key string) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	delete(i.keydir, key)
+	i.keydir.del(key)
+}
+
+// CompareAndSwap key的位置仍为old时更新为new，用于merge后迁移索引
+func (i *StrKeydir) CompareAndSwap(key string, old, new *EntryPos) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if v, ok := i.keydir.get(key); !ok || v.(*EntryPos) != old {
+		return false
+	}
+	i.keydir.set(key, new)
+	return true
+}
+
+// Keys 返回所有key
+func (i *StrKeydir) Keys() (keys []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	i.keydir.each(func(key string, v interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return
+}
+
+// Seek 按key顺序遍历所有key，从不小于start（reverse时不大于start）的key开始，fn返回false时停止
+// 遍历期间持有读锁，fn中不能再访问keydir，只有有序索引支持
+func (i *StrKeydir) Seek(start *string, reverse bool, fn func(key string) bool) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.seek(start, reverse, func(key string, v interface{}) bool {
+		return fn(key)
+	})
+}
+
+// Scan 从cursor开始增量遍历key，返回下一次的cursor，为0时遍历结束，遍历期间一直存在的key一定会被返回
+// 遍历期间持有读锁，fn中不能再访问keydir
+func (i *StrKeydir) Scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.scan(cursor, count, func(key string, v interface{}) {
+		fn(key)
+	}), nil
 }
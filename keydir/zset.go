@@ -9,21 +9,32 @@ import (
 )
 
 type ZSetKeydir struct {
-	keydir map[string]*ds.SkipList
+	keydir keyMap
 	mu     sync.RWMutex
 }
 
-func NewZSetKeydir() *ZSetKeydir {
+// NewZSetKeydir ordered为true时使用B树索引key，支持按key顺序遍历
+func NewZSetKeydir(ordered bool) *ZSetKeydir {
 	return &ZSetKeydir{
-		keydir: make(map[string]*ds.SkipList),
+		keydir: newKeyMap(ordered),
 	}
 }
 
+func (i *ZSetKeydir) zsl(key string) *ds.SkipList {
+	if v, ok := i.keydir.get(key); ok {
+		return v.(*ds.SkipList)
+	}
+	return nil
+}
+
 func (i *ZSetKeydir) GetScore(key string, member string) (score float64, err error) {
-	if i.keydir[key] == nil {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.zsl(key) == nil {
 		return 0, constants.ErrKeyNotFound
 	}
-	score, err = i.keydir[key].GetScore(member)
+	score, err = i.zsl(key).GetScore(member)
 	if errors.Is(err, constants.ErrMemberNotExist) {
 		return 0, err
 	}
@@ -35,60 +46,60 @@ func (i *ZSetKeydir) GetScore(key string, member string) (score float64, err err
 
 func (i *ZSetKeydir) Set(key string, member string, score float64) {
 	i.mu.Lock()
-	if i.keydir[key] == nil {
-		i.keydir[key] = ds.NewSkipList(2)
+	if i.zsl(key) == nil {
+		i.keydir.set(key, ds.NewSkipList(2))
 	}
 	defer i.mu.Unlock()
 
-	oldScore, err := i.keydir[key].GetScore(member)
+	oldScore, err := i.zsl(key).GetScore(member)
 	if err == nil {
-		i.keydir[key].Delete(member, oldScore)
+		i.zsl(key).Delete(member, oldScore)
 	}
-	i.keydir[key].Insert(member, score)
+	i.zsl(key).Insert(member, score)
 }
 
 func (i *ZSetKeydir) Del(key string, member string, score float64) {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return
 	}
-	i.keydir[key].Delete(member, score)
+	i.zsl(key).Delete(member, score)
 }
 
 func (i *ZSetKeydir) GetMemberCount(key string) int64 {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return 0
 	}
-	return i.keydir[key].GetLength()
+	return i.zsl(key).GetLength()
 }
 
 // Update 调用方需要确保key和member存在
 func (i *ZSetKeydir) Update(key string, member string, score float64, updateScore float64) {
-	i.keydir[key].Delete(member, score)
-	i.keydir[key].Insert(member, updateScore)
+	i.zsl(key).Delete(member, score)
+	i.zsl(key).Insert(member, updateScore)
 }
 
 func (i *ZSetKeydir) GetCountByScore(key string, min, max float64) int64 {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return 0
 	}
-	node1 := i.keydir[key].FirstInRange(min, max)
-	node2 := i.keydir[key].LastInRange(min, max)
+	node1 := i.zsl(key).FirstInRange(min, max)
+	node2 := i.zsl(key).LastInRange(min, max)
 	if node1 == nil || node2 == nil {
 		return 0
 	}
-	l := i.keydir[key].GetRank(node1.GetMember(), node1.GetScore())
-	r := i.keydir[key].GetRank(node2.GetMember(), node2.GetScore())
+	l := i.zsl(key).GetRank(node1.GetMember(), node1.GetScore())
+	r := i.zsl(key).GetRank(node2.GetMember(), node2.GetScore())
 	return r - l + 1
 }
 
 func (i *ZSetKeydir) GetMemberByRank(key string, rank int64) (member string, score float64, err error) {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return "", 0, constants.ErrKeyNotFound
 	}
 	if rank < 0 {
-		rank = i.keydir[key].GetLength() + rank
+		rank = i.zsl(key).GetLength() + rank
 	}
-	node := i.keydir[key].GetElementByRank(rank + 1)
+	node := i.zsl(key).GetElementByRank(rank + 1)
 	if node == nil {
 		return "", 0, constants.ErrMemberNotExist
 	}
@@ -96,20 +107,20 @@ func (i *ZSetKeydir) GetMemberByRank(key string, rank int64) (member string, sco
 }
 
 func (i *ZSetKeydir) GetRangeByRank(key string, start, end int64, rev bool) (members []string, scores []float64, err error) {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return nil, nil, constants.ErrKeyNotFound
 	}
 	if start < 0 {
-		start = i.keydir[key].GetLength() + start
+		start = i.zsl(key).GetLength() + start
 	}
 	if end < 0 {
-		end = i.keydir[key].GetLength() + end
+		end = i.zsl(key).GetLength() + end
 	}
 	if start > end {
 		return nil, nil, constants.ErrInvalidRange
 	}
 
-	nodes := i.keydir[key].GetRangeByRank(start+1, end+1)
+	nodes := i.zsl(key).GetRangeByRank(start+1, end+1)
 	if rev {
 		for i := 0; i < len(nodes)/2; i++ {
 			nodes[i], nodes[len(nodes)-1-i] = nodes[len(nodes)-1-i], nodes[i]
@@ -125,14 +136,14 @@ func (i *ZSetKeydir) GetRangeByRank(key string, start, end int64, rev bool) (mem
 }
 
 func (i *ZSetKeydir) GetRangeByScore(key string, min, max float64, rev bool) (members []string, scores []float64, err error) {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return nil, nil, constants.ErrKeyNotFound
 	}
 	if min > max {
 		return nil, nil, constants.ErrInvalidRange
 	}
 
-	nodes := i.keydir[key].GetRangeByScore(min, max)
+	nodes := i.zsl(key).GetRangeByScore(min, max)
 	if rev {
 		for i := 0; i < len(nodes)/2; i++ {
 			nodes[i], nodes[len(nodes)-1-i] = nodes[len(nodes)-1-i], nodes[i]
@@ -148,42 +159,120 @@ func (i *ZSetKeydir) GetRangeByScore(key string, min, max float64, rev bool) (me
 }
 
 func (i *ZSetKeydir) GetRank(key string, member string) (rank int64, score float64, err error) {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return 0, 0, constants.ErrKeyNotFound
 	}
-	score, err = i.keydir[key].GetScore(member)
+	score, err = i.zsl(key).GetScore(member)
 	if err != nil {
 		return 0, 0, err
 	}
-	rank = i.keydir[key].GetRank(member, score) - 1
+	rank = i.zsl(key).GetRank(member, score) - 1
 	return rank, score, nil
 }
 
 func (i *ZSetKeydir) DeleteWithoutScore(key string, member string) bool {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return false
 	}
-	score, err := i.keydir[key].GetScore(member)
+	score, err := i.zsl(key).GetScore(member)
 	if err != nil {
 		return false
 	}
-	res := i.keydir[key].Delete(member, score)
-	if i.keydir[key].GetLength() == 0 {
-		delete(i.keydir, key)
+	res := i.zsl(key).Delete(member, score)
+	if i.zsl(key).GetLength() == 0 {
+		i.keydir.del(key)
 	}
 	return res
 }
 
 func (i *ZSetKeydir) DeleteRangeByScore(key string, min, max float64) []string {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return nil
 	}
-	return i.keydir[key].DeleteRangeByScore(min, max)
+	return i.zsl(key).DeleteRangeByScore(min, max)
 }
 
 func (i *ZSetKeydir) DeleteRangeByRank(key string, start, end int64) []string {
-	if i.keydir[key] == nil {
+	if i.zsl(key) == nil {
 		return nil
 	}
-	return i.keydir[key].DeleteRangeByRank(start+1, end+1)
+	return i.zsl(key).DeleteRangeByRank(start+1, end+1)
+}
+
+// DelKey 删除key的所有member
+func (i *ZSetKeydir) DelKey(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.keydir.del(key)
+}
+
+// GetMembers 返回key的所有member及score
+func (i *ZSetKeydir) GetMembers(key string) (members []string, scores []float64) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.zsl(key) == nil {
+		return nil, nil
+	}
+	nodes := i.zsl(key).GetRangeByRank(1, i.zsl(key).GetLength())
+	members = make([]string, len(nodes))
+	scores = make([]float64, len(nodes))
+	for j, node := range nodes {
+		members[j] = node.GetMember()
+		scores[j] = node.GetScore()
+	}
+	return
+}
+
+// Keys 返回所有非空的key
+func (i *ZSetKeydir) Keys() (keys []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	i.keydir.each(func(key string, v interface{}) bool {
+		if v.(*ds.SkipList).GetLength() > 0 {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return
+}
+
+// Seek 按key顺序遍历所有非空的key，从不小于start（reverse时不大于start）的key开始，fn返回false时停止
+// 遍历期间持有读锁，fn中不能再访问keydir，只有有序索引支持
+func (i *ZSetKeydir) Seek(start *string, reverse bool, fn func(key string) bool) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.seek(start, reverse, func(key string, v interface{}) bool {
+		if v.(*ds.SkipList).GetLength() == 0 {
+			return true
+		}
+		return fn(key)
+	})
+}
+
+// Scan 从cursor开始增量遍历所有非空的key，返回下一次的cursor，为0时遍历结束
+// 遍历期间持有读锁，fn中不能再访问keydir
+func (i *ZSetKeydir) Scan(cursor uint64, count int, fn func(key string)) (uint64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.keydir.scan(cursor, count, func(key string, v interface{}) {
+		if v.(*ds.SkipList).GetLength() > 0 {
+			fn(key)
+		}
+	}), nil
+}
+
+// ScanMembers 从cursor开始增量遍历key的member及score，key不存在时返回ErrKeyNotFound
+func (i *ZSetKeydir) ScanMembers(key string, cursor uint64, count int, fn func(member string, score float64)) (uint64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.zsl(key) == nil {
+		return 0, constants.ErrKeyNotFound
+	}
+	return i.zsl(key).Scan(cursor, count, fn), nil
 }
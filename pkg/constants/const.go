@@ -5,8 +5,10 @@ const (
 	ServerPort  = "6388"
 	DefaultPath = "/Users/southwind/TinyDB"
 
-	ResultOk   = "OK"
-	ResultPong = "PONG"
+	ResultOk     = "OK"
+	ResultPong   = "PONG"
+	ResultQueued = "QUEUED"
+	ResultBGSave = "Background saving started"
 
 	DebugEnv = "DebugEnv"
 )
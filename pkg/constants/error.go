@@ -6,6 +6,8 @@ var (
 	ErrKeyNotFound             = errors.New("key not found")
 	ErrInconsistentCRC         = errors.New("inconsistent CRC")
 	ErrReadNullEntry           = errors.New("read null entry")
+	ErrEntryOutOfFile          = errors.New("entry exceeds end of file")
+	ErrCorruptedTail           = errors.New("corrupted tail in active file")
 	ErrWrongNumberArgs         = errors.New("wrong number arguments")
 	ErrListLengthLimitExceeded = errors.New("list length limit exceeded")
 	ErrListIndexOutOfRange     = errors.New("index out of range")
@@ -13,4 +15,32 @@ var (
 	ErrUnsupportedCommand      = errors.New("unsupported command")
 	ErrMemberNotExist          = errors.New("member not exist")
 	ErrInvalidRange            = errors.New("invalid range")
+	ErrInvalidExpireTime       = errors.New("invalid expire time")
+	ErrSyntax                  = errors.New("syntax error")
+	ErrDataFileNotFound        = errors.New("data file not found")
+	ErrInvalidSyncPolicy       = errors.New("invalid sync policy, should be always, everysec or none")
+	ErrMergeFidExhausted       = errors.New("merge output exceeds reserved fids")
+	ErrDBLocked                = errors.New("database is locked by another process")
+	ErrReadOnly                = errors.New("database is opened in read-only mode")
+	ErrNeedRecovery            = errors.New("database needs recovery, open it in read-write mode first")
+	ErrNestedMulti             = errors.New("MULTI calls can not be nested")
+	ErrExecWithoutMulti        = errors.New("EXEC without MULTI")
+	ErrDiscardWithoutMulti     = errors.New("DISCARD without MULTI")
+	ErrWatchInMulti            = errors.New("WATCH inside MULTI is not allowed")
+	ErrBackupDirNotEmpty       = errors.New("backup dir is not empty")
+	ErrBackupInProgress        = errors.New("background save already in progress")
+	ErrExecAbort               = errors.New("EXECABORT Transaction discarded because of previous errors")
+	ErrUnknownCodec            = errors.New("unknown compression codec")
+	ErrInvalidKey              = errors.New("invalid encryption key")
+	ErrKeyConflict             = errors.New("encryption key id is registered with a different key")
+	ErrUnknownKey              = errors.New("unknown encryption key")
+	ErrDecrypt                 = errors.New("decrypt entry failed")
+	ErrUnsupportedFormat       = errors.New("unsupported data file format version")
+	ErrInvalidFileHeader       = errors.New("data file header does not match its file name")
+	ErrInvalidBlobPtr          = errors.New("invalid blob pointer")
+	ErrBlobMismatch            = errors.New("blob record does not belong to the entry")
+	ErrUnorderedIndex          = errors.New("ordered iteration requires Options.OrderedIndex")
+	ErrCorruptedIndex          = errors.New("corrupted disk index node")
+	ErrIndexFailed             = errors.New("disk index failed, reopen to rebuild it")
+	ErrInvalidCursor           = errors.New("invalid cursor")
 )